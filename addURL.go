@@ -28,40 +28,129 @@ type FileInfo struct {
 	Total    int
 	FilePath string
 	URL      string
+	MimeType string
+	Variants []StreamVariant // HLS/DASH qualities, best first
+	Stream   *StreamVariant  // the chosen variant, nil for plain files
+	Metalink *Metalink       // mirrors and hashes, nil for a single source
+	Torrent  *Torrent        // nil unless it's a .torrent or magnet link
+	Headers  *Headers        // cookies and referer the browser handed over
+	Group    string          // set for the downloads of one url pattern
+	ModTime  time.Time       // Last-Modified, zero when the server doesn't say
+	Actions  []PostAction    // what to do once it's finished, nil for its category's
+
+	Connections int // chunks to download in parallel, 0 picks by size
 }
 
 func AddURLFunc(myapp *MyApp) func() {
 	return func() {
-		// handling Entry
-		urlEntry := widget.NewEntry()
-		urlEntry.SetPlaceHolder("Enter URL...")
-
-		// Create a cancellable context for Cancelling
-		ctx, cancel := context.WithCancel(myapp.AppContext)
-		// Create a cancellable context for Pausing
-		ctxP, cancelP := context.WithCancel(myapp.AppContext)
-
-		//show dialog
-		dialog.ShowCustomConfirm("Add URL", "OK", "Cancel",
-			container.NewVBox(urlEntry),
-			func(confirm bool) {
-				if confirm {
-					fileInfo, err := getFileInfo(myapp.Client, urlEntry.Text)
-					if err != nil {
-						fmt.Println("got an error: ", err)
-						dialog.ShowError(fmt.Errorf("couldnt get fileInfo: %v", err), myapp.MainWindow)
-					}
-					fileItem, cancelC, pauseC := makeFileItem(myapp, fileInfo)
-					cancelC <- cancel
-					pauseC <- cancelP
+		showAddURL(myapp, "")
+	}
+}
 
-					ConfirmURL(myapp, fileInfo, fileItem, ctx, ctxP, cancelC, pauseC)
+// showAddURL asks for a url to download, prefilled with rawURL
+func showAddURL(myapp *MyApp, rawURL string) {
+	// handling Entry
+	urlEntry := widget.NewEntry()
+	urlEntry.SetPlaceHolder("Enter URL...")
+	urlEntry.SetText(rawURL)
+	queue := queueCheck(myapp)
+
+	// Its own post actions, otherwise the category's run
+	var actions []PostAction
+	var actionsButton *widget.Button
+	actionsButton = widget.NewButton("After download...", func() {
+		showDownloadActions(myapp, actions, func(edited []PostAction) {
+			actions = edited
+			actionsButton.SetText(fmt.Sprintf("After download... (%d)", len(actions)))
+		})
+	})
+
+	//show dialog
+	dialog.ShowCustomConfirm("Add URL", "OK", "Cancel",
+		container.NewVBox(urlEntry, queue, actionsButton),
+		func(confirm bool) {
+			if confirm {
+				fileInfo, err := getFileInfo(myapp.Client, urlEntry.Text)
+				if err != nil {
+					logger.Println("got an error: ", err)
+					myapp.showError(fmt.Errorf("couldnt get fileInfo: %v", err))
 					return
-				} else {
+				}
+				fileInfo.Actions = actions
+				if queue.Checked {
+					queueDownload(myapp, urlEntry.Text, fileInfo)
 					return
 				}
-			}, myapp.MainWindow)
+				addDownload(myapp, urlEntry.Text, fileInfo)
+				return
+			} else {
+				return
+			}
+		}, myapp.MainWindow)
+}
+
+// addDownload starts the download getFileInfo probed, streams ask for the quality first
+func addDownload(myapp *MyApp, rawURL string, fileInfo FileInfo) {
+	start := func(fileInfo FileInfo) {
+		startDownload(myapp, rawURL, fileInfo)
+	}
+
+	// Let the user pick the quality of a stream
+	if len(fileInfo.Variants) > 1 {
+		chooseStreamVariant(myapp, fileInfo, start)
+		return
+	}
+	start(fileInfo)
+}
+
+// startDownload starts fileInfo as it is, streams in the quality already
+// picked. The item is nil when the daemon downloads it
+func startDownload(myapp *MyApp, rawURL string, fileInfo FileInfo) *FileItem {
+	if myapp.remote() != nil {
+		go addRemote(myapp, rawURL, fileInfo)
+		return nil
+	}
+
+	// The contexts are only made once the quality is picked, a dismissed
+	// dialog leaves nothing behind
+	// Create a cancellable context for Cancelling
+	ctx, cancel := context.WithCancel(myapp.AppContext)
+	// Create a cancellable context for Pausing
+	ctxP, cancelP := context.WithCancel(myapp.AppContext)
+
+	fileItem, cancelC, pauseC := makeFileItem(myapp, fileInfo)
+	cancelC <- cancel
+	pauseC <- cancelP
+
+	ConfirmURL(myapp, fileInfo, fileItem, ctx, ctxP, cancelC, pauseC)
+	return fileItem
+}
+
+// chooseStreamVariant asks which quality of a stream to download, the best
+// one that can be played is preselected
+func chooseStreamVariant(myapp *MyApp, fileInfo FileInfo, start func(FileInfo)) {
+	ffmpeg := myapp.App.Preferences().String(prefFFmpegPath)
+	options := make([]string, len(fileInfo.Variants))
+	for i, variant := range fileInfo.Variants {
+		options[i] = fmt.Sprintf("%d. %s", i+1, variant.Name)
+		if variant.separateAudio() && ffmpeg == "" {
+			options[i] += " (needs ffmpeg)"
+		}
 	}
+	variantSelect := widget.NewSelect(options, nil)
+	variantSelect.SetSelectedIndex(defaultVariant(myapp, fileInfo.Variants))
+
+	dialog.ShowCustomConfirm("Choose quality", "OK", "Cancel",
+		container.NewVBox(widget.NewLabel(fileInfo.FileName), variantSelect),
+		func(confirm bool) {
+			if !confirm {
+				return
+			}
+			if index := variantSelect.SelectedIndex(); index >= 0 {
+				fileInfo.Stream = &fileInfo.Variants[index]
+			}
+			start(fileInfo)
+		}, myapp.MainWindow)
 }
 
 func ConfirmURL(myapp *MyApp, fileInfo FileInfo, fileItem *FileItem, ctx, ctxP context.Context, cancelC chan context.CancelFunc, pauseC chan context.CancelFunc) {
@@ -71,59 +160,104 @@ func ConfirmURL(myapp *MyApp, fileInfo FileInfo, fileItem *FileItem, ctx, ctxP c
 	pauseCh := make(chan bool, 1)
 	total := int64(fileInfo.Total)
 
-	//determine the Requests
-	numberOfRequests := 0
-	switch {
-	case total <= 10*1024*1024: // <= 10 MB
-		numberOfRequests = 1
-	case total <= 100*1024*1024: // 10 MB - 100 MB
-		numberOfRequests = 5
-	case total <= 1*1024*1024*1024: // 100 MB - 1 GB
-		numberOfRequests = 8
-	default: // > 1 GB
-		numberOfRequests = 15
+	// Streams are downloaded segment by segment
+	if fileInfo.Stream != nil {
+		download := &Download{
+			ID:        fileItem.ID,
+			FileName:  fileInfo.FileName,
+			URL:       fileInfo.URL,
+			FilePath:  fileInfo.FilePath,
+			CreatedAt: time.Now().String(),
+			Stream:    fileInfo.Stream,
+			Headers:   fileInfo.Headers,
+			Group:     fileInfo.Group,
+			Actions:   fileInfo.Actions,
+		}
+		downloadStream(myapp, download, fileItem, ctx, ctxP)
+		return
 	}
 
-	// calculating ChunkSize
-	ChunkSize := total / int64(numberOfRequests)
+	// Torrents come from peers instead of the url
+	if fileInfo.Torrent != nil {
+		download := &Download{
+			ID:        fileItem.ID,
+			FileName:  fileInfo.FileName,
+			URL:       fileInfo.URL,
+			FilePath:  fileInfo.FilePath,
+			TotalSize: total,
+			CreatedAt: time.Now().String(),
+			Torrent:   fileInfo.Torrent,
+			Headers:   fileInfo.Headers,
+			Group:     fileInfo.Group,
+			Actions:   fileInfo.Actions,
+		}
+		downloadTorrent(myapp, download, fileItem, ctx, ctxP)
+		return
+	}
+
+	//determine the Requests
+	numberOfRequests := chunkCount(fileInfo)
+
+	fileItem.setConnections(numberOfRequests)
+	ctx = withStats(ctx, fileItem.stats())
+
+	client := myapp.clientFor(fileInfo.Headers, fileInfo.URL)
+
+	// A failed chunk pauses the whole download, what's there is kept and
+	// resuming tries the chunk again
+	ctxP, pauseOnError := context.WithCancel(ctxP)
 
 	// Start the download in a goroutine
 	go func() {
+		defer pauseOnError()
 		// adding the number of request to waitgroup
 		var wg sync.WaitGroup
 
 		// Pre allocate slice
 		chunkSlice := make([]Chunk, numberOfRequests)
+		fileItem.stats().track(chunkSlice)
 
 		// Create file download
 		outFile, err := os.Create(fileInfo.FilePath)
 		if err != nil {
-			fmt.Println("Error Creating file:", err)
-			dialog.ShowError(fmt.Errorf("error creating file: %v", err), myapp.MainWindow)
+			logger.Println("Error Creating file:", err)
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error creating file: %v", err))
+			fileItem.stopped("Failed")
 			return
 		}
 
 		progressInfo := &ProgressInfo{
-			bar:        fileItem.Bar,
 			downloaded: 0,
 			total:      total,
 		}
 
+		// Spread the chunks over the mirrors, if there are any
+		var mirrors *mirrorSet
+		if fileInfo.Metalink != nil {
+			mirrors = newMirrorSet(fileInfo.Metalink.Mirrors)
+			watchCtx, stopWatch := context.WithCancel(ctx)
+			defer stopWatch()
+			go mirrors.watch(watchCtx, chunkSlice)
+		}
+
 		// Launch goroutines ForLoop
 		for i := 0; i < numberOfRequests; i++ {
-			start := int64(i) * ChunkSize
-			end := start + ChunkSize - 1
-			if i == numberOfRequests-1 {
-				end = total - 1
-			}
+			start, end := chunkRange(total, numberOfRequests, i)
 			wg.Add(1)
 			// Launch a goroutine for each chunk
 			go func(ctx, ctxP context.Context, start, end int64, index int, chunk []Chunk) {
 				defer wg.Done()
-				err := downloadChunk(myapp.Client, ctx, ctxP, fileInfo.URL, start, end, outFile, &progressInfo.downloaded, chunkSlice, i)
+				var err error
+				if mirrors != nil {
+					err = downloadChunkWithMirrors(client, ctx, ctxP, mirrors, start, end, outFile, &progressInfo.downloaded, chunkSlice, index)
+				} else {
+					err = downloadChunk(client, ctx, ctxP, fileInfo.URL, start, end, outFile, &progressInfo.downloaded, chunkSlice, index)
+				}
 				if err != nil && err != context.Canceled {
-					fmt.Printf("Error downloading chunk %v\n", err)
-					dialog.ShowError(fmt.Errorf("error downloading chunk %d: %v", index, err), myapp.MainWindow)
+					logger.Printf("Error downloading chunk %v\n", err)
+					fileItem.stats().failed(fmt.Errorf("chunk %d: %v", index, err))
+					fileItem.failed(myapp, fmt.Errorf("error downloading chunk %d: %v", index, err))
+					pauseOnError()
 				}
 			}(ctx, ctxP, start, end, i, chunkSlice)
 		}
@@ -131,49 +265,24 @@ func ConfirmURL(myapp *MyApp, fileInfo FileInfo, fileItem *FileItem, ctx, ctxP c
 		// Periodically update the progress bar, even if chunks aren't finished
 		ticker := time.NewTicker(500 * time.Millisecond) // Update every 500ms
 		go func() {
-			var speed float64
-			var timeDownload int64 = 0
 			for range ticker.C {
 				select {
 				case <-ctxP.Done():
-					// // Close the file in the main goroutine
-					if err := outFile.Close(); err != nil {
-						dialog.ShowError(fmt.Errorf("error closing file: %v", err), myapp.MainWindow)
-						fmt.Printf("Error closing file: %v\n", err)
-					}
 					pauseCh <- true
 					cancelCh <- false
 					ticker.Stop()
 					return
 				case <-ctx.Done(): // Stop updates if canceled
-					// // Close the file in the main goroutine
-					if err := outFile.Close(); err != nil {
-						fmt.Printf("Error closing file: %v\n", err)
-						dialog.ShowError(fmt.Errorf("error closing file: %v", err), myapp.MainWindow)
-					}
 					cancelCh <- true
 					pauseCh <- false
 					ticker.Stop()
 					return
 				default:
-					downloaded := atomic.LoadInt64(&progressInfo.downloaded)
-					// Calculate progress based on atomic downloaded value
-					value := float64(downloaded) / float64(total)
-
-					// Update the progress bar
-					fileItem.Bar.SetValue(value)
-					// Update download speed
-					speed = float64(downloaded-timeDownload) / 524288
-					fileItem.ProgressSpeed.SetText(fmt.Sprintf("Speed: %.2f MB/s", speed))
-					timeDownload = downloaded
+					// Update the progress bar and the speed
+					fileItem.setTransferred(atomic.LoadInt64(&progressInfo.downloaded), total)
 
 					// Stop the ticker when the download is complete
 					if atomic.LoadInt64(&progressInfo.downloaded) >= total {
-						// // Close the file in the main goroutine
-						if err := outFile.Close(); err != nil {
-							fmt.Printf("Error closing file: %v\n", err)
-							dialog.ShowError(fmt.Errorf("error closing file: %v", err), myapp.MainWindow)
-						}
 						cancelCh <- false
 						pauseCh <- false
 						ticker.Stop()
@@ -183,6 +292,11 @@ func ConfirmURL(myapp *MyApp, fileInfo FileInfo, fileItem *FileItem, ctx, ctxP c
 			}
 		}()
 		wg.Wait()
+		// The chunks are done writing, the file can be closed
+		if err := outFile.Close(); err != nil {
+			logger.Printf("Error closing file: %v\n", err)
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error closing file: %v", err))
+		}
 
 		newFile := Download{
 			ID:         fileItem.ID,
@@ -192,36 +306,53 @@ func ConfirmURL(myapp *MyApp, fileInfo FileInfo, fileItem *FileItem, ctx, ctxP c
 			TotalSize:  total,
 			Downloaded: progressInfo.downloaded,
 			CreatedAt:  time.Now().String(),
+			Metalink:   fileInfo.Metalink,
+			Headers:    fileInfo.Headers,
+			Group:      fileInfo.Group,
+			Actions:    fileInfo.Actions,
 			Chunks:     chunkSlice,
 		}
 
 		paused = <-pauseCh
 		// Handle Pausing
 		if paused {
-			fmt.Println("Download Paused.")
+			logger.Println("Download Paused.")
 			newFile.Status = "Paused"
 			fileItem.Ctx = ctx
 			fileItem.CtxP = ctxP
-			go saveDownloadFileInfo(newFile, myapp.DownloadStateFilePath)
+			saveDownloadFileInfo(newFile, myapp.DownloadStateFilePath)
+			fileItem.stopped("Paused")
 			return
 		}
 
 		canceled = <-cancelCh
 		// Handle cancellation and file deletion
 		if canceled {
-			fmt.Println("Download Cancelled")
+			logger.Println("Download Cancelled")
 			if err := os.Remove(fileInfo.FilePath); err != nil {
-				fmt.Printf("Error deleting file: %v\n", err)
+				logger.Printf("Error deleting file: %v\n", err)
 
 			}
+			fileItem.stopped("Cancelled")
 			return
 		}
 
-		fmt.Println("Download has Finished.")
+		logger.Println("Download has Finished.")
 		newFile.Status = "Finished"
+		err = repairPieces(client, &newFile)
+		if err == nil {
+			newFile.Checksum, err = verifyChecksum(client, newFile)
+		}
+		if err != nil {
+			logger.Println(err)
+			newFile.Status = "Corrupted"
+			myapp.showDownloadError(fileItem.ID, err)
+		}
 
-		go downloadFinished(fileItem, myapp.CurrentDownloadsContainer)
-		go saveDownloadFileInfo(newFile, myapp.DownloadStateFilePath)
+		go downloadFinished(fileItem)
+		saveDownloadFileInfo(newFile, myapp.DownloadStateFilePath)
+		runPostActions(myapp, fileItem, newFile)
+		fileItem.stopped(newFile.Status)
 	}()
 }
 
@@ -236,32 +367,73 @@ func ResumeDownload(myapp *MyApp, fileItem *FileItem, cancelC chan context.Cance
 	ctxP, cancelP := context.WithCancel(myapp.AppContext)
 	cancelC <- cancel
 	pauseC <- cancelP
+	ctx = withStats(ctx, fileItem.stats())
+	// The time it was paused isn't part of the speed
+	fileItem.speed.reset()
 
 	// get downloadFile Info
 	file, err := isFileExistByID(myapp.DownloadStateFilePath, fileItem.ID)
 	if err != nil {
-		fmt.Println(err)
+		logger.Println(err)
 	}
 
+	if file.Stream != nil {
+		downloadStream(myapp, &file, fileItem, ctx, ctxP)
+		return
+	}
+	if file.Torrent != nil {
+		downloadTorrent(myapp, &file, fileItem, ctx, ctxP)
+		return
+	}
+
+	// A failed chunk pauses it again, like in ConfirmURL
+	ctxP, pauseOnError := context.WithCancel(ctxP)
 	go func(file *Download) {
+		defer pauseOnError()
 		// adding the number of request to waitgroup
 		var wg sync.WaitGroup
+		client := myapp.clientFor(file.Headers, file.URL)
+		fileItem.stats().track(file.Chunks)
 
 		outFile, err := os.OpenFile(file.FilePath, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
-			fmt.Printf("failed to open JSON file: %v", err)
-			dialog.ShowError(fmt.Errorf("error opening file: %v", err), myapp.MainWindow)
+			logger.Printf("failed to open JSON file: %v", err)
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error opening file: %v", err))
+			fileItem.stopped("Failed")
 			return
 		}
 
+		// Spread the chunks over the mirrors, if there are any
+		var mirrors *mirrorSet
+		if file.Metalink != nil {
+			mirrors = newMirrorSet(file.Metalink.Mirrors)
+			watchCtx, stopWatch := context.WithCancel(ctx)
+			defer stopWatch()
+			go mirrors.watch(watchCtx, file.Chunks)
+		}
+
+		connections := 0
 		for index, chunk := range file.Chunks {
+			// Finished chunks have nothing left to read
+			if chunk.CurrentOffset > chunk.End {
+				continue
+			}
+			connections++
+			fileItem.setConnections(connections)
 			wg.Add(1)
 			go func(index int, chunk Chunk) {
 				defer wg.Done()
-				err := downloadChunk(myapp.Client, ctx, ctxP, file.URL, chunk.CurrentOffset, chunk.End, outFile, &file.Downloaded, file.Chunks, index)
+				var err error
+				if mirrors != nil {
+					err = downloadChunkWithMirrors(client, ctx, ctxP, mirrors, chunk.CurrentOffset, chunk.End, outFile, &file.Downloaded, file.Chunks, index)
+				} else {
+					err = downloadChunk(client, ctx, ctxP, file.URL, chunk.CurrentOffset, chunk.End, outFile, &file.Downloaded, file.Chunks, index)
+				}
 				if err != nil && err != context.Canceled {
-					fmt.Printf("Error downloading chunk %v\n", err)
-					dialog.ShowError(fmt.Errorf("error downloading chunk %d: %v", index, err), myapp.MainWindow)
+					logger.Printf("Error downloading chunk %v\n", err)
+					fileItem.stats().failed(fmt.Errorf("chunk %d: %v", index, err))
+					fileItem.failed(myapp, fmt.Errorf("error downloading chunk %d: %v", index, err))
+					pauseOnError()
 				}
 			}(index, chunk)
 		}
@@ -269,49 +441,24 @@ func ResumeDownload(myapp *MyApp, fileItem *FileItem, cancelC chan context.Cance
 		// Periodically update the progress bar, even if chunks aren't finished
 		ticker := time.NewTicker(500 * time.Millisecond) // Update every 500ms
 		go func() {
-			var speed float64
-			var timeDownload int64 = 0
 			for range ticker.C {
 				select {
 				case <-ctxP.Done():
-					// Closing file after pausing
-					if err := outFile.Close(); err != nil {
-						fmt.Printf("Error closing file: %v\n", err)
-						dialog.ShowError(fmt.Errorf("error closing file: %v", err), myapp.MainWindow)
-					}
 					pauseCh <- true
 					cancelCh <- false
 					ticker.Stop()
 					return
 				case <-ctx.Done(): // Stop updates if canceled
-					// Closing file after pausing
-					if err := outFile.Close(); err != nil {
-						fmt.Printf("Error closing file: %v\n", err)
-						dialog.ShowError(fmt.Errorf("error closing file: %v", err), myapp.MainWindow)
-					}
 					cancelCh <- true
 					pauseCh <- false
 					ticker.Stop()
 					return
 				default:
-					// Calculate progress based on atomic downloaded value
-					downloaded := atomic.LoadInt64(&file.Downloaded)
-					value := float64(downloaded) / float64(file.TotalSize)
-
-					// Update the progress bar
-					fileItem.Bar.SetValue(value)
-					// Update download speed
-					speed = float64(downloaded-timeDownload) / 524288
-					fileItem.ProgressSpeed.SetText(fmt.Sprintf("Speed: %.2f MB/s", speed))
-					timeDownload = downloaded
+					// Update the progress bar and the speed
+					fileItem.setTransferred(atomic.LoadInt64(&file.Downloaded), file.TotalSize)
 
 					// Stop the ticker when the download is complete
 					if atomic.LoadInt64(&file.Downloaded) >= file.TotalSize {
-						// Closing file after pausing
-						if err := outFile.Close(); err != nil {
-							fmt.Printf("Error closing file: %v\n", err)
-							dialog.ShowError(fmt.Errorf("error closing file: %v", err), myapp.MainWindow)
-						}
 						cancelCh <- false
 						pauseCh <- false
 						ticker.Stop()
@@ -321,55 +468,120 @@ func ResumeDownload(myapp *MyApp, fileItem *FileItem, cancelC chan context.Cance
 			}
 		}()
 		wg.Wait()
+		// The chunks are done writing, the file can be closed
+		if err := outFile.Close(); err != nil {
+			logger.Printf("Error closing file: %v\n", err)
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error closing file: %v", err))
+		}
 
 		paused = <-pauseCh
 		// Handle Pausing
 		if paused {
-			fmt.Println("Download Paused.")
-			go saveDownloadFileInfo(*file, myapp.DownloadStateFilePath)
+			logger.Println("Download Paused.")
+			saveDownloadFileInfo(*file, myapp.DownloadStateFilePath)
+			fileItem.stopped("Paused")
 			return
 		}
 
 		canceled = <-cancelCh
 		// Handle cancellation and file deletion
 		if canceled {
-			fmt.Println("Download Cancelled")
+			logger.Println("Download Cancelled")
 			// Close the file in the main goroutine
 			if err := os.Remove(file.FilePath); err != nil {
-				fmt.Printf("Error deleting file: %v\n", err)
-				return
-			} else {
-				return
+				logger.Printf("Error deleting file: %v\n", err)
 			}
+			fileItem.stopped("Cancelled")
+			return
 		}
 		file.UpdatedAt = time.Now().String()
 
-		fmt.Println("Download has Finished.")
+		logger.Println("Download has Finished.")
+		file.Status = "Finished"
+		err = repairPieces(client, file)
+		if err == nil {
+			file.Checksum, err = verifyChecksum(client, *file)
+		}
+		if err != nil {
+			logger.Println(err)
+			file.Status = "Corrupted"
+			myapp.showDownloadError(fileItem.ID, err)
+		}
 
-		go saveDownloadFileInfo(*file, myapp.DownloadStateFilePath)
-		go downloadFinished(fileItem, myapp.CurrentDownloadsContainer)
+		saveDownloadFileInfo(*file, myapp.DownloadStateFilePath)
+		go downloadFinished(fileItem)
+		runPostActions(myapp, fileItem, *file)
+		fileItem.stopped(file.Status)
 	}(&file)
 }
 
 // ----------------------------------------------- Supplement
 
-func downloadChunk(Client *http.Client, ctx, ctxP context.Context, url string, start, end int64, outFile *os.File, downloaded *int64, chunkSlice []Chunk, index int) error {
+// chunkCount is how many chunks fileInfo is downloaded in
+func chunkCount(fileInfo FileInfo) int {
+	total := int64(fileInfo.Total)
+	numberOfRequests := 0
+	switch {
+	case total <= 10*1024*1024: // <= 10 MB
+		numberOfRequests = 1
+	case total <= 100*1024*1024: // 10 MB - 100 MB
+		numberOfRequests = 5
+	case total <= 1*1024*1024*1024: // 100 MB - 1 GB
+		numberOfRequests = 8
+	default: // > 1 GB
+		numberOfRequests = 15
+	}
+	// Give every mirror something to do
+	if fileInfo.Metalink != nil && total > 1024*1024 {
+		numberOfRequests = max(numberOfRequests, min(len(fileInfo.Metalink.Mirrors), 15))
+	}
+	if fileInfo.Connections > 0 {
+		numberOfRequests = int(max(min(int64(fileInfo.Connections), total), 1))
+	}
+	return numberOfRequests
+}
+
+// chunkRange is where chunk i of count starts and ends, the last one takes the rest
+func chunkRange(total int64, count, i int) (int64, int64) {
+	chunkSize := total / int64(count)
+	start := int64(i) * chunkSize
+	end := start + chunkSize - 1
+	if i == count-1 {
+		end = total - 1
+	}
+	return start, end
+}
 
-	// Prepare the HTTP request with a range header
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+func downloadChunk(Client *http.Client, ctx, ctxP context.Context, url string, start, end int64, outFile *os.File, downloaded *int64, chunkSlice []Chunk, index int) error {
+	// Keep the chunk up to date while it downloads, CurrentOffset is read
+	// concurrently (atomic) to follow the progress of each chunk
+	setChunk(ctx, chunkSlice, index, func(chunk *Chunk) {
+		chunk.End = end
+		chunk.Status = "Downloading"
+	})
+	atomic.StoreInt64(&chunkSlice[index].CurrentOffset, start)
+
+	// Open the chunk range with whatever protocol the url uses
+	source, err := sourceFor(Client, url)
 	if err != nil {
-		fmt.Printf("Error creating the request: %v\n", err)
+		setChunkStatus(ctx, chunkSlice, index, "Failed")
 		return err
 	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
-
-	// Send Request
-	resp, err := Client.Do(req)
+	// Pausing has to unblock a read the source is stuck in as well
+	rangeCtx, stopRange := context.WithCancel(ctx)
+	defer stopRange()
+	unpause := context.AfterFunc(ctxP, stopRange)
+	defer unpause()
+	body, err := source.OpenRange(rangeCtx, url, start, end)
 	if err != nil {
-		fmt.Printf("Error starting the download: %v\n", err)
+		if errors.Is(err, context.Canceled) {
+			setChunkStatus(ctx, chunkSlice, index, "Paused")
+			return context.Canceled
+		}
+		setChunkStatus(ctx, chunkSlice, index, "Failed")
 		return err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
 
 	// Track total bytes
 	totalBytesToRead := end - start + 1
@@ -379,23 +591,42 @@ func downloadChunk(Client *http.Client, ctx, ctxP context.Context, url string, s
 	buf := make([]byte, 1024*256)             // 256KB buffer for reading
 	writeBuffer := make([]byte, 0, 1024*1024) //1 MB buffer for batching
 
+	// flush writes the batched data so the chunk can continue from offset later
+	flush := func() error {
+		if len(writeBuffer) == 0 {
+			return nil
+		}
+		if _, writeErr := outFile.WriteAt(writeBuffer, offset); writeErr != nil {
+			logger.Printf("Error writing to file: %v\n", writeErr)
+			return writeErr
+		}
+		offset += int64(len(writeBuffer)) // Update the offset
+		// Only written bytes count, a paused chunk loses its unwritten buffer
+		atomic.AddInt64(downloaded, int64(len(writeBuffer)))
+		writeBuffer = writeBuffer[:0] // Reset the buffer
+		atomic.StoreInt64(&chunkSlice[index].CurrentOffset, offset)
+		return nil
+	}
+
 Loop:
 	for {
 		select {
 		case <-ctxP.Done(): // Handle pause
-			chunkSlice[index] = Chunk{
-				End:           end,
-				CurrentOffset: offset,
-				Status:        "Paused",
+			if err := flush(); err != nil {
+				return err
 			}
+			setChunkStatus(ctx, chunkSlice, index, "Paused")
 			return context.Canceled
 		case <-ctx.Done(): // Handle cancellation
+			if err := flush(); err != nil {
+				return err
+			}
 			return context.Canceled
 		default:
 			// Calculate bytes left to read
 			bytesLeft := totalBytesToRead - totalRead
 			if bytesLeft <= 0 {
-				fmt.Printf("Chunk %d: All data read\n", start)
+				logger.Printf("Chunk %d: All data read\n", start)
 				break Loop // Exit the for loop
 			}
 
@@ -406,89 +637,142 @@ Loop:
 			}
 
 			// Read data into the buffer
-			n, err := resp.Body.Read(buf[:readSize])
+			n, err := body.Read(buf[:readSize])
 
 			if n > 0 {
 				totalRead += int64(n)
 
 				writeBuffer = append(writeBuffer, buf[:n]...)
 
-				// Update the downloaded bytes
-				atomic.AddInt64(downloaded, int64(n))
+				// Over the speed limit, the next read waits
+				if wait := globalLimit.take(n); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+					case <-ctxP.Done():
+					}
+				}
 
 				// If the write buffer exceeds the threshold or all data is read, write to the file
 				if len(writeBuffer) >= 1024*1024 || totalRead >= totalBytesToRead {
-					if _, writeErr := outFile.WriteAt(writeBuffer, offset); writeErr != nil {
-						fmt.Printf("Error writing to file: %v\n", writeErr)
-						return writeErr
+					if err := flush(); err != nil {
+						return err
 					}
-					offset += int64(len(writeBuffer)) // Update the offset
-					writeBuffer = writeBuffer[:0]     // Reset the buffer
 				}
 			}
 
 			if err != nil {
-				if err == io.EOF {
+				if err == io.EOF && totalRead >= totalBytesToRead {
 					break Loop // Exit the for loop
 				}
 				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					if flushErr := flush(); flushErr != nil {
+						return flushErr
+					}
+					setChunkStatus(ctx, chunkSlice, index, "Paused")
 					return context.Canceled
 				}
-				fmt.Printf("Error reading from response: %v\n", err)
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				// Keep what was read so the chunk can be retried from there
+				if flushErr := flush(); flushErr != nil {
+					return flushErr
+				}
+				setChunkStatus(ctx, chunkSlice, index, "Failed")
+				logger.Printf("Error reading from response: %v\n", err)
 				return err
 			}
 
 			if n == 0 {
 				// No data read, but no error; avoid infinite loop
-				fmt.Printf("Chunk %d: Zero-byte read, breaking loop\n", start)
+				logger.Printf("Chunk %d: Zero-byte read, breaking loop\n", start)
 				break Loop // Exit the for loop
 			}
 		}
 	}
 
 	// Write any remaining data in the buffer to the file (only if not canceled)
-	if len(writeBuffer) > 0 {
-		if _, writeErr := outFile.WriteAt(writeBuffer, offset); writeErr != nil {
-			fmt.Printf("Error writing remaining data to file: %v\n", writeErr)
-			return writeErr
-		}
+	if err := flush(); err != nil {
+		logger.Printf("Error writing remaining data to file: %v\n", err)
+		return err
 	}
+	setChunkStatus(ctx, chunkSlice, index, "Finished")
 	return nil
 }
 
 // ----------------------------------------------- Extra
 
 func getFileInfo(client *http.Client, url string) (FileInfo, error) {
-	// Get file Info
-	resp, err := client.Head(url)
-	if err != nil {
-		fmt.Println("error making the request")
-		return FileInfo{}, fmt.Errorf("error making the request, %v", err)
+	var fileInfo FileInfo
+	var err error
+	if isMagnet(url) {
+		// Nothing to probe, the metadata comes from the peers later
+		fileInfo, err = probeMagnet(url)
+	} else {
+		fileInfo, err = probeURL(client, url)
 	}
-	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Failed to download file: HTTP %d\n", resp.StatusCode)
-		return FileInfo{}, fmt.Errorf("failed to download file %v", err)
+	if err != nil {
+		return FileInfo{}, err
 	}
-	defer resp.Body.Close() // Close response
-
-	fileSize, total := getFileSize(resp)
-	fileName := getFileName(resp, url)
 
 	// Making filePath
 	downloadsFolder, err := getDownloadD()
 	if err != nil {
-		fmt.Printf("Unable to find Downloads folder: %v\n", err)
+		logger.Printf("Unable to find Downloads folder: %v\n", err)
 		return FileInfo{}, fmt.Errorf("unable to find downloads folder %v", err)
 	}
-	filePath := filepath.Join(downloadsFolder, fmt.Sprintf("DownBitDownloads/%s", fileName))
+	fileInfo.FilePath = filepath.Join(downloadsFolder, fmt.Sprintf("DownBitDownloads/%s", fileInfo.FileName))
+	if fileInfo.URL == "" {
+		fileInfo.URL = url
+	}
+
+	return fileInfo, nil
+}
 
-	return FileInfo{
-		FileName: fileName,
-		FileSize: fileSize,
-		Total:    int(total),
-		FilePath: filePath,
-		URL:      url,
-	}, nil
+// saveTo points the download at output, a file or an existing folder to
+// keep the file's own name in
+func (fileInfo *FileInfo) saveTo(output string) error {
+	if stat, err := os.Stat(output); err == nil && stat.IsDir() {
+		output = filepath.Join(output, fileInfo.FileName)
+	}
+	filePath, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	fileInfo.FilePath = filePath
+	return nil
+}
+
+// probeURL asks the source about url and follows metalinks, torrents and
+// stream manifests to what they describe
+func probeURL(client *http.Client, url string) (FileInfo, error) {
+	source, err := sourceFor(client, url)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	// Get file Info
+	fileInfo, err := source.Probe(context.Background(), url)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	// A metalink describes the file to download and its mirrors
+	if isMetalink(url, fileInfo.MimeType) {
+		return probeMetalink(client, url, fileInfo)
+	}
+
+	// A .torrent is downloaded from the peers it leads to
+	if isTorrent(url, fileInfo.MimeType) {
+		return probeTorrent(client, url, fileInfo)
+	}
+
+	// HLS and DASH manifests are downloaded as the stream they describe
+	if kind := streamKind(url, fileInfo.MimeType); kind != "" {
+		return probeStream(client, url, kind, fileInfo)
+	}
+	return fileInfo, nil
 }
 
 func getDownloadD() (string, error) {
@@ -510,14 +794,14 @@ func getFileSize(resp *http.Response) (float64, int64) {
 		cl, _ = strconv.ParseInt(contentLength, 10, 64)
 		sizeInBytes, err := strconv.Atoi(contentLength)
 		if err != nil {
-			fmt.Println("Error parsing Content-Length:", err)
+			logger.Println("Error parsing Content-Length:", err)
 			return size, cl
 		}
 		size = float64(sizeInBytes) / (1024 * 1024)
 		return size, cl
 	} else {
 		cl, _ = strconv.ParseInt(contentLength, 10, 64)
-		fmt.Println("file Size is unkown")
+		logger.Println("file Size is unkown")
 		return size, cl
 	}
 }
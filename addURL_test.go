@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHeadlessApp is enough of the app for a download without a window,
+// with its own database
+func testHeadlessApp(t *testing.T) *MyApp {
+	t.Helper()
+	database, err := createJSONFile(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &MyApp{AppContext: ctx, Client: http.DefaultClient, DownloadStateFilePath: database}
+}
+
+// testHeadlessItem follows a download, the errors it reports are kept
+func testHeadlessItem(id string) (*FileItem, <-chan string, func() []error) {
+	var mu sync.Mutex
+	var errs []error
+	stopped := make(chan string, 1)
+	fileItem := &FileItem{
+		ID:     id,
+		OnStop: func(status string) { stopped <- status },
+		OnError: func(err error) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+	}
+	return fileItem, stopped, func() []error {
+		mu.Lock()
+		defer mu.Unlock()
+		return errs
+	}
+}
+
+func waitStopped(t *testing.T, stopped <-chan string) string {
+	t.Helper()
+	select {
+	case status := <-stopped:
+		return status
+	case <-time.After(10 * time.Second):
+		t.Fatal("the download never stopped")
+		return ""
+	}
+}
+
+// A chunk the server fails pauses the download, so whoever waits for it
+// (the cli, the daemon, a mirror) hears it stopped and it can be resumed
+func TestChunkFailurePauses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	myapp := testHeadlessApp(t)
+
+	fileInfo := FileInfo{
+		FileName: "data.bin",
+		URL:      server.URL + "/data.bin",
+		FilePath: filepath.Join(t.TempDir(), "data.bin"),
+		Total:    4096,
+	}
+	fileItem, stopped, errs := testHeadlessItem("failing")
+	ctx, cancel := context.WithCancel(myapp.AppContext)
+	defer cancel()
+	ConfirmURL(myapp, fileInfo, fileItem, ctx, context.Background(), nil, nil)
+
+	if status := waitStopped(t, stopped); status != "Paused" {
+		t.Errorf("stopped with %q, want Paused", status)
+	}
+	if len(errs()) == 0 {
+		t.Error("the chunk error wasn't reported")
+	}
+	saved, err := isFileExistByID(myapp.DownloadStateFilePath, "failing")
+	if err != nil {
+		t.Fatalf("the paused download wasn't saved: %v", err)
+	}
+	if saved.Status != "Paused" {
+		t.Errorf("saved with status %q, want Paused", saved.Status)
+	}
+
+	// Resuming against a server that still fails stops again
+	resumed, stopped, errs := testHeadlessItem("failing")
+	cancelC := make(chan context.CancelFunc, 1)
+	pauseC := make(chan context.CancelFunc, 1)
+	ResumeDownload(myapp, resumed, cancelC, pauseC)
+	if status := waitStopped(t, stopped); status != "Paused" {
+		t.Errorf("resumed download stopped with %q, want Paused", status)
+	}
+	if len(errs()) == 0 {
+		t.Error("the chunk error of the resumed download wasn't reported")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Archives are extracted next to themselves, into a folder of the same name.
+// Go has no xz or zstd of its own, those are read through the xz and zstd
+// commands.
+
+// archiveExtensions are the endings extractArchive knows, longest first
+var archiveExtensions = []string{".tar.gz", ".tar.xz", ".tar.zst", ".tgz", ".txz", ".tzst", ".tar", ".zip"}
+
+// archiveKind returns the extension of filePath if it's an archive we can extract
+func archiveKind(filePath string) string {
+	lower := strings.ToLower(filePath)
+	for _, extension := range archiveExtensions {
+		if strings.HasSuffix(lower, extension) {
+			return extension
+		}
+	}
+	return ""
+}
+
+// extractTarget is the sibling folder an archive goes to, foo.tar.gz into
+// foo or foo (2) when there already is a foo
+func extractTarget(filePath string) string {
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	if kind := archiveKind(filePath); kind != "" {
+		base = filePath[:len(filePath)-len(kind)]
+	}
+	target := base
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			return target
+		}
+		target = fmt.Sprintf("%s (%d)", base, i)
+	}
+}
+
+// extractArchive extracts the archive at filePath into dir and returns how
+// many files it wrote
+func extractArchive(ctx context.Context, filePath, dir string, progress func(float64)) (int, error) {
+	switch archiveKind(filePath) {
+	case ".zip":
+		return extractZip(ctx, filePath, dir, progress)
+	case ".tar.gz", ".tgz", ".tar.xz", ".txz", ".tar.zst", ".tzst", ".tar":
+		return extractTar(ctx, filePath, dir, progress)
+	}
+	return 0, fmt.Errorf("%s isn't an archive that can be extracted", filepath.Base(filePath))
+}
+
+// entryPath is where an entry named name goes in dir, absolute entries and
+// ones that would land outside of it (zip slip) are refused
+func entryPath(dir, name string) (string, error) {
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || strings.HasPrefix(name, string(filepath.Separator)) {
+		return "", fmt.Errorf("the archive has an absolute entry: %s", name)
+	}
+	target := filepath.Join(dir, name)
+	if target != filepath.Clean(dir) && !strings.HasPrefix(target, filepath.Clean(dir)+string(filepath.Separator)) {
+		return "", fmt.Errorf("the archive has an entry outside of its folder: %s", name)
+	}
+	return target, nil
+}
+
+func extractZip(ctx context.Context, filePath, dir string, progress func(float64)) (int, error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer archive.Close()
+
+	var total, done uint64
+	for _, file := range archive.File {
+		total += file.UncompressedSize64
+	}
+	count := 0
+	for _, file := range archive.File {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		target, err := entryPath(dir, file.Name)
+		if err != nil {
+			return count, err
+		}
+		if file.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return count, err
+			}
+			continue
+		}
+		if !file.Mode().IsRegular() {
+			// A link could point the next entries outside of dir
+			logger.Println("Skipping", file.Name, "of", filepath.Base(filePath))
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return count, err
+		}
+		err = writeEntry(target, reader, file.Mode().Perm())
+		reader.Close()
+		if err != nil {
+			return count, err
+		}
+		count++
+		done += file.UncompressedSize64
+		if total > 0 {
+			progress(float64(done) / float64(total))
+		}
+	}
+	return count, nil
+}
+
+func extractTar(ctx context.Context, filePath, dir string, progress func(float64)) (int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// Progress is how much of the archive was read
+	counter := &countingReader{reader: file}
+	reader, err := decompress(ctx, archiveKind(filePath), counter)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	archive := tar.NewReader(reader)
+	count := 0
+	for {
+		if ctx.Err() != nil {
+			return count, ctx.Err()
+		}
+		header, err := archive.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		target, err := entryPath(dir, header.Name)
+		if err != nil {
+			return count, err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return count, err
+			}
+		case tar.TypeReg:
+			if err := writeEntry(target, archive, os.FileMode(header.Mode).Perm()); err != nil {
+				return count, err
+			}
+			count++
+		default:
+			// Links and devices are left out
+			logger.Println("Skipping", header.Name, "of", filepath.Base(filePath))
+		}
+		if stat.Size() > 0 {
+			progress(min(float64(counter.count.Load())/float64(stat.Size()), 1))
+		}
+	}
+}
+
+// decompress reads the tar out of a compressed one
+func decompress(ctx context.Context, kind string, compressed io.Reader) (io.ReadCloser, error) {
+	var tool string
+	switch kind {
+	case ".tar":
+		return io.NopCloser(compressed), nil
+	case ".tar.gz", ".tgz":
+		return gzip.NewReader(compressed)
+	case ".tar.xz", ".txz":
+		tool = "xz"
+	case ".tar.zst", ".tzst":
+		tool = "zstd"
+	}
+
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return nil, fmt.Errorf("extracting %s needs %s installed", kind, tool)
+	}
+	command := exec.CommandContext(ctx, path, "-dc")
+	command.Stdin = compressed
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	output, err := command.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := command.Start(); err != nil {
+		return nil, err
+	}
+	return &commandReader{ReadCloser: output, command: command, stderr: &stderr}, nil
+}
+
+// commandReader is the output of a command, closing it waits for the command
+type commandReader struct {
+	io.ReadCloser
+	command *exec.Cmd
+	stderr  *strings.Builder
+	waited  bool
+}
+
+func (c *commandReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if err == io.EOF && !c.waited {
+		// A broken archive ends the output early, the command tells why
+		c.waited = true
+		if waitErr := c.command.Wait(); waitErr != nil {
+			return n, fmt.Errorf("%s: %v: %s", filepath.Base(c.command.Path), waitErr, strings.TrimSpace(c.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+func (c *commandReader) Close() error {
+	if !c.waited {
+		// The tar ended before the output did
+		c.command.Process.Kill()
+		c.command.Wait()
+	}
+	return nil
+}
+
+func writeEntry(target string, reader io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// countingReader counts what was read, xz and zstd read it from a goroutine
+// of their own while the progress is taken
+type countingReader struct {
+	reader io.Reader
+	count  atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEntryPath(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "out")
+	tests := []struct {
+		name string
+		want string // empty when it's refused
+	}{
+		{"a.txt", filepath.Join(dir, "a.txt")},
+		{"sub/a.txt", filepath.Join(dir, "sub", "a.txt")},
+		{"sub/../a.txt", filepath.Join(dir, "a.txt")},
+		{"./", dir},
+		{"../a.txt", ""},
+		{"sub/../../a.txt", ""},
+		{"../out2/a.txt", ""},
+		{"/etc/passwd", ""},
+	}
+	for _, test := range tests {
+		got, err := entryPath(dir, test.name)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("entryPath(%q) = %q, want it refused", test.name, got)
+		case test.want != "" && (err != nil || got != test.want):
+			t.Errorf("entryPath(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+// The crafted archives in testdata try to write outside of the folder
+// they're extracted to, with ../, an absolute path or through a link
+func TestExtractStaysInside(t *testing.T) {
+	const absolute = "/tmp/downbit-absolute-evil.txt"
+	tests := []struct {
+		archive string // in testdata
+		count   int
+		err     string // empty when it extracts
+	}{
+		{"slip.zip", 1, "outside of its folder"},
+		{"absolute.zip", 1, "absolute entry"},
+		{"symlink.zip", 2, ""},
+		{"slip.tar", 1, "outside of its folder"},
+		{"absolute.tar", 1, "absolute entry"},
+		{"symlink.tar", 2, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.archive, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "out")
+			filePath, err := filepath.Abs(filepath.Join("testdata", test.archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var extract func(context.Context, string, string, func(float64)) (int, error)
+			if strings.HasSuffix(test.archive, ".zip") {
+				extract = extractZip
+			} else {
+				extract = extractTar
+			}
+			count, err := extract(context.Background(), filePath, dir, func(float64) {})
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("extracting failed: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("extracting returned %v, want an error with %q", err, test.err)
+			}
+			if count != test.count {
+				t.Errorf("wrote %d files, want %d", count, test.count)
+			}
+
+			if _, err := os.Lstat(absolute); err == nil {
+				os.Remove(absolute)
+				t.Errorf("wrote %s", absolute)
+			}
+			filepath.WalkDir(parent, func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if path != parent && path != dir && !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+					t.Errorf("wrote %s outside of %s", path, dir)
+				}
+				if entry.Type()&fs.ModeSymlink != 0 {
+					t.Errorf("made the link %s", path)
+				}
+				return nil
+			})
+			if got, err := os.ReadFile(filepath.Join(dir, "ok.txt")); err != nil || string(got) != "ok" {
+				t.Errorf("ok.txt wasn't extracted (%v)", err)
+			}
+		})
+	}
+}
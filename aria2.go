@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// aria2's JSON-RPC, enough of it for AriaNg and other aria2 frontends to
+// drive the daemon. A gid is the first 16 hex digits of a download's id.
+
+const defaultRPCPort = 6800
+
+type rpcRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *rpcError) Error() string {
+	return err.Message
+}
+
+type rpcNotification struct {
+	JSONRPC string              `json:"jsonrpc"`
+	Method  string              `json:"method"`
+	Params  []map[string]string `json:"params"`
+}
+
+type aria2Server struct {
+	daemon   *daemon
+	secret   string
+	session  string // made up per process, the secret stays a secret
+	upgrader websocket.Upgrader
+}
+
+var aria2Methods = []string{
+	"aria2.addUri", "aria2.remove", "aria2.forceRemove", "aria2.pause", "aria2.forcePause",
+	"aria2.pauseAll", "aria2.forcePauseAll", "aria2.unpause", "aria2.unpauseAll",
+	"aria2.tellStatus", "aria2.getUris", "aria2.getFiles", "aria2.getPeers", "aria2.getServers",
+	"aria2.tellActive", "aria2.tellWaiting", "aria2.tellStopped", "aria2.getOption",
+	"aria2.changeOption", "aria2.getGlobalOption", "aria2.changeGlobalOption", "aria2.getGlobalStat",
+	"aria2.purgeDownloadResult", "aria2.removeDownloadResult", "aria2.getVersion",
+	"aria2.getSessionInfo", "aria2.saveSession", "system.multicall", "system.listMethods",
+	"system.listNotifications",
+}
+
+var aria2Notifications = []string{
+	"aria2.onDownloadStart", "aria2.onDownloadPause", "aria2.onDownloadStop",
+	"aria2.onDownloadComplete", "aria2.onDownloadError", "aria2.onBtDownloadComplete",
+}
+
+func newAria2Server(d *daemon, secret string) *aria2Server {
+	session := make([]byte, 20)
+	rand.Read(session)
+	return &aria2Server{
+		daemon:  d,
+		secret:  secret,
+		session: hex.EncodeToString(session),
+		// Frontends like AriaNg are served from anywhere, the secret protects the rpc
+		upgrader: websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }},
+	}
+}
+
+// ServeHTTP answers POST /jsonrpc and upgrades it to a WebSocket that also
+// carries the notifications
+func (s *aria2Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch {
+	case r.URL.Path != "/jsonrpc":
+		http.NotFound(w, r)
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusOK)
+	case websocket.IsWebSocketUpgrade(r):
+		s.serveWebSocket(w, r)
+	case r.Method == http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1024*1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json-rpc")
+		w.Write(s.handle(body))
+	default:
+		http.Error(w, "use POST or a WebSocket", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *aria2Server) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	write := func(data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	events := s.daemon.subscribe()
+	defer s.daemon.unsubscribe(events)
+	closed := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-closed:
+				return
+			case event := <-events:
+				if data := aria2Notify(event); data != nil {
+					write(data)
+				}
+			}
+		}
+	}()
+	defer close(closed)
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := write(s.handle(message)); err != nil {
+			return
+		}
+	}
+}
+
+// aria2Notify turns a daemon event into an aria2 notification, nil when there's none
+func aria2Notify(event daemonEvent) []byte {
+	var method, id string
+	switch data := event.Data.(type) {
+	case DownloadState:
+		id = data.ID
+		switch {
+		case event.Name == "added" || event.Name == "resumed":
+			method = "aria2.onDownloadStart"
+		case event.Name != "stopped":
+		case data.Status == "Paused":
+			method = "aria2.onDownloadPause"
+		case data.Status == "Finished" && (isMagnet(data.URL) || isTorrent(data.URL, "")):
+			method = "aria2.onBtDownloadComplete"
+		case data.Status == "Finished":
+			method = "aria2.onDownloadComplete"
+		case data.Status == "Corrupted" || data.Status == "Failed":
+			method = "aria2.onDownloadError"
+		}
+	case map[string]string:
+		if event.Name == "removed" {
+			id, method = data["id"], "aria2.onDownloadStop"
+		}
+	}
+	if method == "" {
+		return nil
+	}
+	data, _ := json.Marshal(rpcNotification{JSONRPC: "2.0", Method: method, Params: []map[string]string{{"gid": gidOf(id)}}})
+	return data
+}
+
+// handle answers a request or a batch of them
+func (s *aria2Server) handle(body []byte) []byte {
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		var requests []rpcRequest
+		if err := json.Unmarshal(body, &requests); err != nil {
+			return rpcParseError()
+		}
+		responses := make([]rpcResponse, len(requests))
+		for i, request := range requests {
+			responses[i] = s.respond(request)
+		}
+		data, _ := json.Marshal(responses)
+		return data
+	}
+
+	var request rpcRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return rpcParseError()
+	}
+	data, _ := json.Marshal(s.respond(request))
+	return data
+}
+
+func rpcParseError() []byte {
+	data, _ := json.Marshal(rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: -32700, Message: "Parse error."}})
+	return data
+}
+
+func (s *aria2Server) respond(request rpcRequest) rpcResponse {
+	response := rpcResponse{JSONRPC: "2.0", ID: request.ID}
+	result, err := s.call(request.Method, request.Params)
+	if err != nil {
+		var answer *rpcError
+		if !errors.As(err, &answer) {
+			answer = &rpcError{Code: 1, Message: err.Error()}
+		}
+		response.Error = answer
+		return response
+	}
+	response.Result = result
+	return response
+}
+
+// ----------------------------------------------- Methods
+
+func (s *aria2Server) call(method string, params []json.RawMessage) (any, error) {
+	switch method {
+	case "system.listMethods":
+		return aria2Methods, nil
+	case "system.listNotifications":
+		return aria2Notifications, nil
+	case "system.multicall":
+		return s.multicall(params)
+	}
+
+	// Everything else starts with token:secret
+	var token string
+	if len(params) == 0 || json.Unmarshal(params[0], &token) != nil ||
+		subtle.ConstantTimeCompare([]byte(token), []byte("token:"+s.secret)) != 1 {
+		return nil, &rpcError{Code: 1, Message: "Unauthorized"}
+	}
+	params = params[1:]
+
+	switch method {
+	case "aria2.addUri":
+		return s.addURI(params)
+	case "aria2.remove", "aria2.forceRemove", "aria2.removeDownloadResult":
+		// aria2 never deletes files on a remove
+		return s.withGID(params, func(state DownloadState) error {
+			return s.daemon.removeKeepingFiles(state.ID)
+		})
+	case "aria2.pause", "aria2.forcePause":
+		return s.withGID(params, func(state DownloadState) error {
+			return s.daemon.pause(state.ID)
+		})
+	case "aria2.unpause":
+		return s.withGID(params, func(state DownloadState) error {
+			return s.daemon.resume(state.ID)
+		})
+	case "aria2.pauseAll", "aria2.forcePauseAll":
+		s.daemon.pauseAll()
+		return "OK", nil
+	case "aria2.unpauseAll":
+		states, err := s.daemon.list()
+		if err != nil {
+			return nil, err
+		}
+		for _, state := range states {
+			if state.Status == "Paused" {
+				s.daemon.resume(state.ID)
+			}
+		}
+		return "OK", nil
+	case "aria2.purgeDownloadResult":
+		states, err := s.daemon.list()
+		if err != nil {
+			return nil, err
+		}
+		for _, state := range states {
+			if aria2Status(state.Status) == "complete" || aria2Status(state.Status) == "error" {
+				s.daemon.removeKeepingFiles(state.ID)
+			}
+		}
+		return "OK", nil
+
+	case "aria2.tellStatus":
+		var gid string
+		var keys []string
+		rpcParam(params, 0, &gid)
+		rpcParam(params, 1, &keys)
+		state, err := s.find(gid)
+		if err != nil {
+			return nil, err
+		}
+		return aria2StatusOf(state, keys), nil
+	case "aria2.tellActive":
+		var keys []string
+		rpcParam(params, 0, &keys)
+		return s.tell(keys, 0, -1, "active")
+	case "aria2.tellWaiting":
+		var offset, num int
+		var keys []string
+		rpcParam(params, 0, &offset)
+		rpcParam(params, 1, &num)
+		rpcParam(params, 2, &keys)
+		return s.tell(keys, offset, num, "waiting", "paused")
+	case "aria2.tellStopped":
+		var offset, num int
+		var keys []string
+		rpcParam(params, 0, &offset)
+		rpcParam(params, 1, &num)
+		rpcParam(params, 2, &keys)
+		return s.tell(keys, offset, num, "complete", "error", "removed")
+	case "aria2.getFiles", "aria2.getUris":
+		var gid string
+		rpcParam(params, 0, &gid)
+		state, err := s.find(gid)
+		if err != nil {
+			return nil, err
+		}
+		if method == "aria2.getUris" {
+			return aria2URIs(state), nil
+		}
+		return aria2Files(state), nil
+	case "aria2.getPeers", "aria2.getServers":
+		return []any{}, nil
+	case "aria2.getGlobalStat":
+		return s.globalStat()
+
+	case "aria2.getGlobalOption", "aria2.getOption":
+		downloadsFolder, err := getDownloadD()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"dir": filepath.Join(downloadsFolder, "DownBitDownloads")}, nil
+	case "aria2.changeOption", "aria2.changeGlobalOption", "aria2.saveSession":
+		// Options are DownBit's settings, nothing to change or save here
+		return "OK", nil
+	case "aria2.getVersion":
+		// Frontends check the features against aria2's version
+		return map[string]any{"version": "1.37.0", "enabledFeatures": []string{"BitTorrent", "Metalink", "SFTP", "HTTPS"}}, nil
+	case "aria2.getSessionInfo":
+		return map[string]string{"sessionId": s.session}, nil
+	}
+	return nil, &rpcError{Code: 1, Message: fmt.Sprintf("No such method: %s", method)}
+}
+
+// multicall runs [{methodName, params}...], a result is wrapped in a list
+// and an error is returned as a struct
+func (s *aria2Server) multicall(params []json.RawMessage) (any, error) {
+	var calls []struct {
+		MethodName string            `json:"methodName"`
+		Params     []json.RawMessage `json:"params"`
+	}
+	if len(params) == 0 || json.Unmarshal(params[0], &calls) != nil {
+		return nil, &rpcError{Code: 1, Message: "the first parameter has to be a list of calls"}
+	}
+	results := make([]any, len(calls))
+	for i, call := range calls {
+		if call.MethodName == "system.multicall" {
+			results[i] = rpcError{Code: 1, Message: "Recursive system.multicall forbidden."}
+			continue
+		}
+		result, err := s.call(call.MethodName, call.Params)
+		if err != nil {
+			var answer *rpcError
+			if !errors.As(err, &answer) {
+				answer = &rpcError{Code: 1, Message: err.Error()}
+			}
+			results[i] = answer
+			continue
+		}
+		results[i] = []any{result}
+	}
+	return results, nil
+}
+
+func (s *aria2Server) addURI(params []json.RawMessage) (any, error) {
+	var uris []string
+	var rawOptions map[string]any
+	rpcParam(params, 0, &uris)
+	rpcParam(params, 1, &rawOptions)
+	// Option values are strings in aria2, some clients send numbers anyway
+	options := map[string]string{}
+	for key, value := range rawOptions {
+		options[key] = fmt.Sprint(value)
+	}
+	if len(uris) == 0 {
+		return nil, &rpcError{Code: 1, Message: "no uri to download"}
+	}
+
+	// The other uris are mirrors in aria2, DownBit only takes those from metalinks
+	request := AddRequest{URL: uris[0], Path: options["dir"]}
+	if options["out"] != "" {
+		request.Path = filepath.Join(options["dir"], options["out"])
+	}
+	if request.Path != "" {
+		absolute, err := filepath.Abs(request.Path)
+		if err != nil {
+			return nil, err
+		}
+		request.Path = absolute
+	}
+	for _, key := range []string{"split", "max-connection-per-server"} {
+		if connections, err := strconv.Atoi(options[key]); err == nil && connections > request.Connections {
+			request.Connections = connections
+		}
+	}
+
+	state, err := s.daemon.add(request)
+	if err != nil {
+		return nil, err
+	}
+	return gidOf(state.ID), nil
+}
+
+func (s *aria2Server) withGID(params []json.RawMessage, action func(state DownloadState) error) (any, error) {
+	var gid string
+	rpcParam(params, 0, &gid)
+	state, err := s.find(gid)
+	if err != nil {
+		return nil, err
+	}
+	if err := action(state); err != nil {
+		return nil, err
+	}
+	return gid, nil
+}
+
+func (s *aria2Server) find(gid string) (DownloadState, error) {
+	states, err := s.daemon.list()
+	if err != nil {
+		return DownloadState{}, err
+	}
+	for _, state := range states {
+		if gidOf(state.ID) == gid {
+			return state, nil
+		}
+	}
+	return DownloadState{}, &rpcError{Code: 1, Message: fmt.Sprintf("GID %s is not found", gid)}
+}
+
+// tell lists the downloads in one of statuses, num < 0 lists all of them
+func (s *aria2Server) tell(keys []string, offset, num int, statuses ...string) (any, error) {
+	states, err := s.daemon.list()
+	if err != nil {
+		return nil, err
+	}
+	var matching []map[string]any
+	for _, state := range states {
+		for _, status := range statuses {
+			if aria2Status(state.Status) == status {
+				matching = append(matching, aria2StatusOf(state, keys))
+			}
+		}
+	}
+	// A negative offset counts from the end, -1 is the last one, and aria2
+	// returns those in reverse: [A,B,C] from -1 for 2 is [C,B]
+	if offset < 0 {
+		for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 {
+			matching[i], matching[j] = matching[j], matching[i]
+		}
+		offset = -offset - 1
+	}
+	offset = min(offset, len(matching))
+	matching = matching[offset:]
+	if num >= 0 && num < len(matching) {
+		matching = matching[:num]
+	}
+	if len(matching) == 0 {
+		return []any{}, nil
+	}
+	return matching, nil
+}
+
+func (s *aria2Server) globalStat() (any, error) {
+	states, err := s.daemon.list()
+	if err != nil {
+		return nil, err
+	}
+	var speed int64
+	count := map[string]int{}
+	for _, state := range states {
+		count[aria2Status(state.Status)]++
+		speed += state.Rate
+	}
+	stopped := count["complete"] + count["error"] + count["removed"]
+	return map[string]string{
+		"downloadSpeed":   strconv.FormatInt(speed, 10),
+		"uploadSpeed":     "0",
+		"numActive":       strconv.Itoa(count["active"]),
+		"numWaiting":      strconv.Itoa(count["waiting"] + count["paused"]),
+		"numStopped":      strconv.Itoa(stopped),
+		"numStoppedTotal": strconv.Itoa(stopped),
+	}, nil
+}
+
+// ----------------------------------------------- Mapping
+
+func gidOf(id string) string {
+	digits := strings.ReplaceAll(id, "-", "")
+	return digits[:min(len(digits), 16)]
+}
+
+func aria2Status(status string) string {
+	switch status {
+	case "Running":
+		return "active"
+	case "Paused":
+		return "paused"
+	case "Finished":
+		return "complete"
+	case "Cancelled":
+		return "removed"
+	default:
+		return "error"
+	}
+}
+
+// aria2StatusOf is what tellStatus answers for a download, only keys if there are any
+func aria2StatusOf(state DownloadState, keys []string) map[string]any {
+	connections := "0"
+	if state.Status == "Running" {
+		connections = "1"
+	}
+	status := map[string]any{
+		"gid":             gidOf(state.ID),
+		"status":          aria2Status(state.Status),
+		"totalLength":     strconv.FormatInt(state.TotalSize, 10),
+		"completedLength": strconv.FormatInt(state.Downloaded, 10),
+		"uploadLength":    "0",
+		"downloadSpeed":   strconv.FormatInt(state.Rate, 10),
+		"uploadSpeed":     "0",
+		"connections":     connections,
+		"dir":             filepath.Dir(state.FilePath),
+		"files":           aria2Files(state),
+	}
+	if status["status"] == "error" {
+		status["errorCode"] = "1"
+		status["errorMessage"] = state.Status
+	}
+	if len(keys) == 0 {
+		return status
+	}
+	picked := map[string]any{}
+	for _, key := range keys {
+		if value, ok := status[key]; ok {
+			picked[key] = value
+		}
+	}
+	return picked
+}
+
+func aria2Files(state DownloadState) []map[string]any {
+	return []map[string]any{{
+		"index":           "1",
+		"path":            state.FilePath,
+		"length":          strconv.FormatInt(state.TotalSize, 10),
+		"completedLength": strconv.FormatInt(state.Downloaded, 10),
+		"selected":        "true",
+		"uris":            aria2URIs(state),
+	}}
+}
+
+func aria2URIs(state DownloadState) []map[string]string {
+	return []map[string]string{{"uri": state.URL, "status": "used"}}
+}
+
+// rpcParam decodes params[i] into value, missing ones leave it alone
+func rpcParam(params []json.RawMessage, i int, value any) {
+	if i < len(params) {
+		json.Unmarshal(params[i], value)
+	}
+}
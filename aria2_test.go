@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// tellWaiting and tellStopped page like aria2, a negative offset counts
+// back from the end and lists in reverse
+func TestAria2TellPaging(t *testing.T) {
+	myapp := testHeadlessApp(t)
+	downloads := []Download{
+		{ID: "a", Status: "Paused"},
+		{ID: "b", Status: "Paused"},
+		{ID: "c", Status: "Paused"},
+		{ID: "d", Status: "Finished"},
+		{ID: "e", Status: "Finished"},
+		{ID: "f", Status: "Finished"},
+	}
+	if err := writeDatabase(myapp.DownloadStateFilePath, downloads); err != nil {
+		t.Fatal(err)
+	}
+	s := &aria2Server{daemon: &daemon{myapp: myapp, jobs: map[string]*daemonJob{}}, secret: "s"}
+
+	tests := []struct {
+		method      string
+		offset, num int
+		want        []string
+	}{
+		{"aria2.tellWaiting", 0, 2, []string{"a", "b"}},
+		{"aria2.tellWaiting", 1, 1, []string{"b"}},
+		{"aria2.tellWaiting", 1, 10, []string{"b", "c"}},
+		{"aria2.tellWaiting", 3, 1, []string{}},
+		{"aria2.tellWaiting", -1, 2, []string{"c", "b"}},
+		{"aria2.tellWaiting", -1, 1, []string{"c"}},
+		{"aria2.tellWaiting", -2, 10, []string{"b", "a"}},
+		{"aria2.tellWaiting", -4, 1, []string{}},
+		{"aria2.tellStopped", 0, 1000, []string{"d", "e", "f"}},
+		{"aria2.tellStopped", 2, 1, []string{"f"}},
+		{"aria2.tellStopped", -1, 3, []string{"f", "e", "d"}},
+		{"aria2.tellStopped", -3, 1, []string{"d"}},
+	}
+	for _, test := range tests {
+		params := []json.RawMessage{
+			json.RawMessage(`"token:s"`),
+			json.RawMessage(strconv.Itoa(test.offset)),
+			json.RawMessage(strconv.Itoa(test.num)),
+			json.RawMessage(`["gid"]`),
+		}
+		result, err := s.call(test.method, params)
+		if err != nil {
+			t.Fatalf("%s(%d, %d): %v", test.method, test.offset, test.num, err)
+		}
+		got := []string{}
+		if statuses, ok := result.([]map[string]any); ok {
+			for _, status := range statuses {
+				got = append(got, status["gid"].(string))
+			}
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s(%d, %d) = %v, want %v", test.method, test.offset, test.num, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/driver/desktop"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// All downloads share one speed limit, and the main window draws how
+// much every download gets over the last few minutes against it.
+
+// ----------------------------------------------- Speed limit
+
+// speedLimiter is a token bucket, a second of the rate can be used at once
+type speedLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+var globalLimit = &speedLimiter{}
+
+// applySpeedLimit reads the limit from the settings
+func applySpeedLimit(prefs fyne.Preferences) {
+	globalLimit.setRate(float64(prefs.Int(prefSpeedLimit)) * 1024)
+}
+
+func (l *speedLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	l.rate = max(rate, 0)
+	l.tokens = l.rate
+	l.last = time.Now()
+	l.mu.Unlock()
+}
+
+func (l *speedLimiter) limit() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// take uses n bytes of the limit and returns how long to wait before reading on
+func (l *speedLimiter) take(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait holds up until n more bytes fit in the limit, or ctx is done
+func (l *speedLimiter) wait(ctx context.Context, n int) {
+	wait := l.take(n)
+	if wait <= 0 {
+		return
+	}
+	select {
+	case <-time.After(wait):
+	case <-ctx.Done():
+	}
+}
+
+// limitedReader reads within the global limit, for what doesn't go through
+// downloadChunk (stream segments, torrent peers)
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	globalLimit.wait(lr.ctx, n)
+	return n, err
+}
+
+// ----------------------------------------------- Graph
+
+const (
+	bandwidthSamples  = 180 // a sample a second, the last 3 minutes
+	bandwidthInterval = time.Second
+	bandwidthLines    = 5 // the busiest downloads get a line of their own
+)
+
+// downloadRate is how fast one download went at a sample
+type downloadRate struct {
+	ID, Name string
+	Rate     float64
+}
+
+type bandwidthSeries struct {
+	id, name string
+	rates    []float64 // one per sample, oldest first
+	color    color.Color
+}
+
+// bandwidthGraph draws the total speed and the speed of each download
+type bandwidthGraph struct {
+	widget.BaseWidget
+	mu     sync.Mutex
+	times  []time.Time
+	total  []float64
+	series []*bandwidthSeries
+	limit  float64
+	hover  int // the sample under the mouse, -1 when it's elsewhere
+	colors int // how many series were ever added, a download keeps its colour
+}
+
+func newBandwidthGraph() *bandwidthGraph {
+	g := &bandwidthGraph{hover: -1}
+	g.ExtendBaseWidget(g)
+	return g
+}
+
+// add records a sample of the running downloads
+func (g *bandwidthGraph) add(now time.Time, rates []downloadRate, limit float64) {
+	g.mu.Lock()
+	g.limit = limit
+	g.times = append(g.times, now)
+	total := 0.0
+	byID := map[string]downloadRate{}
+	for _, rate := range rates {
+		total += rate.Rate
+		byID[rate.ID] = rate
+	}
+	g.total = append(g.total, total)
+	for _, s := range g.series {
+		s.rates = append(s.rates, byID[s.id].Rate)
+		delete(byID, s.id)
+	}
+	// Downloads that just started were at 0 before
+	for _, rate := range rates {
+		if _, started := byID[rate.ID]; started {
+			rates := append(make([]float64, len(g.times)-1), rate.Rate)
+			g.series = append(g.series, &bandwidthSeries{id: rate.ID, name: rate.Name, rates: rates, color: bandwidthColors[g.colors%len(bandwidthColors)]})
+			g.colors++
+		}
+	}
+	if len(g.times) > bandwidthSamples {
+		drop := len(g.times) - bandwidthSamples
+		g.times, g.total = g.times[drop:], g.total[drop:]
+		for _, s := range g.series {
+			s.rates = s.rates[drop:]
+		}
+	}
+	// Downloads that did nothing the whole time are left out
+	kept := g.series[:0]
+	for _, s := range g.series {
+		if peak(s.rates) > 0 {
+			kept = append(kept, s)
+		}
+	}
+	g.series = kept
+	g.mu.Unlock()
+	g.Refresh()
+}
+
+func peak(rates []float64) float64 {
+	highest := 0.0
+	for _, rate := range rates {
+		highest = max(highest, rate)
+	}
+	return highest
+}
+
+// lines are the series that get drawn, the busiest ones
+func (g *bandwidthGraph) lines() []*bandwidthSeries {
+	lines := slices.Clone(g.series)
+	slices.SortStableFunc(lines, func(a, b *bandwidthSeries) int { return cmp.Compare(peak(b.rates), peak(a.rates)) })
+	if len(lines) > bandwidthLines {
+		lines = lines[:bandwidthLines]
+	}
+	return lines
+}
+
+// legend is what the graph says about sample i, each download in its
+// colour. g.mu is held
+func (g *bandwidthGraph) legend(i int) []*canvas.Text {
+	texts := []*canvas.Text{
+		canvas.NewText(g.times[i].Format("15:04:05"), CDTextColor),
+		canvas.NewText("Total "+formatRate(g.total[i]), theme.Color(theme.ColorNamePrimary)),
+	}
+	for _, s := range g.lines() {
+		if s.rates[i] > 0 {
+			texts = append(texts, canvas.NewText(fmt.Sprintf("%s %s", s.name, formatRate(s.rates[i])), s.color))
+		}
+	}
+	return texts
+}
+
+func (g *bandwidthGraph) MouseIn(event *desktop.MouseEvent) { g.MouseMoved(event) }
+
+func (g *bandwidthGraph) MouseMoved(event *desktop.MouseEvent) {
+	g.mu.Lock()
+	hover := -1
+	if count := len(g.times); count > 0 && g.Size().Width > 0 {
+		// Samples are spread over the whole width, the newest on the right
+		at := min(max(float64(event.Position.X/g.Size().Width), 0), 1)
+		hover = int(math.Round(at*float64(bandwidthSamples-1))) - (bandwidthSamples - count)
+		if hover < 0 {
+			hover = -1
+		}
+	}
+	changed := hover != g.hover
+	g.hover = hover
+	g.mu.Unlock()
+	if changed {
+		g.Refresh()
+	}
+}
+
+func (g *bandwidthGraph) MouseOut() {
+	g.mu.Lock()
+	g.hover = -1
+	g.mu.Unlock()
+	g.Refresh()
+}
+
+func (g *bandwidthGraph) CreateRenderer() fyne.WidgetRenderer {
+	return &bandwidthGraphRenderer{g: g}
+}
+
+// The colours of the download lines, the total is drawn in the primary colour
+var bandwidthColors = []color.Color{
+	color.RGBA{R: 255, G: 152, B: 0, A: 255},
+	color.RGBA{R: 76, G: 175, B: 80, A: 255},
+	color.RGBA{R: 233, G: 30, B: 99, A: 255},
+	color.RGBA{R: 156, G: 39, B: 176, A: 255},
+	color.RGBA{R: 0, G: 188, B: 212, A: 255},
+}
+
+type bandwidthGraphRenderer struct {
+	g       *bandwidthGraph
+	objects []fyne.CanvasObject
+}
+
+// Layout draws everything again, the points depend on the size
+func (r *bandwidthGraphRenderer) Layout(size fyne.Size) {
+	g := r.g
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	background := canvas.NewRectangle(CDBackgroundColor)
+	background.Resize(size)
+	r.objects = []fyne.CanvasObject{background}
+
+	// Leave room above the highest point and the limit
+	top := max(peak(g.total), g.limit) * 1.1
+	if top <= 0 {
+		top = 1024 * 1024
+	}
+	y := func(rate float64) float32 {
+		return size.Height - size.Height*float32(rate/top)
+	}
+	step := size.Width / float32(bandwidthSamples-1)
+	x := func(i int) float32 {
+		return float32(bandwidthSamples-len(g.times)+i) * step
+	}
+	polyline := func(rates []float64, stroke color.Color, width float32) {
+		for i := 1; i < len(rates); i++ {
+			line := canvas.NewLine(stroke)
+			line.StrokeWidth = width
+			line.Position1 = fyne.NewPos(x(i-1), y(rates[i-1]))
+			line.Position2 = fyne.NewPos(x(i), y(rates[i]))
+			r.objects = append(r.objects, line)
+		}
+	}
+	label := func(t *canvas.Text, pos fyne.Position) {
+		t.TextSize = 11
+		t.Move(pos)
+		t.Resize(t.MinSize())
+		r.objects = append(r.objects, t)
+	}
+
+	for _, s := range g.lines() {
+		polyline(s.rates, s.color, 1)
+	}
+	polyline(g.total, theme.Color(theme.ColorNamePrimary), 2)
+
+	// Flat at the limit means we're throttled, below it the servers are the slow part
+	if g.limit > 0 {
+		limitLine := canvas.NewLine(theme.Color(theme.ColorNameError))
+		limitLine.StrokeWidth = 1
+		limitLine.Position1 = fyne.NewPos(0, y(g.limit))
+		limitLine.Position2 = fyne.NewPos(size.Width, y(g.limit))
+		r.objects = append(r.objects, limitLine)
+		text := canvas.NewText("Limit "+formatRate(g.limit), theme.Color(theme.ColorNameError))
+		text.TextSize = 11
+		label(text, fyne.NewPos(size.Width-text.MinSize().Width-4, y(g.limit)))
+	}
+
+	if g.hover >= 0 && g.hover < len(g.times) {
+		cursor := canvas.NewLine(CDTextColor)
+		cursor.Position1 = fyne.NewPos(x(g.hover), 0)
+		cursor.Position2 = fyne.NewPos(x(g.hover), size.Height)
+		r.objects = append(r.objects, cursor)
+		// One after the other along the top
+		left := float32(4)
+		for _, text := range g.legend(g.hover) {
+			label(text, fyne.NewPos(left, 2))
+			left += text.MinSize().Width + 10
+		}
+	} else if len(g.total) > 0 {
+		label(canvas.NewText("Total "+formatRate(g.total[len(g.total)-1]), CDTextColor), fyne.NewPos(4, 2))
+	}
+}
+
+func (r *bandwidthGraphRenderer) MinSize() fyne.Size {
+	return fyne.NewSize(200, 90)
+}
+
+func (r *bandwidthGraphRenderer) Refresh() {
+	r.Layout(r.g.Size())
+	canvas.Refresh(r.g)
+}
+
+func (r *bandwidthGraphRenderer) Objects() []fyne.CanvasObject { return r.objects }
+func (r *bandwidthGraphRenderer) Destroy()                     {}
+
+// makeBandwidthGraph samples the downloads of the table every second
+func makeBandwidthGraph(myapp *MyApp) *bandwidthGraph {
+	graph := newBandwidthGraph()
+	go func() {
+		for now := range time.Tick(bandwidthInterval) {
+			graph.add(now, myapp.Downloads.rates(), globalLimit.limit())
+		}
+	}()
+	return graph
+}
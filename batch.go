@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Batch add takes many urls at once, pasted or imported from a list file:
+// one url per line like wget -i, or an aria2 input file where the lines
+// under a url that start with a space set its options (dir=, out=, ...).
+// A url can be a pattern for a series of files, see urlPattern.go.
+
+// Probes running at the same time
+const batchProbes = 8
+
+// batchEntry is a url of the batch with the options the list gave it
+type batchEntry struct {
+	URL         string
+	Dir         string
+	Out         string
+	Connections int
+	Headers     *Headers
+	Group       string // the pattern the url came from
+
+	fileInfo FileInfo
+	err      error
+	probed   bool
+	skipped  bool  // not on the server, one of a series most likely
+	rejected error // why it isn't picked though it could be downloaded
+}
+
+// parseURLList reads a list of urls, # starts a comment
+func parseURLList(list io.Reader) ([]*batchEntry, error) {
+	var entries, last []*batchEntry
+	scanner := bufio.NewScanner(list)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// An option of the url above it, for all of the files of a pattern
+		if line[0] == ' ' || line[0] == '\t' {
+			for _, entry := range last {
+				entry.setOption(trimmed, len(last) > 1)
+			}
+			continue
+		}
+
+		// aria2 puts mirrors of the same file on one line split by tabs, the first one is used
+		pattern := strings.Fields(trimmed)[0]
+		urls, err := expandURLPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		last = nil
+		for _, rawURL := range urls {
+			entry := &batchEntry{URL: rawURL}
+			if len(urls) > 1 {
+				entry.Group = pattern
+			}
+			last = append(last, entry)
+		}
+		entries = append(entries, last...)
+	}
+	return entries, scanner.Err()
+}
+
+// setOption applies an aria2 option, the ones DownBit has no use for are
+// skipped. The files of a series can't share a name, they keep their own
+func (entry *batchEntry) setOption(option string, series bool) {
+	key, value, ok := strings.Cut(option, "=")
+	if !ok {
+		return
+	}
+	value = strings.TrimSpace(value)
+	headers := func() *Headers {
+		if entry.Headers == nil {
+			entry.Headers = &Headers{}
+		}
+		return entry.Headers
+	}
+
+	switch strings.TrimSpace(key) {
+	case "dir":
+		entry.Dir = value
+	case "out":
+		if !series {
+			entry.Out = value
+		}
+	case "split", "max-connection-per-server":
+		if connections, err := strconv.Atoi(value); err == nil && connections > entry.Connections {
+			entry.Connections = connections
+		}
+	case "referer":
+		headers().Referer = value
+	case "user-agent":
+		headers().UserAgent = value
+	case "header":
+		name, headerValue, _ := strings.Cut(value, ":")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "cookie":
+			headers().Cookie = strings.TrimSpace(headerValue)
+		case "referer":
+			headers().Referer = strings.TrimSpace(headerValue)
+		case "user-agent":
+			headers().UserAgent = strings.TrimSpace(headerValue)
+		}
+	}
+}
+
+// probe gets the entry's fileInfo and puts the list's options on it
+func (entry *batchEntry) probe(myapp *MyApp) {
+	fileInfo, err := getFileInfo(myapp.clientFor(entry.Headers, entry.URL), entry.URL)
+	if err == nil {
+		fileInfo.Headers = entry.Headers
+		fileInfo.Connections = entry.Connections
+		fileInfo.Group = entry.Group
+		if name := filepath.Base(entry.Out); entry.Out != "" && name != "." && name != ".." {
+			fileInfo.FileName = name
+			fileInfo.FilePath = filepath.Join(filepath.Dir(fileInfo.FilePath), name)
+		}
+		// The folder is made when the entry is queued, not for every url looked at
+		if entry.Dir != "" {
+			var dir string
+			if dir, err = filepath.Abs(entry.Dir); err == nil {
+				fileInfo.FilePath = filepath.Join(dir, fileInfo.FileName)
+			}
+		}
+	}
+	var statusError *httpStatusError
+	if errors.As(err, &statusError) && (statusError.Code == http.StatusNotFound || statusError.Code == http.StatusGone) {
+		entry.skipped = true
+	}
+	entry.fileInfo, entry.err = fileInfo, err
+}
+
+// ----------------------------------------------- UI
+
+func BatchAddFunc(myapp *MyApp) func() {
+	return func() {
+		showBatchAdd(myapp)
+	}
+}
+
+// showBatchAdd asks for the urls, typed, pasted or imported from a file
+func showBatchAdd(myapp *MyApp) {
+	urlsEntry := widget.NewMultiLineEntry()
+	urlsEntry.SetPlaceHolder("One URL per line, part[001-120].bin or img{a..z}.jpg for a series...")
+	urlsEntry.SetMinRowsVisible(10)
+
+	importButton := widget.NewButtonWithIcon("Import from file", theme.FolderOpenIcon(), func() {
+		dialog.ShowFileOpen(func(reader fyne.URIReadCloser, err error) {
+			if err != nil {
+				myapp.showError(err)
+				return
+			}
+			if reader == nil {
+				return
+			}
+			defer reader.Close()
+			data, err := io.ReadAll(reader)
+			if err != nil {
+				myapp.showError(fmt.Errorf("couldnt read the list: %v", err))
+				return
+			}
+			text := strings.TrimRight(urlsEntry.Text, "\n")
+			if text != "" {
+				text += "\n"
+			}
+			urlsEntry.SetText(text + string(data))
+		}, myapp.MainWindow)
+	})
+
+	content := container.NewBorder(nil, importButton, nil, nil, urlsEntry)
+	addDialog := dialog.NewCustomConfirm("Add URLs", "Check", "Cancel", content, func(confirm bool) {
+		if !confirm {
+			return
+		}
+		entries, err := parseURLList(strings.NewReader(urlsEntry.Text))
+		if err != nil {
+			myapp.showError(fmt.Errorf("couldnt read the urls: %v", err))
+			return
+		}
+		if len(entries) == 0 {
+			return
+		}
+		showBatchReview(myapp, entries, nil)
+	}, myapp.MainWindow)
+	addDialog.Resize(fyne.NewSize(560, 360))
+	addDialog.Show()
+}
+
+// showBatchReview probes every entry and lets the user pick which to queue.
+// What accept turns down is listed with the reason but not picked.
+func showBatchReview(myapp *MyApp, entries []*batchEntry, accept func(fileInfo FileInfo) error) {
+	var mu sync.Mutex
+	selected := make([]bool, len(entries))
+
+	table := widget.NewTableWithHeaders(
+		func() (int, int) { return len(entries), 4 },
+		func() fyne.CanvasObject {
+			return container.NewStack(widget.NewCheck("", nil), widget.NewLabel(""))
+		},
+		func(id widget.TableCellID, cell fyne.CanvasObject) {
+			mu.Lock()
+			defer mu.Unlock()
+			entry := entries[id.Row]
+			check := cell.(*fyne.Container).Objects[0].(*widget.Check)
+			label := cell.(*fyne.Container).Objects[1].(*widget.Label)
+			label.Truncation = fyne.TextTruncateEllipsis
+
+			if id.Col == 0 {
+				label.Hide()
+				check.Show()
+				row := id.Row
+				check.OnChanged = nil
+				check.SetChecked(selected[row])
+				if entry.probed && entry.err == nil {
+					check.Enable()
+				} else {
+					check.Disable()
+				}
+				check.OnChanged = func(checked bool) {
+					mu.Lock()
+					selected[row] = checked
+					mu.Unlock()
+				}
+				return
+			}
+			check.Hide()
+			label.Show()
+			switch id.Col {
+			case 1:
+				label.SetText(entry.URL)
+				if entry.probed && entry.err == nil {
+					label.SetText(entry.fileInfo.FileName)
+				}
+			case 2:
+				label.SetText("")
+				if entry.probed && entry.fileInfo.FileSize > 0 {
+					label.SetText(fmt.Sprintf("%.2f MB", entry.fileInfo.FileSize))
+				}
+			case 3:
+				switch {
+				case !entry.probed:
+					label.SetText("Checking...")
+				case entry.skipped:
+					label.SetText("Skipped, not found")
+				case entry.err != nil:
+					label.SetText(entry.err.Error())
+				case entry.rejected != nil:
+					label.SetText(entry.rejected.Error())
+				default:
+					label.SetText("OK")
+				}
+			}
+		},
+	)
+	table.ShowHeaderColumn = false
+	table.CreateHeader = func() fyne.CanvasObject { return widget.NewLabel("") }
+	table.UpdateHeader = func(id widget.TableCellID, header fyne.CanvasObject) {
+		header.(*widget.Label).SetText([]string{"", "Name", "Size", "Status"}[id.Col])
+	}
+	table.SetColumnWidth(0, 40)
+	table.SetColumnWidth(1, 260)
+	table.SetColumnWidth(2, 90)
+	table.SetColumnWidth(3, 160)
+
+	setAll := func(checked bool) {
+		mu.Lock()
+		for i, entry := range entries {
+			selected[i] = checked && entry.probed && entry.err == nil
+		}
+		mu.Unlock()
+		table.Refresh()
+	}
+
+	var reviewDialog *dialog.CustomDialog
+	queue := queueCheck(myapp)
+	queueButton := widget.NewButtonWithIcon("Queue selected", theme.DownloadIcon(), func() {
+		reviewDialog.Hide()
+		mu.Lock()
+		defer mu.Unlock()
+		for i, entry := range entries {
+			if !selected[i] {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(entry.fileInfo.FilePath), 0755); err != nil {
+				myapp.showError(fmt.Errorf("couldnt create the folder for %s: %v", entry.fileInfo.FileName, err))
+				continue
+			}
+			switch {
+			case queue.Checked:
+				enqueueDownload(myapp, entry.URL, entry.fileInfo)
+			default:
+				startDownload(myapp, entry.URL, entry.fileInfo)
+			}
+		}
+	})
+	queueButton.Importance = widget.HighImportance
+
+	buttons := container.NewHBox(
+		queue,
+		widget.NewButton("Select all", func() { setAll(true) }),
+		widget.NewButton("Select none", func() { setAll(false) }),
+		widget.NewButton("Cancel", func() { reviewDialog.Hide() }),
+		queueButton,
+	)
+	reviewDialog = dialog.NewCustomWithoutButtons(fmt.Sprintf("Add %d URLs", len(entries)),
+		container.NewBorder(nil, container.NewCenter(buttons), nil, nil, table), myapp.MainWindow)
+	reviewDialog.Resize(fyne.NewSize(620, 420))
+	reviewDialog.Show()
+
+	// Probe them all, a few at a time. Only what's been checked can be queued
+	go func() {
+		slots := make(chan struct{}, batchProbes)
+		for i, entry := range entries {
+			slots <- struct{}{}
+			go func() {
+				defer func() { <-slots }()
+				probed := *entry
+				probed.probe(myapp)
+
+				mu.Lock()
+				entry.fileInfo, entry.err, entry.skipped, entry.probed = probed.fileInfo, probed.err, probed.skipped, true
+				if entry.err == nil && accept != nil {
+					entry.rejected = accept(entry.fileInfo)
+				}
+				selected[i] = entry.err == nil && entry.rejected == nil
+				mu.Unlock()
+				table.Refresh()
+			}()
+		}
+	}()
+}
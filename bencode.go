@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// bencodeDecoder decodes bencoded data into int64, string, []any and
+// map[string]any values. It remembers where the "info" dictionary of a
+// .torrent starts and ends, the info hash is computed over those exact bytes.
+type bencodeDecoder struct {
+	data      []byte
+	pos       int
+	infoStart int
+	infoEnd   int
+}
+
+func bencodeDecode(data []byte) (any, error) {
+	value, _, err := bencodeDecodePrefix(data)
+	return value, err
+}
+
+// bencodeDecodePrefix decodes the first value of data and returns how many
+// bytes it used (ut_metadata messages carry raw data after the dictionary)
+func bencodeDecodePrefix(data []byte) (any, int, error) {
+	decoder := &bencodeDecoder{data: data}
+	value, err := decoder.value(0)
+	return value, decoder.pos, err
+}
+
+func (d *bencodeDecoder) value(depth int) (any, error) {
+	if depth > 64 {
+		return nil, errors.New("bencode nested too deep")
+	}
+	if d.pos >= len(d.data) {
+		return nil, errors.New("unexpected end of bencode data")
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, errors.New("unterminated bencode integer")
+		}
+		n, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bencode integer: %v", err)
+		}
+		d.pos += end + 1
+		return n, nil
+
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(d.data[d.pos:], ':')
+		if colon < 0 {
+			return nil, errors.New("invalid bencode string")
+		}
+		length, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+		if err != nil || length < 0 || d.pos+colon+1+length > len(d.data) {
+			return nil, errors.New("invalid bencode string length")
+		}
+		start := d.pos + colon + 1
+		d.pos = start + length
+		return string(d.data[start:d.pos]), nil
+
+	case c == 'l':
+		d.pos++
+		list := []any{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			item, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		if d.pos >= len(d.data) {
+			return nil, errors.New("unterminated bencode list")
+		}
+		d.pos++
+		return list, nil
+
+	case c == 'd':
+		d.pos++
+		dict := map[string]any{}
+		for d.pos < len(d.data) && d.data[d.pos] != 'e' {
+			key, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, errors.New("bencode dictionary key isn't a string")
+			}
+			valueStart := d.pos
+			item, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if depth == 0 && keyString == "info" {
+				d.infoStart, d.infoEnd = valueStart, d.pos
+			}
+			dict[keyString] = item
+		}
+		if d.pos >= len(d.data) {
+			return nil, errors.New("unterminated bencode dictionary")
+		}
+		d.pos++
+		return dict, nil
+	}
+	return nil, fmt.Errorf("invalid bencode data at %d", d.pos)
+}
+
+// bencodeEncode encodes int, int64, string, []byte, []any and map[string]any
+func bencodeEncode(value any) []byte {
+	var buf bytes.Buffer
+	bencodeWrite(&buf, value)
+	return buf.Bytes()
+}
+
+func bencodeWrite(buf *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range v {
+			bencodeWrite(buf, item)
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		// Keys have to be sorted
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, key := range keys {
+			bencodeWrite(buf, key)
+			bencodeWrite(buf, v[key])
+		}
+		buf.WriteByte('e')
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// Checksummer is implemented by sources that can hash the original file,
+// a finished download gets compared against it.
+type Checksummer interface {
+	Checksum(ctx context.Context, rawURL string) (string, error)
+}
+
+// verifyChecksum compares the finished download against the strongest hash
+// the metalink (or Digest header) tells, or the source hashes of the original.
+// Downloads with nothing to compare against aren't hashed here, the post
+// actions and the cli hash them when they need to.
+// It returns the sha256 of the download when it was hashed with it, so it can be saved with it.
+func verifyChecksum(client *http.Client, download Download) (string, error) {
+	hashType, expected := "sha-256", ""
+	if download.Metalink != nil {
+		if strongest := strongestHash(download.Metalink.Hashes); strongest != "" {
+			hashType, expected = strongest, download.Metalink.Hashes[strongest]
+		}
+	}
+	if expected == "" {
+		source, err := sourceFor(client, download.URL)
+		if err != nil {
+			return "", nil
+		}
+		checksummer, ok := source.(Checksummer)
+		if !ok {
+			return "", nil
+		}
+		expected, err = checksummer.Checksum(context.Background(), download.URL)
+		if err != nil {
+			return "", fmt.Errorf("could not hash the source of %s: %v", download.FileName, err)
+		}
+	}
+
+	checksum, err := fileHash(download.FilePath, hashType)
+	if err != nil {
+		return "", fmt.Errorf("could not hash %s: %v", download.FileName, err)
+	}
+	if expected != checksum {
+		err = fmt.Errorf("%s mismatch for %s: expected %s, got %s", hashType, download.FileName, expected, checksum)
+	}
+	// Only a sha256 is kept, it's what {sha256} and verify use
+	if hashType != "sha-256" {
+		return "", err
+	}
+	return checksum, err
+}
+
+func fileSHA256(filePath string) (string, error) {
+	return fileHash(filePath, "sha-256")
+}
+
+// fileHash hashes the file with one of the hashes newHash knows
+func fileHash(filePath, hashType string) (string, error) {
+	hash := newHash(hashType)
+	if hash == nil {
+		return "", fmt.Errorf("unsupported hash %s", hashType)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,782 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"fyne.io/fyne/v2/app"
+	"github.com/google/uuid"
+)
+
+// Exit codes of the cli, scripts can tell what happened from them
+const (
+	exitOK          = 0
+	exitFailed      = 1 // the download or the database failed
+	exitUsage       = 2
+	exitCorrupted   = 3 // checksum or piece verification failed
+	exitNotFound    = 4 // no download with that id
+	exitInterrupted = 130
+)
+
+var cliCommands = map[string]func(myapp *MyApp, args []string) int{
+	"get":    cliGet,
+	"list":   cliList,
+	"pause":  cliPause,
+	"resume": cliResume,
+	"cancel": cliCancel,
+	"verify": cliVerify,
+	"daemon": cliDaemon,
+
+	"native-host": cliNativeHost,
+}
+
+// With a daemon running these go through it instead
+var remoteCommands = map[string]func(remote *daemonClient, args []string) int{
+	"get":    remoteGet,
+	"list":   remoteList,
+	"pause":  remotePause,
+	"resume": remoteResume,
+	"cancel": remoteCancel,
+}
+
+const cliUsage = `usage: downbit <command> [arguments]
+
+  get URL [-o path] [-c connections]   download URL in the foreground
+  list                                 list the downloads in the database
+  pause ID                             pause a running download
+  resume ID                            continue a paused download in the foreground
+  cancel ID                            stop a download and delete its files
+  verify ID                            check a finished download against its checksums
+  daemon [-p port] [-rpc-port port]    keep downloads running in the background, get, list,
+                                       pause, resume and cancel go through it while it runs.
+                                       It also speaks aria2's JSON-RPC (port 6800 by default)
+  native-host [-dry-run]               take downloads from a browser extension on stdin
+  native-host -manifest chrome|firefox -extension ID
+                                       print the manifest that registers the host
+
+exit codes: 0 ok, 1 failed, 2 usage, 3 corrupted, 4 unknown id, 130 interrupted (paused)
+`
+
+func isCLICommand(args []string) bool {
+	_, ok := cliCommands[args[0]]
+	return ok || args[0] == "help" || args[0] == "-h" || args[0] == "--help" || isBrowserLaunch(args)
+}
+
+func runCLI(args []string) int {
+	// The browser doesn't know about commands
+	if isBrowserLaunch(args) {
+		args = []string{"native-host"}
+	}
+	command, ok := cliCommands[args[0]]
+	if !ok {
+		fmt.Print(cliUsage)
+		return exitOK
+	}
+
+	myapp, err := newHeadlessApp()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	if remoteCommand, ok := remoteCommands[args[0]]; ok {
+		if remote := findDaemon(filepath.Dir(myapp.DownloadStateFilePath)); remote != nil {
+			return remoteCommand(remote, args[1:])
+		}
+	}
+	return command(myapp, args[1:])
+}
+
+// newHeadlessApp sets up what the downloader needs without a window, the
+// fyne app is only created for the preferences shared with the GUI
+func newHeadlessApp() (*MyApp, error) {
+	databasePath, err := getDatabasePath()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database path: %v", err)
+	}
+	jsonFilePath, err := openJSONFile(databasePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	if err := DownBitDownloadsDirectory(); err != nil {
+		return nil, err
+	}
+
+	// The downloader's logging would mix with the cli's output, it goes to
+	// stderr when debugging and nowhere otherwise
+	if os.Getenv("DOWNBIT_DEBUG") == "" {
+		logger.SetOutput(io.Discard)
+	} else {
+		logger.SetOutput(os.Stderr)
+	}
+
+	cliApp := app.NewWithID("com.Bardia49.DownBit")
+	applySpeedLimit(cliApp.Preferences())
+	return &MyApp{
+		App:                   cliApp,
+		AppContext:            context.Background(),
+		Client:                newHTTPClient(),
+		DownloadStateFilePath: jsonFilePath,
+	}, nil
+}
+
+// ----------------------------------------------- Commands
+
+func cliGet(myapp *MyApp, args []string) int {
+	rawURL, output, connections, code := parseGetArgs(args)
+	if code != exitOK {
+		return code
+	}
+
+	fileInfo, err := getFileInfo(myapp.Client, rawURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	// Streams get their best variant, torrents their folder
+	if len(fileInfo.Variants) > 0 {
+		fileInfo.Stream = &fileInfo.Variants[defaultVariant(myapp, fileInfo.Variants)]
+	}
+	if output != "" {
+		if err := fileInfo.saveTo(output); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return exitFailed
+		}
+	}
+	fileInfo.Connections = connections
+
+	fileItem := &FileItem{ID: uuid.New().String()}
+	fmt.Fprintf(os.Stderr, "ID: %s\n", fileItem.ID)
+
+	ctx, cancel := context.WithCancel(myapp.AppContext)
+	defer cancel()
+	ctxP, cancelP := context.WithCancel(myapp.AppContext)
+	defer cancelP()
+	return runForeground(myapp, fileItem, fileInfo.FileName, cancelP, func() {
+		ConfirmURL(myapp, fileInfo, fileItem, ctx, ctxP, nil, nil)
+	})
+}
+
+func cliResume(myapp *MyApp, args []string) int {
+	download, code := cliDownload(myapp, args)
+	if code != exitOK {
+		return code
+	}
+	if download.Status == "Finished" {
+		fmt.Fprintf(os.Stderr, "%s is already finished\n", download.ID)
+		return exitOK
+	}
+	if pid, running := runningDownload(myapp, download.ID); running {
+		fmt.Fprintf(os.Stderr, "%s is already running (pid %d)\n", download.ID, pid)
+		return exitFailed
+	}
+
+	fileItem := &FileItem{ID: download.ID}
+	cancelC := make(chan context.CancelFunc, 1)
+	pauseC := make(chan context.CancelFunc, 1)
+	return runForeground(myapp, fileItem, download.FileName, nil, func() {
+		ResumeDownload(myapp, fileItem, cancelC, pauseC)
+		// ResumeDownload hands out its cancel funcs, pausing is how ctrl-c stops it
+		cancelP := <-pauseC
+		setInterrupt(cancelP)
+	})
+}
+
+func cliList(myapp *MyApp, args []string) int {
+	downloads, _, err := loadDatabase(myapp.DownloadStateFilePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+
+	states := make([]DownloadState, len(downloads))
+	for i, download := range downloads {
+		states[i] = downloadState(download)
+		if _, running := runningDownload(myapp, download.ID); running {
+			states[i].Status = "Running"
+		}
+	}
+	printDownloads(states)
+	return exitOK
+}
+
+func cliPause(myapp *MyApp, args []string) int {
+	download, code := cliDownload(myapp, args)
+	if code != exitOK {
+		return code
+	}
+	if err := stopRunningDownload(myapp, download.ID); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	if download.Status == "Finished" {
+		fmt.Fprintf(os.Stderr, "%s is already finished\n", download.ID)
+		return exitFailed
+	}
+	return exitOK
+}
+
+func cliCancel(myapp *MyApp, args []string) int {
+	download, code := cliDownload(myapp, args)
+	if code != exitOK {
+		return code
+	}
+	if download.Status == "Finished" {
+		fmt.Fprintf(os.Stderr, "%s is already finished, its files are kept\n", download.ID)
+		return exitFailed
+	}
+	if err := stopRunningDownload(myapp, download.ID); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	// A stopped download saved itself, that's where its files are
+	if saved, err := isFileExistByID(myapp.DownloadStateFilePath, download.ID); err == nil {
+		download = saved
+	}
+	if download.FilePath == "" {
+		return exitOK
+	}
+
+	if err := deleteDownloadFiles(download); err != nil {
+		fmt.Fprintln(os.Stderr, "Error deleting file:", err)
+	}
+	if err := removeDownload(myapp.DownloadStateFilePath, download.ID); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+func cliVerify(myapp *MyApp, args []string) int {
+	download, code := cliDownload(myapp, args)
+	if code != exitOK {
+		return code
+	}
+	if download.Status != "Finished" && download.Status != "Corrupted" {
+		fmt.Fprintf(os.Stderr, "%s isn't finished (%s)\n", download.ID, download.Status)
+		return exitFailed
+	}
+
+	// Torrents are checked piece by piece against their info dictionary
+	if download.Torrent != nil {
+		bad, err := torrentBadPieces(download)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return exitFailed
+		}
+		if len(bad) > 0 {
+			fmt.Fprintf(os.Stderr, "%d of the pieces are corrupted\n", len(bad))
+			return exitCorrupted
+		}
+		cliPrintln("OK", download.FilePath)
+		return exitOK
+	}
+
+	// Metalinks know the hash of every piece
+	if download.Metalink != nil && len(download.Metalink.Pieces) > 0 {
+		bad, err := badPieces(download.FilePath, download.Metalink)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return exitFailed
+		}
+		if len(bad) > 0 {
+			fmt.Fprintf(os.Stderr, "%d of the pieces are corrupted\n", len(bad))
+			return exitCorrupted
+		}
+	}
+
+	// The file has to match the metalink's strongest hash, or what was
+	// recorded when it finished
+	hashType, expected := "sha-256", download.Checksum
+	if download.Metalink != nil {
+		if strongest := strongestHash(download.Metalink.Hashes); strongest != "" {
+			hashType, expected = strongest, download.Metalink.Hashes[strongest]
+		}
+	}
+	checksum, err := fileHash(download.FilePath, hashType)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	if expected != "" && expected != checksum {
+		fmt.Fprintf(os.Stderr, "%s mismatch for %s: expected %s, got %s\n", hashType, download.FileName, expected, checksum)
+		return exitCorrupted
+	}
+	cliPrintln("OK", checksum, download.FilePath)
+	return exitOK
+}
+
+// ----------------------------------------------- Supplement
+
+// parseGetArgs reads the url and flags of get, flags may come before or after the url
+func parseGetArgs(args []string) (rawURL, output string, connections int, code int) {
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	outputFlag := flags.String("o", "", "file (or existing folder) to save to")
+	connectionsFlag := flags.Int("c", 0, "connections to use, 0 picks by size")
+
+	for {
+		if err := flags.Parse(args); err != nil {
+			return "", "", 0, exitUsage
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		if rawURL != "" {
+			fmt.Fprintln(os.Stderr, "get takes a single URL")
+			return "", "", 0, exitUsage
+		}
+		rawURL, args = flags.Arg(0), flags.Args()[1:]
+	}
+	if rawURL == "" || *connectionsFlag < 0 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return "", "", 0, exitUsage
+	}
+	return rawURL, *outputFlag, *connectionsFlag, exitOK
+}
+
+// cliDownload finds the download named by the only argument
+func cliDownload(myapp *MyApp, args []string) (Download, int) {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return Download{}, exitUsage
+	}
+	downloads, _, err := loadDatabase(myapp.DownloadStateFilePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return Download{}, exitFailed
+	}
+	for _, download := range downloads {
+		if download.ID == args[0] {
+			return download, exitOK
+		}
+	}
+	// A download only reaches the database once it's paused or finished
+	if _, running := runningDownload(myapp, args[0]); running {
+		return Download{ID: args[0]}, exitOK
+	}
+	fmt.Fprintf(os.Stderr, "no download with id %s\n", args[0])
+	return Download{}, exitNotFound
+}
+
+var (
+	interruptMu sync.Mutex
+	interrupt   context.CancelFunc
+)
+
+// setInterrupt sets what ctrl-c (or downbit pause) calls
+func setInterrupt(cancelP context.CancelFunc) {
+	interruptMu.Lock()
+	interrupt = cancelP
+	interruptMu.Unlock()
+}
+
+// runForeground starts a download with start and waits for it while
+// drawing a progress bar. Ctrl-c pauses it so it can be resumed later.
+func runForeground(myapp *MyApp, fileItem *FileItem, name string, cancelP context.CancelFunc, start func()) int {
+	if err := writePidFile(myapp, fileItem.ID); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	defer os.Remove(pidFilePath(myapp, fileItem.ID))
+	// A stop file left from an earlier run isn't meant for this one
+	os.Remove(stopFilePath(myapp, fileItem.ID))
+
+	progress := newTerminalProgress(name)
+	fileItem.OnProgress = progress.setValue
+	fileItem.OnSpeed = progress.setText
+	stopped := make(chan string, 1)
+	fileItem.OnStop = func(status string) { stopped <- status }
+
+	var mu sync.Mutex
+	failed, interrupted := false, false
+	pause := func() {
+		interruptMu.Lock()
+		defer interruptMu.Unlock()
+		if interrupt != nil {
+			interrupt()
+		}
+	}
+	setInterrupt(cancelP)
+
+	// A failed chunk or segment pauses the download itself, that only has
+	// to fail the exit code. Errors after ctrl-c are just chunks noticing the pause
+	myapp.OnError = func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if interrupted {
+			return
+		}
+		progress.clear()
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		failed = true
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	interruptAndPause := func() {
+		mu.Lock()
+		interrupted = true
+		mu.Unlock()
+		pause()
+	}
+	go func() {
+		for range signals {
+			interruptAndPause()
+		}
+	}()
+	// downbit pause and cancel from another terminal
+	done := make(chan struct{})
+	go watchStopFile(myapp, fileItem.ID, interruptAndPause, done)
+
+	start()
+	status := <-stopped
+	close(done)
+	progress.done()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return foregroundExit(fileItem.ID, status, interrupted, failed)
+}
+
+// foregroundExit is the exit code for a download that stopped with status
+func foregroundExit(id, status string, interrupted, failed bool) int {
+	switch {
+	case status == "Finished":
+		return exitOK
+	case status == "Corrupted":
+		return exitCorrupted
+	case status == "Paused" && interrupted && !failed:
+		fmt.Fprintf(os.Stderr, "Paused, continue with: downbit resume %s\n", id)
+		return exitInterrupted
+	default:
+		return exitFailed
+	}
+}
+
+func printDownloads(states []DownloadState) {
+	writer := tabwriter.NewWriter(cliStdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSTATUS\tPROGRESS\tSIZE\tNAME")
+	for _, state := range states {
+		progress := "-"
+		if state.TotalSize > 0 {
+			progress = fmt.Sprintf("%.1f%%", state.Progress*100)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%.1f MB\t%s\n", state.ID, state.Status, progress, float64(state.TotalSize)/(1024*1024), state.FileName)
+	}
+	writer.Flush()
+}
+
+// cliStdout is where the cli's own output goes
+var cliStdout = os.Stdout
+
+func cliPrintln(a ...any) {
+	fmt.Fprintln(cliStdout, a...)
+}
+
+// ----------------------------------------------- Through the daemon
+
+func remoteGet(remote *daemonClient, args []string) int {
+	rawURL, output, connections, code := parseGetArgs(args)
+	if code != exitOK {
+		return code
+	}
+	// The daemon doesn't share our working directory
+	if output != "" {
+		var err error
+		if output, err = filepath.Abs(output); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return exitFailed
+		}
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	events, err := remote.subscribe(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	state, err := remote.add(AddRequest{URL: rawURL, Path: output, Connections: connections})
+	if err != nil {
+		return remoteExit(err)
+	}
+	fmt.Fprintf(os.Stderr, "ID: %s\n", state.ID)
+	return followRemote(remote, state, events)
+}
+
+func remoteResume(remote *daemonClient, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	state, err := remote.get(args[0])
+	if err != nil {
+		return remoteExit(err)
+	}
+	if state.Status == "Finished" {
+		fmt.Fprintf(os.Stderr, "%s is already finished\n", state.ID)
+		return exitOK
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	events, err := remote.subscribe(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	if err := remote.resume(state.ID); err != nil {
+		return remoteExit(err)
+	}
+	return followRemote(remote, state, events)
+}
+
+func remoteList(remote *daemonClient, args []string) int {
+	states, err := remote.list()
+	if err != nil {
+		return remoteExit(err)
+	}
+	printDownloads(states)
+	return exitOK
+}
+
+func remotePause(remote *daemonClient, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	return remoteExit(remote.pause(args[0]))
+}
+
+func remoteCancel(remote *daemonClient, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	state, err := remote.get(args[0])
+	if err != nil {
+		return remoteExit(err)
+	}
+	if state.Status == "Finished" {
+		fmt.Fprintf(os.Stderr, "%s is already finished, its files are kept\n", state.ID)
+		return exitFailed
+	}
+	return remoteExit(remote.remove(state.ID, false))
+}
+
+// followRemote draws the progress of a download the daemon runs until it
+// stops, ctrl-c pauses it like a foreground download
+func followRemote(remote *daemonClient, state DownloadState, events <-chan remoteEvent) int {
+	progress := newTerminalProgress(state.FileName)
+	failed := false
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-signals:
+			go remote.pause(state.ID)
+		case event, ok := <-events:
+			if !ok {
+				progress.clear()
+				fmt.Fprintln(os.Stderr, "Error: lost the daemon")
+				return exitFailed
+			}
+			switch event.Name {
+			case "progress", "stopped":
+				var update DownloadState
+				if json.Unmarshal(event.Data, &update) != nil || update.ID != state.ID {
+					continue
+				}
+				progress.setText(update.Speed)
+				progress.setValue(update.Progress)
+				// Pausing it from anywhere counts as an interrupt, like downbit pause does locally
+				if event.Name == "stopped" {
+					progress.done()
+					return foregroundExit(state.ID, update.Status, true, failed)
+				}
+			case "removed":
+				var removed struct {
+					ID string `json:"id"`
+				}
+				if json.Unmarshal(event.Data, &removed) == nil && removed.ID == state.ID {
+					progress.done()
+					return exitFailed
+				}
+			case "error":
+				// Only the errors of this download fail it
+				var answer struct {
+					ID    string `json:"id"`
+					Error string `json:"error"`
+				}
+				if json.Unmarshal(event.Data, &answer) != nil || answer.ID != state.ID {
+					continue
+				}
+				progress.clear()
+				fmt.Fprintln(os.Stderr, "Error:", answer.Error)
+				failed = true
+			}
+		}
+	}
+}
+
+func remoteExit(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	var answer *daemonError
+	if errors.As(err, &answer) && answer.Status == http.StatusNotFound {
+		return exitNotFound
+	}
+	return exitFailed
+}
+
+// ----------------------------------------------- Running downloads
+
+// A download running in a cli process leaves a pid file next to the
+// database. Pause and cancel ask that process to stop with a stop file next
+// to it, signals can't interrupt a process on windows
+func pidFilePath(myapp *MyApp, id string) string {
+	return filepath.Join(filepath.Dir(myapp.DownloadStateFilePath), id+".pid")
+}
+
+func stopFilePath(myapp *MyApp, id string) string {
+	return filepath.Join(filepath.Dir(myapp.DownloadStateFilePath), id+".stop")
+}
+
+// watchStopFile calls stop once another process asks this download to
+// stop, until done is closed
+func watchStopFile(myapp *MyApp, id string, stop func(), done <-chan struct{}) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := os.Stat(stopFilePath(myapp, id)); err == nil {
+				os.Remove(stopFilePath(myapp, id))
+				stop()
+			}
+		}
+	}
+}
+
+func writePidFile(myapp *MyApp, id string) error {
+	return os.WriteFile(pidFilePath(myapp, id), []byte(strconv.Itoa(os.Getpid())), 0644)
+}
+
+func runningDownload(myapp *MyApp, id string) (int, bool) {
+	data, err := os.ReadFile(pidFilePath(myapp, id))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || !processAlive(pid) {
+		os.Remove(pidFilePath(myapp, id))
+		return 0, false
+	}
+	return pid, true
+}
+
+// stopRunningDownload pauses a download running in another process and
+// waits until it saved its state
+func stopRunningDownload(myapp *MyApp, id string) error {
+	pid, running := runningDownload(myapp, id)
+	if !running {
+		return nil
+	}
+	if err := os.WriteFile(stopFilePath(myapp, id), nil, 0644); err != nil {
+		return fmt.Errorf("could not ask the download (pid %d) to stop: %v", pid, err)
+	}
+	for wait := 0; wait < 300; wait++ {
+		if _, running := runningDownload(myapp, id); !running {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Don't leave it for the next run of this download
+	os.Remove(stopFilePath(myapp, id))
+	return fmt.Errorf("download (pid %d) didn't stop", pid)
+}
+
+// ----------------------------------------------- Progress bar
+
+type terminalProgress struct {
+	mu       sync.Mutex
+	name     string
+	value    float64
+	text     string
+	terminal bool
+	lastStep int
+}
+
+func newTerminalProgress(name string) *terminalProgress {
+	terminal := false
+	if stat, err := os.Stderr.Stat(); err == nil {
+		terminal = stat.Mode()&os.ModeCharDevice != 0
+	}
+	return &terminalProgress{name: name, terminal: terminal, lastStep: -1}
+}
+
+func (p *terminalProgress) setValue(value float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.value = min(max(value, 0), 1)
+	p.draw()
+}
+
+func (p *terminalProgress) setText(text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.text = text
+	p.draw()
+}
+
+// draw redraws the bar in place on a terminal, logs and pipes get a line
+// every 10% instead. mu must be held.
+func (p *terminalProgress) draw() {
+	if !p.terminal {
+		if step := int(p.value * 10); step > p.lastStep {
+			p.lastStep = step
+			fmt.Fprintf(os.Stderr, "%s: %3.0f%% %s\n", p.name, p.value*100, p.text)
+		}
+		return
+	}
+	const width = 30
+	filled := int(p.value * width)
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", width-filled)
+	fmt.Fprintf(os.Stderr, "\r\033[K[%s] %5.1f%% %s", bar, p.value*100, p.text)
+}
+
+func (p *terminalProgress) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.terminal {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+func (p *terminalProgress) done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.terminal {
+		fmt.Fprintln(os.Stderr)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestParseGetArgs(t *testing.T) {
+	const rawURL = "https://example.com/a.iso"
+	tests := []struct {
+		name        string
+		args        []string
+		output      string
+		connections int
+		code        int
+	}{
+		{name: "url only", args: []string{rawURL}},
+		{name: "flags before", args: []string{"-c", "4", "-o", "out.iso", rawURL}, output: "out.iso", connections: 4},
+		{name: "flags after", args: []string{rawURL, "-o", "out.iso", "-c", "4"}, output: "out.iso", connections: 4},
+		{name: "flags around", args: []string{"-o", "dl", rawURL, "-c=2"}, output: "dl", connections: 2},
+		{name: "no args", args: nil, code: exitUsage},
+		{name: "missing url", args: []string{"-o", "out.iso"}, code: exitUsage},
+		{name: "flag without its value", args: []string{rawURL, "-o"}, code: exitUsage},
+		{name: "bad -c", args: []string{rawURL, "-c", "four"}, code: exitUsage},
+		{name: "negative -c", args: []string{"-c", "-1", rawURL}, code: exitUsage},
+		{name: "unknown flag", args: []string{"-x", rawURL}, code: exitUsage},
+		{name: "two urls", args: []string{rawURL, "https://example.com/b.iso"}, code: exitUsage},
+	}
+	for _, test := range tests {
+		gotURL, output, connections, code := parseGetArgs(test.args)
+		if code != test.code {
+			t.Errorf("%s: exit code %d, want %d", test.name, code, test.code)
+			continue
+		}
+		if code != exitOK {
+			continue
+		}
+		if gotURL != rawURL || output != test.output || connections != test.connections {
+			t.Errorf("%s: got %q %q %d, want %q %q %d", test.name, gotURL, output, connections, rawURL, test.output, test.connections)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// The clipboard watcher looks at the clipboard every second, when a link to
+// something worth downloading shows up it's probed and offered in a bar above
+// the downloads. Per domain the user can say to always add or never offer.
+
+const defaultClipboardPatterns = "zip rar 7z tar gz xz iso exe msi dmg deb rpm apk mp4 mkv avi mov mp3 flac pdf torrent metalink m3u8 mpd magnet:*"
+
+// watchClipboard runs as long as the app does, it only looks while the pref is on
+func (myapp *MyApp) watchClipboard() {
+	prefs := myapp.App.Preferences()
+	clipboard := myapp.MainWindow.Clipboard()
+	// What was copied before DownBit started isn't offered
+	last := clipboard.Content()
+
+	var prompt fyne.CanvasObject
+	for range time.Tick(time.Second) {
+		if !prefs.Bool(prefClipboardWatch) {
+			continue
+		}
+		content := clipboard.Content()
+		if content == last {
+			continue
+		}
+		last = content
+
+		rawURL, ok := clipboardURL(content)
+		if !ok || !matchesPatterns(rawURL, prefs.StringWithFallback(prefClipboardPatterns, defaultClipboardPatterns)) {
+			continue
+		}
+		domain := urlDomain(rawURL)
+		if slices.Contains(prefs.StringList(prefClipboardNever), domain) {
+			continue
+		}
+
+		fileInfo, err := getFileInfo(myapp.Client, rawURL)
+		if err != nil {
+			logger.Println("Error probing the copied url:", err)
+			continue
+		}
+		if slices.Contains(prefs.StringList(prefClipboardAlways), domain) {
+			addDownload(myapp, rawURL, fileInfo)
+			continue
+		}
+
+		// A newer link takes the place of the one not answered yet
+		if prompt != nil {
+			myapp.MainContainer.Remove(prompt)
+		}
+		prompt = myapp.clipboardPrompt(rawURL, domain, fileInfo, func(bar fyne.CanvasObject) {
+			myapp.MainContainer.Remove(bar)
+		})
+		// Right under the buttons
+		myapp.MainContainer.Objects = slices.Insert(myapp.MainContainer.Objects, 1, prompt)
+		myapp.MainContainer.Refresh()
+	}
+}
+
+// clipboardPrompt is the bar offering a copied link, it doesn't get in the way
+// of anything else in the window
+func (myapp *MyApp) clipboardPrompt(rawURL, domain string, fileInfo FileInfo, done func(bar fyne.CanvasObject)) fyne.CanvasObject {
+	prefs := myapp.App.Preferences()
+	text := fmt.Sprintf("Copied: %s", fileInfo.FileName)
+	if fileInfo.FileSize > 0 {
+		text += fmt.Sprintf(" (%.2f MB)", fileInfo.FileSize)
+	}
+	label := widget.NewLabel(text)
+	label.Truncation = fyne.TextTruncateEllipsis
+
+	var bar *fyne.Container
+	download := widget.NewButtonWithIcon("Download", theme.DownloadIcon(), func() {
+		done(bar)
+		addDownload(myapp, rawURL, fileInfo)
+	})
+	download.Importance = widget.HighImportance
+	always := widget.NewButton("Always", func() {
+		done(bar)
+		prefs.SetStringList(prefClipboardAlways, appendDomain(prefs.StringList(prefClipboardAlways), domain))
+		addDownload(myapp, rawURL, fileInfo)
+	})
+	never := widget.NewButton("Never", func() {
+		done(bar)
+		prefs.SetStringList(prefClipboardNever, appendDomain(prefs.StringList(prefClipboardNever), domain))
+	})
+	dismiss := widget.NewButtonWithIcon("", theme.CancelIcon(), func() {
+		done(bar)
+	})
+	always.Importance, never.Importance, dismiss.Importance = widget.LowImportance, widget.LowImportance, widget.LowImportance
+
+	bar = container.NewBorder(nil, nil, nil,
+		container.NewHBox(download, always, never, dismiss),
+		label,
+	)
+	return bar
+}
+
+// clipboardURL returns the url when the clipboard holds nothing else
+func clipboardURL(content string) (string, bool) {
+	content = strings.TrimSpace(content)
+	if content == "" || strings.ContainsAny(content, " \t\r\n") {
+		return "", false
+	}
+	if isMagnet(content) {
+		return content, true
+	}
+	parsed, err := url.Parse(content)
+	if err != nil || parsed.Host == "" {
+		return "", false
+	}
+	switch parsed.Scheme {
+	case "http", "https", "ftp", "sftp":
+		return content, true
+	}
+	return "", false
+}
+
+// matchesPatterns tells if rawURL ends in one of the extensions in patterns,
+// or matches one of its globs (* is anything)
+func matchesPatterns(rawURL, patterns string) bool {
+	extension := ""
+	if parsed, err := url.Parse(rawURL); err == nil {
+		extension = strings.TrimPrefix(strings.ToLower(path.Ext(parsed.Path)), ".")
+	}
+	for _, pattern := range strings.Fields(strings.ReplaceAll(patterns, ",", " ")) {
+		if !strings.ContainsAny(pattern, "*:/") {
+			if extension != "" && strings.TrimPrefix(strings.ToLower(pattern), ".") == extension {
+				return true
+			}
+			continue
+		}
+		glob := "(?i)^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if matched, _ := regexp.MatchString(glob, rawURL); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// urlDomain is what always/never is remembered for, magnets all share one
+func urlDomain(rawURL string) string {
+	if isMagnet(rawURL) {
+		return "magnet"
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+}
+
+func appendDomain(domains []string, domain string) []string {
+	if slices.Contains(domains, domain) {
+		return domains
+	}
+	return append(domains, domain)
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// downbit daemon keeps downloads going without a window. The GUI and the
+// cli become clients of it through a small HTTP/JSON api on localhost, its
+// address and token are left in daemon.json next to the database.
+
+const defaultDaemonPort = 6801
+
+type daemonInfo struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token"`
+	Pid   int    `json:"pid"`
+}
+
+// DownloadState is a download as the api reports it
+type DownloadState struct {
+	ID         string  `json:"id"`
+	FileName   string  `json:"file_name"`
+	URL        string  `json:"url"`
+	FilePath   string  `json:"file_path"`
+	TotalSize  int64   `json:"total_size"`
+	Downloaded int64   `json:"downloaded"`
+	Status     string  `json:"status"`
+	Progress   float64 `json:"progress"`
+	Speed      string  `json:"speed"`
+	Rate       int64   `json:"rate"` // bytes per second
+	Group      string  `json:"group,omitempty"`
+}
+
+// AddRequest is the body of POST /api/downloads
+type AddRequest struct {
+	URL         string `json:"url"`
+	Path        string `json:"path"`        // file or existing folder, empty for the downloads folder
+	Connections int    `json:"connections"` // 0 picks by size
+	Variant     int    `json:"variant"`     // quality of a stream, 0 picks the best that can be played
+
+	// What a browser knows about the download
+	FileName string   `json:"file_name"` // instead of the name the server suggests
+	Headers  *Headers `json:"headers"`
+	Group    string   `json:"group"` // downloads added together, like the files of a url pattern
+
+	Actions []PostAction `json:"actions,omitempty"` // run when it finishes, instead of its category's
+}
+
+// speedLimitRequest is the body of PUT /api/limit
+type speedLimitRequest struct {
+	Limit float64 `json:"limit"` // bytes per second for all downloads, 0 for none
+}
+
+// daemonEvent goes out on /api/events as a server-sent event, name is
+// added, resumed, progress, stopped, removed or error
+type daemonEvent struct {
+	Name string
+	Data any
+}
+
+type daemonJob struct {
+	download Download // what the download was started with
+	state    DownloadState
+	started  time.Time
+	cancel   context.CancelFunc
+	pause    context.CancelFunc
+	running  bool
+	remove   bool // forget the download once it stopped
+	done     chan struct{}
+}
+
+type daemon struct {
+	myapp *MyApp
+	token string
+
+	mu          sync.Mutex
+	jobs        map[string]*daemonJob
+	subscribers map[chan daemonEvent]struct{}
+}
+
+var errNotFound = errors.New("no download with that id")
+
+// daemonInfoPath is daemon.json in the database folder
+func daemonInfoPath(databasePath string) string {
+	return filepath.Join(databasePath, "daemon.json")
+}
+
+func cliDaemon(myapp *MyApp, args []string) int {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	prefs := myapp.App.Preferences()
+	port := flags.Int("p", prefs.IntWithFallback(prefDaemonPort, defaultDaemonPort), "port to listen on (localhost only)")
+	rpcPort := flags.Int("rpc-port", prefs.IntWithFallback(prefRPCPort, defaultRPCPort), "port of the aria2 JSON-RPC, 0 turns it off")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	databasePath := filepath.Dir(myapp.DownloadStateFilePath)
+	if findDaemon(databasePath) != nil {
+		fmt.Fprintln(os.Stderr, "a daemon is already running")
+		return exitFailed
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *port))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+
+	// Only whoever can read daemon.json gets to use the api, so web pages
+	// can't drive it through the browser
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	d := &daemon{
+		myapp:       myapp,
+		token:       hex.EncodeToString(token),
+		jobs:        map[string]*daemonJob{},
+		subscribers: map[chan daemonEvent]struct{}{},
+	}
+	myapp.OnError = func(err error) {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		data := map[string]string{"error": err.Error()}
+		// Clients following one download only care about its errors
+		var failed *downloadError
+		if errors.As(err, &failed) {
+			data["id"] = failed.ID
+		}
+		d.broadcast(daemonEvent{Name: "error", Data: data})
+	}
+
+	info, _ := json.Marshal(daemonInfo{Addr: listener.Addr().String(), Token: d.token, Pid: os.Getpid()})
+	if err := os.WriteFile(daemonInfoPath(databasePath), info, 0600); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	defer os.Remove(daemonInfoPath(databasePath))
+
+	// The daemon checks the watched urls while it runs, not the window
+	go watchDownloads(myapp, nil)
+
+	server := &http.Server{Handler: d.handler()}
+	go server.Serve(listener)
+	defer server.Close()
+	fmt.Fprintf(os.Stderr, "DownBit daemon listening on %s\n", listener.Addr())
+
+	// aria2 frontends get their own port, they expect /jsonrpc and a secret
+	if *rpcPort > 0 {
+		secret := prefs.String(prefRPCSecret)
+		if secret == "" {
+			rand.Read(token)
+			secret = hex.EncodeToString(token)
+			prefs.SetString(prefRPCSecret, secret)
+		}
+		if rpcListener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *rpcPort)); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: no aria2 JSON-RPC:", err)
+		} else {
+			rpcServer := &http.Server{Handler: newAria2Server(d, secret)}
+			go rpcServer.Serve(rpcListener)
+			defer rpcServer.Close()
+			fmt.Fprintf(os.Stderr, "aria2 JSON-RPC on http://%s/jsonrpc, secret %s\n", rpcListener.Addr(), secret)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	// Pause whatever runs so it can be resumed by the next daemon
+	fmt.Fprintln(os.Stderr, "Pausing the running downloads...")
+	d.pauseAll()
+	return exitOK
+}
+
+// ----------------------------------------------- Api
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/downloads", func(w http.ResponseWriter, r *http.Request) {
+		states, err := d.list()
+		writeJSON(w, states, err)
+	})
+	mux.HandleFunc("POST /api/downloads", func(w http.ResponseWriter, r *http.Request) {
+		var request AddRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.URL == "" {
+			writeJSONError(w, http.StatusBadRequest, "the body needs a url")
+			return
+		}
+		state, err := d.add(request)
+		if err != nil {
+			// Mostly the url couldn't be probed
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(state)
+	})
+	mux.HandleFunc("GET /api/downloads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		state, err := d.get(r.PathValue("id"))
+		writeJSON(w, state, err)
+	})
+	mux.HandleFunc("POST /api/downloads/{id}/pause", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, nil, d.pause(r.PathValue("id")))
+	})
+	mux.HandleFunc("POST /api/downloads/{id}/resume", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, nil, d.resume(r.PathValue("id")))
+	})
+	mux.HandleFunc("DELETE /api/downloads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, nil, d.remove(r.PathValue("id"), r.URL.Query().Get("files") == "true"))
+	})
+	mux.HandleFunc("PUT /api/limit", func(w http.ResponseWriter, r *http.Request) {
+		var request speedLimitRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Limit < 0 {
+			writeJSONError(w, http.StatusBadRequest, "the body needs a limit of 0 or more")
+			return
+		}
+		globalLimit.setRate(request.Limit)
+		writeJSON(w, nil, nil)
+	})
+	mux.HandleFunc("GET /api/events", d.handleEvents)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+d.token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "missing or wrong token")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleEvents streams the events as text/event-stream until the client leaves
+func (d *daemon) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming isn't supported")
+		return
+	}
+	events := d.subscribe()
+	defer d.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			data, _ := json.Marshal(event.Data)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, data)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value any, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case err != nil:
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case value == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// ----------------------------------------------- Downloads
+
+// list is the database with the live state of the running downloads on top
+func (d *daemon) list() ([]DownloadState, error) {
+	downloads, _, err := loadDatabase(d.myapp.DownloadStateFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	states := []DownloadState{}
+	saved := map[string]bool{}
+	for _, download := range downloads {
+		saved[download.ID] = true
+		if job, ok := d.jobs[download.ID]; ok {
+			states = append(states, job.state)
+			continue
+		}
+		state := downloadState(download)
+		if _, running := runningDownload(d.myapp, download.ID); running {
+			state.Status = "Running"
+		}
+		states = append(states, state)
+	}
+
+	// New downloads reach the database once they pause or finish
+	var jobs []*daemonJob
+	for id, job := range d.jobs {
+		if !saved[id] {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].started.Before(jobs[j].started) })
+	for _, job := range jobs {
+		states = append(states, job.state)
+	}
+	return states, nil
+}
+
+func (d *daemon) get(id string) (DownloadState, error) {
+	states, err := d.list()
+	if err != nil {
+		return DownloadState{}, err
+	}
+	for _, state := range states {
+		if state.ID == id {
+			return state, nil
+		}
+	}
+	return DownloadState{}, errNotFound
+}
+
+func (d *daemon) add(request AddRequest) (DownloadState, error) {
+	fileInfo, err := getFileInfo(d.myapp.clientFor(request.Headers, request.URL), request.URL)
+	if err != nil {
+		return DownloadState{}, err
+	}
+	fileInfo.Headers = request.Headers
+	fileInfo.Group = request.Group
+	fileInfo.Actions = request.Actions
+	if name := filepath.Base(request.FileName); request.FileName != "" && name != "." && name != ".." && name != string(filepath.Separator) {
+		fileInfo.FileName = name
+		fileInfo.FilePath = filepath.Join(filepath.Dir(fileInfo.FilePath), name)
+	}
+	if request.Variant > 0 && request.Variant < len(fileInfo.Variants) {
+		fileInfo.Stream = &fileInfo.Variants[request.Variant]
+	} else if len(fileInfo.Variants) > 0 {
+		fileInfo.Stream = &fileInfo.Variants[defaultVariant(d.myapp, fileInfo.Variants)]
+	}
+	if request.Path != "" {
+		if err := fileInfo.saveTo(request.Path); err != nil {
+			return DownloadState{}, err
+		}
+	}
+	fileInfo.Connections = max(request.Connections, 0)
+
+	download := Download{
+		ID:        uuid.New().String(),
+		FileName:  fileInfo.FileName,
+		URL:       fileInfo.URL,
+		FilePath:  fileInfo.FilePath,
+		TotalSize: int64(fileInfo.Total),
+		Torrent:   fileInfo.Torrent,
+		Group:     fileInfo.Group,
+		Actions:   fileInfo.Actions,
+	}
+	fileItem, job := d.track(download)
+
+	ctx, cancel := context.WithCancel(d.myapp.AppContext)
+	ctxP, cancelP := context.WithCancel(d.myapp.AppContext)
+	d.mu.Lock()
+	job.cancel, job.pause = cancel, cancelP
+	state := job.state
+	d.mu.Unlock()
+	d.broadcast(daemonEvent{Name: "added", Data: state})
+
+	go ConfirmURL(d.myapp, fileInfo, fileItem, ctx, ctxP, nil, nil)
+	return state, nil
+}
+
+func (d *daemon) resume(id string) error {
+	d.mu.Lock()
+	if job, ok := d.jobs[id]; ok && job.running {
+		d.mu.Unlock()
+		return fmt.Errorf("%s is already running", id)
+	}
+	d.mu.Unlock()
+	download, err := isFileExistByID(d.myapp.DownloadStateFilePath, id)
+	if err != nil {
+		return errNotFound
+	}
+	if download.Status == "Finished" {
+		return fmt.Errorf("%s is already finished", id)
+	}
+	if _, running := runningDownload(d.myapp, id); running {
+		return fmt.Errorf("%s is running in another process", id)
+	}
+
+	fileItem, job := d.track(download)
+	d.mu.Lock()
+	state := job.state
+	d.mu.Unlock()
+	d.broadcast(daemonEvent{Name: "resumed", Data: state})
+
+	// ResumeDownload makes its own contexts and hands out their cancel funcs
+	cancelC := make(chan context.CancelFunc, 1)
+	pauseC := make(chan context.CancelFunc, 1)
+	go ResumeDownload(d.myapp, fileItem, cancelC, pauseC)
+	cancel, cancelP := <-cancelC, <-pauseC
+	d.mu.Lock()
+	job.cancel, job.pause = cancel, cancelP
+	d.mu.Unlock()
+	return nil
+}
+
+// pause stops a running download and waits until it saved itself
+func (d *daemon) pause(id string) error {
+	d.mu.Lock()
+	job, ok := d.jobs[id]
+	if !ok || !job.running {
+		d.mu.Unlock()
+		download, err := isFileExistByID(d.myapp.DownloadStateFilePath, id)
+		if err != nil && !ok {
+			return errNotFound
+		}
+		// A cli running it in the foreground is paused through its pid file
+		if _, running := runningDownload(d.myapp, id); running {
+			return stopRunningDownload(d.myapp, id)
+		}
+		if download.Status == "Paused" {
+			return nil
+		}
+		return fmt.Errorf("%s isn't running", id)
+	}
+	pause := job.pause
+	d.mu.Unlock()
+
+	pause()
+	return waitJob(job)
+}
+
+// remove forgets a download. A download that didn't finish takes its files
+// with it, files takes the finished ones too
+func (d *daemon) remove(id string, files bool) error {
+	return d.forget(id, func(download Download) bool { return files || download.Status != "Finished" })
+}
+
+// removeKeepingFiles forgets a download and leaves its files alone, like
+// aria2's remove does
+func (d *daemon) removeKeepingFiles(id string) error {
+	return d.forget(id, nil)
+}
+
+// forget stops the download with id and drops its record, deleteFiles says
+// whether its files go too (nil keeps them)
+func (d *daemon) forget(id string, deleteFiles func(download Download) bool) error {
+	d.mu.Lock()
+	job, ok := d.jobs[id]
+	if ok && job.running {
+		job.remove = true
+		// Cancelling deletes what was downloaded, pausing keeps it
+		stop := job.cancel
+		if deleteFiles == nil {
+			stop = job.pause
+		}
+		d.mu.Unlock()
+		stop()
+		if err := waitJob(job); err != nil {
+			return err
+		}
+	} else {
+		d.mu.Unlock()
+	}
+
+	download, err := isFileExistByID(d.myapp.DownloadStateFilePath, id)
+	if err != nil {
+		if !ok {
+			return errNotFound
+		}
+		download = job.download
+	}
+	if _, running := runningDownload(d.myapp, id); running {
+		return fmt.Errorf("%s is running in another process", id)
+	}
+	if deleteFiles != nil && deleteFiles(download) {
+		if err := deleteDownloadFiles(download); err != nil {
+			return err
+		}
+	}
+	if download.Status != "" {
+		if err := removeDownload(d.myapp.DownloadStateFilePath, id); err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	delete(d.jobs, id)
+	d.mu.Unlock()
+	d.broadcast(daemonEvent{Name: "removed", Data: map[string]string{"id": id}})
+	return nil
+}
+
+func (d *daemon) pauseAll() {
+	d.mu.Lock()
+	var running []*daemonJob
+	for _, job := range d.jobs {
+		if job.running {
+			running = append(running, job)
+			job.pause()
+		}
+	}
+	d.mu.Unlock()
+	for _, job := range running {
+		waitJob(job)
+	}
+}
+
+// track follows a download through a headless FileItem
+func (d *daemon) track(download Download) (*FileItem, *daemonJob) {
+	state := downloadState(download)
+	state.Status = "Running"
+	job := &daemonJob{
+		download: download,
+		state:    state,
+		started:  time.Now(),
+		cancel:   func() {},
+		pause:    func() {},
+		running:  true,
+		done:     make(chan struct{}),
+	}
+	d.mu.Lock()
+	d.jobs[download.ID] = job
+	d.mu.Unlock()
+
+	fileItem := &FileItem{ID: download.ID}
+	var speed rateEstimator
+	fileItem.OnProgress = func(value float64) {
+		d.mu.Lock()
+		downloaded := int64(value * float64(job.state.TotalSize))
+		job.state.Rate = int64(speed.update(downloaded, time.Now()))
+		job.state.Progress = value
+		job.state.Downloaded = downloaded
+		state := job.state
+		d.mu.Unlock()
+		d.broadcast(daemonEvent{Name: "progress", Data: state})
+	}
+	fileItem.OnSpeed = func(text string) {
+		d.mu.Lock()
+		job.state.Speed = text
+		d.mu.Unlock()
+	}
+	fileItem.OnStop = func(status string) {
+		d.mu.Lock()
+		job.running = false
+		job.state.Status = status
+		job.state.Speed = ""
+		job.state.Rate = 0
+		if status == "Finished" {
+			job.state.Progress = 1
+		}
+		state := job.state
+		// The database has it from here on, failed new downloads only live here
+		if status != "Failed" && !job.remove {
+			delete(d.jobs, download.ID)
+		}
+		d.mu.Unlock()
+		close(job.done)
+		d.broadcast(daemonEvent{Name: "stopped", Data: state})
+	}
+	return fileItem, job
+}
+
+func waitJob(job *daemonJob) error {
+	select {
+	case <-job.done:
+		return nil
+	case <-time.After(30 * time.Second):
+		return fmt.Errorf("%s didn't stop", job.download.ID)
+	}
+}
+
+func downloadState(download Download) DownloadState {
+	state := DownloadState{
+		ID:         download.ID,
+		FileName:   download.FileName,
+		URL:        download.URL,
+		FilePath:   download.FilePath,
+		TotalSize:  download.TotalSize,
+		Downloaded: download.Downloaded,
+		Status:     download.Status,
+		Group:      download.Group,
+	}
+	if download.TotalSize > 0 {
+		state.Progress = min(float64(download.Downloaded)/float64(download.TotalSize), 1)
+	}
+	if download.Status == "Finished" {
+		state.Progress = 1
+	}
+	return state
+}
+
+// ----------------------------------------------- Events
+
+func (d *daemon) subscribe() chan daemonEvent {
+	events := make(chan daemonEvent, 256)
+	d.mu.Lock()
+	d.subscribers[events] = struct{}{}
+	d.mu.Unlock()
+	return events
+}
+
+func (d *daemon) unsubscribe(events chan daemonEvent) {
+	d.mu.Lock()
+	delete(d.subscribers, events)
+	d.mu.Unlock()
+}
+
+// broadcast never blocks, a client that can't keep up misses events
+func (d *daemon) broadcast(event daemonEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for events := range d.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
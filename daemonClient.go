@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// daemonClient talks to a running downbit daemon
+type daemonClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// daemonError is what the api answered with when a call didn't work
+type daemonError struct {
+	Status  int
+	Message string
+}
+
+func (err *daemonError) Error() string {
+	return err.Message
+}
+
+// remoteEvent is a server-sent event from /api/events
+type remoteEvent struct {
+	Name string
+	Data []byte
+}
+
+// findDaemon returns a client for the daemon using this database, nil when none runs
+func findDaemon(databasePath string) *daemonClient {
+	data, err := os.ReadFile(daemonInfoPath(databasePath))
+	if err != nil {
+		return nil
+	}
+	var info daemonInfo
+	if err := json.Unmarshal(data, &info); err != nil || !processAlive(info.Pid) {
+		return nil
+	}
+	remote := &daemonClient{base: "http://" + info.Addr, token: info.Token, client: &http.Client{}}
+	// The pid may belong to something else by now
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := remote.call(ctx, http.MethodGet, "/api/downloads", nil, nil); err != nil {
+		return nil
+	}
+	return remote
+}
+
+// startDaemon runs downbit daemon in the background and waits until it answers
+func startDaemon(databasePath string) (*daemonClient, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	command := exec.Command(executable, "daemon")
+	detachProcess(command)
+	if err := command.Start(); err != nil {
+		return nil, fmt.Errorf("could not start the daemon: %v", err)
+	}
+	command.Process.Release()
+
+	for wait := 0; wait < 50; wait++ {
+		time.Sleep(100 * time.Millisecond)
+		if remote := findDaemon(databasePath); remote != nil {
+			return remote, nil
+		}
+	}
+	return nil, fmt.Errorf("the daemon didn't start")
+}
+
+// ----------------------------------------------- Calls
+
+func (remote *daemonClient) list() ([]DownloadState, error) {
+	var states []DownloadState
+	err := remote.call(context.Background(), http.MethodGet, "/api/downloads", nil, &states)
+	return states, err
+}
+
+func (remote *daemonClient) get(id string) (DownloadState, error) {
+	var state DownloadState
+	err := remote.call(context.Background(), http.MethodGet, "/api/downloads/"+url.PathEscape(id), nil, &state)
+	return state, err
+}
+
+func (remote *daemonClient) add(request AddRequest) (DownloadState, error) {
+	var state DownloadState
+	err := remote.call(context.Background(), http.MethodPost, "/api/downloads", request, &state)
+	return state, err
+}
+
+func (remote *daemonClient) pause(id string) error {
+	return remote.call(context.Background(), http.MethodPost, "/api/downloads/"+url.PathEscape(id)+"/pause", nil, nil)
+}
+
+func (remote *daemonClient) resume(id string) error {
+	return remote.call(context.Background(), http.MethodPost, "/api/downloads/"+url.PathEscape(id)+"/resume", nil, nil)
+}
+
+func (remote *daemonClient) remove(id string, files bool) error {
+	path := "/api/downloads/" + url.PathEscape(id)
+	if files {
+		path += "?files=true"
+	}
+	return remote.call(context.Background(), http.MethodDelete, path, nil, nil)
+}
+
+// setSpeedLimit changes the daemon's limit, in bytes per second
+func (remote *daemonClient) setSpeedLimit(rate float64) error {
+	return remote.call(context.Background(), http.MethodPut, "/api/limit", speedLimitRequest{Limit: rate}, nil)
+}
+
+func (remote *daemonClient) call(ctx context.Context, method, path string, body, result any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, remote.base+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+remote.token)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := remote.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("could not reach the daemon: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		var answer struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&answer)
+		if answer.Error == "" {
+			answer.Error = response.Status
+		}
+		return &daemonError{Status: response.StatusCode, Message: answer.Error}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// subscribe follows /api/events, the channel is closed when the stream ends.
+// It returns once the daemon accepted the subscription so nothing after it is missed.
+func (remote *daemonClient) subscribe(ctx context.Context) (<-chan remoteEvent, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, remote.base+"/api/events", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+remote.token)
+	response, err := remote.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach the daemon: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("could not follow the daemon: %s", response.Status)
+	}
+
+	events := make(chan remoteEvent, 64)
+	go func() {
+		defer close(events)
+		defer response.Body.Close()
+		scanner := bufio.NewScanner(response.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		var event remoteEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.Name != "" {
+					select {
+					case events <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+				event = remoteEvent{}
+			case strings.HasPrefix(line, "event: "):
+				event.Name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.Data = []byte(strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}()
+	return events, nil
+}
+
+// ----------------------------------------------- GUI
+
+// followDaemon shows the downloads of the daemon in the window and keeps
+// them up to date, the buttons of those items go to the daemon
+func (myapp *MyApp) followDaemon() {
+	events, err := myapp.remote().subscribe(context.Background())
+	if err != nil {
+		myapp.showError(err)
+		return
+	}
+	states, err := myapp.remote().list()
+	if err != nil {
+		myapp.showError(err)
+	}
+
+	items := map[string]*FileItem{}
+	for _, state := range states {
+		if state.Status == "Running" || state.Status == "Paused" {
+			items[state.ID] = makeRemoteFileItem(myapp, state)
+		}
+	}
+
+	for event := range events {
+		switch event.Name {
+		case "added", "resumed", "progress", "stopped":
+			var state DownloadState
+			if json.Unmarshal(event.Data, &state) != nil {
+				continue
+			}
+			fileItem, ok := items[state.ID]
+			if !ok {
+				if state.Status == "Cancelled" {
+					continue
+				}
+				fileItem = makeRemoteFileItem(myapp, state)
+				items[state.ID] = fileItem
+			}
+			fileItem.setProgress(state.Progress)
+			if state.Speed != "" {
+				fileItem.setSpeed(state.Speed)
+			}
+			switch event.Name {
+			case "resumed":
+				// Maybe resumed by another client
+				fileItem.Row.setPaused(false)
+			case "stopped":
+				remoteStopped(myapp, fileItem, state.Status)
+			}
+		case "removed":
+			var removed struct {
+				ID string `json:"id"`
+			}
+			json.Unmarshal(event.Data, &removed)
+			if fileItem, ok := items[removed.ID]; ok {
+				myapp.Downloads.remove(fileItem.Row)
+				delete(items, removed.ID)
+			}
+		case "error":
+			var answer struct {
+				Error string `json:"error"`
+			}
+			json.Unmarshal(event.Data, &answer)
+			myapp.showError(errors.New(answer.Error))
+		}
+	}
+	myapp.showError(fmt.Errorf("lost the background service"))
+}
+
+// makeRemoteFileItem is a FileItem for a download the daemon runs
+func makeRemoteFileItem(myapp *MyApp, state DownloadState) *FileItem {
+	remote := myapp.remote()
+	fileItem, _, _ := makeFileItem(myapp, FileInfo{FileName: state.FileName, Total: int(state.TotalSize)})
+	fileItem.ID = state.ID
+	fileItem.Row.ID = state.ID
+
+	fileItem.Row.Pause = func() {
+		go func() {
+			if err := remote.pause(state.ID); err != nil {
+				myapp.showError(err)
+			}
+		}()
+	}
+	fileItem.Row.Resume = func() {
+		go func() {
+			if err := remote.resume(state.ID); err != nil {
+				myapp.showError(err)
+			}
+		}()
+	}
+	// The item goes away once the daemon says it's removed
+	fileItem.Row.Cancel = func() {
+		go func() {
+			if err := remote.remove(state.ID, false); err != nil {
+				myapp.showError(err)
+			}
+		}()
+	}
+
+	fileItem.setProgress(state.Progress)
+	if state.Status == "Paused" {
+		fileItem.Row.setPaused(true)
+	}
+	return fileItem
+}
+
+func remoteStopped(myapp *MyApp, fileItem *FileItem, status string) {
+	switch status {
+	case "Paused":
+		fileItem.Row.setPaused(true)
+	case "Cancelled":
+		myapp.Downloads.remove(fileItem.Row)
+	default:
+		fileItem.stopped(status)
+		downloadFinished(fileItem)
+	}
+}
+
+// addRemote hands a download to the daemon, it shows up through its events
+func addRemote(myapp *MyApp, rawURL string, fileInfo FileInfo) {
+	request := AddRequest{URL: rawURL, Path: fileInfo.FilePath, Connections: fileInfo.Connections, Headers: fileInfo.Headers, Group: fileInfo.Group, Actions: fileInfo.Actions}
+	for i := range fileInfo.Variants {
+		if fileInfo.Stream == &fileInfo.Variants[i] {
+			request.Variant = i
+		}
+	}
+	if _, err := myapp.remote().add(request); err != nil {
+		myapp.showError(fmt.Errorf("couldnt add the download: %v", err))
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type mpd struct {
+	XMLName                   xml.Name    `xml:"MPD"`
+	Type                      string      `xml:"type,attr"`
+	MediaPresentationDuration string      `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   string      `xml:"BaseURL"`
+	Periods                   []mpdPeriod `xml:"Period"`
+}
+
+type mpdPeriod struct {
+	Duration       string             `xml:"duration,attr"`
+	BaseURL        string             `xml:"BaseURL"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	MimeType        string              `xml:"mimeType,attr"`
+	ContentType     string              `xml:"contentType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+	Representations []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int                 `xml:"bandwidth,attr"`
+	Width           int                 `xml:"width,attr"`
+	Height          int                 `xml:"height,attr"`
+	MimeType        string              `xml:"mimeType,attr"`
+	BaseURL         string              `xml:"BaseURL"`
+	SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+}
+
+type mpdSegmentTemplate struct {
+	Media          string `xml:"media,attr"`
+	Initialization string `xml:"initialization,attr"`
+	StartNumber    *int64 `xml:"startNumber,attr"`
+	Timescale      int64  `xml:"timescale,attr"`
+	Duration       int64  `xml:"duration,attr"`
+	Timeline       *struct {
+		S []struct {
+			T *int64 `xml:"t,attr"`
+			D int64  `xml:"d,attr"`
+			R int64  `xml:"r,attr"`
+		} `xml:"S"`
+	} `xml:"SegmentTimeline"`
+}
+
+type mpdSegmentList struct {
+	Initialization *struct {
+		SourceURL string `xml:"sourceURL,attr"`
+	} `xml:"Initialization"`
+	SegmentURLs []struct {
+		Media string `xml:"media,attr"`
+	} `xml:"SegmentURL"`
+}
+
+// dashRepresentation is a representation together with the settings it
+// inherits from its adaptation set
+type dashRepresentation struct {
+	mpdRepresentation
+	isVideo bool
+	isAudio bool
+	baseURL string
+	period  mpdPeriod
+}
+
+func parseMPD(manifest []byte) (*mpd, error) {
+	var parsed mpd
+	if err := xml.Unmarshal(manifest, &parsed); err != nil {
+		return nil, fmt.Errorf("could not parse mpd: %v", err)
+	}
+	if parsed.Type == "dynamic" {
+		return nil, errors.New("live dash streams aren't supported")
+	}
+	if len(parsed.Periods) == 0 {
+		return nil, errors.New("mpd has no periods")
+	}
+	return &parsed, nil
+}
+
+// dashRepresentations flattens the representations of the first period
+// (multi-period manifests are mostly ads and are not stitched together)
+func dashRepresentations(manifest *mpd, manifestURL string) []dashRepresentation {
+	period := manifest.Periods[0]
+	periodBase := resolveURL(resolveURL(manifestURL, manifest.BaseURL), period.BaseURL)
+
+	var representations []dashRepresentation
+	for _, set := range period.AdaptationSets {
+		setBase := resolveURL(periodBase, set.BaseURL)
+		for _, rep := range set.Representations {
+			if rep.SegmentTemplate == nil {
+				rep.SegmentTemplate = set.SegmentTemplate
+			}
+			if rep.SegmentList == nil {
+				rep.SegmentList = set.SegmentList
+			}
+			kind := rep.MimeType + set.MimeType + set.ContentType
+			representations = append(representations, dashRepresentation{
+				mpdRepresentation: rep,
+				isVideo:           strings.Contains(kind, "video"),
+				isAudio:           strings.Contains(kind, "audio"),
+				baseURL:           resolveURL(setBase, rep.BaseURL),
+				period:            period,
+			})
+		}
+	}
+	return representations
+}
+
+// parseDASHVariants offers every video representation, paired with the best
+// audio. Manifests without video offer their audio representations instead.
+func parseDASHVariants(manifest []byte, manifestURL string) ([]StreamVariant, error) {
+	parsed, err := parseMPD(manifest)
+	if err != nil {
+		return nil, err
+	}
+	representations := dashRepresentations(parsed, manifestURL)
+
+	bestAudio := dashRepresentation{}
+	hasVideo := false
+	for _, rep := range representations {
+		if rep.isAudio && rep.Bandwidth >= bestAudio.Bandwidth {
+			bestAudio = rep
+		}
+		hasVideo = hasVideo || rep.isVideo
+	}
+
+	var variants []StreamVariant
+	for _, rep := range representations {
+		switch {
+		case hasVideo && rep.isVideo:
+			name := fmt.Sprintf("%d kbps", rep.Bandwidth/1000)
+			if rep.Height > 0 {
+				name = fmt.Sprintf("%dx%d %s", rep.Width, rep.Height, name)
+			}
+			variants = append(variants, StreamVariant{
+				Kind:      "dash",
+				Name:      name,
+				Bandwidth: rep.Bandwidth + bestAudio.Bandwidth,
+				URL:       manifestURL,
+				VideoID:   rep.ID,
+				AudioID:   bestAudio.ID,
+			})
+		case !hasVideo:
+			variants = append(variants, StreamVariant{
+				Kind:      "dash",
+				Name:      fmt.Sprintf("audio %d kbps", rep.Bandwidth/1000),
+				Bandwidth: rep.Bandwidth,
+				URL:       manifestURL,
+				VideoID:   rep.ID,
+			})
+		}
+	}
+	if len(variants) == 0 {
+		return nil, errors.New("mpd has no representations")
+	}
+	return variants, nil
+}
+
+// parseDASHSegments lists the segments of the chosen representations, track 0
+// is the video (or only) track and track 1 the audio.
+func parseDASHSegments(manifest []byte, variant StreamVariant) ([]streamSegment, error) {
+	parsed, err := parseMPD(manifest)
+	if err != nil {
+		return nil, err
+	}
+	representations := dashRepresentations(parsed, variant.URL)
+
+	var segments []streamSegment
+	for track, id := range []string{variant.VideoID, variant.AudioID} {
+		if id == "" {
+			continue
+		}
+		index := slices.IndexFunc(representations, func(rep dashRepresentation) bool { return rep.ID == id })
+		if index < 0 {
+			return nil, fmt.Errorf("representation %q is gone from the manifest", id)
+		}
+
+		urls, err := dashSegmentURLs(parsed, representations[index])
+		if err != nil {
+			return nil, err
+		}
+		for _, segmentURL := range urls {
+			segments = append(segments, streamSegment{URL: segmentURL, Track: track, RangeLength: -1})
+		}
+	}
+	return segments, nil
+}
+
+func dashSegmentURLs(manifest *mpd, rep dashRepresentation) ([]string, error) {
+	// A single file per representation
+	if rep.SegmentTemplate == nil && rep.SegmentList == nil {
+		return []string{rep.baseURL}, nil
+	}
+
+	if list := rep.SegmentList; list != nil && rep.SegmentTemplate == nil {
+		var urls []string
+		if list.Initialization != nil && list.Initialization.SourceURL != "" {
+			urls = append(urls, resolveURL(rep.baseURL, list.Initialization.SourceURL))
+		}
+		for _, segment := range list.SegmentURLs {
+			urls = append(urls, resolveURL(rep.baseURL, segment.Media))
+		}
+		return urls, nil
+	}
+
+	template := rep.SegmentTemplate
+	number := int64(1)
+	if template.StartNumber != nil {
+		number = *template.StartNumber
+	}
+
+	var urls []string
+	if template.Initialization != "" {
+		urls = append(urls, resolveURL(rep.baseURL, expandDASHTemplate(template.Initialization, rep, 0, 0)))
+	}
+
+	if template.Timeline != nil {
+		var time int64
+		for _, s := range template.Timeline.S {
+			if s.T != nil {
+				time = *s.T
+			}
+			for repeat := int64(0); repeat <= s.R; repeat++ {
+				urls = append(urls, resolveURL(rep.baseURL, expandDASHTemplate(template.Media, rep, number, time)))
+				number++
+				time += s.D
+			}
+		}
+		return urls, nil
+	}
+
+	// Fixed duration segments, the count comes from the presentation length
+	if template.Duration <= 0 {
+		return nil, errors.New("segment template without duration or timeline")
+	}
+	length := rep.period.Duration
+	if length == "" {
+		length = manifest.MediaPresentationDuration
+	}
+	seconds, err := parseISODuration(length)
+	if err != nil {
+		return nil, err
+	}
+	timescale := template.Timescale
+	if timescale == 0 {
+		timescale = 1
+	}
+	count := int64(math.Ceil(seconds * float64(timescale) / float64(template.Duration)))
+	for i := int64(0); i < count; i++ {
+		urls = append(urls, resolveURL(rep.baseURL, expandDASHTemplate(template.Media, rep, number+i, i*template.Duration)))
+	}
+	return urls, nil
+}
+
+var dashTemplateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0(\d+)d)?\$`)
+
+func expandDASHTemplate(template string, rep dashRepresentation, number, time int64) string {
+	expanded := dashTemplateIdentifier.ReplaceAllStringFunc(template, func(match string) string {
+		parts := dashTemplateIdentifier.FindStringSubmatch(match)
+		var value int64
+		switch parts[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			value = number
+		case "Bandwidth":
+			value = int64(rep.Bandwidth)
+		case "Time":
+			value = time
+		}
+		width, _ := strconv.Atoi(parts[3])
+		return fmt.Sprintf("%0*d", width, value)
+	})
+	return strings.ReplaceAll(expanded, "$$", "$")
+}
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:([\d.]+)S)?)?$`)
+
+// parseISODuration parses durations like PT1H2M3.5S into seconds
+func parseISODuration(duration string) (float64, error) {
+	parts := isoDuration.FindStringSubmatch(duration)
+	if parts == nil {
+		return 0, fmt.Errorf("invalid duration %q", duration)
+	}
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		if parts[i+1] != "" {
+			value, _ := strconv.ParseFloat(parts[i+1], 64)
+			seconds += value * unit
+		}
+	}
+	return seconds, nil
+}
@@ -2,59 +2,83 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 )
 
-func saveDownloadFileInfo(newDownload Download, database string) {
-	// Step 1: Open the JSON file
-	file, err := os.OpenFile(database, os.O_RDWR, 0644)
-	if err != nil {
-		fmt.Printf("could not open file: %v", err)
-	}
-	defer file.Close()
+// Everything that downloads goes through downloads.json: the app, the daemon,
+// the cli, the scheduler and the watches. Writes are serialised with a mutex
+// for this process and a lock file for the others, and the new contents are
+// written next to it and renamed over it so nobody reads half a file.
 
-	// Step 2: Read the existing downloads
-	var downloads []Download
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&downloads); err != nil {
-		// Handle empty or new file scenario
-		if err != io.EOF {
-			fmt.Printf("could not decode file: %v", err)
-		}
-		downloads = []Download{} // Initialize an empty slice if file is empty
-	}
+var databaseMu sync.Mutex
 
-	// Step 3: Append the new download
-	updated := false
-	for i, download := range downloads {
-		if download.ID == newDownload.ID {
-			downloads[i] = newDownload // Update the existing download
-			updated = true
-			break
+func saveDownloadFileInfo(newDownload Download, database string) {
+	err := updateDatabase(database, func(downloads []Download) []Download {
+		for i, download := range downloads {
+			if download.ID == newDownload.ID {
+				downloads[i] = newDownload // Update the existing download
+				return downloads
+			}
 		}
+		return append(downloads, newDownload)
+	})
+	if err != nil {
+		logger.Printf("could not save %s: %v\n", newDownload.FileName, err)
 	}
+}
 
-	if !updated {
-		downloads = append(downloads, newDownload)
+// updateDatabase reads the downloads, lets edit change them and writes them
+// back. A database that doesn't decode is left alone rather than emptied
+func updateDatabase(database string, edit func(downloads []Download) []Download) error {
+	databaseMu.Lock()
+	defer databaseMu.Unlock()
+	lock, err := lockFileWait(database + ".lock")
+	if err != nil {
+		return fmt.Errorf("could not lock the database: %v", err)
 	}
+	defer lock.Close()
 
-	// Step 4: Overwrite the file with the updated data
-	// Truncate the file to ensure old data is removed
-	if err := file.Truncate(0); err != nil {
-		fmt.Printf("could not truncate file: %v", err)
+	downloads, _, err := loadDatabase(database)
+	if err != nil {
+		return err
 	}
-	// Move the file pointer to the beginning
-	if _, err := file.Seek(0, 0); err != nil {
-		fmt.Printf("could not seek to beginning: %v", err)
+	return writeDatabase(database, edit(downloads))
+}
+
+// writeDatabase replaces the database with downloads in one rename
+func writeDatabase(database string, downloads []Download) error {
+	// The temp file is 0600 and the database keeps that, downloads keep
+	// their cookies so only the user gets to read it
+	temp, err := os.CreateTemp(filepath.Dir(database), ".downloads-*.json")
+	if err != nil {
+		return fmt.Errorf("could not write the database: %v", err)
 	}
+	defer os.Remove(temp.Name()) // Nothing left once it's renamed
 
-	encoder := json.NewEncoder(file)
+	encoder := json.NewEncoder(temp)
 	encoder.SetIndent("", "  ") // Pretty-print JSON
 	if err := encoder.Encode(downloads); err != nil {
-		fmt.Printf("could not write updated data: %v", err)
+		temp.Close()
+		return fmt.Errorf("could not write the database: %v", err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return fmt.Errorf("could not write the database: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("could not write the database: %v", err)
+	}
+	if err := os.Rename(temp.Name(), database); err != nil {
+		return fmt.Errorf("could not write the database: %v", err)
 	}
+	return nil
 }
 
 func isFileExistByID(database string, id string) (Download, error) {
@@ -100,8 +124,69 @@ func loadDatabase(database string) ([]Download, *os.File, error) {
 	var downloads []Download
 	decoder := json.NewDecoder(file)
 	if err = decoder.Decode(&downloads); err != nil {
+		// An empty file is an empty database
+		if err == io.EOF {
+			return []Download{}, file, nil
+		}
 		return nil, file, fmt.Errorf("could not decode database: %v", err)
 	}
 
 	return downloads, file, nil
 }
+
+// removeDownload deletes the record with id, the files are left alone
+func removeDownload(database string, id string) error {
+	return updateDatabase(database, func(downloads []Download) []Download {
+		return slices.DeleteFunc(downloads, func(download Download) bool { return download.ID == id })
+	})
+}
+
+// deleteDownloadFiles removes what a download wrote so far
+func deleteDownloadFiles(download Download) error {
+	if download.FilePath == "" {
+		return nil
+	}
+	os.RemoveAll(streamPartsDir(download.FilePath))
+	// A multi file torrent is a folder
+	if download.Torrent != nil {
+		return removeDownloadFolder(download.FilePath)
+	}
+	if err := os.Remove(download.FilePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// removeDownloadFolder deletes the folder a download wrote, but never one the
+// downloads go into (a torrent named ".." would point at one)
+func removeDownloadFolder(folder string) error {
+	if isProtectedFolder(folder) {
+		return fmt.Errorf("refusing to delete %s", folder)
+	}
+	return os.RemoveAll(folder)
+}
+
+// isProtectedFolder tells whether folder is a root, the home folder (or above
+// it) or one of the downloads folders
+func isProtectedFolder(folder string) bool {
+	if folder == "" {
+		return true
+	}
+	folder, err := filepath.Abs(folder)
+	if err != nil || filepath.Dir(folder) == folder {
+		return true
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return true
+	}
+	home = filepath.Clean(home)
+	if strings.HasPrefix(home+string(filepath.Separator), folder+string(filepath.Separator)) {
+		return true
+	}
+	downloads, err := getDownloadD()
+	if err != nil {
+		return true
+	}
+	return folder == filepath.Clean(downloads) || folder == filepath.Join(downloads, "DownBitDownloads")
+}
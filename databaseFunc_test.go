@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// Downloads keep their cookies in the database, nobody else may read it
+func TestDatabaseIsPrivate(t *testing.T) {
+	databasePath := t.TempDir()
+	database, err := createJSONFile(databasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMode := func() {
+		t.Helper()
+		stat, err := os.Stat(database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := stat.Mode().Perm(); mode != 0600 {
+			t.Errorf("database mode = %o, want 600", mode)
+		}
+	}
+	checkMode()
+
+	download := Download{ID: "a", Headers: &Headers{Cookie: "session=secret"}}
+	if err := writeDatabase(database, []Download{download}); err != nil {
+		t.Fatal(err)
+	}
+	checkMode()
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Clicking a download shows what its connections are doing: where every
+// chunk is, how fast each one goes and what the server answered.
+
+// downloadStats is what a download recorded for the details pane
+type downloadStats struct {
+	mu       sync.Mutex
+	chunks   []Chunk // the download's own, their fields change under mu (the offsets atomically)
+	response string  // status line of the last response
+	headers  http.Header
+	remoteIP string
+	retries  int
+	errors   []string
+}
+
+// At most this many errors are kept
+const statsErrorLimit = 100
+
+type statsKey struct{}
+
+// withStats makes the requests made with ctx report to stats
+func withStats(ctx context.Context, stats *downloadStats) context.Context {
+	if stats == nil {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, statsKey{}, stats)
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			stats.connected(info.Conn.RemoteAddr().String())
+		},
+	})
+}
+
+// statsFrom returns the stats of ctx, nil when nobody is looking
+func statsFrom(ctx context.Context) *downloadStats {
+	stats, _ := ctx.Value(statsKey{}).(*downloadStats)
+	return stats
+}
+
+func (stats *downloadStats) track(chunks []Chunk) {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	stats.chunks = chunks
+	stats.mu.Unlock()
+}
+
+// setChunk edits a chunk under the lock of the stats of ctx, the details
+// pane reads the chunks while they download
+func setChunk(ctx context.Context, chunks []Chunk, index int, edit func(chunk *Chunk)) {
+	if stats := statsFrom(ctx); stats != nil {
+		stats.mu.Lock()
+		defer stats.mu.Unlock()
+	}
+	edit(&chunks[index])
+}
+
+func setChunkStatus(ctx context.Context, chunks []Chunk, index int, status string) {
+	setChunk(ctx, chunks, index, func(chunk *Chunk) { chunk.Status = status })
+}
+
+func (stats *downloadStats) connected(addr string) {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	stats.remoteIP = addr
+	stats.mu.Unlock()
+}
+
+func (stats *downloadStats) gotResponse(resp *http.Response) {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	stats.response = resp.Proto + " " + resp.Status
+	stats.headers = resp.Header.Clone()
+	stats.mu.Unlock()
+}
+
+// retried counts a chunk that is tried again after err
+func (stats *downloadStats) retried(index int, err error) {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	stats.retries++
+	stats.mu.Unlock()
+	stats.failed(fmt.Errorf("chunk %d, retrying: %v", index, err))
+}
+
+func (stats *downloadStats) failed(err error) {
+	if stats == nil {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	stats.errors = append(stats.errors, time.Now().Format("15:04:05")+" "+err.Error())
+	if len(stats.errors) > statsErrorLimit {
+		stats.errors = stats.errors[len(stats.errors)-statsErrorLimit:]
+	}
+}
+
+// segment is one chunk as the map draws it
+type segment struct {
+	Start, End, Offset int64
+	Status             string
+	Mirror             string
+}
+
+// segments reads where every chunk is. A chunk starts where the one before
+// it ended, the first at 0
+func (stats *downloadStats) segments() []segment {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	chunks := stats.chunks
+
+	segments := make([]segment, len(chunks))
+	var start int64
+	for i := range chunks {
+		end := chunks[i].End
+		segments[i] = segment{
+			Start:  start,
+			End:    end,
+			Offset: atomic.LoadInt64(&chunks[i].CurrentOffset),
+			Status: chunks[i].Status,
+			Mirror: chunks[i].Mirror,
+		}
+		// A chunk that didn't start yet hasn't got an end
+		if end >= start {
+			start = end + 1
+		}
+	}
+	return segments
+}
+
+// ----------------------------------------------- Segment map
+
+var segmentColors = map[string]fyne.ThemeColorName{
+	"Downloading": theme.ColorNamePrimary,
+	"Finished":    theme.ColorNameSuccess,
+	"Paused":      theme.ColorNameWarning,
+	"Failed":      theme.ColorNameError,
+}
+
+// segmentMap draws the chunks of a download side by side, each filled up
+// to its offset
+type segmentMap struct {
+	widget.BaseWidget
+	segments []segment
+}
+
+func newSegmentMap() *segmentMap {
+	m := &segmentMap{}
+	m.ExtendBaseWidget(m)
+	return m
+}
+
+func (m *segmentMap) set(segments []segment) {
+	m.segments = segments
+	m.Refresh()
+}
+
+func (m *segmentMap) CreateRenderer() fyne.WidgetRenderer {
+	return &segmentMapRenderer{m: m}
+}
+
+type segmentMapRenderer struct {
+	m       *segmentMap
+	objects []fyne.CanvasObject
+}
+
+func (r *segmentMapRenderer) Layout(size fyne.Size) {
+	segments := r.m.segments
+	if len(r.objects) != 2*len(segments) {
+		return
+	}
+	var total int64
+	for _, s := range segments {
+		total = max(total, s.End+1)
+	}
+	if total <= 0 {
+		return
+	}
+	x := func(offset int64) float32 {
+		return size.Width * float32(min(max(offset, 0), total)) / float32(total)
+	}
+	for i, s := range segments {
+		background, done := r.objects[2*i], r.objects[2*i+1]
+		start, end := x(s.Start), x(s.End+1)
+		// A pixel between the chunks
+		background.Move(fyne.NewPos(start, 0))
+		background.Resize(fyne.NewSize(max(end-start-1, 0), size.Height))
+		done.Move(fyne.NewPos(start, 0))
+		done.Resize(fyne.NewSize(min(max(x(s.Offset)-start, 0), max(end-start-1, 0)), size.Height))
+	}
+}
+
+func (r *segmentMapRenderer) MinSize() fyne.Size {
+	return fyne.NewSize(100, 24)
+}
+
+func (r *segmentMapRenderer) Refresh() {
+	r.objects = r.objects[:0]
+	for _, s := range r.m.segments {
+		fill := theme.Color(theme.ColorNameDisabled)
+		if name, ok := segmentColors[s.Status]; ok {
+			fill = theme.Color(name)
+		}
+		r.objects = append(r.objects, canvas.NewRectangle(theme.Color(theme.ColorNameInputBackground)), canvas.NewRectangle(fill))
+	}
+	r.Layout(r.m.Size())
+	canvas.Refresh(r.m)
+}
+
+func (r *segmentMapRenderer) Objects() []fyne.CanvasObject { return r.objects }
+func (r *segmentMapRenderer) Destroy()                     {}
+
+// ----------------------------------------------- Details pane
+
+// downloadDetails is the pane under the table, it follows one row
+type downloadDetails struct {
+	mu       sync.Mutex
+	row      *downloadRow
+	last     []int64 // offsets at the last refresh, for the speeds
+	lastTime time.Time
+
+	title       *widget.Label
+	segmentMap  *segmentMap
+	connections *widget.Label
+	info        *widget.Label
+	headers     *widget.Label
+	errors      *widget.Label
+	content     fyne.CanvasObject
+}
+
+func newDownloadDetails() *downloadDetails {
+	details := &downloadDetails{
+		title:       widget.NewLabelWithStyle("Click a download to see its details", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		segmentMap:  newSegmentMap(),
+		connections: widget.NewLabel(""),
+		info:        widget.NewLabel(""),
+		headers:     widget.NewLabel(""),
+		errors:      widget.NewLabel(""),
+	}
+	details.title.Truncation = fyne.TextTruncateEllipsis
+	details.headers.TextStyle = fyne.TextStyle{Monospace: true}
+	details.errors.Wrapping = fyne.TextWrapWord
+	tabs := container.NewAppTabs(
+		container.NewTabItem("Connections", container.NewVScroll(details.connections)),
+		container.NewTabItem("Headers", container.NewVScroll(details.headers)),
+		container.NewTabItem("Errors", container.NewVScroll(details.errors)),
+	)
+	top := container.NewVBox(details.title, details.segmentMap, details.info)
+	details.content = container.NewBorder(top, nil, nil, nil, tabs)
+	return details
+}
+
+// show makes the pane follow row
+func (details *downloadDetails) show(row *downloadRow) {
+	details.mu.Lock()
+	details.row = row
+	details.last = nil
+	details.mu.Unlock()
+	details.refresh()
+}
+
+// refresh reads the row again, it's called with the table's
+func (details *downloadDetails) refresh() {
+	details.mu.Lock()
+	defer details.mu.Unlock()
+	row := details.row
+	if row == nil {
+		return
+	}
+	stats := row.Stats
+	if stats == nil {
+		stats = &downloadStats{}
+	}
+	segments := stats.segments()
+	now := time.Now()
+	elapsed := now.Sub(details.lastTime).Seconds()
+
+	var lines []string
+	for i, s := range segments {
+		if s.End < s.Start {
+			lines = append(lines, fmt.Sprintf("#%d  waiting", i+1))
+			continue
+		}
+		speed := "-"
+		if len(details.last) == len(segments) && elapsed > 0 && s.Status == "Downloading" {
+			speed = "0 KB/s"
+			if rate := int64(float64(s.Offset-details.last[i]) / elapsed); rate > 0 {
+				speed = formatSize(rate) + "/s"
+			}
+		}
+		from := formatSize(s.Start)
+		if from == "" {
+			from = "0"
+		}
+		percent := float64(min(s.Offset, s.End+1)-s.Start) / float64(s.End-s.Start+1) * 100
+		line := fmt.Sprintf("#%d  %s - %s  %.0f%%  %s  %s", i+1, from, formatSize(s.End+1), percent, speed, s.Status)
+		if s.Mirror != "" {
+			if parsed, err := url.Parse(s.Mirror); err == nil {
+				line += "  " + parsed.Host
+			}
+		}
+		lines = append(lines, line)
+	}
+	details.last = details.last[:0]
+	for _, s := range segments {
+		details.last = append(details.last, s.Offset)
+	}
+	details.lastTime = now
+	if len(lines) == 0 {
+		lines = append(lines, "This download has no chunks to show")
+	}
+
+	stats.mu.Lock()
+	remoteIP, retries, response := stats.remoteIP, stats.retries, stats.response
+	var headerLines []string
+	for name, values := range stats.headers {
+		headerLines = append(headerLines, name+": "+strings.Join(values, ", "))
+	}
+	errors := slices.Clone(stats.errors)
+	stats.mu.Unlock()
+
+	slices.Sort(headerLines)
+	if response != "" {
+		headerLines = append([]string{response}, headerLines...)
+	}
+	if len(headerLines) == 0 {
+		headerLines = append(headerLines, "No response yet")
+	}
+	if remoteIP == "" {
+		remoteIP = "-"
+	}
+	if len(errors) == 0 {
+		errors = append(errors, "No errors")
+	}
+
+	details.title.SetText(row.Name)
+	details.segmentMap.set(segments)
+	details.info.SetText(fmt.Sprintf("Server: %s    Retries: %d    Connections: %d", remoteIP, retries, len(segments)))
+	details.connections.SetText(strings.Join(lines, "\n"))
+	details.headers.SetText(strings.Join(headerLines, "\n"))
+	details.errors.SetText(strings.Join(errors, "\n"))
+}
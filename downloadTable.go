@@ -0,0 +1,503 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// The current downloads are rows of a table. Downloads only change their
+// row, the table draws the rows it has on screen from them every so often.
+
+// downloadRow is what the table knows about a download
+type downloadRow struct {
+	ID          string
+	Name        string
+	Size        int64 // bytes, 0 when unknown
+	Progress    float64
+	Speed       string  // what the download last said, speed or otherwise
+	Rate        float64 // bytes per second
+	ETA         time.Duration
+	Status      string // Running, Paused, Finished, Corrupted, Failed
+	Connections int
+	Added       time.Time
+	Paused      bool
+	Done        bool // nothing left to pause or cancel
+	HasLog      bool
+	Selected    bool
+
+	// What the download does when the user asks, whoever runs it sets them
+	Pause  func()
+	Resume func()
+	Cancel func()
+
+	// What the details pane shows, nil when the download doesn't record any
+	Stats *downloadStats
+
+	table *downloadTable
+	speed rateEstimator
+}
+
+// The columns of the table, the first one picks the row
+var downloadColumns = []string{"", "Name", "Size", "Progress", "Speed", "ETA", "Status", "Conn.", "Added"}
+
+var downloadColumnWidths = []float32{36, 220, 80, 110, 110, 70, 90, 50, 90}
+
+// How often the table is redrawn while downloads change
+const tableRefresh = 500 * time.Millisecond
+
+// downloadTable is the model of the current downloads and the table showing it
+type downloadTable struct {
+	mu         sync.Mutex
+	rows       []*downloadRow // in the order they're shown
+	sortColumn int            // 0 keeps the order they were added in
+	descending bool
+	dirty      bool
+	widget     *widget.Table
+}
+
+// add puts a new row at the end, or where its sort puts it
+func (t *downloadTable) add(row *downloadRow) {
+	t.mu.Lock()
+	row.table = t
+	row.Added = time.Now()
+	row.Status = "Running"
+	t.rows = append(t.rows, row)
+	t.sortRows()
+	t.dirty = true
+	t.mu.Unlock()
+}
+
+func (t *downloadTable) remove(row *downloadRow) {
+	t.mu.Lock()
+	t.rows = slices.DeleteFunc(t.rows, func(other *downloadRow) bool { return other == row })
+	t.dirty = true
+	t.mu.Unlock()
+}
+
+// change edits a row under the table's lock
+func (t *downloadTable) change(row *downloadRow, edit func(row *downloadRow)) {
+	t.mu.Lock()
+	edit(row)
+	t.dirty = true
+	t.mu.Unlock()
+}
+
+// active tells whether the download id has a row that isn't done, it can
+// still write its files then
+func (t *downloadTable) active(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.ContainsFunc(t.rows, func(row *downloadRow) bool { return row.ID == id && !row.Done })
+}
+
+// selected returns the checked rows
+func (t *downloadTable) selected() []*downloadRow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var rows []*downloadRow
+	for _, row := range t.rows {
+		if row.Selected {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func (t *downloadTable) selectAll(selected bool) {
+	t.mu.Lock()
+	for _, row := range t.rows {
+		row.Selected = selected
+	}
+	t.dirty = true
+	t.mu.Unlock()
+}
+
+// totals adds up the downloads that are running, the eta is for all of them
+func (t *downloadTable) totals() (active int, rate float64, eta time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var remaining int64
+	for _, row := range t.rows {
+		if row.Paused || row.Done {
+			continue
+		}
+		active++
+		rate += row.Rate
+		if row.Size > 0 {
+			remaining += row.Size - int64(row.Progress*float64(row.Size))
+		}
+	}
+	return active, rate, estimateETA(remaining, rate)
+}
+
+// rates returns the speed of every running download
+func (t *downloadTable) rates() []downloadRate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var rates []downloadRate
+	for _, row := range t.rows {
+		if !row.Paused && !row.Done {
+			rates = append(rates, downloadRate{ID: row.ID, Name: row.Name, Rate: row.Rate})
+		}
+	}
+	return rates
+}
+
+// sortBy sorts on column, the same column again turns the order around
+func (t *downloadTable) sortBy(column int) {
+	t.mu.Lock()
+	if t.sortColumn == column {
+		t.descending = !t.descending
+	} else {
+		t.sortColumn, t.descending = column, false
+	}
+	t.sortRows()
+	t.dirty = true
+	t.mu.Unlock()
+}
+
+// sortRows sorts stably so equal rows keep their order, t.mu is held
+func (t *downloadTable) sortRows() {
+	if t.sortColumn == 0 {
+		slices.SortStableFunc(t.rows, func(a, b *downloadRow) int { return a.Added.Compare(b.Added) })
+		return
+	}
+	slices.SortStableFunc(t.rows, func(a, b *downloadRow) int {
+		order := compareRows(a, b, t.sortColumn)
+		if t.descending {
+			return -order
+		}
+		return order
+	})
+}
+
+func compareRows(a, b *downloadRow, column int) int {
+	compare := func(x, y float64) int {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	switch column {
+	case 1:
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	case 2:
+		return compare(float64(a.Size), float64(b.Size))
+	case 3:
+		return compare(a.Progress, b.Progress)
+	case 4:
+		return compare(a.Rate, b.Rate)
+	case 5:
+		// Unknown ETAs go last
+		etaA, etaB := a.ETA, b.ETA
+		if etaA <= 0 {
+			etaA = 1 << 62
+		}
+		if etaB <= 0 {
+			etaB = 1 << 62
+		}
+		return compare(float64(etaA), float64(etaB))
+	case 6:
+		return strings.Compare(a.Status, b.Status)
+	case 7:
+		return compare(float64(a.Connections), float64(b.Connections))
+	}
+	return a.Added.Compare(b.Added)
+}
+
+// ----------------------------------------------- Row
+
+// setProgress also works out the rate and what's left, from how much was
+// downloaded since the last second
+func (row *downloadRow) setProgress(value float64) {
+	row.table.change(row, func(row *downloadRow) {
+		row.Progress = value
+		if row.Size <= 0 {
+			return
+		}
+		downloaded := int64(value * float64(row.Size))
+		row.Rate = row.speed.update(downloaded, time.Now())
+		row.ETA = estimateETA(row.Size-downloaded, row.Rate)
+	})
+}
+
+// pause, resume and cancel are what the buttons do for a row
+func (row *downloadRow) pause() {
+	var pause func()
+	row.table.change(row, func(row *downloadRow) {
+		if row.Done || row.Paused || row.Pause == nil {
+			return
+		}
+		pause = row.Pause
+		row.Paused, row.Status, row.Rate, row.ETA = true, "Paused", 0, 0
+		row.speed.reset()
+	})
+	if pause != nil {
+		pause()
+	}
+}
+
+func (row *downloadRow) resume() {
+	var resume func()
+	row.table.change(row, func(row *downloadRow) {
+		if row.Done || !row.Paused || row.Resume == nil {
+			return
+		}
+		resume = row.Resume
+		row.Paused, row.Status = false, "Running"
+	})
+	if resume != nil {
+		resume()
+	}
+}
+
+func (row *downloadRow) cancel() {
+	var cancel func()
+	row.table.change(row, func(row *downloadRow) {
+		if !row.Done {
+			cancel = row.Cancel
+		}
+	})
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// setPaused shows the row paused or running, for downloads someone else paused
+func (row *downloadRow) setPaused(paused bool) {
+	row.table.change(row, func(row *downloadRow) {
+		row.Paused, row.Status = paused, map[bool]string{false: "Running", true: "Paused"}[paused]
+	})
+}
+
+func (row *downloadRow) isPaused() bool {
+	row.table.mu.Lock()
+	defer row.table.mu.Unlock()
+	return row.Paused
+}
+
+// ----------------------------------------------- UI
+
+func formatETA(eta time.Duration) string {
+	if eta <= 0 {
+		return ""
+	}
+	eta = eta.Round(time.Second)
+	if eta >= time.Hour {
+		return fmt.Sprintf("%dh%02dm", int(eta.Hours()), int(eta.Minutes())%60)
+	}
+	return fmt.Sprintf("%dm%02ds", int(eta.Minutes()), int(eta.Seconds())%60)
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size <= 0:
+		return ""
+	case size >= 1024*1024*1024:
+		return fmt.Sprintf("%.2f GB", float64(size)/1024/1024/1024)
+	case size < 1024*1024:
+		return fmt.Sprintf("%.0f KB", max(float64(size)/1024, 1))
+	}
+	return fmt.Sprintf("%.1f MB", float64(size)/1024/1024)
+}
+
+// cellText is what a text column shows for row
+func cellText(row *downloadRow, column int) string {
+	switch column {
+	case 1:
+		return row.Name
+	case 2:
+		return formatSize(row.Size)
+	case 4:
+		return strings.TrimPrefix(row.Speed, "Speed: ")
+	case 5:
+		if row.Paused || row.Done {
+			return ""
+		}
+		return formatETA(row.ETA)
+	case 6:
+		return row.Status
+	case 7:
+		if row.Connections == 0 {
+			return ""
+		}
+		return fmt.Sprint(row.Connections)
+	case 8:
+		if time.Since(row.Added) < 24*time.Hour {
+			return row.Added.Format("15:04")
+		}
+		return row.Added.Format("Jan 2")
+	}
+	return ""
+}
+
+// makeDownloadsTable builds the table and the buttons that act on the
+// checked rows
+func makeDownloadsTable(myapp *MyApp) *fyne.Container {
+	downloads := &downloadTable{}
+	myapp.Downloads = downloads
+
+	table := widget.NewTableWithHeaders(
+		func() (int, int) {
+			downloads.mu.Lock()
+			defer downloads.mu.Unlock()
+			return len(downloads.rows), len(downloadColumns)
+		},
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("")
+			label.Truncation = fyne.TextTruncateEllipsis
+			return container.NewStack(widget.NewCheck("", nil), label, widget.NewProgressBar())
+		},
+		func(id widget.TableCellID, cell fyne.CanvasObject) {
+			downloads.mu.Lock()
+			if id.Row >= len(downloads.rows) {
+				downloads.mu.Unlock()
+				return
+			}
+			row := downloads.rows[id.Row]
+			selected, progress, size, text := row.Selected, row.Progress, row.Size, cellText(row, id.Col)
+			downloads.mu.Unlock()
+
+			objects := cell.(*fyne.Container).Objects
+			check, label, bar := objects[0].(*widget.Check), objects[1].(*widget.Label), objects[2].(*widget.ProgressBar)
+			check.Hide()
+			label.Hide()
+			bar.Hide()
+			switch id.Col {
+			case 0:
+				check.OnChanged = nil
+				check.SetChecked(selected)
+				check.OnChanged = func(checked bool) {
+					downloads.change(row, func(row *downloadRow) { row.Selected = checked })
+				}
+				check.Show()
+			case 3:
+				bar.TextFormatter = func() string { return formatProgress(progress, size) }
+				bar.SetValue(progress)
+				bar.Show()
+			default:
+				label.SetText(text)
+				label.Show()
+			}
+		},
+	)
+	table.ShowHeaderColumn = false
+	table.CreateHeader = func() fyne.CanvasObject {
+		return widget.NewButton("", nil)
+	}
+	table.UpdateHeader = func(id widget.TableCellID, header fyne.CanvasObject) {
+		button := header.(*widget.Button)
+		column := id.Col
+		downloads.mu.Lock()
+		text := downloadColumns[column]
+		if column != 0 && column == downloads.sortColumn {
+			text += map[bool]string{false: " ▲", true: " ▼"}[downloads.descending]
+		}
+		downloads.mu.Unlock()
+		button.SetText(text)
+		button.Importance = widget.LowImportance
+		if column == 0 {
+			// Back to the order they were added in
+			button.SetIcon(theme.ViewRestoreIcon())
+		} else {
+			button.SetIcon(nil)
+		}
+		button.OnTapped = func() {
+			if column == 0 {
+				downloads.mu.Lock()
+				downloads.sortColumn, downloads.descending = 0, false
+				downloads.sortRows()
+				downloads.dirty = true
+				downloads.mu.Unlock()
+			} else {
+				downloads.sortBy(column)
+			}
+			table.Refresh()
+		}
+	}
+	for column, width := range downloadColumnWidths {
+		table.SetColumnWidth(column, width)
+	}
+	downloads.widget = table
+
+	details := newDownloadDetails()
+	table.OnSelected = func(id widget.TableCellID) {
+		downloads.mu.Lock()
+		if id.Row >= len(downloads.rows) {
+			downloads.mu.Unlock()
+			return
+		}
+		row := downloads.rows[id.Row]
+		downloads.mu.Unlock()
+		details.show(row)
+	}
+
+	// Bulk actions on the checked rows
+	each := func(action func(row *downloadRow)) func() {
+		return func() {
+			for _, row := range downloads.selected() {
+				action(row)
+			}
+			table.Refresh()
+		}
+	}
+	toolbar := container.NewHBox(
+		widget.NewButton("Select all", func() { downloads.selectAll(true); table.Refresh() }),
+		widget.NewButton("None", func() { downloads.selectAll(false); table.Refresh() }),
+		widget.NewButtonWithIcon("Pause", theme.MediaPauseIcon(), each((*downloadRow).pause)),
+		widget.NewButtonWithIcon("Resume", theme.MediaPlayIcon(), each((*downloadRow).resume)),
+		widget.NewButtonWithIcon("Cancel", theme.ContentClearIcon(), each((*downloadRow).cancel)),
+		widget.NewButtonWithIcon("Log", theme.DocumentIcon(), func() {
+			for _, row := range downloads.selected() {
+				if row.HasLog {
+					showDownloadLog(myapp, row.ID)
+				}
+			}
+		}),
+		widget.NewButtonWithIcon("Clear finished", resourceCheckSolidSvg, func() {
+			downloads.mu.Lock()
+			downloads.rows = slices.DeleteFunc(downloads.rows, func(row *downloadRow) bool { return row.Done })
+			downloads.dirty = true
+			downloads.mu.Unlock()
+			table.Refresh()
+		}),
+	)
+
+	// Redraw what changed, rather than on every progress update
+	go func() {
+		for range time.Tick(tableRefresh) {
+			downloads.mu.Lock()
+			dirty := downloads.dirty
+			downloads.dirty = false
+			if dirty && downloads.sortColumn != 0 {
+				downloads.sortRows()
+			}
+			downloads.mu.Unlock()
+			if dirty {
+				table.Refresh()
+			}
+			// The speeds of the connections change even when the rows don't
+			details.refresh()
+		}
+	}()
+
+	// The table sits in a VBox, it would be squeezed to one row otherwise
+	minSize := canvas.NewRectangle(color.Transparent)
+	minSize.SetMinSize(fyne.NewSize(300, 560))
+	split := container.NewVSplit(table, details.content)
+	split.Offset = 0.6
+	return container.NewStack(minSize, container.NewBorder(toolbar, nil, nil, nil, split))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpSource downloads from ftp:// (plain), ftps:// (implicit TLS, port 990)
+// and ftpes:// (explicit AUTH TLS, port 21) servers.
+// Every range gets its own control connection because FTP can only run one
+// transfer per connection, REST is used to start at the chunk offset.
+type ftpSource struct{}
+
+func (s *ftpSource) Probe(ctx context.Context, rawURL string) (FileInfo, error) {
+	conn, filePath, err := dialFTP(ctx, rawURL)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer conn.Quit()
+
+	// SIZE is needed to split the file into chunks
+	total, err := conn.FileSize(filePath)
+	if err != nil {
+		logger.Printf("Failed to get file size: %v\n", err)
+		return FileInfo{}, fmt.Errorf("failed to get file size: %v", err)
+	}
+
+	fileName := sanitizeFileName(path.Base(filePath))
+	if fileName == "" || fileName == "." || fileName == "_" {
+		fileName = "unknown_file"
+	}
+
+	return FileInfo{
+		FileName: fileName,
+		FileSize: float64(total) / (1024 * 1024),
+		Total:    int(total),
+	}, nil
+}
+
+func (s *ftpSource) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	conn, filePath, err := dialFTP(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// REST + RETR starts the transfer at the chunk offset
+	resp, err := conn.RetrFrom(filePath, uint64(start))
+	if err != nil {
+		conn.Quit()
+		logger.Printf("Error starting the download: %v\n", err)
+		return nil, fmt.Errorf("error starting the download: %v", err)
+	}
+
+	// Unblock a pending read when the download gets paused or cancelled
+	stop := context.AfterFunc(ctx, func() {
+		resp.SetDeadline(time.Now())
+	})
+
+	return &ftpRangeReader{
+		Reader: io.LimitReader(resp, end-start+1),
+		ctx:    ctx,
+		resp:   resp,
+		conn:   conn,
+		stop:   stop,
+	}, nil
+}
+
+// ftpRangeReader stops reading at the end of the chunk and closes both the
+// data and the control connection when the chunk is done.
+type ftpRangeReader struct {
+	io.Reader
+	ctx  context.Context
+	resp *ftp.Response
+	conn *ftp.ServerConn
+	stop func() bool
+}
+
+func (r *ftpRangeReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	if err != nil && r.ctx.Err() != nil {
+		// the deadline set on cancel shows up as a timeout, report the cancel instead
+		return n, r.ctx.Err()
+	}
+	return n, err
+}
+
+func (r *ftpRangeReader) Close() error {
+	r.stop()
+	// The server answers an aborted transfer with 426, that's expected here
+	// since most chunks stop before the end of the file.
+	r.resp.SetDeadline(time.Now().Add(5 * time.Second))
+	r.resp.Close()
+	return r.conn.Quit()
+}
+
+// dialFTP connects and logs in to the server in rawURL and returns the path of the file
+func dialFTP(ctx context.Context, rawURL string) (*ftp.ServerConn, string, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid url: %v", err)
+	}
+	scheme := strings.ToLower(parsedURL.Scheme)
+
+	host := parsedURL.Hostname()
+	port := parsedURL.Port()
+	if port == "" {
+		port = "21"
+		if scheme == "ftps" {
+			port = "990"
+		}
+	}
+
+	options := []ftp.DialOption{
+		ftp.DialWithContext(ctx),
+		ftp.DialWithTimeout(30 * time.Second),
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	switch scheme {
+	case "ftps":
+		options = append(options, ftp.DialWithTLS(tlsConfig))
+	case "ftpes":
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+
+	conn, err := ftp.Dial(net.JoinHostPort(host, port), options...)
+	if err != nil {
+		logger.Printf("Error connecting to ftp server: %v\n", err)
+		return nil, "", fmt.Errorf("error connecting to ftp server: %v", err)
+	}
+
+	// Anonymous login unless the url has credentials
+	user, password := "anonymous", "anonymous"
+	if parsedURL.User != nil {
+		user = parsedURL.User.Username()
+		password, _ = parsedURL.User.Password()
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, "", fmt.Errorf("ftp login failed: %v", err)
+	}
+
+	return conn, parsedURL.Path, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFTPServer is a plain FTP server with what the client needs to log in
+// and download: FEAT, SIZE, EPSV, REST and RETR. It keeps the REST offsets
+// it was sent. Files under /stalled never send any data.
+type testFTPServer struct {
+	addr  string
+	files map[string][]byte
+
+	mu       sync.Mutex
+	restarts []int64
+}
+
+func startTestFTPServer(t *testing.T, files map[string][]byte) *testFTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testFTPServer{addr: listener.Addr().String(), files: files}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serveConn(conn)
+		}
+	}()
+	return server
+}
+
+func (server *testFTPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("220 ready")
+
+	var dataListener net.Listener
+	defer func() {
+		if dataListener != nil {
+			dataListener.Close()
+		}
+	}()
+	var offset int64
+	lines := bufio.NewScanner(conn)
+	for lines.Scan() {
+		command, argument, _ := strings.Cut(strings.TrimRight(lines.Text(), "\r"), " ")
+		switch strings.ToUpper(command) {
+		case "USER":
+			reply("331 password please")
+		case "PASS":
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n REST STREAM\r\n211 End")
+		case "TYPE":
+			reply("200 binary it is")
+		case "SIZE":
+			content, ok := server.files[argument]
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", len(content))
+		case "EPSV":
+			if dataListener != nil {
+				dataListener.Close()
+			}
+			var err error
+			if dataListener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 can't open a data connection")
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", dataListener.Addr().(*net.TCPAddr).Port)
+		case "REST":
+			var err error
+			if offset, err = strconv.ParseInt(argument, 10, 64); err != nil {
+				reply("501 bad offset")
+				continue
+			}
+			server.mu.Lock()
+			server.restarts = append(server.restarts, offset)
+			server.mu.Unlock()
+			reply("350 restarting at %d", offset)
+		case "RETR":
+			content, ok := server.files[argument]
+			if !ok || dataListener == nil {
+				reply("550 no such file")
+				continue
+			}
+			reply("150 sending")
+			data, err := dataListener.Accept()
+			if err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			if strings.HasPrefix(argument, "/stalled") {
+				// Wait for the client to give up
+				io.Copy(io.Discard, data)
+				err = errors.New("aborted")
+			} else {
+				_, err = data.Write(content[min(offset, int64(len(content))):])
+			}
+			data.Close()
+			offset = 0
+			if err != nil {
+				reply("426 transfer aborted")
+				continue
+			}
+			reply("226 done")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (server *testFTPServer) url(filePath string) string {
+	return "ftp://" + server.addr + filePath
+}
+
+func (server *testFTPServer) restartOffsets() []int64 {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]int64(nil), server.restarts...)
+}
+
+func TestFTPProbe(t *testing.T) {
+	content := testSFTPContent(300_001)
+	server := startTestFTPServer(t, map[string][]byte{"/files/data.bin": content})
+
+	info, err := (&ftpSource{}).Probe(context.Background(), server.url("/files/data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Total != len(content) {
+		t.Errorf("Total = %d, want %d", info.Total, len(content))
+	}
+	if info.FileName != "data.bin" {
+		t.Errorf("FileName = %q, want %q", info.FileName, "data.bin")
+	}
+
+	if _, err := (&ftpSource{}).Probe(context.Background(), server.url("/files/missing.bin")); err == nil {
+		t.Error("Probe of a missing file succeeded")
+	}
+}
+
+func TestFTPOpenRange(t *testing.T) {
+	content := testSFTPContent(1_000_003)
+	server := startTestFTPServer(t, map[string][]byte{"/data.bin": content})
+
+	tests := []struct {
+		name       string
+		start, end int64
+	}{
+		{"whole file", 0, int64(len(content)) - 1},
+		{"start of the file", 0, 65535},
+		{"middle", 12345, 654321},
+		{"one byte", 999, 999},
+		{"last bytes", int64(len(content)) - 7, int64(len(content)) - 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := (&ftpSource{}).OpenRange(context.Background(), server.url("/data.bin"), test.start, test.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content[test.start:test.end+1]) {
+				t.Errorf("got %d bytes, want %d bytes of the range", len(got), test.end-test.start+1)
+			}
+		})
+	}
+}
+
+// Every chunk starts its transfer with REST at its own offset
+func TestFTPChunks(t *testing.T) {
+	content := testSFTPContent(400_000)
+	server := startTestFTPServer(t, map[string][]byte{"/data.bin": content})
+
+	const chunks = 4
+	size := int64(len(content)) / chunks
+	var got []byte
+	var wantRestarts []int64
+	for i := range chunks {
+		start := int64(i) * size
+		reader, err := (&ftpSource{}).OpenRange(context.Background(), server.url("/data.bin"), start, start+size-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, part...)
+		if start > 0 {
+			wantRestarts = append(wantRestarts, start)
+		}
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Error("the chunks don't add up to the file")
+	}
+	if restarts := server.restartOffsets(); fmt.Sprint(restarts) != fmt.Sprint(wantRestarts) {
+		t.Errorf("REST offsets = %v, want %v", restarts, wantRestarts)
+	}
+}
+
+// Pausing a chunk stuck waiting on the server stops it, without the download being cancelled
+func TestFTPPause(t *testing.T) {
+	server := startTestFTPServer(t, map[string][]byte{"/stalled.bin": testSFTPContent(1000)})
+
+	outFile, err := os.Create(filepath.Join(t.TempDir(), "stalled.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outFile.Close()
+
+	ctxP, pause := context.WithCancel(context.Background())
+	chunkSlice := []Chunk{{}}
+	var downloaded int64
+	done := make(chan error, 1)
+	go func() {
+		done <- downloadChunk(http.DefaultClient, context.Background(), ctxP, server.url("/stalled.bin"), 0, 999, outFile, &downloaded, chunkSlice, 0)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	pause()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("downloadChunk returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the chunk didn't stop after the pause")
+	}
+	if chunkSlice[0].Status != "Paused" {
+		t.Errorf("chunk status = %q, want Paused", chunkSlice[0].Status)
+	}
+}
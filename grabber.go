@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"golang.org/x/net/html"
+)
+
+// The link grabber reads a web page and offers the files it links to, from
+// a, img, video and source tags. It can follow the page's links to other
+// pages of the same site, one level deep.
+
+// Pages bigger than this aren't read to the end
+const maxPageSize = 10 * 1024 * 1024
+
+// Pages followed from the first one, at most
+const maxFollowedPages = 50
+
+// grabbedLink is a link found on a page
+type grabbedLink struct {
+	URL string
+	Tag string // a, img, video or source
+}
+
+// extractLinks returns the links of the page at pageURL, resolved against
+// its <base> when it has one. Each link is there once, in page order.
+func extractLinks(page io.Reader, pageURL *url.URL) ([]grabbedLink, error) {
+	base := pageURL
+	var raw []grabbedLink
+	tokenizer := html.NewTokenizer(page)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if tokenizer.Err() != io.EOF {
+				return nil, tokenizer.Err()
+			}
+			return resolveLinks(raw, base), nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "base":
+				// Only the first <base> counts
+				if href := attribute(token, "href"); href != "" && base == pageURL {
+					if resolved, err := pageURL.Parse(href); err == nil {
+						base = resolved
+					}
+				}
+			case "a":
+				raw = append(raw, grabbedLink{URL: attribute(token, "href"), Tag: "a"})
+			case "img", "video", "source":
+				raw = append(raw, grabbedLink{URL: attribute(token, "src"), Tag: token.Data})
+				// The first candidate of a srcset, the others are the same picture
+				if srcset := strings.Fields(attribute(token, "srcset")); len(srcset) > 0 {
+					raw = append(raw, grabbedLink{URL: strings.TrimSuffix(srcset[0], ","), Tag: token.Data})
+				}
+			}
+		}
+	}
+}
+
+func attribute(token html.Token, name string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == name {
+			return strings.TrimSpace(attr.Val)
+		}
+	}
+	return ""
+}
+
+// resolveLinks makes the links absolute and drops the ones that aren't files
+func resolveLinks(raw []grabbedLink, base *url.URL) []grabbedLink {
+	var links []grabbedLink
+	seen := map[string]bool{}
+	for _, link := range raw {
+		if link.URL == "" || strings.HasPrefix(link.URL, "#") {
+			continue
+		}
+		resolved, err := base.Parse(link.URL)
+		if err != nil {
+			continue
+		}
+		switch resolved.Scheme {
+		case "http", "https", "ftp", "sftp":
+		default:
+			continue // javascript:, mailto:, data:...
+		}
+		resolved.Fragment = ""
+		link.URL = resolved.String()
+		if !seen[link.URL] {
+			seen[link.URL] = true
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// fetchPage downloads an html page and returns its links
+func fetchPage(ctx context.Context, client *http.Client, pageURL string) ([]grabbedLink, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{Code: response.StatusCode}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("%s isn't a web page (%s)", pageURL, mediaType)
+	}
+	// Relative links are relative to where the redirects ended
+	return extractLinks(io.LimitReader(response.Body, maxPageSize), response.Request.URL)
+}
+
+// grabLinks returns the links of pageURL and, with follow, of the pages of
+// the same site it links to
+func grabLinks(ctx context.Context, client *http.Client, pageURL string, follow bool) ([]grabbedLink, error) {
+	links, err := fetchPage(ctx, client, pageURL)
+	if err != nil || !follow {
+		return links, err
+	}
+
+	start, _ := url.Parse(pageURL)
+	var pages []string
+	for _, link := range links {
+		if link.Tag == "a" && isSubpage(start, link.URL) && len(pages) < maxFollowedPages {
+			pages = append(pages, link.URL)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	found := make([][]grabbedLink, len(pages))
+	slots := make(chan struct{}, 4)
+	for i, page := range pages {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			// A followed page that doesn't load just has no links
+			pageLinks, err := fetchPage(ctx, client, page)
+			if err != nil {
+				logger.Println("Error grabbing", page+":", err)
+			}
+			mu.Lock()
+			found[i] = pageLinks
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, link := range links {
+		seen[link.URL] = true
+	}
+	for _, pageLinks := range found {
+		for _, link := range pageLinks {
+			if !seen[link.URL] {
+				seen[link.URL] = true
+				links = append(links, link)
+			}
+		}
+	}
+	return links, nil
+}
+
+// isSubpage tells if link looks like another page of start's site
+func isSubpage(start *url.URL, link string) bool {
+	parsed, err := url.Parse(link)
+	if err != nil || start == nil || parsed.Host != start.Host {
+		return false
+	}
+	switch strings.ToLower(path.Ext(parsed.Path)) {
+	case "", ".html", ".htm", ".php", ".asp", ".aspx", ".jsp":
+		return true
+	}
+	return false
+}
+
+// linkFilter picks the links worth downloading
+type linkFilter struct {
+	Patterns string         // extensions or globs like the clipboard's, empty for all
+	Regex    *regexp.Regexp // nil for all
+	MinSize  float64        // MB, 0 for no limit
+	MaxSize  float64        // MB, 0 for no limit
+}
+
+// match is checked before probing, the size after
+func (filter linkFilter) match(link grabbedLink) bool {
+	if filter.Patterns != "" && !matchesPatterns(link.URL, filter.Patterns) {
+		return false
+	}
+	return filter.Regex == nil || filter.Regex.MatchString(link.URL)
+}
+
+func (filter linkFilter) checkSize(fileInfo FileInfo) error {
+	// An unknown size isn't held against the file
+	if fileInfo.FileSize <= 0 {
+		return nil
+	}
+	if filter.MinSize > 0 && fileInfo.FileSize < filter.MinSize {
+		return fmt.Errorf("smaller than %g MB", filter.MinSize)
+	}
+	if filter.MaxSize > 0 && fileInfo.FileSize > filter.MaxSize {
+		return fmt.Errorf("bigger than %g MB", filter.MaxSize)
+	}
+	return nil
+}
+
+// ----------------------------------------------- UI
+
+func GrabLinksFunc(myapp *MyApp) func() {
+	return func() {
+		showGrabLinks(myapp)
+	}
+}
+
+// showGrabLinks asks for the page and how to filter its links
+func showGrabLinks(myapp *MyApp) {
+	pageEntry := widget.NewEntry()
+	pageEntry.SetPlaceHolder("https://example.com/files/")
+	followCheck := widget.NewCheck("Also the pages it links to (same site)", nil)
+	patternsEntry := widget.NewEntry()
+	patternsEntry.SetPlaceHolder("e.g. zip pdf, empty for all")
+	patternsEntry.SetText(myapp.App.Preferences().StringWithFallback(prefClipboardPatterns, defaultClipboardPatterns))
+	regexEntry := widget.NewEntry()
+	regexEntry.SetPlaceHolder("optional, matched against the url")
+	minSizeEntry := widget.NewEntry()
+	minSizeEntry.SetPlaceHolder("MB, optional")
+	maxSizeEntry := widget.NewEntry()
+	maxSizeEntry.SetPlaceHolder("MB, optional")
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("Page", pageEntry),
+		widget.NewFormItem("", followCheck),
+		widget.NewFormItem("Links", patternsEntry),
+		widget.NewFormItem("Regex", regexEntry),
+		widget.NewFormItem("Min size", minSizeEntry),
+		widget.NewFormItem("Max size", maxSizeEntry),
+	}
+	form := dialog.NewForm("Grab links", "Grab", "Cancel", items, func(confirm bool) {
+		if !confirm || strings.TrimSpace(pageEntry.Text) == "" {
+			return
+		}
+		filter := linkFilter{Patterns: strings.TrimSpace(patternsEntry.Text)}
+		if regexEntry.Text != "" {
+			regex, err := regexp.Compile(regexEntry.Text)
+			if err != nil {
+				myapp.showError(fmt.Errorf("invalid regex: %v", err))
+				return
+			}
+			filter.Regex = regex
+		}
+		filter.MinSize, _ = strconv.ParseFloat(strings.TrimSpace(minSizeEntry.Text), 64)
+		filter.MaxSize, _ = strconv.ParseFloat(strings.TrimSpace(maxSizeEntry.Text), 64)
+
+		go grabAndReview(myapp, strings.TrimSpace(pageEntry.Text), followCheck.Checked, filter)
+	}, myapp.MainWindow)
+	form.Resize(fyne.NewSize(480, 0))
+	form.Show()
+}
+
+// grabAndReview fetches the page and shows the links that passed the filter
+func grabAndReview(myapp *MyApp, pageURL string, follow bool, filter linkFilter) {
+	ctx, cancel := context.WithTimeout(myapp.AppContext, 2*time.Minute)
+	defer cancel()
+	progress := dialog.NewCustomWithoutButtons("Grabbing links", container.NewVBox(
+		widget.NewLabel(pageURL),
+		widget.NewProgressBarInfinite(),
+		widget.NewButtonWithIcon("Cancel", theme.CancelIcon(), cancel),
+	), myapp.MainWindow)
+	progress.Show()
+
+	links, err := grabLinks(ctx, myapp.clientFor(nil, pageURL), pageURL, follow)
+	progress.Hide()
+	if err != nil {
+		if ctx.Err() != context.Canceled {
+			myapp.showError(fmt.Errorf("couldnt grab the links: %v", err))
+		}
+		return
+	}
+
+	var entries []*batchEntry
+	for _, link := range links {
+		if filter.match(link) {
+			// Some sites only hand files to their own pages
+			entries = append(entries, &batchEntry{URL: link.URL, Headers: &Headers{Referer: pageURL}})
+		}
+	}
+	if len(entries) == 0 {
+		dialog.ShowInformation("Grab links", fmt.Sprintf("Found %d links, none of them passed the filter.", len(links)), myapp.MainWindow)
+		return
+	}
+	showBatchReview(myapp, entries, filter.checkSize)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestExtractLinks(t *testing.T) {
+	tests := []struct {
+		page    string // in testdata
+		pageURL string
+		want    []grabbedLink
+	}{
+		{
+			page:    "base.html",
+			pageURL: "https://example.com/downloads/index.html",
+			want: []grabbedLink{
+				{URL: "https://example.com/mirror/releases/app-1.0.tar.gz", Tag: "a"},
+				{URL: "https://example.com/mirror/old/app-0.9.tar.gz", Tag: "a"},
+				{URL: "https://example.com/checksums.txt", Tag: "a"},
+				{URL: "https://cdn.example.net/app-1.0.zip", Tag: "a"},
+				{URL: "https://github.com/example/app", Tag: "a"},
+			},
+		},
+		{
+			page:    "relative.html",
+			pageURL: "https://mirror.example.com/pub/iso/",
+			want: []grabbedLink{
+				{URL: "https://mirror.example.com/pub/", Tag: "a"},
+				{URL: "https://mirror.example.com/pub/iso/debian.iso", Tag: "a"},
+				{URL: "https://mirror.example.com/pub/iso/ubuntu.iso", Tag: "a"},
+				{URL: "https://mirror.example.com/pub/iso/sub/fedora.iso", Tag: "a"},
+				{URL: "https://mirror.example.com/pub/iso/?C=M;O=A", Tag: "a"},
+				{URL: "https://mirror.example.com/pub/iso/Arch.ISO", Tag: "a"},
+			},
+		},
+		{
+			page:    "srcset.html",
+			pageURL: "https://example.com/gallery/",
+			want: []grabbedLink{
+				{URL: "https://example.com/gallery/thumb.jpg", Tag: "img"},
+				{URL: "https://example.com/gallery/photo-1x.jpg", Tag: "img"},
+				{URL: "https://example.com/gallery/wide.jpg", Tag: "img"},
+				{URL: "https://example.com/gallery/photo.webp", Tag: "source"},
+				{URL: "https://example.com/media/clip.mp4", Tag: "video"},
+				{URL: "https://example.com/media/clip.webm", Tag: "source"},
+			},
+		},
+		{
+			page:    "schemes.html",
+			pageURL: "http://example.com/files/",
+			want: []grabbedLink{
+				{URL: "ftp://ftp.example.com/pub/file.tar.xz", Tag: "a"},
+				{URL: "sftp://files.example.com/home/share/file.bin", Tag: "a"},
+				{URL: "http://example.com/files/file.zip", Tag: "a"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.page, func(t *testing.T) {
+			page, err := os.Open(filepath.Join("testdata", test.page))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer page.Close()
+			pageURL, err := url.Parse(test.pageURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			links, err := extractLinks(page, pageURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(links, test.want) {
+				t.Errorf("got links\n%v\nwant\n%v", links, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// The history tab lists every download in the database, finished or not,
+// newest first. It's read again whenever the tab is opened.
+
+// historyFilter is what the user narrowed the history down to
+type historyFilter struct {
+	Query    string // words that all have to be in the name or the url
+	Status   string // "" for any
+	Since    time.Time
+	Category string // "" for any
+}
+
+const anyChoice = "Any"
+
+var historyPeriods = map[string]time.Duration{
+	"Today":        24 * time.Hour,
+	"Last 7 days":  7 * 24 * time.Hour,
+	"Last 30 days": 30 * 24 * time.Hour,
+}
+
+func (filter historyFilter) match(download Download) bool {
+	if filter.Status != "" && download.Status != filter.Status {
+		return false
+	}
+	if filter.Category != "" && categoryOf(download.FileName) != filter.Category {
+		return false
+	}
+	if !filter.Since.IsZero() && storedTime(download.CreatedAt).Before(filter.Since) {
+		return false
+	}
+	text := strings.ToLower(download.FileName + " " + download.URL)
+	for _, word := range strings.Fields(strings.ToLower(filter.Query)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// storedTime parses the dates of the database, they're saved with
+// time.Time.String. Broken ones are the zero time
+func storedTime(value string) time.Time {
+	// The monotonic clock reading means nothing after a restart
+	value, _, _ = strings.Cut(value, " m=")
+	// Zone names are made up by the OS, the offset is enough
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+	parsed, err := time.Parse("2006-01-02 15:04:05.999999999 -0700", strings.Join(fields[:3], " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return parsed
+}
+
+// historyDownloads returns the downloads that pass filter, newest first
+func historyDownloads(databasePath string, filter historyFilter) ([]Download, error) {
+	downloads, _, err := loadDatabase(databasePath)
+	if err != nil {
+		return nil, err
+	}
+	var matching []Download
+	for _, download := range downloads {
+		if filter.match(download) {
+			matching = append(matching, download)
+		}
+	}
+	slices.SortStableFunc(matching, func(a, b Download) int {
+		return storedTime(b.CreatedAt).Compare(storedTime(a.CreatedAt))
+	})
+	return matching, nil
+}
+
+// redownload gets the file of download again, into the same folder
+func redownload(myapp *MyApp, download Download) error {
+	fileInfo, err := getFileInfo(myapp.clientFor(download.Headers, download.URL), download.URL)
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Stat(filepath.Dir(download.FilePath)); err == nil && stat.IsDir() {
+		if err := fileInfo.saveTo(filepath.Dir(download.FilePath)); err != nil {
+			return err
+		}
+	}
+	fileInfo.Headers = download.Headers
+	fileInfo.Actions = download.Actions
+	// The same quality as last time, the best when it's gone
+	if download.Stream != nil {
+		fileInfo.Stream = download.Stream
+	}
+	startDownload(myapp, download.URL, fileInfo)
+	return nil
+}
+
+// deleteRecord forgets download, and with files what it downloaded
+func deleteRecord(myapp *MyApp, download Download, files bool) error {
+	if remote := myapp.remote(); remote != nil {
+		return remote.remove(download.ID, files)
+	}
+	// Its row would resume or write into what's deleted
+	if myapp.Downloads != nil && myapp.Downloads.active(download.ID) {
+		return fmt.Errorf("%s is still in the current downloads, cancel it there first", download.FileName)
+	}
+	if err := removeDownload(myapp.DownloadStateFilePath, download.ID); err != nil {
+		return err
+	}
+	if files {
+		// What an extracted archive left
+		if stat, err := os.Stat(download.FilePath); err == nil && stat.IsDir() {
+			return removeDownloadFolder(download.FilePath)
+		}
+		return deleteDownloadFiles(download)
+	}
+	return nil
+}
+
+// ----------------------------------------------- UI
+
+// makeHistoryTab builds the history, refresh reads the database again
+func makeHistoryTab(myapp *MyApp) (content fyne.CanvasObject, refresh func()) {
+	var downloads []Download
+	filter := historyFilter{}
+
+	searchEntry := widget.NewEntry()
+	searchEntry.SetPlaceHolder("Search names and urls...")
+	statusSelect := widget.NewSelect([]string{anyChoice, "Finished", "Paused", "Corrupted", "Watching"}, nil)
+	statusSelect.SetSelected(anyChoice)
+	periodSelect := widget.NewSelect([]string{anyChoice, "Today", "Last 7 days", "Last 30 days"}, nil)
+	periodSelect.SetSelected(anyChoice)
+	categorySelect := widget.NewSelect(append([]string{anyChoice}, categoryNames()...), nil)
+	categorySelect.SetSelected(anyChoice)
+	countLabel := widget.NewLabel("")
+
+	var list *widget.List
+	refresh = func() {
+		filter.Query = searchEntry.Text
+		filter.Status = strings.TrimPrefix(statusSelect.Selected, anyChoice)
+		filter.Category = strings.TrimPrefix(categorySelect.Selected, anyChoice)
+		filter.Since = time.Time{}
+		if period, ok := historyPeriods[periodSelect.Selected]; ok {
+			filter.Since = time.Now().Add(-period)
+		}
+		var err error
+		downloads, err = historyDownloads(myapp.DownloadStateFilePath, filter)
+		if err != nil {
+			logger.Println("Error loading the history:", err)
+		}
+		countLabel.SetText(fmt.Sprintf("%d downloads", len(downloads)))
+		list.UnselectAll()
+		list.Refresh()
+	}
+	searchEntry.OnChanged = func(string) { refresh() }
+	statusSelect.OnChanged = func(string) { refresh() }
+	periodSelect.OnChanged = func(string) { refresh() }
+	categorySelect.OnChanged = func(string) { refresh() }
+
+	list = widget.NewList(
+		func() int { return len(downloads) },
+		func() fyne.CanvasObject {
+			name := widget.NewLabelWithStyle("", fyne.TextAlignLeading, fyne.TextStyle{Bold: true})
+			name.Truncation = fyne.TextTruncateEllipsis
+			details := widget.NewLabel("")
+			details.Truncation = fyne.TextTruncateEllipsis
+			buttons := container.NewHBox(
+				widget.NewButtonWithIcon("", theme.FileIcon(), nil),
+				widget.NewButtonWithIcon("", theme.FolderOpenIcon(), nil),
+				widget.NewButtonWithIcon("", theme.ContentCopyIcon(), nil),
+				widget.NewButtonWithIcon("", theme.ViewRefreshIcon(), nil),
+				widget.NewButtonWithIcon("", theme.DeleteIcon(), nil),
+			)
+			return container.NewBorder(nil, nil, nil, buttons, container.NewVBox(name, details))
+		},
+		func(id widget.ListItemID, item fyne.CanvasObject) {
+			if id >= len(downloads) {
+				return
+			}
+			download := downloads[id]
+			row := item.(*fyne.Container)
+			labels := row.Objects[0].(*fyne.Container).Objects
+			labels[0].(*widget.Label).SetText(download.FileName)
+			labels[1].(*widget.Label).SetText(historyDetails(download))
+
+			buttons := row.Objects[1].(*fyne.Container).Objects
+			buttons[0].(*widget.Button).OnTapped = func() {
+				if err := openPath(download.FilePath); err != nil {
+					myapp.showError(err)
+				}
+			}
+			buttons[1].(*widget.Button).OnTapped = func() {
+				if err := revealPath(download.FilePath); err != nil {
+					myapp.showError(err)
+				}
+			}
+			buttons[2].(*widget.Button).OnTapped = func() {
+				myapp.MainWindow.Clipboard().SetContent(download.URL)
+			}
+			buttons[3].(*widget.Button).OnTapped = func() {
+				go func() {
+					if err := redownload(myapp, download); err != nil {
+						myapp.showError(fmt.Errorf("couldnt download %s again: %v", download.FileName, err))
+					}
+				}()
+			}
+			buttons[4].(*widget.Button).OnTapped = func() {
+				confirmDeleteRecord(myapp, download, refresh)
+			}
+			// Files that are gone can't be opened
+			_, err := os.Stat(download.FilePath)
+			for _, button := range buttons[:2] {
+				if errors.Is(err, os.ErrNotExist) {
+					button.(*widget.Button).Disable()
+				} else {
+					button.(*widget.Button).Enable()
+				}
+			}
+		},
+	)
+
+	filters := container.NewBorder(nil, nil, nil, container.NewHBox(statusSelect, periodSelect, categorySelect), searchEntry)
+	refreshButton := widget.NewButtonWithIcon("", theme.ViewRefreshIcon(), func() { refresh() })
+	top := container.NewVBox(filters, container.NewBorder(nil, nil, nil, refreshButton, countLabel))
+
+	// The tab sits in a VBox, it would be squeezed to one row otherwise
+	minSize := canvas.NewRectangle(color.Transparent)
+	minSize.SetMinSize(fyne.NewSize(300, 400))
+	return container.NewStack(minSize, container.NewBorder(top, nil, nil, nil, list)), refresh
+}
+
+func historyDetails(download Download) string {
+	parts := []string{download.Status}
+	if download.TotalSize > 0 {
+		parts = append(parts, fmt.Sprintf("%.1f MB", float64(download.TotalSize)/1024/1024))
+	}
+	if added := storedTime(download.CreatedAt); !added.IsZero() {
+		parts = append(parts, added.Local().Format("2006-01-02 15:04"))
+	}
+	parts = append(parts, categoryOf(download.FileName), download.URL)
+	return strings.Join(parts, " · ")
+}
+
+// confirmDeleteRecord asks whether the file goes too
+func confirmDeleteRecord(myapp *MyApp, download Download, done func()) {
+	deleteFiles := widget.NewCheck("Also delete the downloaded file", nil)
+	dialog.ShowCustomConfirm("Delete "+download.FileName, "Delete", "Cancel",
+		container.NewVBox(widget.NewLabel("It's removed from the history."), deleteFiles),
+		func(confirm bool) {
+			if !confirm {
+				return
+			}
+			if err := deleteRecord(myapp, download, deleteFiles.Checked); err != nil {
+				myapp.showError(fmt.Errorf("couldnt delete %s: %v", download.FileName, err))
+			}
+			done()
+		}, myapp.MainWindow)
+}
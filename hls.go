@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var hlsAttribute = regexp.MustCompile(`([A-Z0-9-]+)=("[^"]*"|[^,]*)`)
+
+// parseHLSAttributes reads an attribute list like BANDWIDTH=1280000,URI="a.key"
+func parseHLSAttributes(line string) map[string]string {
+	attributes := map[string]string{}
+	for _, match := range hlsAttribute.FindAllStringSubmatch(line, -1) {
+		attributes[match[1]] = strings.Trim(match[2], `"`)
+	}
+	return attributes
+}
+
+// parseHLSVariants lists the variants of a master playlist.
+// A media playlist is returned as its only variant.
+func parseHLSVariants(playlist []byte, playlistURL string) ([]StreamVariant, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(playlist), []byte("#EXTM3U")) {
+		return nil, errors.New("not an m3u8 playlist")
+	}
+
+	var variants []StreamVariant
+	var audioGroups []string // of the variants, in the same order
+	// Alternate audio by GROUP-ID, the default rendition or else the first
+	audio := map[string]map[string]string{}
+	var pending map[string]string
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA:"):
+			attributes := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-MEDIA:"))
+			// Renditions without a URI are in the variant's own stream
+			if attributes["TYPE"] != "AUDIO" || attributes["URI"] == "" {
+				continue
+			}
+			group := attributes["GROUP-ID"]
+			if _, found := audio[group]; !found || attributes["DEFAULT"] == "YES" {
+				audio[group] = attributes
+			}
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			pending = parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-STREAM-INF:"))
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case pending != nil:
+			// The uri line right after EXT-X-STREAM-INF
+			bandwidth, _ := strconv.Atoi(pending["BANDWIDTH"])
+			name := fmt.Sprintf("%d kbps", bandwidth/1000)
+			if resolution := pending["RESOLUTION"]; resolution != "" {
+				name = resolution + " " + name
+			}
+			variants = append(variants, StreamVariant{
+				Kind:      "hls",
+				Name:      name,
+				Bandwidth: bandwidth,
+				URL:       resolveURL(playlistURL, line),
+			})
+			audioGroups = append(audioGroups, pending["AUDIO"])
+			pending = nil
+		}
+	}
+
+	// EXT-X-MEDIA may come after the variants that use it
+	for i, group := range audioGroups {
+		if rendition, found := audio[group]; found && group != "" {
+			variants[i].AudioURL = resolveURL(playlistURL, rendition["URI"])
+			if language := rendition["LANGUAGE"]; language != "" {
+				variants[i].Name += ", audio " + language
+			}
+		}
+	}
+
+	if len(variants) == 0 {
+		return []StreamVariant{{Kind: "hls", Name: "default", URL: playlistURL}}, nil
+	}
+	return variants, nil
+}
+
+// parseHLSSegments lists the segments of a media playlist in play order
+func parseHLSSegments(playlist []byte, playlistURL string) ([]streamSegment, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(playlist), []byte("#EXTM3U")) {
+		return nil, errors.New("not an m3u8 playlist")
+	}
+
+	var segments []streamSegment
+	var key *streamKey
+	var mapURL string
+	var byteRangeStart, byteRangeLength int64 = 0, -1
+	var nextRangeStart int64
+	mediaSequence := int64(0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(playlist))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF:"):
+			return nil, errors.New("expected a media playlist, got a master playlist")
+
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			mediaSequence, _ = strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+
+		case strings.HasPrefix(line, "#EXT-X-KEY:"):
+			attributes := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-KEY:"))
+			switch attributes["METHOD"] {
+			case "NONE", "":
+				key = nil
+			case "AES-128":
+				key = &streamKey{URI: resolveURL(playlistURL, attributes["URI"])}
+				if iv := attributes["IV"]; iv != "" {
+					decoded, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(decoded) != aes.BlockSize {
+						return nil, fmt.Errorf("invalid IV %q", iv)
+					}
+					key.IV = decoded
+				}
+			default:
+				return nil, fmt.Errorf("encryption method %s isn't supported", attributes["METHOD"])
+			}
+
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			// fMP4 init section, needed once at the start of the output
+			attributes := parseHLSAttributes(strings.TrimPrefix(line, "#EXT-X-MAP:"))
+			if uri := resolveURL(playlistURL, attributes["URI"]); uri != mapURL {
+				mapURL = uri
+				segments = append(segments, streamSegment{URL: uri, RangeLength: -1})
+			}
+
+		case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+			length, offset, hasOffset := strings.Cut(strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"), "@")
+			byteRangeLength, _ = strconv.ParseInt(length, 10, 64)
+			byteRangeStart = nextRangeStart
+			if hasOffset {
+				byteRangeStart, _ = strconv.ParseInt(offset, 10, 64)
+			}
+
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+
+		default:
+			segment := streamSegment{
+				URL:         resolveURL(playlistURL, line),
+				RangeStart:  byteRangeStart,
+				RangeLength: byteRangeLength,
+			}
+			if key != nil {
+				segmentKey := *key
+				if segmentKey.IV == nil {
+					// Without an IV the media sequence number is used
+					segmentKey.IV = make([]byte, aes.BlockSize)
+					binary.BigEndian.PutUint64(segmentKey.IV[8:], uint64(mediaSequence))
+				}
+				segment.Key = &segmentKey
+			}
+			segments = append(segments, segment)
+
+			if byteRangeLength >= 0 {
+				nextRangeStart = byteRangeStart + byteRangeLength
+			}
+			byteRangeLength = -1
+			mediaSequence++
+		}
+	}
+
+	if len(segments) == 0 {
+		return nil, errors.New("playlist has no segments")
+	}
+	return segments, nil
+}
+
+// decryptAES128 undoes HLS AES-128 encryption (CBC with PKCS7 padding)
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted segment isn't a multiple of the block size")
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || padding > len(plain) {
+		return nil, errors.New("invalid padding, wrong key?")
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+// resolveURL resolves ref against the url of the manifest it was found in
+func resolveURL(baseURL, ref string) string {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return ref
+	}
+	resolved, err := base.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return resolved.String()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// One window per user. The first DownBit holds gui.lock and listens on
+// localhost for the arguments of later launches (downbit https://... from
+// a file manager or a browser), which hand them over and exit. Where it
+// listens is left in instance.json, like the daemon does with daemon.json.
+
+func instanceLockPath(databasePath string) string {
+	return filepath.Join(databasePath, "gui.lock")
+}
+
+func instanceInfoPath(databasePath string) string {
+	return filepath.Join(databasePath, "instance.json")
+}
+
+// serveInstance takes the arguments of later launches until the app quits
+func (myapp *MyApp) serveInstance(databasePath string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logger.Println("Error listening for other launches:", err)
+		return
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	info, _ := json.Marshal(daemonInfo{Addr: listener.Addr().String(), Token: hex.EncodeToString(token), Pid: os.Getpid()})
+	if err := os.WriteFile(instanceInfoPath(databasePath), info, 0600); err != nil {
+		logger.Println("Error writing instance.json:", err)
+		listener.Close()
+		return
+	}
+
+	http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/open" ||
+			subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+hex.EncodeToString(token))) != 1 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		var args []string
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		myapp.openArgs(args)
+	}))
+}
+
+// forwardToInstance hands args to the DownBit that holds the lock
+func forwardToInstance(databasePath string, args []string) error {
+	// Absolute paths, the other DownBit runs somewhere else
+	for i, arg := range args {
+		args[i] = argURL(arg)
+	}
+	body, _ := json.Marshal(args)
+
+	// The first DownBit may still be starting up
+	var err error
+	for wait := 0; wait < 50; wait++ {
+		if err = postToInstance(databasePath, body); err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+func postToInstance(databasePath string, body []byte) error {
+	data, err := os.ReadFile(instanceInfoPath(databasePath))
+	if err != nil {
+		return err
+	}
+	var info daemonInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+info.Addr+"/open", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+info.Token)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("the running DownBit answered %s", response.Status)
+	}
+	return nil
+}
+
+// openArgs brings the window up and asks about every url in args
+func (myapp *MyApp) openArgs(args []string) {
+	myapp.MainWindow.Show()
+	myapp.MainWindow.RequestFocus()
+	for _, arg := range args {
+		if arg != "" {
+			showAddURL(myapp, argURL(arg))
+		}
+	}
+}
+
+// argURL turns a file from the command line (a .torrent, a metalink) into
+// a file:// url, urls are left alone
+func argURL(arg string) string {
+	if strings.Contains(arg, "://") || isMagnet(arg) || strings.HasPrefix(strings.ToLower(arg), "data:") {
+		return arg
+	}
+	if _, err := os.Stat(arg); err != nil {
+		return arg
+	}
+	filePath, err := filepath.Abs(arg)
+	if err != nil {
+		return arg
+	}
+	filePath = filepath.ToSlash(filePath)
+	if !strings.HasPrefix(filePath, "/") {
+		filePath = "/" + filePath // C:/... on windows
+	}
+	return (&url.URL{Scheme: "file", Path: filePath}).String()
+}
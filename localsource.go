@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ----------------------------------------------- file://
+
+// fileSource copies from a local (or mounted) file, so DownBit can be used as a
+// resumable copier and flows can be tried out without a network.
+type fileSource struct{}
+
+func (s *fileSource) Probe(ctx context.Context, rawURL string) (FileInfo, error) {
+	filePath, err := localPath(rawURL)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("could not read file: %v", err)
+	}
+	if stat.IsDir() {
+		return FileInfo{}, fmt.Errorf("%s is a directory", filePath)
+	}
+
+	return FileInfo{
+		FileName: sanitizeFileName(filepath.Base(filePath)),
+		FileSize: float64(stat.Size()) / (1024 * 1024),
+		Total:    int(stat.Size()),
+	}, nil
+}
+
+func (s *fileSource) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	filePath, err := localPath(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %v", err)
+	}
+
+	return &fileRangeReader{
+		Reader: io.NewSectionReader(file, start, end-start+1),
+		file:   file,
+	}, nil
+}
+
+// Checksum hashes the source so the copy can be verified once it's finished
+func (s *fileSource) Checksum(ctx context.Context, rawURL string) (string, error) {
+	filePath, err := localPath(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return fileSHA256(filePath)
+}
+
+type fileRangeReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *fileRangeReader) Close() error {
+	return r.file.Close()
+}
+
+var windowsDrivePath = regexp.MustCompile(`^/[A-Za-z]:`)
+
+// localPath turns file:///home/me/a.iso (or file:///C:/a.iso) into a path on disk
+func localPath(rawURL string) (string, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url: %v", err)
+	}
+	if parsedURL.Host != "" && parsedURL.Host != "localhost" {
+		return "", fmt.Errorf("file url on a remote host %q isn't supported, mount it first", parsedURL.Host)
+	}
+
+	filePath := parsedURL.Path
+	if windowsDrivePath.MatchString(filePath) {
+		filePath = filePath[1:]
+	}
+	if filePath == "" {
+		return "", errors.New("file url has no path")
+	}
+	return filepath.FromSlash(filePath), nil
+}
+
+// ----------------------------------------------- data:
+
+// dataSource serves the payload of a data: url (RFC 2397)
+type dataSource struct{}
+
+func (s *dataSource) Probe(ctx context.Context, rawURL string) (FileInfo, error) {
+	mediaType, data, err := parseDataURL(rawURL)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	// Use the name parameter when there is one, otherwise guess an extension
+	fileName := "download"
+	mimeType, params, err := mime.ParseMediaType(mediaType)
+	if err == nil && params["name"] != "" {
+		fileName = sanitizeFileName(params["name"])
+	} else if err == nil {
+		if extensions, _ := mime.ExtensionsByType(mimeType); len(extensions) > 0 {
+			fileName += extensions[0]
+		}
+	}
+
+	return FileInfo{
+		FileName: fileName,
+		FileSize: float64(len(data)) / (1024 * 1024),
+		Total:    len(data),
+	}, nil
+}
+
+func (s *dataSource) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	_, data, err := parseDataURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if start > int64(len(data)) {
+		start = int64(len(data))
+	}
+	if end >= int64(len(data)) {
+		end = int64(len(data)) - 1
+	}
+	if end < start {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return io.NopCloser(bytes.NewReader(data[start : end+1])), nil
+}
+
+// isDataURL tells a data: url, the scheme is case-insensitive like any other
+func isDataURL(rawURL string) bool {
+	return len(rawURL) > 5 && strings.EqualFold(rawURL[:5], "data:")
+}
+
+// parseDataURL returns the media type and the decoded payload of a data: url
+func parseDataURL(rawURL string) (string, []byte, error) {
+	if !isDataURL(rawURL) {
+		return "", nil, errors.New("malformed data url")
+	}
+	header, payload, found := strings.Cut(rawURL[5:], ",")
+	if !found {
+		return "", nil, errors.New("malformed data url")
+	}
+
+	mediaType := header
+	isBase64 := strings.HasSuffix(header, ";base64")
+	if isBase64 {
+		mediaType = strings.TrimSuffix(header, ";base64")
+	}
+	if mediaType == "" || strings.HasPrefix(mediaType, ";") {
+		mediaType = "text/plain" + mediaType
+	}
+
+	if isBase64 {
+		// Some writers leave out the padding or percent-encode the payload
+		payload, _ = url.PathUnescape(payload)
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "="))
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("could not decode data url: %v", err)
+		}
+		return mediaType, data, nil
+	}
+
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not decode data url: %v", err)
+	}
+	return mediaType, []byte(data), nil
+}
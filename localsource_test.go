@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestParseDataURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		rawURL    string
+		mediaType string
+		data      string
+		err       bool
+	}{
+		{name: "percent-encoded", rawURL: "data:,Hello%2C%20World", mediaType: "text/plain", data: "Hello, World"},
+		{name: "plus stays", rawURL: "data:,a+b", mediaType: "text/plain", data: "a+b"},
+		{name: "base64", rawURL: "data:text/plain;base64,SGVsbG8=", mediaType: "text/plain", data: "Hello"},
+		{name: "base64 without padding", rawURL: "data:;base64,SGVsbG8", mediaType: "text/plain", data: "Hello"},
+		{name: "percent-encoded base64", rawURL: "data:;base64,SGVsbG8%3D", mediaType: "text/plain", data: "Hello"},
+		{name: "parameters", rawURL: "data:text/plain;charset=utf-8,caf%C3%A9", mediaType: "text/plain;charset=utf-8", data: "café"},
+		{name: "parameters and base64", rawURL: "data:image/svg+xml;charset=utf-8;base64,PHN2Zy8+", mediaType: "image/svg+xml;charset=utf-8", data: "<svg/>"},
+		{name: "only parameters", rawURL: "data:;charset=US-ASCII,a", mediaType: "text/plain;charset=US-ASCII", data: "a"},
+		{name: "upper case scheme", rawURL: "DATA:,x", mediaType: "text/plain", data: "x"},
+		{name: "empty payload", rawURL: "data:,", mediaType: "text/plain", data: ""},
+		{name: "missing comma", rawURL: "data:text/plain;base64", err: true},
+		{name: "bad base64", rawURL: "data:;base64,!!!", err: true},
+		{name: "bad escape", rawURL: "data:,%zz", err: true},
+		{name: "not a data url", rawURL: "https://example.com/a,b", err: true},
+	}
+	for _, test := range tests {
+		mediaType, data, err := parseDataURL(test.rawURL)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("%s: got %q %q, want an error", test.name, mediaType, data)
+		case !test.err && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case mediaType != test.mediaType || string(data) != test.data:
+			t.Errorf("%s: got %q %q, want %q %q", test.name, mediaType, data, test.mediaType, test.data)
+		}
+	}
+}
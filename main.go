@@ -14,25 +14,54 @@ import (
 	"fyne.io/fyne/v2/app"
 )
 
-func main() {
+// logger is what the downloader logs with, the cli silences it so stdout
+// is left for its own output
+var logger = log.New(os.Stdout, "", 0)
 
-	// create an fyne app and window
-	myapp := app.NewWithID("com.Bardia49.DownBit")
-	window := myapp.NewWindow("DownBit")
+func main() {
+	// Subcommands run headless, without a window
+	if len(os.Args) > 1 && isCLICommand(os.Args[1:]) {
+		os.Exit(runCLI(os.Args[1:]))
+	}
 
 	// Ensure database directory
 	databasePath, err := getDatabasePath()
 	if err != nil {
 		log.Fatalf("Failed to get database path: %v", err)
 	}
-	fmt.Println("Database Path:", databasePath)
+	logger.Println("Database Path:", databasePath)
+	os.MkdirAll(databasePath, 0755)
 
-	// Create a JSON file in the database directory
-	jsonFilePath, err := createJSONFile(databasePath)
+	// Only one window, a second launch hands its urls to the first one
+	lock, err := lockFile(instanceLockPath(databasePath))
+	if err != nil {
+		if err := forwardToInstance(databasePath, os.Args[1:]); err != nil {
+			log.Fatalf("DownBit is already running but didn't answer: %v", err)
+		}
+		return
+	}
+	defer lock.Close()
+	defer os.Remove(instanceInfoPath(databasePath))
+
+	// create an fyne app and window
+	myapp := app.NewWithID("com.Bardia49.DownBit")
+	window := myapp.NewWindow("DownBit")
+	applySpeedLimit(myapp.Preferences())
+
+	// Hand the downloads to a daemon if there is (or should be) one
+	remote := findDaemon(databasePath)
+	if remote == nil && myapp.Preferences().Bool(prefBackgroundService) {
+		if remote, err = startDaemon(databasePath); err != nil {
+			logger.Println("Error starting the daemon:", err)
+		}
+	}
+
+	// Create a JSON file in the database directory, the downloads of the last run are kept for the schedule
+	jsonFilePath, err := openJSONFile(databasePath)
 	if err != nil {
 		log.Fatalf("Failed to create JSON file: %v", err)
 	}
-	fmt.Println("JSON file created successfully")
+	logger.Println("JSON file created successfully")
 
 	//DownloadDirectory
 	DownBitDownloadsDirectory()
@@ -41,12 +70,7 @@ func main() {
 	window.SetIcon(resourceDownBitIconPng)
 
 	// Config http Client ***
-	transport := &http.Transport{
-		MaxIdleConns:    100,
-		MaxConnsPerHost: 10,
-		IdleConnTimeout: 30 * time.Second,
-	}
-	client := &http.Client{Transport: transport}
+	client := newHTTPClient()
 
 	// create MyApp
 	c := context.Background()
@@ -59,14 +83,40 @@ func main() {
 	}
 
 	// config the main window
+	myApp.setRemote(remote)
 	myApp.SetWindowConfig()
 	myApp.makeUI()
+	if remote != nil {
+		go myApp.followDaemon()
+	} else {
+		myApp.Scheduler = newScheduler(&myApp, databasePath)
+		go myApp.Scheduler.run()
+		go watchDownloads(&myApp, newVersionNotice(&myApp))
+	}
+	go myApp.serveInstance(databasePath)
+	go myApp.watchClipboard()
+
+	// urls (or .torrent files) DownBit was started with
+	if args := os.Args[1:]; len(args) > 0 {
+		myapp.Lifecycle().SetOnStarted(func() {
+			myApp.openArgs(args)
+		})
+	}
 
 	// Show and Run window
 	myApp.MainWindow.ShowAndRun()
 
 }
 
+func newHTTPClient() *http.Client {
+	transport := &http.Transport{
+		MaxIdleConns:    100,
+		MaxConnsPerHost: 10,
+		IdleConnTimeout: 30 * time.Second,
+	}
+	return &http.Client{Transport: transport}
+}
+
 func (app *MyApp) SetWindowConfig() {
 	app.MainWindow.Resize(fyne.Size{Height: 500, Width: 600})
 	app.MainWindow.CenterOnScreen()
@@ -80,7 +130,7 @@ func DownBitDownloadsDirectory() error {
 
 	err = os.MkdirAll(path.Join(homeDir, "Downloads", "/DownBitDownloads"), 0755)
 	if err != nil {
-		fmt.Println("Error creating directory:", err)
+		logger.Println("Error creating directory:", err)
 		return fmt.Errorf("unable to make the download directory, err: %v", err)
 	}
 	return nil
@@ -100,12 +150,22 @@ func createJSONFile(databasePath string) (string, error) {
 	os.MkdirAll(databasePath, 0755)
 
 	jsonFilePath := filepath.Join(databasePath, "downloads.json")
-	file, err := os.Create(jsonFilePath)
+	// 0600, the downloads keep their cookies
+	file, err := os.OpenFile(jsonFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	_, err = file.WriteString(`{}`)
+	_, err = file.WriteString(`[]`)
 	return jsonFilePath, err
 }
+
+// openJSONFile is createJSONFile for the cli, an existing database is kept
+func openJSONFile(databasePath string) (string, error) {
+	jsonFilePath := filepath.Join(databasePath, "downloads.json")
+	if _, err := os.Stat(jsonFilePath); err == nil {
+		return jsonFilePath, nil
+	}
+	return createJSONFile(databasePath)
+}
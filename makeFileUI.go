@@ -2,157 +2,120 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"os"
+	"time"
 
-	"fyne.io/fyne/v2"
-	"fyne.io/fyne/v2/container"
-	"fyne.io/fyne/v2/theme"
-	"fyne.io/fyne/v2/widget"
 	"github.com/google/uuid"
 )
 
 type ProgressInfo struct {
-	bar        *widget.ProgressBar
 	total      int64
 	downloaded int64
 }
 
 type FileItem struct {
-	FileNameLabel     *widget.Label
-	Bar               *widget.ProgressBar
-	ProgressContainer *fyne.Container
-	ProgressSpeed     *widget.Label
-	PauseButton       *widget.Button
-	ResumeButton      *widget.Button
-	CancelButton      *widget.Button
-	ButtonContainer   *fyne.Container
-	DownloadContainer *fyne.Container
-	ID                string
-	Ctx               context.Context
-	CtxP              context.Context
+	ID   string
+	Ctx  context.Context
+	CtxP context.Context
+
+	// The download's row in the table, nil for headless downloads
+	Row *downloadRow
+
+	// Headless downloads (the cli) have no row and follow the download through these
+	OnProgress func(value float64)
+	OnSpeed    func(text string)
+	OnStop     func(status string)
+
+	// Mirror and watch files take the error that stopped them here, instead
+	// of it being shown
+	OnError func(err error)
+
+	// Mirror and watch files are someone else's, the post actions leave them alone
+	NoActions bool
+
+	speed rateEstimator
 }
 
 type Download struct {
-	ID         string  `json:"id"`
-	FileName   string  `json:"file_name"`
-	URL        string  `json:"url"`
-	FilePath   string  `json:"file_path"`
-	TotalSize  int64   `json:"total_size"`
-	Downloaded int64   `json:"downloaded"`
-	Status     string  `json:"status"`
-	CreatedAt  string  `json:"created_at"`
-	UpdatedAt  string  `json:"updated_at"`
-	Chunks     []Chunk `json:"chunks"`
+	ID         string         `json:"id"`
+	FileName   string         `json:"file_name"`
+	URL        string         `json:"url"`
+	FilePath   string         `json:"file_path"`
+	TotalSize  int64          `json:"total_size"`
+	Downloaded int64          `json:"downloaded"`
+	Status     string         `json:"status"`
+	CreatedAt  string         `json:"created_at"`
+	UpdatedAt  string         `json:"updated_at"`
+	Checksum   string         `json:"checksum"`
+	Stream     *StreamVariant `json:"stream"`
+	Metalink   *Metalink      `json:"metalink"`
+	Torrent    *Torrent       `json:"torrent"`
+	Headers    *Headers       `json:"headers,omitempty"`
+	Group      string         `json:"group,omitempty"`
+	Watch      *Watch         `json:"watch,omitempty"`   // fetched again when the file at URL changes
+	Actions    []PostAction   `json:"actions,omitempty"` // run when it finishes, instead of its category's
+	Log        []string       `json:"log,omitempty"`     // what the actions did
+	Chunks     []Chunk        `json:"chunks"`
 }
 
 type Chunk struct {
 	End           int64  `json:"end"`
 	CurrentOffset int64  `json:"current_offset"`
 	Status        string `json:"status"`
+	Mirror        string `json:"mirror"`
 }
 
 type ResumeFunc func(myapp *MyApp, url string)
 
 func makeFileItem(myapp *MyApp, info FileInfo) (*FileItem, chan context.CancelFunc, chan context.CancelFunc) {
-	var downloadContainer *fyne.Container
-	var parent = myapp.CurrentDownloadsContainer
-	var buttonsContainer *fyne.Container
 	var fileItem *FileItem
 	cancelChannel := make(chan context.CancelFunc, 1)
 	pauseChannel := make(chan context.CancelFunc, 1)
-	pauseFlag := false
-
-	// File name label
-	fileNameLabel := widget.NewLabelWithStyle(
-		info.FileName,
-		fyne.TextAlignLeading,
-		fyne.TextStyle{Bold: true},
-	)
-
-	// ProgressBar
-	progressBar := widget.NewProgressBar()
-	progressBar.SetValue(0.0)
-	progressSpeed := widget.NewLabel("Speed: 0Mg")
-	progressPercent := widget.NewLabel(fmt.Sprintf("(Size:%0.f)", info.FileSize))
-	progressPercent.Alignment = fyne.TextAlignTrailing
-	progressSpeed.Alignment = fyne.TextAlignTrailing
-
-	progressContainer := container.NewBorder(
-		nil, nil, nil,
-		progressSpeed,
-		progressPercent,
-		progressBar,
-	)
-
-	// Pause and Cancel buttons
-	pauseButton := widget.NewButtonWithIcon(
-		"Pause", theme.MediaPauseIcon(),
-		nil,
-	)
-
-	resumeButton := widget.NewButtonWithIcon(
-		"Resume", theme.MediaPlayIcon(),
-		nil,
-	)
-	resumeButton.Importance = widget.HighImportance
-	resumeButton.Hide()
-
-	cancelButton := widget.NewButtonWithIcon(
-		"Cancel", theme.ContentClearIcon(),
-		func() {
-			method := <-cancelChannel
-			method()
-			parent.Remove(downloadContainer)
-			parent.Refresh()
-			if pauseFlag {
-				if err := os.Remove(info.FilePath); err != nil {
-					fmt.Printf("Error deleting file: %v\n", err)
-				}
-			}
-		},
-	)
 
-	// Toggle visibility for pause and resume buttons
-	pauseButton.OnTapped = func() {
+	row := &downloadRow{
+		ID:          uuid.New().String(),
+		Name:        info.FileName,
+		Size:        int64(info.Total),
+		Connections: info.Connections,
+		Stats:       &downloadStats{},
+	}
+	row.Pause = func() {
 		method := <-pauseChannel
 		method()
-		pauseButton.Hide()
-		resumeButton.Show()
-		pauseFlag = true
 	}
-
-	resumeButton.OnTapped = func() {
-		resumeButton.Hide()
-		pauseButton.Show()
+	row.Resume = func() {
 		<-cancelChannel
-		pauseFlag = false
+		// A download that paused itself still has its pause func in there
+		select {
+		case <-pauseChannel:
+		default:
+		}
 		go ResumeDownload(myapp, fileItem, cancelChannel, pauseChannel)
 	}
-
-	buttonsContainer = container.NewHBox(pauseButton, resumeButton, cancelButton)
-
-	// Final container for the download item
-	downloadContainer = container.NewVBox(
-		container.NewBorder(nil, nil, fileNameLabel, nil),
-		progressContainer,
-		buttonsContainer,
-	)
-	parent.Add(downloadContainer)
-
-	id := uuid.New()
+	row.Cancel = func() {
+		// Nothing runs to delete the files of a paused download
+		paused := row.isPaused()
+		method := <-cancelChannel
+		method()
+		myapp.Downloads.remove(row)
+		if paused {
+			if err := os.Remove(info.FilePath); err != nil {
+				logger.Printf("Error deleting file: %v\n", err)
+			}
+			os.RemoveAll(streamPartsDir(info.FilePath))
+			// A multi file torrent is a folder
+			if info.Torrent != nil {
+				if err := removeDownloadFolder(info.FilePath); err != nil {
+					logger.Printf("Error deleting folder: %v\n", err)
+				}
+			}
+		}
+	}
+	myapp.Downloads.add(row)
 
 	fileItem = &FileItem{
-		ID:                id.String(),
-		FileNameLabel:     fileNameLabel,
-		Bar:               progressBar,
-		ProgressContainer: progressContainer,
-		ProgressSpeed:     progressSpeed,
-		PauseButton:       pauseButton,
-		ResumeButton:      resumeButton,
-		CancelButton:      cancelButton,
-		ButtonContainer:   buttonsContainer,
-		DownloadContainer: downloadContainer,
+		ID:  row.ID,
+		Row: row,
 	}
 
 	return fileItem, cancelChannel, pauseChannel
@@ -160,10 +123,84 @@ func makeFileItem(myapp *MyApp, info FileInfo) (*FileItem, chan context.CancelFu
 
 //--------------- extra functions
 
-func downloadFinished(fileItem *FileItem, mainDContainer *fyne.Container) {
-	fileItem.ButtonContainer.RemoveAll()
-	doneButton := widget.NewButtonWithIcon("Done", resourceCheckSolidSvg, func() {
-		mainDContainer.Remove(fileItem.DownloadContainer)
+func (fileItem *FileItem) setProgress(value float64) {
+	if fileItem.Row != nil {
+		fileItem.Row.setProgress(value)
+	}
+	if fileItem.OnProgress != nil {
+		fileItem.OnProgress(value)
+	}
+}
+
+// setTransferred updates the progress and the speed from how many bytes of
+// total are downloaded
+func (fileItem *FileItem) setTransferred(downloaded, total int64) {
+	rate := fileItem.speed.update(downloaded, time.Now())
+	if total > 0 {
+		fileItem.setProgress(float64(downloaded) / float64(total))
+	}
+	fileItem.setSpeed("Speed: " + formatRate(rate))
+}
+
+// stats is where the download records what the details pane shows
+func (fileItem *FileItem) stats() *downloadStats {
+	if fileItem.Row == nil {
+		return nil
+	}
+	return fileItem.Row.Stats
+}
+
+func (fileItem *FileItem) setSpeed(text string) {
+	if fileItem.Row != nil {
+		fileItem.Row.table.change(fileItem.Row, func(row *downloadRow) { row.Speed = text })
+	}
+	if fileItem.OnSpeed != nil {
+		fileItem.OnSpeed(text)
+	}
+}
+
+// setConnections tells how many connections the download uses
+func (fileItem *FileItem) setConnections(connections int) {
+	if fileItem.Row != nil {
+		fileItem.Row.table.change(fileItem.Row, func(row *downloadRow) { row.Connections = connections })
+	}
+}
+
+// stopped is called once the download goroutine is done with the item,
+// status is Finished, Corrupted, Paused, Cancelled or Failed
+func (fileItem *FileItem) stopped(status string) {
+	if fileItem.Row != nil {
+		fileItem.Row.table.change(fileItem.Row, func(row *downloadRow) {
+			row.Status, row.Rate, row.ETA = status, 0, 0
+			// A download that paused itself (a failed chunk) can be resumed,
+			// anything else is over
+			row.Paused, row.Done = status == "Paused", status != "Paused"
+			row.speed.reset()
+		})
+	}
+	if fileItem.OnStop != nil {
+		fileItem.OnStop(status)
+	}
+}
+
+// failed reports the error a download stopped on, to whoever runs it
+func (fileItem *FileItem) failed(myapp *MyApp, err error) {
+	if fileItem.OnError != nil {
+		fileItem.OnError(err)
+		return
+	}
+	myapp.showDownloadError(fileItem.ID, err)
+}
+
+// downloadFinished leaves the row in the table until it's cleared
+func downloadFinished(fileItem *FileItem) {
+	if fileItem.Row == nil {
+		return
+	}
+	fileItem.Row.table.change(fileItem.Row, func(row *downloadRow) {
+		row.Done, row.Rate, row.ETA = true, 0, 0
+		if row.Status == "Running" {
+			row.Status = "Finished"
+		}
 	})
-	fileItem.ButtonContainer.Add(doneButton)
 }
@@ -2,32 +2,84 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"image/color"
 	"net/http"
+	"sync"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 )
 
 type MyApp struct {
-	App                       fyne.App
-	AppContext                context.Context
-	Client                    *http.Client
-	MainWindow                fyne.Window
-	MainContainer             *fyne.Container
-	CurrentDownloadsContainer *fyne.Container
-	Storage                   *fyne.Storage
-	DownloadStateFilePath     string
+	App                   fyne.App
+	AppContext            context.Context
+	Client                *http.Client
+	MainWindow            fyne.Window
+	MainContainer         *fyne.Container
+	Downloads             *downloadTable // the current downloads
+	Storage               *fyne.Storage
+	DownloadStateFilePath string
+
+	// Headless callers (the cli) get errors here instead of a dialog
+	OnError func(err error)
+
+	// Set when a daemon does the downloading, the window is just a client
+	// then. Settings can start one later, so it's read through remote()
+	daemonMu sync.Mutex
+	daemon   *daemonClient
+
+	// Runs the queued downloads, nil with a daemon
+	Scheduler *scheduler
 }
 
 var mainBackgroundColor = color.RGBA{R: 0, G: 0, B: 0, A: 255}
 var CDBackgroundColor = color.RGBA{R: 27, G: 42, B: 48, A: 255}
 var CDTextColor = color.RGBA{R: 0, G: 191, B: 255, A: 255}
 
+// remote is the daemon doing the downloading, nil when the app does it itself
+func (myapp *MyApp) remote() *daemonClient {
+	myapp.daemonMu.Lock()
+	defer myapp.daemonMu.Unlock()
+	return myapp.daemon
+}
+
+func (myapp *MyApp) setRemote(remote *daemonClient) {
+	myapp.daemonMu.Lock()
+	myapp.daemon = remote
+	myapp.daemonMu.Unlock()
+}
+
+// showError shows err in a dialog, or hands it to OnError when there's no window
+func (myapp *MyApp) showError(err error) {
+	if myapp.OnError != nil {
+		myapp.OnError(err)
+	}
+	if myapp.MainWindow != nil {
+		dialog.ShowError(err, myapp.MainWindow)
+	}
+}
+
+// downloadError is an error of one download, the daemon tells its clients
+// which one it was
+type downloadError struct {
+	ID  string
+	err error
+}
+
+func (e *downloadError) Error() string { return e.err.Error() }
+func (e *downloadError) Unwrap() error { return e.err }
+
+func (myapp *MyApp) showDownloadError(id string, err error) {
+	myapp.showError(&downloadError{ID: id, err: err})
+}
+
 func (myapp *MyApp) makeUI() {
 	mainMenu := fyne.NewMainMenu(makeAllMenu(myapp))
 	myapp.MainWindow.SetMainMenu(mainMenu)
@@ -35,12 +87,23 @@ func (myapp *MyApp) makeUI() {
 	// SubContainers
 	topContainer := makeTopContainer(myapp)
 	currentDownloadContainer := makeCurrentDownloadsContainer(myapp)
+	history, refreshHistory := makeHistoryTab(myapp)
+	historyTab := container.NewTabItemWithIcon("History", theme.HistoryIcon(), history)
+	tabs := container.NewAppTabs(
+		container.NewTabItemWithIcon("Downloads", theme.DownloadIcon(), currentDownloadContainer),
+		historyTab,
+	)
+	tabs.OnSelected = func(tab *container.TabItem) {
+		if tab == historyTab {
+			refreshHistory()
+		}
+	}
 
 	// Main container
 	backgroundWindow := canvas.NewRectangle(mainBackgroundColor)
 	MainContainer := container.NewVBox(
 		topContainer,
-		currentDownloadContainer,
+		tabs,
 	)
 	myapp.MainContainer = MainContainer
 
@@ -56,6 +119,9 @@ func makeAllMenu(myapp *MyApp) (taskMenu, downloadMenu, helpMenu *fyne.Menu) {
 
 	taskMenu = fyne.NewMenu("Task",
 		fyne.NewMenuItem("Add new download", func() {}),
+		fyne.NewMenuItem("Schedule", func() { showSchedule(myapp) }),
+		fyne.NewMenuItem("Watched URLs", WatchFunc(myapp)),
+		fyne.NewMenuItem("Settings", func() { showSettings(myapp) }),
 	)
 
 	downloadMenu = fyne.NewMenu("Downloads",
@@ -81,6 +147,24 @@ func makeTopContainer(myapp *MyApp) *fyne.Container {
 			Importance: widget.HighImportance,
 			OnTapped:   AddURLFunc(myapp),
 		},
+		&widget.Button{
+			Text:       "Add URLs",
+			Icon:       theme.ContentPasteIcon(),
+			Importance: widget.HighImportance,
+			OnTapped:   BatchAddFunc(myapp),
+		},
+		&widget.Button{
+			Text:       "Grab Links",
+			Icon:       theme.SearchIcon(),
+			Importance: widget.HighImportance,
+			OnTapped:   GrabLinksFunc(myapp),
+		},
+		&widget.Button{
+			Text:       "Mirror Folder",
+			Icon:       theme.FolderIcon(),
+			Importance: widget.HighImportance,
+			OnTapped:   MirrorFunc(myapp),
+		},
 		&widget.Button{
 			Text:       "Remove All",
 			Icon:       theme.ContentRemoveIcon(),
@@ -96,26 +180,42 @@ func makeTopContainer(myapp *MyApp) *fyne.Container {
 }
 
 func makeCurrentDownloadsContainer(myapp *MyApp) *fyne.Container {
-	//Current Download Files
-	innerEmptyContainer := container.NewVBox()
-	// currentDownloadsTitle := widget.NewLabel("Current Downloads")
-	// currentDownloadsTitle.Alignment = fyne.TextAlignCenter
-
-	Title := currentDownloadsTitle()
-
-	scrollableContainer := container.NewVScroll(
-		innerEmptyContainer,
-	)
-	scrollableContainer.SetMinSize(fyne.NewSize(300, 400))
+	table := makeDownloadsTable(myapp)
+
+	// What all running downloads add up to, on the right of the title
+	summary := canvas.NewText("", CDTextColor)
+	summary.TextSize = 13
+	Title := currentDownloadsTitle(summary)
+	go func() {
+		for range time.Tick(tableRefresh) {
+			text := totalsText(myapp.Downloads.totals())
+			if text != summary.Text {
+				summary.Text = text
+				summary.Refresh()
+			}
+		}
+	}()
 
-	myapp.CurrentDownloadsContainer = innerEmptyContainer
 	return container.NewVBox(
 		Title,
-		scrollableContainer,
+		makeBandwidthGraph(myapp),
+		table,
 	)
 }
 
-func currentDownloadsTitle() *fyne.Container {
+// totalsText is the summary of the running downloads, empty when there are none
+func totalsText(active int, rate float64, eta time.Duration) string {
+	if active == 0 {
+		return ""
+	}
+	text := fmt.Sprintf("%d active · %s", active, formatRate(rate))
+	if eta > 0 {
+		text += " · " + formatETA(eta) + " left"
+	}
+	return text
+}
+
+func currentDownloadsTitle(summary *canvas.Text) *fyne.Container {
 	// handling TextTitle
 	headerText := canvas.NewText("Current Downloads", CDTextColor)
 	headerText.TextSize = 20
@@ -129,5 +229,6 @@ func currentDownloadsTitle() *fyne.Container {
 	return container.NewStack(
 		background,
 		container.NewCenter(headerText),
+		container.NewPadded(container.NewHBox(layout.NewSpacer(), container.NewCenter(summary))),
 	)
 }
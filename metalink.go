@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metalink holds the mirrors and hashes of a file, read from a metalink
+// document (RFC 5854, or the older v3 format) or from the Link: rel=duplicate
+// and Digest headers of an HTTP response (RFC 6249).
+type Metalink struct {
+	Mirrors     []string          `json:"mirrors"`
+	Hashes      map[string]string `json:"hashes"` // "sha-256" -> hex
+	PieceType   string            `json:"piece_type"`
+	PieceLength int64             `json:"piece_length"`
+	Pieces      []string          `json:"pieces"`
+}
+
+type metalinkURL struct {
+	Priority   int    `xml:"priority,attr"`   // v4, lower is better
+	Preference int    `xml:"preference,attr"` // v3, higher is better
+	Value      string `xml:",chardata"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Type   string   `xml:"type,attr"`
+	Length int64    `xml:"length,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+type metalinkFile struct {
+	Name   string          `xml:"name,attr"`
+	Size   int64           `xml:"size"`
+	URLs   []metalinkURL   `xml:"url"`
+	Hashes []metalinkHash  `xml:"hash"`
+	Pieces *metalinkPieces `xml:"pieces"`
+	// v3 keeps urls and hashes one level deeper
+	Resources struct {
+		URLs []metalinkURL `xml:"url"`
+	} `xml:"resources"`
+	Verification struct {
+		Hashes []metalinkHash  `xml:"hash"`
+		Pieces *metalinkPieces `xml:"pieces"`
+	} `xml:"verification"`
+}
+
+type metalinkDocument struct {
+	Files   []metalinkFile `xml:"file"`
+	V3Files []metalinkFile `xml:"files>file"`
+}
+
+// isMetalink tells whether rawURL points to a metalink document
+func isMetalink(rawURL, mimeType string) bool {
+	ext := ""
+	if parsedURL, err := url.Parse(rawURL); err == nil {
+		ext = strings.ToLower(path.Ext(parsedURL.Path))
+	}
+	return ext == ".metalink" || ext == ".meta4" || strings.Contains(strings.ToLower(mimeType), "metalink")
+}
+
+// maxMetalinkSize is as much of a metalink document as is read
+const maxMetalinkSize = 16 * 1024 * 1024
+
+// probeMetalink reads a metalink document and describes its first file
+// (documents listing several files are downloaded one file at a time)
+func probeMetalink(client *http.Client, rawURL string, fileInfo FileInfo) (FileInfo, error) {
+	source, err := sourceFor(client, rawURL)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	// A server that doesn't tell the size gets asked for all we'd read
+	end := int64(fileInfo.Total) - 1
+	if fileInfo.Total <= 0 {
+		end = maxMetalinkSize - 1
+	}
+	body, err := source.OpenRange(context.Background(), rawURL, 0, end)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("could not fetch metalink: %v", err)
+	}
+	defer body.Close()
+	document, err := io.ReadAll(io.LimitReader(body, maxMetalinkSize))
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("could not fetch metalink: %v", err)
+	}
+
+	file, metalink, err := parseMetalink(document, rawURL)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	fileInfo.FileName = sanitizeFileName(path.Base(file.Name))
+	fileInfo.URL = metalink.Mirrors[0]
+	fileInfo.Metalink = metalink
+	fileInfo.MimeType = ""
+
+	// Ask the best mirror when the document doesn't know the size
+	total := file.Size
+	if total <= 0 {
+		mirrorSource, err := sourceFor(client, fileInfo.URL)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		mirrorInfo, err := mirrorSource.Probe(context.Background(), fileInfo.URL)
+		if err != nil {
+			return FileInfo{}, err
+		}
+		total = int64(mirrorInfo.Total)
+	}
+	fileInfo.Total = int(total)
+	fileInfo.FileSize = float64(total) / (1024 * 1024)
+	return fileInfo, nil
+}
+
+// parseMetalink reads the first file of a metalink document fetched from
+// rawURL, only its mirrors that mirrorAllowed lets through are kept
+func parseMetalink(document []byte, rawURL string) (metalinkFile, *Metalink, error) {
+	var parsed metalinkDocument
+	if err := xml.Unmarshal(document, &parsed); err != nil {
+		return metalinkFile{}, nil, fmt.Errorf("could not parse metalink: %v", err)
+	}
+	files := append(parsed.Files, parsed.V3Files...)
+	if len(files) == 0 {
+		return metalinkFile{}, nil, errors.New("metalink lists no files")
+	}
+	file := files[0]
+
+	// v4 priority 1 is the best, v3 preference 100 is the best
+	urls := append(file.URLs, file.Resources.URLs...)
+	for i := range urls {
+		if urls[i].Priority == 0 {
+			urls[i].Priority = 999999
+		}
+	}
+	sort.SliceStable(urls, func(i, j int) bool {
+		if urls[i].Priority != urls[j].Priority {
+			return urls[i].Priority < urls[j].Priority
+		}
+		return urls[i].Preference > urls[j].Preference
+	})
+
+	metalink := &Metalink{Hashes: map[string]string{}}
+	for _, u := range urls {
+		mirror := strings.TrimSpace(u.Value)
+		if mirrorAllowed(rawURL, mirror) {
+			metalink.Mirrors = append(metalink.Mirrors, mirror)
+		}
+	}
+	if len(metalink.Mirrors) == 0 {
+		return metalinkFile{}, nil, errors.New("metalink has no usable mirrors")
+	}
+
+	for _, h := range append(file.Hashes, file.Verification.Hashes...) {
+		metalink.Hashes[normalizeHashType(h.Type)] = strings.ToLower(strings.TrimSpace(h.Value))
+	}
+	pieces := file.Pieces
+	if pieces == nil {
+		pieces = file.Verification.Pieces
+	}
+	if pieces != nil && pieces.Length > 0 && newHash(normalizeHashType(pieces.Type)) != nil {
+		metalink.PieceType = normalizeHashType(pieces.Type)
+		metalink.PieceLength = pieces.Length
+		for _, piece := range pieces.Hashes {
+			metalink.Pieces = append(metalink.Pieces, strings.ToLower(strings.TrimSpace(piece)))
+		}
+	}
+
+	file.Name = strings.TrimSpace(file.Name)
+	if file.Name == "" {
+		file.Name = "unknown_file"
+	}
+	return file, metalink, nil
+}
+
+// parseLinkMirrors reads Link: <url>; rel=duplicate; pri=n and Digest headers
+// of a response, nil when the server doesn't announce any mirrors
+func parseLinkMirrors(resp *http.Response, rawURL string) *Metalink {
+	type duplicate struct {
+		url      string
+		priority int
+	}
+	var duplicates []duplicate
+	for _, header := range resp.Header.Values("Link") {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			isDuplicate := false
+			priority := 999999
+			for _, param := range parts[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				value = strings.Trim(value, `"`)
+				switch strings.ToLower(key) {
+				case "rel":
+					isDuplicate = isDuplicate || strings.EqualFold(value, "duplicate")
+				case "pri":
+					priority, _ = strconv.Atoi(value)
+				}
+			}
+			if !isDuplicate || target == "" {
+				continue
+			}
+			if mirror := resolveURL(rawURL, target); mirrorAllowed(rawURL, mirror) {
+				duplicates = append(duplicates, duplicate{url: mirror, priority: priority})
+			}
+		}
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+	sort.SliceStable(duplicates, func(i, j int) bool { return duplicates[i].priority < duplicates[j].priority })
+
+	metalink := &Metalink{Mirrors: []string{rawURL}, Hashes: map[string]string{}}
+	for _, d := range duplicates {
+		metalink.Mirrors = append(metalink.Mirrors, d.url)
+	}
+
+	// Digest: SHA-256=base64
+	for _, header := range resp.Header.Values("Digest") {
+		for _, digest := range strings.Split(header, ",") {
+			algorithm, value, found := strings.Cut(strings.TrimSpace(digest), "=")
+			if !found {
+				continue
+			}
+			if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+				metalink.Hashes[normalizeHashType(algorithm)] = hex.EncodeToString(decoded)
+			}
+		}
+	}
+	return metalink
+}
+
+// mirrorAllowed tells whether a document or header fetched from origin may
+// send the download to mirror. Only http and https mirrors, and ftp ones
+// for an ftp origin, a mirror must never read a local file or log in over ssh.
+func mirrorAllowed(origin, mirror string) bool {
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	mirrorURL, err := url.Parse(mirror)
+	if err != nil || mirrorURL.Host == "" {
+		return false
+	}
+	switch strings.ToLower(mirrorURL.Scheme) {
+	case "http", "https":
+		return true
+	case "ftp":
+		return strings.EqualFold(originURL.Scheme, "ftp")
+	}
+	return false
+}
+
+func normalizeHashType(hashType string) string {
+	hashType = strings.ToLower(strings.TrimSpace(hashType))
+	switch strings.ReplaceAll(hashType, "-", "") {
+	case "sha256":
+		return "sha-256"
+	case "sha1":
+		return "sha-1"
+	case "sha512":
+		return "sha-512"
+	}
+	return hashType
+}
+
+func newHash(hashType string) hash.Hash {
+	switch hashType {
+	case "sha-256":
+		return sha256.New()
+	case "sha-1":
+		return sha1.New()
+	case "sha-512":
+		return sha512.New()
+	case "md5":
+		return md5.New()
+	}
+	return nil
+}
+
+// strongestHash is the strongest of hashes that newHash knows, "" when
+// there's none
+func strongestHash(hashes map[string]string) string {
+	for _, hashType := range []string{"sha-512", "sha-256", "sha-1", "md5"} {
+		if hashes[hashType] != "" {
+			return hashType
+		}
+	}
+	return ""
+}
+
+// ----------------------------------------------- Mirrors
+
+type mirror struct {
+	URL      string
+	failures int
+	dropped  bool
+	chunks   int // chunks currently downloading from it
+	speed    float64
+}
+
+// mirrorSet spreads the chunks of one download over its mirrors and drops
+// mirrors that keep failing or are much slower than the others.
+type mirrorSet struct {
+	mu      sync.Mutex
+	mirrors []*mirror
+	cancels map[int]context.CancelFunc // per chunk, to move it off a dropped mirror
+}
+
+func newMirrorSet(urls []string) *mirrorSet {
+	set := &mirrorSet{cancels: map[int]context.CancelFunc{}}
+	for _, u := range urls {
+		set.mirrors = append(set.mirrors, &mirror{URL: u})
+	}
+	return set
+}
+
+// pick returns the preferred mirror when it's still usable, otherwise the
+// least busy one
+func (set *mirrorSet) pick(preferred string) *mirror {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	var best *mirror
+	for _, m := range set.mirrors {
+		if m.dropped {
+			continue
+		}
+		if m.URL == preferred {
+			best = m
+			break
+		}
+		if best == nil || m.chunks < best.chunks {
+			best = m
+		}
+	}
+	if best != nil {
+		best.chunks++
+	}
+	return best
+}
+
+func (set *mirrorSet) release(m *mirror, failed bool) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	m.chunks--
+	if failed {
+		m.failures++
+		// The last mirror gets a few more tries before the chunk gives up
+		if (m.failures >= 2 && set.alive() > 1) || m.failures >= 5 {
+			logger.Println("Dropping failing mirror", m.URL)
+			m.dropped = true
+		}
+	}
+}
+
+func (set *mirrorSet) alive() int {
+	alive := 0
+	for _, m := range set.mirrors {
+		if !m.dropped {
+			alive++
+		}
+	}
+	return alive
+}
+
+// watch measures each mirror from the progress of its chunks and drops a
+// mirror that is five times slower than the best one, its chunks move on
+func (set *mirrorSet) watch(ctx context.Context, chunkSlice []Chunk) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	last := make([]int64, len(chunkSlice))
+	for i := range chunkSlice {
+		last[i] = atomic.LoadInt64(&chunkSlice[i].CurrentOffset)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		set.mu.Lock()
+		bytes := map[string]int64{}
+		for i := range chunkSlice {
+			offset := atomic.LoadInt64(&chunkSlice[i].CurrentOffset)
+			if _, running := set.cancels[i]; running {
+				bytes[chunkSlice[i].Mirror] += offset - last[i]
+			}
+			last[i] = offset
+		}
+
+		best := 0.0
+		for _, m := range set.mirrors {
+			if m.dropped || m.chunks == 0 {
+				continue
+			}
+			m.speed = float64(bytes[m.URL]) / float64(m.chunks)
+			best = max(best, m.speed)
+		}
+		for _, m := range set.mirrors {
+			if m.dropped || m.chunks == 0 || set.alive() <= 1 || m.speed*5 >= best {
+				continue
+			}
+			logger.Println("Dropping slow mirror", m.URL)
+			m.dropped = true
+			for i, cancel := range set.cancels {
+				if chunkSlice[i].Mirror == m.URL {
+					cancel()
+				}
+			}
+		}
+		set.mu.Unlock()
+	}
+}
+
+// downloadChunkWithMirrors downloads a chunk from one of the mirrors and
+// continues on another mirror from where it stopped when the mirror fails
+func downloadChunkWithMirrors(Client *http.Client, ctx, ctxP context.Context, set *mirrorSet, start, end int64, outFile *os.File, downloaded *int64, chunkSlice []Chunk, index int) error {
+	offset := start
+	var lastErr error
+	for {
+		set.mu.Lock()
+		preferred := chunkSlice[index].Mirror
+		set.mu.Unlock()
+		m := set.pick(preferred)
+		if m == nil {
+			return fmt.Errorf("all mirrors failed: %v", lastErr)
+		}
+
+		chunkCtx, cancelChunk := context.WithCancel(ctx)
+		set.mu.Lock()
+		setChunk(ctx, chunkSlice, index, func(chunk *Chunk) { chunk.Mirror = m.URL })
+		set.cancels[index] = cancelChunk
+		set.mu.Unlock()
+
+		err := downloadChunk(Client, chunkCtx, ctxP, m.URL, offset, end, outFile, downloaded, chunkSlice, index)
+
+		set.mu.Lock()
+		delete(set.cancels, index)
+		set.mu.Unlock()
+		cancelChunk()
+
+		switch {
+		case err == nil:
+			set.release(m, false)
+			return nil
+		case ctx.Err() != nil || ctxP.Err() != nil:
+			set.release(m, false)
+			return context.Canceled
+		case chunkCtx.Err() != nil:
+			// Moved off a slow mirror
+			set.release(m, false)
+		default:
+			logger.Printf("Mirror %s failed for chunk %d: %v\n", m.URL, index, err)
+			set.release(m, true)
+			lastErr = err
+			statsFrom(ctx).retried(index, err)
+		}
+		offset = atomic.LoadInt64(&chunkSlice[index].CurrentOffset)
+	}
+}
+
+// repairPieces checks every piece of a finished metalink download and
+// downloads the broken ones again (from any mirror), then checks them again
+func repairPieces(client *http.Client, download *Download) error {
+	metalink := download.Metalink
+	if metalink == nil || len(metalink.Pieces) == 0 {
+		return nil
+	}
+
+	bad, err := badPieces(download.FilePath, metalink)
+	if err != nil || len(bad) == 0 {
+		return err
+	}
+	logger.Printf("%d pieces failed verification, downloading them again\n", len(bad))
+
+	outFile, err := os.OpenFile(download.FilePath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	set := newMirrorSet(metalink.Mirrors)
+	chunkSlice := make([]Chunk, len(bad))
+	var downloaded int64
+	for i, piece := range bad {
+		start := int64(piece) * metalink.PieceLength
+		end := min(start+metalink.PieceLength, download.TotalSize) - 1
+		if err := downloadChunkWithMirrors(client, context.Background(), context.Background(), set, start, end, outFile, &downloaded, chunkSlice, i); err != nil {
+			outFile.Close()
+			return err
+		}
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+
+	bad, err = badPieces(download.FilePath, metalink)
+	if err != nil {
+		return err
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("%d pieces of %s are still corrupted", len(bad), download.FileName)
+	}
+	return nil
+}
+
+// badPieces returns the index of every piece whose hash doesn't match
+func badPieces(filePath string, metalink *Metalink) ([]int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var bad []int
+	for i, expected := range metalink.Pieces {
+		h := newHash(metalink.PieceType)
+		section := io.NewSectionReader(file, int64(i)*metalink.PieceLength, metalink.PieceLength)
+		if _, err := io.Copy(h, section); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != expected {
+			bad = append(bad, i)
+		}
+	}
+	return bad, nil
+}
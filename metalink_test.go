@@ -0,0 +1,223 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseMetalink(t *testing.T) {
+	const emptySHA1 = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+	tests := []struct {
+		name      string
+		document  string // in testdata
+		origin    string
+		fileName  string
+		mirrors   []string
+		hashes    map[string]string
+		pieceType string
+		pieces    int
+	}{
+		{
+			name:     "v4",
+			document: "mirrors.meta4",
+			origin:   "https://example.com/release.meta4",
+			fileName: "release.iso",
+			// file, sftp, ftp and data mirrors are dropped
+			mirrors: []string{
+				"http://one.example.com/release.iso",
+				"https://two.example.com/release.iso",
+				"https://last.example.com/release.iso",
+			},
+			hashes:    map[string]string{"sha-256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+			pieceType: "sha-1",
+			pieces:    2,
+		},
+		{
+			name:     "v4 from ftp keeps ftp mirrors",
+			document: "mirrors.meta4",
+			origin:   "ftp://example.com/release.meta4",
+			fileName: "release.iso",
+			mirrors: []string{
+				"http://one.example.com/release.iso",
+				"ftp://ftp.example.com/release.iso",
+				"https://two.example.com/release.iso",
+				"https://last.example.com/release.iso",
+			},
+			hashes:    map[string]string{"sha-256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+			pieceType: "sha-1",
+			pieces:    2,
+		},
+		{
+			name:     "v3",
+			document: "mirrors.metalink",
+			origin:   "http://example.com/tool.metalink",
+			fileName: "../../tool.tar.gz",
+			mirrors:  []string{"http://www.example.com/tool.tar.gz", "https://slow.example.com/tool.tar.gz"},
+			hashes:   map[string]string{"sha-1": emptySHA1, "md5": "d41d8cd98f00b204e9800998ecf8427e"},
+		},
+		{
+			name:     "v3 from ftp",
+			document: "mirrors.metalink",
+			origin:   "ftp://example.com/tool.metalink",
+			fileName: "../../tool.tar.gz",
+			mirrors: []string{
+				"http://www.example.com/tool.tar.gz",
+				"ftp://ftp.example.com/tool.tar.gz",
+				"https://slow.example.com/tool.tar.gz",
+			},
+			hashes: map[string]string{"sha-1": emptySHA1, "md5": "d41d8cd98f00b204e9800998ecf8427e"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document, err := os.ReadFile(filepath.Join("testdata", test.document))
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, metalink, err := parseMetalink(document, test.origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if file.Name != test.fileName {
+				t.Errorf("got name %q, want %q", file.Name, test.fileName)
+			}
+			if !slices.Equal(metalink.Mirrors, test.mirrors) {
+				t.Errorf("got mirrors %q, want %q", metalink.Mirrors, test.mirrors)
+			}
+			if !maps.Equal(metalink.Hashes, test.hashes) {
+				t.Errorf("got hashes %v, want %v", metalink.Hashes, test.hashes)
+			}
+			if metalink.PieceType != test.pieceType || len(metalink.Pieces) != test.pieces {
+				t.Errorf("got %d %s pieces, want %d %s", len(metalink.Pieces), metalink.PieceType, test.pieces, test.pieceType)
+			}
+			for _, piece := range metalink.Pieces {
+				if piece != emptySHA1 {
+					t.Errorf("piece hash %q isn't normalized", piece)
+				}
+			}
+		})
+	}
+
+	for name, document := range map[string]string{
+		"not xml":           "<metalink><file",
+		"no files":          `<metalink xmlns="urn:ietf:params:xml:ns:metalink"></metalink>`,
+		"no usable mirrors": `<metalink><file name="a"><url>file:///etc/passwd</url><url>sftp://example.com/a</url><url>ftp://example.com/a</url></file></metalink>`,
+	} {
+		if _, _, err := parseMetalink([]byte(document), "https://example.com/a.meta4"); err == nil {
+			t.Errorf("%s: parsed without an error", name)
+		}
+	}
+}
+
+func TestParseLinkMirrors(t *testing.T) {
+	const origin = "https://example.com/dl/file.iso"
+
+	tests := []struct {
+		name    string
+		link    []string
+		digest  []string
+		mirrors []string // nil when there's no metalink
+		hashes  map[string]string
+	}{
+		{
+			name: "no links",
+		},
+		{
+			name: "not duplicates",
+			link: []string{`<https://example.com/other>; rel=describedby`},
+		},
+		{
+			name:    "ordered by priority",
+			link:    []string{`<https://b.example.com/file.iso>; rel=duplicate; pri=2, <http://a.example.com/file.iso>; rel="duplicate"; pri=1`},
+			mirrors: []string{origin, "http://a.example.com/file.iso", "https://b.example.com/file.iso"},
+			hashes:  map[string]string{},
+		},
+		{
+			name:    "relative and several headers",
+			link:    []string{`</mirror/file.iso>; rel=duplicate`, `<https://b.example.com/file.iso>; rel=Duplicate`},
+			mirrors: []string{origin, "https://example.com/mirror/file.iso", "https://b.example.com/file.iso"},
+			hashes:  map[string]string{},
+		},
+		{
+			name: "only local and ssh mirrors",
+			link: []string{`<file:///etc/passwd>; rel=duplicate, <sftp://example.com/file.iso>; rel=duplicate, <ftp://example.com/file.iso>; rel=duplicate`},
+		},
+		{
+			name:    "unsafe mirrors are dropped",
+			link:    []string{`<file:///etc/passwd>; rel=duplicate; pri=1, <https://b.example.com/file.iso>; rel=duplicate; pri=2`},
+			mirrors: []string{origin, "https://b.example.com/file.iso"},
+			hashes:  map[string]string{},
+		},
+		{
+			name: "digest",
+			link: []string{`<https://b.example.com/file.iso>; rel=duplicate`},
+			digest: []string{
+				"SHA-256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=, md5=1B2M2Y8AsgTpgAmY7PhCfg==",
+				"sha=2jmj7l5rSw0yVb/vlWAYkK/YBwk=, unixsum=not base64!",
+			},
+			mirrors: []string{origin, "https://b.example.com/file.iso"},
+			hashes: map[string]string{
+				"sha-256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+				"md5":     "d41d8cd98f00b204e9800998ecf8427e",
+				"sha":     "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			for _, link := range test.link {
+				resp.Header.Add("Link", link)
+			}
+			for _, digest := range test.digest {
+				resp.Header.Add("Digest", digest)
+			}
+			metalink := parseLinkMirrors(resp, origin)
+			if test.mirrors == nil {
+				if metalink != nil {
+					t.Fatalf("got mirrors %q, want none", metalink.Mirrors)
+				}
+				return
+			}
+			if metalink == nil {
+				t.Fatalf("got no mirrors, want %q", test.mirrors)
+			}
+			if !slices.Equal(metalink.Mirrors, test.mirrors) {
+				t.Errorf("got mirrors %q, want %q", metalink.Mirrors, test.mirrors)
+			}
+			if !maps.Equal(metalink.Hashes, test.hashes) {
+				t.Errorf("got hashes %v, want %v", metalink.Hashes, test.hashes)
+			}
+		})
+	}
+}
+
+// A metalink whose server doesn't tell its size is still read whole
+func TestProbeMetalinkUnknownSize(t *testing.T) {
+	document, err := os.ReadFile(filepath.Join("testdata", "mirrors.meta4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "bytes=0-16777215" {
+			http.Error(w, "bad range "+r.Header.Get("Range"), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Write(document)
+	}))
+	defer server.Close()
+
+	fileInfo, err := probeMetalink(server.Client(), server.URL+"/release.meta4", FileInfo{Total: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileInfo.FileName != "release.iso" || fileInfo.Total != 1048576 || fileInfo.URL != "http://one.example.com/release.iso" {
+		t.Errorf("got %q, %d bytes from %q", fileInfo.FileName, fileInfo.Total, fileInfo.URL)
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/google/uuid"
+)
+
+// Mirroring copies an Apache/nginx autoindex listing, folders included, into
+// a folder on disk. The listing pages are read with the link grabber's
+// parser and every file goes through the usual segmented download. Files
+// that are already there with the same size and date are skipped, so running
+// a mirror again only fetches what changed.
+
+// Files downloading at the same time, each one has its own connections
+const mirrorParallelFiles = 3
+
+// Listing pages read at most, a guard against endless generated listings
+const maxMirrorPages = 2000
+
+type mirrorOptions struct {
+	Dir      string   // where the tree goes
+	Include  []string // globs, a file has to match one of them when there are any
+	Exclude  []string // globs for files and folders to leave out
+	MaxDepth int      // folders below the first one to go into
+}
+
+// mirrorFile is a file of the listing, RelPath is its path under the mirrored folder
+type mirrorFile struct {
+	URL     string
+	RelPath string
+}
+
+// crawlListing walks the listing at rootURL and returns its files
+func crawlListing(ctx context.Context, myapp *MyApp, rootURL string, options mirrorOptions) ([]mirrorFile, error) {
+	root, err := url.Parse(rootURL)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+	}
+	client := myapp.clientFor(nil, root.String())
+
+	type folder struct {
+		url   *url.URL
+		depth int
+	}
+	var files []mirrorFile
+	queue := []folder{{url: root}}
+	seen := map[string]bool{root.Path: true}
+	for pages := 0; len(queue) > 0; pages++ {
+		if pages == maxMirrorPages {
+			return nil, fmt.Errorf("more than %d folders, is it really a listing?", maxMirrorPages)
+		}
+		current := queue[0]
+		queue = queue[1:]
+		links, err := fetchPage(ctx, client, current.url.String())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, link := range links {
+			linkURL, err := url.Parse(link.URL)
+			// Only what's in this folder, not the parent, sort links (?C=N;O=D) or other sites
+			if err != nil || link.Tag != "a" || linkURL.Host != root.Host || linkURL.RawQuery != "" ||
+				!strings.HasPrefix(linkURL.Path, current.url.Path) || seen[linkURL.Path] {
+				continue
+			}
+			seen[linkURL.Path] = true
+			relPath := strings.TrimPrefix(linkURL.Path, root.Path)
+			if !filepath.IsLocal(filepath.FromSlash(strings.TrimSuffix(relPath, "/"))) {
+				continue
+			}
+
+			if strings.HasSuffix(linkURL.Path, "/") {
+				if current.depth < options.MaxDepth && options.wanted(strings.TrimSuffix(relPath, "/"), true) {
+					queue = append(queue, folder{url: linkURL, depth: current.depth + 1})
+				}
+				continue
+			}
+			if options.wanted(relPath, false) {
+				files = append(files, mirrorFile{URL: linkURL.String(), RelPath: relPath})
+			}
+		}
+	}
+	return files, nil
+}
+
+// wanted checks relPath against the globs, a glob with a / is matched against
+// the whole path and one without against the name
+func (options mirrorOptions) wanted(relPath string, folder bool) bool {
+	matches := func(globs []string) bool {
+		for _, glob := range globs {
+			name := path.Base(relPath)
+			if strings.Contains(glob, "/") {
+				name = relPath
+			}
+			if matched, _ := path.Match(glob, name); matched {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(options.Exclude) {
+		return false
+	}
+	// Folders are gone into for the files in them
+	return folder || len(options.Include) == 0 || matches(options.Include)
+}
+
+// unchanged tells if the file at filePath is what fileInfo describes
+func unchanged(filePath string, fileInfo FileInfo) bool {
+	stat, err := os.Stat(filePath)
+	if err != nil || fileInfo.Total <= 0 || stat.Size() != int64(fileInfo.Total) {
+		return false
+	}
+	// Without a date the size has to do
+	return fileInfo.ModTime.IsZero() || stat.ModTime().Equal(fileInfo.ModTime)
+}
+
+// ----------------------------------------------- Job
+
+// mirrorJob runs the downloads of a mirror, shown as one item
+type mirrorJob struct {
+	myapp   *MyApp
+	rootURL string
+	options mirrorOptions
+	item    *FileItem
+	wake    chan struct{}
+	ctx     context.Context // done once the mirror is cancelled
+	stop    context.CancelFunc
+
+	mu        sync.Mutex
+	tasks     []*mirrorTask
+	paused    bool
+	cancelled bool
+	skipped   int
+	failed    int
+}
+
+// mirrorTask is one file of the mirror, its Download is grouped under the mirror's url
+type mirrorTask struct {
+	fileInfo FileInfo
+	id       string
+	status   string // empty until it's started
+	progress float64
+	err      error // what stopped it, a failed file pauses itself
+	cancel   context.CancelFunc
+	pause    context.CancelFunc
+}
+
+func startMirror(myapp *MyApp, rootURL string, options mirrorOptions) {
+	name := path.Base(strings.TrimSuffix(rootURL, "/")) + "/"
+	item, _, _ := makeFileItem(myapp, FileInfo{FileName: name})
+	job := &mirrorJob{myapp: myapp, rootURL: rootURL, options: options, item: item, wake: make(chan struct{}, 1)}
+	job.ctx, job.stop = context.WithCancel(myapp.AppContext)
+
+	// The item's buttons act on all of the files
+	item.Row.Pause = func() {
+		job.setPaused(true)
+	}
+	item.Row.Resume = func() {
+		job.setPaused(false)
+	}
+	item.Row.Cancel = func() {
+		job.cancelAll()
+		myapp.Downloads.remove(item.Row)
+	}
+	go job.run()
+}
+
+func (job *mirrorJob) run() {
+	defer job.stop()
+	job.item.setSpeed("Reading the listing...")
+	files, err := crawlListing(job.ctx, job.myapp, job.rootURL, job.options)
+	if err != nil {
+		if job.ctx.Err() == nil {
+			job.finish(fmt.Sprintf("Failed: %v", err))
+			job.myapp.showError(fmt.Errorf("couldnt read the listing: %v", err))
+		}
+		return
+	}
+	job.probe(job.ctx, files)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var lastBytes float64
+	for {
+		job.mu.Lock()
+		if job.cancelled {
+			job.mu.Unlock()
+			return
+		}
+		running, left := 0, 0
+		for _, task := range job.tasks {
+			switch task.status {
+			case "Running":
+				running++
+				left++
+			case "", "Paused":
+				left++
+			}
+		}
+		if !job.paused {
+			for _, task := range job.tasks {
+				if running == mirrorParallelFiles {
+					break
+				}
+				if task.status == "" {
+					job.startTask(task)
+					running++
+				}
+			}
+		}
+		done, total := job.bytes()
+		finished := len(job.tasks) - left
+		job.mu.Unlock()
+
+		if left == 0 {
+			break
+		}
+		select {
+		case <-job.wake:
+		case <-ticker.C:
+			if total > 0 {
+				job.item.setProgress(done / total)
+			}
+			job.item.setSpeed(fmt.Sprintf("%d/%d files, %.2f MB/s", finished, len(job.tasks), max(done-lastBytes, 0)/(1024*1024)))
+			lastBytes = done
+		}
+	}
+
+	job.mu.Lock()
+	downloaded := 0
+	for _, task := range job.tasks {
+		if task.status == "Finished" {
+			downloaded++
+		}
+	}
+	summary := fmt.Sprintf("%d downloaded", downloaded)
+	if job.skipped > 0 {
+		summary += fmt.Sprintf(", %d unchanged", job.skipped)
+	}
+	if job.failed > 0 {
+		summary += fmt.Sprintf(", %d failed", job.failed)
+	}
+	job.mu.Unlock()
+	job.finish(summary)
+}
+
+// probe asks about every file, the ones already mirrored are left out
+func (job *mirrorJob) probe(ctx context.Context, files []mirrorFile) {
+	job.item.setSpeed(fmt.Sprintf("Checking %d files...", len(files)))
+	client := job.myapp.clientFor(nil, job.rootURL)
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, batchProbes)
+	for _, file := range files {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			// The source's own probe, a .torrent or .m3u8 in the listing is mirrored as a file
+			var fileInfo FileInfo
+			source, err := sourceFor(client, file.URL)
+			if err == nil {
+				fileInfo, err = source.Probe(ctx, file.URL)
+			}
+
+			job.mu.Lock()
+			defer job.mu.Unlock()
+			if err != nil {
+				logger.Println("Error probing", file.URL+":", err)
+				job.failed++
+				return
+			}
+			fileInfo.URL = file.URL
+			fileInfo.FileName = path.Base(file.RelPath)
+			fileInfo.FilePath = filepath.Join(job.options.Dir, filepath.FromSlash(file.RelPath))
+			fileInfo.Group = job.rootURL
+			if unchanged(fileInfo.FilePath, fileInfo) {
+				job.skipped++
+				return
+			}
+			job.tasks = append(job.tasks, &mirrorTask{fileInfo: fileInfo})
+		}()
+	}
+	wg.Wait()
+}
+
+// startTask starts the download of a file, job.mu is held
+func (job *mirrorJob) startTask(task *mirrorTask) {
+	if err := os.MkdirAll(filepath.Dir(task.fileInfo.FilePath), 0755); err != nil {
+		logger.Println("Error creating the folder:", err)
+		task.status = "Failed"
+		job.failed++
+		return
+	}
+	task.id = uuid.New().String()
+	task.status = "Running"
+	ctx, cancel := context.WithCancel(job.myapp.AppContext)
+	ctxP, cancelP := context.WithCancel(job.myapp.AppContext)
+	task.cancel, task.pause = cancel, cancelP
+	go ConfirmURL(job.myapp, task.fileInfo, job.taskItem(task), ctx, ctxP, nil, nil)
+}
+
+// resumeTask goes on with a paused file, job.mu is held
+func (job *mirrorJob) resumeTask(task *mirrorTask) {
+	task.status = "Running"
+	task.err = nil
+	cancelC := make(chan context.CancelFunc, 1)
+	pauseC := make(chan context.CancelFunc, 1)
+	go ResumeDownload(job.myapp, job.taskItem(task), cancelC, pauseC)
+	task.cancel, task.pause = <-cancelC, <-pauseC
+}
+
+// taskItem is the headless item a file of the mirror downloads with
+func (job *mirrorJob) taskItem(task *mirrorTask) *FileItem {
+	fileItem := &FileItem{ID: task.id, NoActions: true}
+	fileItem.OnProgress = func(value float64) {
+		job.mu.Lock()
+		task.progress = value
+		job.mu.Unlock()
+	}
+	fileItem.OnError = func(err error) {
+		logger.Println("Error mirroring", task.fileInfo.URL+":", err)
+		job.mu.Lock()
+		task.err = err
+		job.mu.Unlock()
+	}
+	fileItem.OnStop = func(status string) {
+		job.mu.Lock()
+		// Paused by its own error rather than by the mirror's pause button
+		if status == "Paused" && task.err != nil {
+			status = "Failed"
+		}
+		task.status = status
+		switch status {
+		case "Finished":
+			task.progress = 1
+			// The server's date, the next run compares it
+			if !task.fileInfo.ModTime.IsZero() {
+				os.Chtimes(task.fileInfo.FilePath, task.fileInfo.ModTime, task.fileInfo.ModTime)
+			}
+		case "Paused", "Cancelled":
+		default:
+			job.failed++
+		}
+		job.mu.Unlock()
+		job.signal()
+	}
+	return fileItem
+}
+
+// bytes is how much of the mirror is downloaded, job.mu is held
+func (job *mirrorJob) bytes() (done, total float64) {
+	for _, task := range job.tasks {
+		size := float64(max(task.fileInfo.Total, 0))
+		total += size
+		done += size * task.progress
+	}
+	return done, total
+}
+
+func (job *mirrorJob) setPaused(paused bool) {
+	job.mu.Lock()
+	job.paused = paused
+	for _, task := range job.tasks {
+		switch {
+		case paused && task.status == "Running":
+			task.pause()
+		case !paused && task.status == "Paused":
+			job.resumeTask(task)
+		}
+	}
+	job.mu.Unlock()
+	job.signal()
+}
+
+// cancelAll stops the mirror, the files it didn't finish are deleted and
+// forgotten. The finished ones stay
+func (job *mirrorJob) cancelAll() {
+	job.stop()
+	job.mu.Lock()
+	job.cancelled = true
+	var unfinished []*mirrorTask
+	for _, task := range job.tasks {
+		switch task.status {
+		case "Running":
+			// Its download deletes what it wrote
+			task.cancel()
+			unfinished = append(unfinished, task)
+		case "Paused", "Failed":
+			// Nothing runs that would delete it
+			task.status = "Cancelled"
+			if err := deleteDownloadFiles(Download{FilePath: task.fileInfo.FilePath}); err != nil {
+				logger.Println("Error deleting", task.fileInfo.FilePath+":", err)
+			}
+			unfinished = append(unfinished, task)
+		}
+	}
+	job.mu.Unlock()
+	job.signal()
+
+	// Paused files were saved to the database
+	for _, task := range unfinished {
+		if err := removeDownload(job.myapp.DownloadStateFilePath, task.id); err != nil {
+			logger.Println("Error removing", task.fileInfo.FileName, "from the database:", err)
+		}
+	}
+}
+
+func (job *mirrorJob) signal() {
+	select {
+	case job.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (job *mirrorJob) finish(summary string) {
+	job.item.setProgress(1)
+	job.item.setSpeed(summary)
+	downloadFinished(job.item)
+}
+
+// ----------------------------------------------- UI
+
+func MirrorFunc(myapp *MyApp) func() {
+	return func() {
+		showMirror(myapp)
+	}
+}
+
+// showMirror asks for the listing to mirror and where to put it
+func showMirror(myapp *MyApp) {
+	urlEntry := widget.NewEntry()
+	urlEntry.SetPlaceHolder("https://example.com/pub/releases/")
+	dirEntry := widget.NewEntry()
+	dirEntry.SetPlaceHolder("empty for the DownBit downloads folder")
+	includeEntry := widget.NewEntry()
+	includeEntry.SetPlaceHolder("e.g. *.iso *.sha256, empty for all")
+	excludeEntry := widget.NewEntry()
+	excludeEntry.SetPlaceHolder("e.g. old beta/*")
+	depthEntry := widget.NewEntry()
+	depthEntry.SetText("5")
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("Listing", urlEntry),
+		widget.NewFormItem("Save to", dirEntry),
+		widget.NewFormItem("Include", includeEntry),
+		widget.NewFormItem("Exclude", excludeEntry),
+		widget.NewFormItem("Depth", depthEntry),
+	}
+	form := dialog.NewForm("Mirror folder", "Mirror", "Cancel", items, func(confirm bool) {
+		rootURL := strings.TrimSpace(urlEntry.Text)
+		if !confirm || rootURL == "" {
+			return
+		}
+		options := mirrorOptions{
+			Dir:     strings.TrimSpace(dirEntry.Text),
+			Include: strings.Fields(includeEntry.Text),
+			Exclude: strings.Fields(excludeEntry.Text),
+		}
+		depth, err := strconv.Atoi(strings.TrimSpace(depthEntry.Text))
+		if err != nil || depth < 0 {
+			myapp.showError(fmt.Errorf("the depth is a number of folders, 0 for just this one"))
+			return
+		}
+		options.MaxDepth = depth
+
+		// Into a folder named like the listing's
+		if options.Dir == "" {
+			downloadsFolder, err := getDownloadD()
+			if err != nil {
+				myapp.showError(err)
+				return
+			}
+			options.Dir = filepath.Join(downloadsFolder, "DownBitDownloads")
+		}
+		if name, err := url.PathUnescape(path.Base(strings.TrimSuffix(rootURL, "/"))); err == nil && filepath.IsLocal(name) {
+			options.Dir = filepath.Join(options.Dir, name)
+		}
+		startMirror(myapp, rootURL, options)
+	}, myapp.MainWindow)
+	form.Resize(fyne.NewSize(480, 0))
+	form.Show()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A file whose download fails is counted as failed and the mirror still finishes
+func TestMirrorFailedFile(t *testing.T) {
+	content := testSFTPContent(5000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pub/":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><body><a href="../">Parent</a><a href="good.bin">good.bin</a><a href="broken.bin">broken.bin</a></body></html>`)
+		case "/pub/good.bin":
+			http.ServeContent(w, r, "good.bin", time.Time{}, bytes.NewReader(content))
+		case "/pub/broken.bin":
+			// It looks fine until it's downloaded
+			if r.Method == http.MethodHead {
+				w.Header().Set("Content-Length", "5000")
+				return
+			}
+			http.Error(w, "broken", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	myapp := testHeadlessApp(t)
+	var mu sync.Mutex
+	var summary string
+	dir := t.TempDir()
+	job := &mirrorJob{
+		myapp:   myapp,
+		rootURL: server.URL + "/pub/",
+		options: mirrorOptions{Dir: dir},
+		item: &FileItem{OnSpeed: func(text string) {
+			mu.Lock()
+			summary = text
+			mu.Unlock()
+		}},
+		wake: make(chan struct{}, 1),
+	}
+	job.ctx, job.stop = context.WithCancel(myapp.AppContext)
+
+	done := make(chan struct{})
+	go func() {
+		job.run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		job.cancelAll()
+		t.Fatal("the mirror never finished")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if summary != "1 downloaded, 1 failed" {
+		t.Errorf("summary = %q, want %q", summary, "1 downloaded, 1 failed")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "good.bin"))
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("good.bin wasn't mirrored (%v)", err)
+	}
+}
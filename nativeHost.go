@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A browser extension hands downloads over to DownBit through native
+// messaging: the browser starts `downbit` as the host and both sides talk
+// in JSON messages, each prefixed with its length as a 32 bit little
+// endian number. Every message is answered with a nativeReply.
+
+const nativeHostName = "com.bardia49.downbit"
+
+// Browsers cap what a host may send at 1MB, we don't take more either
+const maxNativeMessage = 1024 * 1024
+
+// nativeMessage is what the extension sends for a download
+type nativeMessage struct {
+	URL       string `json:"url"`
+	Cookies   string `json:"cookies"`
+	Referer   string `json:"referer"`
+	FileName  string `json:"filename"`
+	UserAgent string `json:"user_agent"`
+}
+
+type nativeReply struct {
+	OK    bool   `json:"ok"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// isBrowserLaunch tells if the browser started us as the host, chrome passes
+// the extension's origin, firefox the path of the host manifest
+func isBrowserLaunch(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	if strings.HasPrefix(args[0], "chrome-extension://") {
+		return true
+	}
+	return len(args) == 2 && filepath.IsAbs(args[0]) && strings.HasSuffix(args[0], ".json")
+}
+
+func cliNativeHost(myapp *MyApp, args []string) int {
+	flags := flag.NewFlagSet("native-host", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "answer the messages without adding the downloads")
+	manifest := flags.String("manifest", "", "print the host manifest for chrome or firefox")
+	extension := flags.String("extension", "", "id of the extension allowed to use the host (with -manifest)")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *manifest != "" {
+		return printNativeManifest(*manifest, *extension)
+	}
+
+	handle := func(message nativeMessage) (string, error) {
+		return handOver(myapp, message)
+	}
+	if *dryRun {
+		handle = func(message nativeMessage) (string, error) {
+			return "", nil
+		}
+	}
+	if err := serveNativeMessages(os.Stdin, cliStdout, handle); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+	return exitOK
+}
+
+// serveNativeMessages answers the messages on in until the browser closes it
+func serveNativeMessages(in io.Reader, out io.Writer, handle func(message nativeMessage) (string, error)) error {
+	for {
+		data, err := readNativeMessage(in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var reply nativeReply
+		var message nativeMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			reply.Error = fmt.Sprintf("invalid message: %v", err)
+		} else if message.URL == "" {
+			reply.Error = "the message has no url"
+		} else if id, err := handle(message); err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.OK, reply.ID = true, id
+		}
+		if err := writeNativeMessage(out, reply); err != nil {
+			return err
+		}
+	}
+}
+
+// readNativeMessage reads one framed message, io.EOF when there are no more
+func readNativeMessage(in io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(in, binary.LittleEndian, &length); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated message length")
+		}
+		return nil, err
+	}
+	if length > maxNativeMessage {
+		return nil, fmt.Errorf("message of %d bytes is too big", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return nil, fmt.Errorf("truncated message: %v", err)
+	}
+	return data, nil
+}
+
+func writeNativeMessage(out io.Writer, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	frame := binary.LittleEndian.AppendUint32(nil, uint32(len(data)))
+	_, err = out.Write(append(frame, data...))
+	return err
+}
+
+// handOver adds the download to the running daemon, starting one if needed
+func handOver(myapp *MyApp, message nativeMessage) (string, error) {
+	databasePath := filepath.Dir(myapp.DownloadStateFilePath)
+	remote := findDaemon(databasePath)
+	if remote == nil {
+		var err error
+		if remote, err = startDaemon(databasePath); err != nil {
+			return "", err
+		}
+	}
+
+	request := AddRequest{URL: message.URL, FileName: message.FileName}
+	if message.Cookies != "" || message.Referer != "" || message.UserAgent != "" {
+		request.Headers = &Headers{Cookie: message.Cookies, Referer: message.Referer, UserAgent: message.UserAgent}
+	}
+	state, err := remote.add(request)
+	if err != nil {
+		return "", err
+	}
+	return state.ID, nil
+}
+
+// printNativeManifest prints what goes in the browser's NativeMessagingHosts
+// folder (or the registry on windows) as com.bardia49.downbit.json
+func printNativeManifest(browser, extension string) int {
+	if extension == "" {
+		fmt.Fprintln(os.Stderr, "-manifest needs the -extension id")
+		return exitUsage
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return exitFailed
+	}
+
+	manifest := map[string]any{
+		"name":        nativeHostName,
+		"description": "DownBit download manager",
+		"path":        executable,
+		"type":        "stdio",
+	}
+	switch browser {
+	case "chrome":
+		manifest["allowed_origins"] = []string{"chrome-extension://" + extension + "/"}
+	case "firefox":
+		manifest["allowed_extensions"] = []string{extension}
+	default:
+		fmt.Fprintln(os.Stderr, "-manifest is chrome or firefox")
+		return exitUsage
+	}
+	data, _ := json.MarshalIndent(manifest, "", "  ")
+	cliPrintln(string(data))
+	return exitOK
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// nativeFrame frames data like the browser does
+func nativeFrame(data string) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...)
+}
+
+// readNativeReplies reads back everything the host answered
+func readNativeReplies(t *testing.T, out *bytes.Buffer) []nativeReply {
+	t.Helper()
+	var replies []nativeReply
+	for {
+		data, err := readNativeMessage(out)
+		if errors.Is(err, io.EOF) {
+			return replies
+		}
+		if err != nil {
+			t.Fatalf("bad reply frame: %v", err)
+		}
+		var reply nativeReply
+		if err := json.Unmarshal(data, &reply); err != nil {
+			t.Fatalf("bad reply %q: %v", data, err)
+		}
+		replies = append(replies, reply)
+	}
+}
+
+func TestServeNativeMessages(t *testing.T) {
+	oversized := binary.LittleEndian.AppendUint32(nil, maxNativeMessage+1)
+
+	tests := []struct {
+		name    string
+		in      []byte
+		replies []nativeReply
+		err     string // what serving stops with, empty when the input just ends
+	}{
+		{
+			name:    "valid",
+			in:      nativeFrame(`{"url":"https://example.com/a.zip","cookies":"a=b"}`),
+			replies: []nativeReply{{OK: true, ID: "https://example.com/a.zip"}},
+		},
+		{
+			name: "several",
+			in: append(nativeFrame(`{"url":"https://example.com/a.zip"}`),
+				nativeFrame(`{"url":"https://example.com/b.zip"}`)...),
+			replies: []nativeReply{{OK: true, ID: "https://example.com/a.zip"}, {OK: true, ID: "https://example.com/b.zip"}},
+		},
+		{
+			name: "bad json is answered and the next message still served",
+			in:   append(nativeFrame(`{"url":`), nativeFrame(`{"url":"https://example.com/a.zip"}`)...),
+			replies: []nativeReply{
+				{Error: "invalid message: unexpected end of JSON input"},
+				{OK: true, ID: "https://example.com/a.zip"},
+			},
+		},
+		{
+			name:    "no url",
+			in:      nativeFrame(`{"referer":"https://example.com"}`),
+			replies: []nativeReply{{Error: "the message has no url"}},
+		},
+		{
+			name:    "handler error",
+			in:      nativeFrame(`{"url":"https://example.com/fail"}`),
+			replies: []nativeReply{{Error: "no daemon"}},
+		},
+		{
+			name: "oversized",
+			in:   append(oversized, make([]byte, 16)...),
+			err:  "too big",
+		},
+		{
+			name: "truncated length",
+			in:   []byte{5, 0},
+			err:  "truncated message length",
+		},
+		{
+			name:    "truncated message",
+			in:      append(nativeFrame(`{"url":"https://example.com/a.zip"}`), nativeFrame(`{"url":"https://example.com/b.zip"}`)[:10]...),
+			replies: []nativeReply{{OK: true, ID: "https://example.com/a.zip"}},
+			err:     "truncated message",
+		},
+		{
+			name: "nothing",
+			in:   nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := serveNativeMessages(bytes.NewReader(test.in), &out, func(message nativeMessage) (string, error) {
+				if strings.HasSuffix(message.URL, "/fail") {
+					return "", errors.New("no daemon")
+				}
+				return message.URL, nil
+			})
+			switch {
+			case test.err == "" && err != nil:
+				t.Errorf("serving failed: %v", err)
+			case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+				t.Errorf("serving returned %v, want an error with %q", err, test.err)
+			}
+
+			replies := readNativeReplies(t, &out)
+			if len(replies) != len(test.replies) {
+				t.Fatalf("got %d replies %+v, want %d", len(replies), replies, len(test.replies))
+			}
+			for i, reply := range replies {
+				if reply != test.replies[i] {
+					t.Errorf("reply %d = %+v, want %+v", i, reply, test.replies[i])
+				}
+			}
+		})
+	}
+}
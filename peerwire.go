@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Peer wire message ids (BEP 3 and BEP 10)
+const (
+	msgChoke         = 0
+	msgUnchoke       = 1
+	msgInterested    = 2
+	msgNotInterested = 3
+	msgHave          = 4
+	msgBitfield      = 5
+	msgRequest       = 6
+	msgPiece         = 7
+	msgCancel        = 8
+	msgExtended      = 20
+)
+
+const (
+	blockSize      = 16 * 1024
+	maxMessageSize = 256 * 1024
+
+	// our id for ut_metadata messages (BEP 9), peers send them with it
+	utMetadataID = 1
+)
+
+var protocolName = []byte("BitTorrent protocol")
+
+type peerMessage struct {
+	ID      byte
+	Payload []byte
+}
+
+func writeHandshake(w io.Writer, infoHash, peerID [20]byte) error {
+	handshake := make([]byte, 0, 68)
+	handshake = append(handshake, byte(len(protocolName)))
+	handshake = append(handshake, protocolName...)
+	reserved := make([]byte, 8)
+	reserved[5] |= 0x10 // extension protocol
+	handshake = append(handshake, reserved...)
+	handshake = append(handshake, infoHash[:]...)
+	handshake = append(handshake, peerID[:]...)
+	_, err := w.Write(handshake)
+	return err
+}
+
+// readHandshake returns the info hash, peer id and whether the peer speaks
+// the extension protocol
+func readHandshake(r io.Reader) ([20]byte, [20]byte, bool, error) {
+	var infoHash, peerID [20]byte
+	handshake := make([]byte, 68)
+	if _, err := io.ReadFull(r, handshake); err != nil {
+		return infoHash, peerID, false, err
+	}
+	if handshake[0] != byte(len(protocolName)) || !bytes.Equal(handshake[1:20], protocolName) {
+		return infoHash, peerID, false, errors.New("not a bittorrent peer")
+	}
+	copy(infoHash[:], handshake[28:48])
+	copy(peerID[:], handshake[48:68])
+	return infoHash, peerID, handshake[25]&0x10 != 0, nil
+}
+
+// readMessage reads the next message, nil is a keep-alive
+func readMessage(r io.Reader) (*peerMessage, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("peer message too long (%d bytes)", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &peerMessage{ID: buf[0], Payload: buf[1:]}, nil
+}
+
+func encodeMessage(id byte, payload []byte) []byte {
+	buf := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(payload)))
+	buf[4] = id
+	copy(buf[5:], payload)
+	return buf
+}
+
+// requestPayload is the payload of request, cancel and have (index only) messages
+func requestPayload(index, begin, length int) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:], uint32(length))
+	return payload
+}
+
+func havePayload(index int) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return payload
+}
+
+// ----------------------------------------------- Bitfield
+
+type bitfield []byte
+
+func newBitfield(n int) bitfield {
+	return make(bitfield, (n+7)/8)
+}
+
+func (b bitfield) has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]&(0x80>>(index%8)) != 0
+}
+
+// set grows the bitfield when a peer says it has a piece we can't place yet
+func (b *bitfield) set(index int) {
+	for index/8 >= len(*b) {
+		*b = append(*b, 0)
+	}
+	(*b)[index/8] |= 0x80 >> (index % 8)
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Post actions run on a finished download: a command, moving it, opening it,
+// extracting it or showing it in the file manager. A download can have its
+// own, otherwise its category's from the settings are used. What they did
+// goes to the download's log.
+
+// PostAction is one thing to do with a finished download
+type PostAction struct {
+	Kind string `json:"kind"`          // one of postActionKinds
+	Arg  string `json:"arg,omitempty"` // the command line or the folder to move to
+}
+
+var postActionKinds = []string{"command", "move", "open", "extract", "reveal"}
+
+// downloadCategory groups files by extension, like the folders of other download managers
+type downloadCategory struct {
+	Name       string
+	Extensions []string
+}
+
+// Anything that isn't in one of them is Other
+var downloadCategories = []downloadCategory{
+	{"Compressed", []string{".zip", ".rar", ".7z", ".tar", ".gz", ".tgz", ".xz", ".txz", ".zst", ".tzst", ".bz2"}},
+	{"Documents", []string{".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx", ".odt", ".txt", ".epub"}},
+	{"Music", []string{".mp3", ".flac", ".wav", ".ogg", ".m4a", ".aac", ".opus"}},
+	{"Video", []string{".mp4", ".mkv", ".avi", ".mov", ".webm", ".ts", ".m4v"}},
+	{"Programs", []string{".exe", ".msi", ".dmg", ".pkg", ".deb", ".rpm", ".appimage", ".apk", ".iso"}},
+}
+
+const otherCategory = "Other"
+
+// A command that runs longer than this is stopped
+const postCommandTimeout = 30 * time.Minute
+
+// Only the end of a command's output is logged
+const maxLoggedOutput = 4096
+
+func categoryOf(fileName string) string {
+	extension := strings.ToLower(filepath.Ext(fileName))
+	for _, category := range downloadCategories {
+		for _, candidate := range category.Extensions {
+			if extension == candidate {
+				return category.Name
+			}
+		}
+	}
+	return otherCategory
+}
+
+func categoryNames() []string {
+	var names []string
+	for _, category := range downloadCategories {
+		names = append(names, category.Name)
+	}
+	return append(names, otherCategory)
+}
+
+// categoryActions reads the actions of every category from the settings
+func categoryActions(prefs fyne.Preferences) map[string][]PostAction {
+	actions := map[string][]PostAction{}
+	if saved := prefs.String(prefPostActions); saved != "" {
+		if err := json.Unmarshal([]byte(saved), &actions); err != nil {
+			logger.Println("Error reading the post actions:", err)
+		}
+	}
+	return actions
+}
+
+func saveCategoryActions(prefs fyne.Preferences, actions map[string][]PostAction) {
+	saved, _ := json.Marshal(actions)
+	prefs.SetString(prefPostActions, string(saved))
+}
+
+// runPostActions runs the actions of a finished download one after the
+// other, the first one that fails stops the rest
+func runPostActions(myapp *MyApp, fileItem *FileItem, download Download) {
+	if download.Status != "Finished" || fileItem.NoActions {
+		return
+	}
+	prefs := myapp.App.Preferences()
+	actions := download.Actions
+	if len(actions) == 0 {
+		actions = categoryActions(prefs)[categoryOf(download.FileName)]
+	}
+	// Archives go first, the other actions may want what's inside
+	if prefs.Bool(prefAutoExtract) && archiveKind(download.FilePath) != "" && !hasAction(actions, "extract") {
+		actions = append([]PostAction{{Kind: "extract"}}, actions...)
+	}
+	if len(actions) == 0 {
+		return
+	}
+
+	for _, action := range actions {
+		fileItem.setSpeed("Running " + action.Kind + "...")
+		text, err := runPostAction(myapp, fileItem, &download, action)
+		if err != nil {
+			text = strings.TrimSpace(text + "\n" + action.Kind + " failed: " + err.Error())
+		}
+		logDownload(myapp, download.ID, text, download.FilePath)
+		if err != nil {
+			logger.Println("Error running", action.Kind, "on", download.FileName+":", err)
+			fileItem.setSpeed(action.Kind + " failed")
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("%s of %s failed: %v", action.Kind, download.FileName, err))
+			break
+		}
+		fileItem.setSpeed("Done")
+	}
+	// The Log button of its row shows what they did
+	if fileItem.Row != nil {
+		fileItem.Row.table.change(fileItem.Row, func(row *downloadRow) { row.HasLog = true })
+	}
+}
+
+func hasAction(actions []PostAction, kind string) bool {
+	for _, action := range actions {
+		if action.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// runPostAction returns what to log about the action
+func runPostAction(myapp *MyApp, fileItem *FileItem, download *Download, action PostAction) (string, error) {
+	switch action.Kind {
+	case "command":
+		return runPostCommand(myapp.AppContext, action.Arg, *download)
+	case "move":
+		moved, err := moveFile(download.FilePath, expandHome(action.Arg))
+		if err != nil {
+			return "", err
+		}
+		download.FilePath = moved
+		return "moved to " + moved, nil
+	case "open":
+		return "opened " + download.FilePath, openPath(download.FilePath)
+	case "reveal":
+		return "showed " + download.FilePath, revealPath(download.FilePath)
+	case "extract":
+		return extractDownload(myapp, fileItem, download)
+	}
+	return "", fmt.Errorf("unknown action %q", action.Kind)
+}
+
+// extractDownload extracts the archive into a sibling folder, on the
+// download's own progress bar
+func extractDownload(myapp *MyApp, fileItem *FileItem, download *Download) (string, error) {
+	target := extractTarget(download.FilePath)
+	fileItem.setProgress(0)
+	count, err := extractArchive(myapp.AppContext, download.FilePath, target, func(value float64) {
+		fileItem.setProgress(value)
+		fileItem.setSpeed(fmt.Sprintf("Extracting %.0f%%", value*100))
+	})
+	fileItem.setProgress(1)
+	if err != nil {
+		// Half an archive is no use to anyone
+		os.RemoveAll(target)
+		return "", err
+	}
+	text := fmt.Sprintf("extracted %d files to %s", count, target)
+	if myapp.App.Preferences().Bool(prefExtractDelete) {
+		if err := os.Remove(download.FilePath); err != nil {
+			return text, err
+		}
+		// The folder is what's left of the download
+		text += ", deleted " + filepath.Base(download.FilePath)
+		download.FilePath = target
+	}
+	return text, nil
+}
+
+// runPostCommand runs command with the download filled in, it isn't handed
+// to a shell so a file name can't add commands of its own
+func runPostCommand(ctx context.Context, command string, download Download) (string, error) {
+	args, err := splitCommandLine(command)
+	if err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", fmt.Errorf("the command is empty")
+	}
+	for i := range args {
+		if args[i], err = expandPostTemplate(args[i], &download); err != nil {
+			return "", err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, postCommandTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	exitCode := 0
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		exitCode = exitErr.ExitCode()
+	case err != nil:
+		return "", err
+	}
+
+	text := fmt.Sprintf("%s exited with %d", strings.Join(args, " "), exitCode)
+	if trimmed := strings.TrimSpace(string(output)); trimmed != "" {
+		if len(trimmed) > maxLoggedOutput {
+			trimmed = "..." + trimmed[len(trimmed)-maxLoggedOutput:]
+		}
+		text += "\n" + trimmed
+	}
+	if exitCode != 0 {
+		return text, fmt.Errorf("exit status %d", exitCode)
+	}
+	return text, nil
+}
+
+// expandPostTemplate fills {path}, {dir}, {name}, {url} and {sha256} in,
+// the hash is kept in download for the next argument
+func expandPostTemplate(arg string, download *Download) (string, error) {
+	if strings.Contains(arg, "{sha256}") && download.Checksum == "" {
+		// Only downloads with a hash to check against were hashed when they finished
+		checksum, err := fileSHA256(download.FilePath)
+		if err != nil {
+			return "", fmt.Errorf("could not hash %s: %v", download.FileName, err)
+		}
+		download.Checksum = checksum
+	}
+	return strings.NewReplacer(
+		"{path}", download.FilePath,
+		"{dir}", filepath.Dir(download.FilePath),
+		"{name}", filepath.Base(download.FilePath),
+		"{url}", download.URL,
+		"{sha256}", download.Checksum,
+	).Replace(arg), nil
+}
+
+// splitCommandLine splits on spaces, "double" and 'single' quotes keep
+// spaces and a backslash escapes the next character outside single quotes
+func splitCommandLine(command string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inArg, escaped := false, false
+	var quote rune
+	for _, char := range command {
+		switch {
+		case escaped:
+			current.WriteRune(char)
+			escaped = false
+		case char == '\\' && quote != '\'' && runtime.GOOS != "windows":
+			escaped, inArg = true, true
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			} else {
+				current.WriteRune(char)
+			}
+		case char == '"' || char == '\'':
+			quote, inArg = char, true
+		case char == ' ' || char == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(char)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed %c in the command", quote)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// moveFile moves filePath (a file or a torrent's folder) into dir and
+// returns where it is now
+func moveFile(filePath, dir string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("no folder to move to")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, filepath.Base(filePath))
+	if _, err := os.Lstat(target); err == nil {
+		return "", fmt.Errorf("%s already exists", target)
+	}
+	if err := os.Rename(filePath, target); err == nil {
+		return target, nil
+	}
+
+	// Another disk, copy it over and then remove it
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	if stat.IsDir() {
+		return "", fmt.Errorf("can't move the folder %s to another disk", filePath)
+	}
+	if err := copyFile(filePath, target); err != nil {
+		os.Remove(target)
+		return "", err
+	}
+	return target, os.Remove(filePath)
+}
+
+func copyFile(from, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(target, source); err != nil {
+		target.Close()
+		return err
+	}
+	return target.Close()
+}
+
+// expandHome lets the settings say ~/Videos
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, strings.TrimPrefix(path, "~"))
+		}
+	}
+	return path
+}
+
+// openPath opens the file with its default app
+func openPath(path string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", path).Start()
+	case "darwin":
+		return exec.Command("open", path).Start()
+	}
+	return exec.Command("xdg-open", path).Start()
+}
+
+// revealPath shows the file in the file manager, selected where it can be
+func revealPath(path string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("explorer", "/select,", path).Start()
+	case "darwin":
+		return exec.Command("open", "-R", path).Start()
+	}
+	return exec.Command("xdg-open", filepath.Dir(path)).Start()
+}
+
+// logDownload adds a line to the log of the download with id, filePath is
+// where the download is now
+func logDownload(myapp *MyApp, id, text, filePath string) {
+	download, err := isFileExistByID(myapp.DownloadStateFilePath, id)
+	if err != nil {
+		return // removed meanwhile
+	}
+	download.Log = append(download.Log, time.Now().Format("2006-01-02 15:04:05")+" "+text)
+	download.FilePath = filePath
+	download.UpdatedAt = time.Now().String()
+	saveDownloadFileInfo(download, myapp.DownloadStateFilePath)
+}
+
+// ----------------------------------------------- UI
+
+func showDownloadLog(myapp *MyApp, id string) {
+	download, err := isFileExistByID(myapp.DownloadStateFilePath, id)
+	if err != nil {
+		myapp.showError(fmt.Errorf("couldnt read the log: %v", err))
+		return
+	}
+	logEntry := widget.NewMultiLineEntry()
+	logEntry.SetText(strings.Join(download.Log, "\n"))
+	logEntry.Wrapping = fyne.TextWrapWord
+	logEntry.Disable()
+	logDialog := dialog.NewCustom(download.FileName, "Close", logEntry, myapp.MainWindow)
+	logDialog.Resize(fyne.NewSize(560, 360))
+	logDialog.Show()
+}
+
+// actionsEditor edits a list of actions, actions returns them as they are now
+func actionsEditor(initial []PostAction) (content fyne.CanvasObject, actions func() []PostAction) {
+	type row struct {
+		kind *widget.Select
+		arg  *widget.Entry
+	}
+	var rows []*row
+	list := container.NewVBox()
+
+	var addRow func(action PostAction)
+	addRow = func(action PostAction) {
+		r := &row{arg: widget.NewEntry()}
+		r.arg.SetText(action.Arg)
+		r.kind = widget.NewSelect(postActionKinds, func(kind string) {
+			switch kind {
+			case "command":
+				r.arg.SetPlaceHolder("e.g. sha256sum -c {path}.sha256, also {dir} {name} {url} {sha256}")
+				r.arg.Enable()
+			case "move":
+				r.arg.SetPlaceHolder("folder, e.g. ~/Videos")
+				r.arg.Enable()
+			default:
+				r.arg.SetPlaceHolder("")
+				r.arg.Disable()
+			}
+		})
+		r.kind.SetSelected(action.Kind)
+		rows = append(rows, r)
+
+		var line *fyne.Container
+		remove := widget.NewButtonWithIcon("", theme.DeleteIcon(), func() {
+			for i := range rows {
+				if rows[i] == r {
+					rows = append(rows[:i], rows[i+1:]...)
+					break
+				}
+			}
+			list.Remove(line)
+		})
+		line = container.NewBorder(nil, nil, r.kind, remove, r.arg)
+		list.Add(line)
+	}
+	for _, action := range initial {
+		addRow(action)
+	}
+
+	add := widget.NewButtonWithIcon("Add action", theme.ContentAddIcon(), func() {
+		addRow(PostAction{Kind: "command"})
+	})
+	actions = func() []PostAction {
+		var result []PostAction
+		for _, r := range rows {
+			if r.kind.Selected == "" || (r.kind.Selected == "command" || r.kind.Selected == "move") && strings.TrimSpace(r.arg.Text) == "" {
+				continue
+			}
+			action := PostAction{Kind: r.kind.Selected}
+			if !r.arg.Disabled() {
+				action.Arg = strings.TrimSpace(r.arg.Text)
+			}
+			result = append(result, action)
+		}
+		return result
+	}
+	return container.NewBorder(nil, add, nil, nil, container.NewVScroll(list)), actions
+}
+
+// showDownloadActions edits the actions of the download about to be added
+func showDownloadActions(myapp *MyApp, actions []PostAction, done func([]PostAction)) {
+	content, current := actionsEditor(actions)
+	editor := dialog.NewCustomConfirm("After this download", "OK", "Cancel",
+		container.NewBorder(widget.NewLabel("Instead of the ones of its category, in this order"), nil, nil, nil, content),
+		func(confirm bool) {
+			if confirm {
+				done(current())
+			}
+		}, myapp.MainWindow)
+	editor.Resize(fyne.NewSize(620, 340))
+	editor.Show()
+}
+
+// showCategoryActions edits what happens after the downloads of each category
+func showCategoryActions(myapp *MyApp) {
+	prefs := myapp.App.Preferences()
+	all := categoryActions(prefs)
+
+	var current func() []PostAction
+	var category string
+	editorBox := container.NewStack()
+	categorySelect := widget.NewSelect(categoryNames(), func(name string) {
+		// Keep what was typed for the one left
+		if current != nil {
+			all[category] = current()
+		}
+		category = name
+		var content fyne.CanvasObject
+		content, current = actionsEditor(all[name])
+		editorBox.Objects = []fyne.CanvasObject{content}
+		editorBox.Refresh()
+	})
+	categorySelect.SetSelectedIndex(0)
+
+	editor := dialog.NewCustomConfirm("After download", "Save", "Cancel",
+		container.NewBorder(container.NewVBox(categorySelect, widget.NewLabel("In this order, the first that fails stops the rest")), nil, nil, nil, editorBox),
+		func(confirm bool) {
+			if !confirm {
+				return
+			}
+			all[category] = current()
+			for name, actions := range all {
+				if len(actions) == 0 {
+					delete(all, name)
+				}
+			}
+			saveCategoryActions(prefs, all)
+		}, myapp.MainWindow)
+	editor.Resize(fyne.NewSize(620, 380))
+	editor.Show()
+}
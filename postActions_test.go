@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandPostTemplate(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "file.iso")
+	if err := os.WriteFile(filePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	tests := []struct {
+		name     string
+		arg      string
+		download Download
+		want     string
+		err      bool
+	}{
+		{
+			name:     "every placeholder",
+			arg:      "{path} {dir} {name} {url}",
+			download: Download{FilePath: filePath, URL: "https://example.com/file.iso"},
+			want:     filePath + " " + dir + " file.iso https://example.com/file.iso",
+		},
+		{
+			name:     "repeated and inside a word",
+			arg:      "--out={name}.{name}",
+			download: Download{FilePath: filePath},
+			want:     "--out=file.iso.file.iso",
+		},
+		{
+			name:     "unknown placeholders stay",
+			arg:      "{size} {Name} {path",
+			download: Download{FilePath: filePath},
+			want:     "{size} {Name} {path",
+		},
+		{
+			name:     "known hash",
+			arg:      "{sha256}",
+			download: Download{FilePath: filePath, Checksum: "abc"},
+			want:     "abc",
+		},
+		{
+			name:     "hash of the file",
+			arg:      "sha256={sha256}",
+			download: Download{FilePath: filePath},
+			want:     "sha256=" + emptySHA256,
+		},
+		{
+			name:     "hash of a missing file",
+			arg:      "{sha256}",
+			download: Download{FilePath: filepath.Join(dir, "missing.iso"), FileName: "missing.iso"},
+			err:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := expandPostTemplate(test.arg, &test.download)
+			if test.err {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// The hash is kept for the next argument
+	download := Download{FilePath: filePath}
+	expandPostTemplate("{sha256}", &download)
+	if download.Checksum != emptySHA256 {
+		t.Errorf("kept checksum %q, want %q", download.Checksum, emptySHA256)
+	}
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+		err     bool
+	}{
+		{command: "", want: nil},
+		{command: "  tar   -xf\tfile  ", want: []string{"tar", "-xf", "file"}},
+		{command: `cp "my file" 'other file'`, want: []string{"cp", "my file", "other file"}},
+		{command: `echo 'say "hi"' "it's"`, want: []string{"echo", `say "hi"`, "it's"}},
+		{command: `echo "" a""b`, want: []string{"echo", "", "ab"}},
+		{command: `echo "unclosed`, err: true},
+		{command: `echo 'unclosed`, err: true},
+		// Backslashes only escape outside of Windows
+		{command: `cp my\ file \"quoted\"`, want: []string{"cp", "my file", `"quoted"`}},
+		{command: `echo "a \"b\" \\"`, want: []string{"echo", `a "b" \`}},
+		{command: `echo 'C:\dir\'`, want: []string{"echo", `C:\dir\`}},
+	}
+	for _, test := range tests {
+		if runtime.GOOS == "windows" && strings.Contains(test.command, `\`) {
+			continue
+		}
+		got, err := splitCommandLine(test.command)
+		switch {
+		case test.err && err == nil:
+			t.Errorf("splitCommandLine(%q) = %q, want an error", test.command, got)
+		case !test.err && err != nil:
+			t.Errorf("splitCommandLine(%q) failed: %v", test.command, err)
+		case !slices.Equal(got, test.want):
+			t.Errorf("splitCommandLine(%q) = %q, want %q", test.command, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// FindProcess opens a handle on windows, which fails once the process is gone
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+// detachProcess lets a started process outlive us and our console
+func detachProcess(command *exec.Cmd) {
+	const detachedProcess = 0x00000008 // DETACHED_PROCESS
+	command.SysProcAttr = &syscall.SysProcAttr{CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// lockFile opens path without sharing it, a second open fails until the
+// process is gone
+func lockFile(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
+
+// lockFileWait is lockFile that waits for the lock instead of failing
+func lockFileWait(path string) (*os.File, error) {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		file, err := lockFile(path)
+		if err == nil || time.Now().After(deadline) {
+			return file, err
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
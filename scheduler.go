@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/google/uuid"
+)
+
+// The scheduler runs queued downloads in time windows, like overnight on
+// weekdays, or once from a given time. A queued download is saved like one
+// paused before it read anything, nothing is connected to or written until
+// its window opens. The scheduler then resumes and pauses it with the
+// item's own buttons so it behaves like one the user paused. The schedule
+// and the queue are kept in schedule.json next to downloads.json.
+
+// Schedule is what schedule.json holds
+type Schedule struct {
+	Windows    []ScheduleWindow `json:"windows"`
+	StartAt    time.Time        `json:"start_at"`    // one-off start, zero when there's none
+	Queue      []string         `json:"queue"`       // ids of the queued downloads, started in order
+	MaxRunning int              `json:"max_running"` // queued downloads running at once
+	AfterQueue string           `json:"after_queue"` // "quit" quits DownBit once the queue is done
+}
+
+// ScheduleWindow is a time of day the queue runs in, End before Start goes past midnight
+type ScheduleWindow struct {
+	Days  []time.Weekday `json:"days"` // empty for every day
+	Start string         `json:"start"`
+	End   string         `json:"end"`
+}
+
+const defaultMaxRunning = 2
+
+// How often the scheduler looks at the clock
+const scheduleTick = 20 * time.Second
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func schedulePath(databasePath string) string {
+	return filepath.Join(databasePath, "schedule.json")
+}
+
+func loadSchedule(databasePath string) (Schedule, error) {
+	schedule := Schedule{MaxRunning: defaultMaxRunning}
+	data, err := os.ReadFile(schedulePath(databasePath))
+	if errors.Is(err, os.ErrNotExist) {
+		return schedule, nil
+	}
+	if err != nil {
+		return schedule, err
+	}
+	err = json.Unmarshal(data, &schedule)
+	return schedule, err
+}
+
+// saveSchedule replaces schedule.json in one rename like writeDatabase,
+// the temp file is 0600 and it keeps that
+func saveSchedule(databasePath string, schedule Schedule) error {
+	data, err := json.MarshalIndent(schedule, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(databasePath, ".schedule-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name()) // Nothing left once it's renamed
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), schedulePath(databasePath))
+}
+
+// active tells if the queue should run at now
+func (schedule Schedule) active(now time.Time) bool {
+	if !schedule.StartAt.IsZero() && !now.Before(schedule.StartAt) {
+		return true
+	}
+	for _, window := range schedule.Windows {
+		if window.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (window ScheduleWindow) contains(now time.Time) bool {
+	start, err := parseClock(window.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(window.End)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return window.onDay(now.Weekday()) && start <= minute && minute < end
+	}
+	// Past midnight, the window belongs to the day it started on
+	return window.onDay(now.Weekday()) && minute >= start || window.onDay((now.Weekday()+6)%7) && minute < end
+}
+
+func (window ScheduleWindow) onDay(day time.Weekday) bool {
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, windowDay := range window.Days {
+		if windowDay == day {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock turns 07:30 into minutes since midnight
+func parseClock(clock string) (int, error) {
+	hours, minutes, ok := strings.Cut(clock, ":")
+	hour, err := strconv.Atoi(hours)
+	if !ok || err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("%q isn't a time like 07:30", clock)
+	}
+	minute, err := strconv.Atoi(minutes)
+	if err != nil || minute < 0 || minute > 59 || hour == 24 && minute > 0 {
+		return 0, fmt.Errorf("%q isn't a time like 07:30", clock)
+	}
+	return hour*60 + minute, nil
+}
+
+// parseWindows reads windows written one per line as "mon-fri 01:00-07:00",
+// without days for every day
+func parseWindows(text string) ([]ScheduleWindow, error) {
+	var windows []ScheduleWindow
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var window ScheduleWindow
+		if len(fields) == 2 {
+			days, err := parseDays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			window.Days = days
+		} else if len(fields) != 1 {
+			return nil, fmt.Errorf("%q isn't like mon-fri 01:00-07:00", line)
+		}
+
+		var ok bool
+		window.Start, window.End, ok = strings.Cut(fields[len(fields)-1], "-")
+		if !ok {
+			return nil, fmt.Errorf("%q has no end time", line)
+		}
+		if _, err := parseClock(window.Start); err != nil {
+			return nil, err
+		}
+		if _, err := parseClock(window.End); err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// parseDays reads days like mon-fri, sat,sun or mon,wed-fri
+func parseDays(text string) ([]time.Weekday, error) {
+	day := func(name string) (time.Weekday, error) {
+		name = strings.ToLower(name)
+		for i, weekday := range weekdayNames {
+			if len(name) >= 3 && strings.HasPrefix(name, weekday) {
+				return time.Weekday(i), nil
+			}
+		}
+		return 0, fmt.Errorf("%q isn't a day", name)
+	}
+
+	var days []time.Weekday
+	for _, part := range strings.Split(text, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := day(from)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = day(to); err != nil {
+				return nil, err
+			}
+		}
+		// fri-mon goes over the weekend
+		for weekday := first; ; weekday = (weekday + 1) % 7 {
+			days = append(days, weekday)
+			if weekday == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func formatWindows(windows []ScheduleWindow) string {
+	var lines []string
+	for _, window := range windows {
+		line := window.Start + "-" + window.End
+		if len(window.Days) > 0 {
+			var days []string
+			for _, day := range window.Days {
+				days = append(days, weekdayNames[day])
+			}
+			line = strings.Join(days, ",") + " " + line
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ----------------------------------------------- Scheduler
+
+// scheduler runs the queue of the window's downloads
+type scheduler struct {
+	myapp        *MyApp
+	databasePath string
+	wake         chan struct{}
+
+	mu       sync.Mutex
+	schedule Schedule
+	items    map[string]*FileItem
+	started  map[string]bool // resumed by the scheduler, it pauses them again
+	pausing  map[string]bool // paused by the scheduler, the others the user paused
+	held     map[string]bool // paused by the user, left alone until DownBit restarts
+	ranQueue bool            // something of the queue ran since it was last empty
+}
+
+func newScheduler(myapp *MyApp, databasePath string) *scheduler {
+	schedule, err := loadSchedule(databasePath)
+	if err != nil {
+		logger.Println("Error loading the schedule:", err)
+	}
+	return &scheduler{
+		myapp:        myapp,
+		databasePath: databasePath,
+		wake:         make(chan struct{}, 1),
+		schedule:     schedule,
+		items:        map[string]*FileItem{},
+		started:      map[string]bool{},
+		pausing:      map[string]bool{},
+		held:         map[string]bool{},
+	}
+}
+
+// run looks at the clock until the app quits
+func (s *scheduler) run() {
+	s.restoreQueue()
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	for {
+		s.check(time.Now())
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// restoreQueue shows the downloads queued before DownBit was last closed
+func (s *scheduler) restoreQueue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var queue []string
+	for _, id := range s.schedule.Queue {
+		download, err := isFileExistByID(s.myapp.DownloadStateFilePath, id)
+		if err != nil || download.Status == "Finished" {
+			continue
+		}
+		s.track(s.queuedItem(download))
+		queue = append(queue, id)
+	}
+	s.schedule.Queue = queue
+	s.save()
+}
+
+// enqueue saves download, that hasn't started, and puts it at the end of the queue
+func (s *scheduler) enqueue(download Download) {
+	saveDownloadFileInfo(download, s.myapp.DownloadStateFilePath)
+	s.mu.Lock()
+	s.track(s.queuedItem(download))
+	s.schedule.Queue = append(s.schedule.Queue, download.ID)
+	s.save()
+	s.mu.Unlock()
+	s.signal()
+}
+
+// queuedItem shows the saved download paused, resuming it goes on from the record
+func (s *scheduler) queuedItem(download Download) *FileItem {
+	fileItem, cancelC, _ := makeFileItem(s.myapp, FileInfo{
+		FileName: download.FileName,
+		FilePath: download.FilePath,
+		Total:    int(download.TotalSize),
+		Torrent:  download.Torrent,
+	})
+	fileItem.ID = download.ID
+	fileItem.Row.ID = download.ID
+	// Resuming takes the cancel func of the last run out first
+	cancelC <- func() {}
+	fileItem.Row.setPaused(true)
+	if download.TotalSize > 0 {
+		fileItem.setProgress(float64(download.Downloaded) / float64(download.TotalSize))
+	}
+	return fileItem
+}
+
+// track follows a queued item until it's done, s.mu is held
+func (s *scheduler) track(fileItem *FileItem) {
+	fileItem.setSpeed("Queued")
+	s.items[fileItem.ID] = fileItem
+	fileItem.OnStop = func(status string) {
+		s.mu.Lock()
+		delete(s.started, fileItem.ID)
+		switch {
+		case status != "Paused":
+			s.remove(fileItem.ID)
+		case s.pausing[fileItem.ID]:
+			delete(s.pausing, fileItem.ID)
+		default:
+			s.held[fileItem.ID] = true
+		}
+		s.mu.Unlock()
+		s.signal()
+	}
+
+	// A paused download doesn't stop again when it's cancelled
+	cancel := fileItem.Row.Cancel
+	fileItem.Row.Cancel = func() {
+		s.mu.Lock()
+		s.remove(fileItem.ID)
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// pause pauses a running item like its pause button, s.mu is held
+func (s *scheduler) pause(fileItem *FileItem) {
+	s.pausing[fileItem.ID] = true
+	fileItem.Row.pause()
+	fileItem.setSpeed("Queued")
+}
+
+// remove takes id off the queue, s.mu is held
+func (s *scheduler) remove(id string) {
+	delete(s.items, id)
+	delete(s.started, id)
+	delete(s.held, id)
+	for i, queued := range s.schedule.Queue {
+		if queued == id {
+			s.schedule.Queue = append(s.schedule.Queue[:i], s.schedule.Queue[i+1:]...)
+			break
+		}
+	}
+	s.save()
+}
+
+// check starts or pauses the queue for the time it is
+func (s *scheduler) check(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.schedule.Queue) == 0 {
+		if s.ranQueue {
+			s.ranQueue = false
+			s.queueDone(now)
+		}
+		return
+	}
+
+	if !s.schedule.active(now) {
+		for id := range s.started {
+			if fileItem := s.items[id]; fileItem != nil && !fileItem.Row.isPaused() {
+				s.pause(fileItem)
+			}
+			delete(s.started, id)
+		}
+		return
+	}
+
+	maxRunning := s.schedule.MaxRunning
+	if maxRunning <= 0 {
+		maxRunning = defaultMaxRunning
+	}
+	for _, id := range s.schedule.Queue {
+		if len(s.started) >= maxRunning {
+			break
+		}
+		fileItem := s.items[id]
+		// Ones the user resumed are left to them
+		if fileItem == nil || s.started[id] || s.held[id] || !fileItem.Row.isPaused() {
+			continue
+		}
+		fileItem.Row.resume()
+		s.started[id] = true
+		s.ranQueue = true
+	}
+}
+
+// queueDone is called once the queue ran empty, s.mu is held
+func (s *scheduler) queueDone(now time.Time) {
+	// The one-off start is used up
+	if !s.schedule.StartAt.IsZero() && !now.Before(s.schedule.StartAt) {
+		s.schedule.StartAt = time.Time{}
+		s.save()
+	}
+	if s.schedule.AfterQueue == "quit" {
+		logger.Println("The queue is done, quitting")
+		go s.myapp.App.Quit()
+	}
+}
+
+// save writes the schedule, s.mu is held
+func (s *scheduler) save() {
+	if err := saveSchedule(s.databasePath, s.schedule); err != nil {
+		logger.Println("Error saving the schedule:", err)
+	}
+}
+
+func (s *scheduler) setSchedule(schedule Schedule) {
+	s.mu.Lock()
+	schedule.Queue = s.schedule.Queue
+	s.schedule = schedule
+	s.save()
+	s.mu.Unlock()
+	s.signal()
+}
+
+// ----------------------------------------------- Queueing
+
+// queueDownload queues the download getFileInfo probed, streams ask for the quality first
+func queueDownload(myapp *MyApp, rawURL string, fileInfo FileInfo) {
+	if len(fileInfo.Variants) > 1 {
+		chooseStreamVariant(myapp, fileInfo, func(fileInfo FileInfo) {
+			enqueueDownload(myapp, rawURL, fileInfo)
+		})
+		return
+	}
+	enqueueDownload(myapp, rawURL, fileInfo)
+}
+
+// enqueueDownload leaves fileInfo to the scheduler, it starts once its window opens
+func enqueueDownload(myapp *MyApp, rawURL string, fileInfo FileInfo) {
+	if myapp.remote() != nil || myapp.Scheduler == nil {
+		myapp.showError(fmt.Errorf("the schedule only runs the downloads of this window, turn Background off in the settings to queue"))
+		return
+	}
+	myapp.Scheduler.enqueue(queuedDownload(uuid.New().String(), fileInfo))
+}
+
+// queuedDownload is the record of fileInfo as if it paused before reading
+// anything, resuming it downloads every chunk from its start
+func queuedDownload(id string, fileInfo FileInfo) Download {
+	download := Download{
+		ID:        id,
+		FileName:  fileInfo.FileName,
+		URL:       fileInfo.URL,
+		FilePath:  fileInfo.FilePath,
+		TotalSize: int64(fileInfo.Total),
+		Status:    "Paused",
+		CreatedAt: time.Now().String(),
+		Metalink:  fileInfo.Metalink,
+		Stream:    fileInfo.Stream,
+		Torrent:   fileInfo.Torrent,
+		Headers:   fileInfo.Headers,
+		Group:     fileInfo.Group,
+		Actions:   fileInfo.Actions,
+	}
+	// Streams and torrents keep track of their own parts
+	if fileInfo.Stream != nil || fileInfo.Torrent != nil {
+		return download
+	}
+	count := chunkCount(fileInfo)
+	for i := range count {
+		start, end := chunkRange(download.TotalSize, count, i)
+		download.Chunks = append(download.Chunks, Chunk{End: end, CurrentOffset: start, Status: "Paused"})
+	}
+	return download
+}
+
+// ----------------------------------------------- UI
+
+// showSchedule edits the windows, the one-off start and what happens after the queue
+func showSchedule(myapp *MyApp) {
+	if myapp.Scheduler == nil {
+		myapp.showError(fmt.Errorf("the schedule only runs the downloads of this window, turn Background off in the settings to use it"))
+		return
+	}
+	s := myapp.Scheduler
+	s.mu.Lock()
+	schedule := s.schedule
+	queued := len(schedule.Queue)
+	s.mu.Unlock()
+
+	windowsEntry := widget.NewMultiLineEntry()
+	windowsEntry.SetPlaceHolder("mon-fri 01:00-07:00\nsat,sun 00:00-24:00")
+	windowsEntry.SetText(formatWindows(schedule.Windows))
+	windowsEntry.SetMinRowsVisible(3)
+	startAtEntry := widget.NewEntry()
+	startAtEntry.SetPlaceHolder("2006-01-02 15:04, optional")
+	if !schedule.StartAt.IsZero() {
+		startAtEntry.SetText(schedule.StartAt.Local().Format("2006-01-02 15:04"))
+	}
+	maxRunningEntry := widget.NewEntry()
+	maxRunningEntry.SetText(strconv.Itoa(schedule.MaxRunning))
+	afterOptions := []string{"Nothing", "Quit DownBit"}
+	afterSelect := widget.NewSelect(afterOptions, nil)
+	afterSelect.SetSelectedIndex(0)
+	if schedule.AfterQueue == "quit" {
+		afterSelect.SetSelectedIndex(1)
+	}
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("Queued", widget.NewLabel(fmt.Sprintf("%d downloads", queued))),
+		widget.NewFormItem("Run", windowsEntry),
+		widget.NewFormItem("Start at", startAtEntry),
+		widget.NewFormItem("At once", maxRunningEntry),
+		widget.NewFormItem("After the queue", afterSelect),
+	}
+	form := dialog.NewForm("Schedule", "Save", "Cancel", items, func(confirm bool) {
+		if !confirm {
+			return
+		}
+		windows, err := parseWindows(windowsEntry.Text)
+		if err != nil {
+			myapp.showError(err)
+			return
+		}
+		schedule := Schedule{Windows: windows, MaxRunning: defaultMaxRunning}
+		if text := strings.TrimSpace(startAtEntry.Text); text != "" {
+			if schedule.StartAt, err = time.ParseInLocation("2006-01-02 15:04", text, time.Local); err != nil {
+				myapp.showError(fmt.Errorf("start at is like 2006-01-02 15:04"))
+				return
+			}
+		}
+		if maxRunning, err := strconv.Atoi(strings.TrimSpace(maxRunningEntry.Text)); err == nil && maxRunning > 0 {
+			schedule.MaxRunning = maxRunning
+		}
+		if afterSelect.SelectedIndex() == 1 {
+			schedule.AfterQueue = "quit"
+		}
+		s.setSchedule(schedule)
+	}, myapp.MainWindow)
+	form.Resize(fyne.NewSize(420, 0))
+	form.Show()
+}
+
+// queueCheck is the "queue it" choice of the add dialogs, hidden when there's no schedule
+func queueCheck(myapp *MyApp) *widget.Check {
+	check := widget.NewCheck("Queue for the schedule", nil)
+	if myapp.Scheduler == nil {
+		check.Hide()
+	}
+	return check
+}
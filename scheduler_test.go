@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"fyne.io/fyne/v2/test"
+)
+
+// A queued download connects to nothing and writes nothing until it's
+// resumed, then it downloads from its record like a paused one
+func TestQueuedDownload(t *testing.T) {
+	content := testSFTPContent(5000)
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	myapp := testHeadlessApp(t)
+	myapp.App = test.NewApp() // for the actions once it's finished
+
+	filePath := filepath.Join(t.TempDir(), "data.bin")
+	download := queuedDownload("queued", FileInfo{
+		FileName:    "data.bin",
+		URL:         server.URL + "/data.bin",
+		FilePath:    filePath,
+		Total:       len(content),
+		Connections: 3,
+	})
+	if len(download.Chunks) != 3 || download.Chunks[2].End != int64(len(content))-1 {
+		t.Fatalf("queued with chunks %+v, want 3 up to %d", download.Chunks, len(content)-1)
+	}
+	saveDownloadFileInfo(download, myapp.DownloadStateFilePath)
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("queuing touched the file (%v)", err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 0 {
+		t.Errorf("queuing made %d requests", n)
+	}
+
+	fileItem, stopped, errs := testHeadlessItem("queued")
+	cancelC := make(chan context.CancelFunc, 1)
+	pauseC := make(chan context.CancelFunc, 1)
+	ResumeDownload(myapp, fileItem, cancelC, pauseC)
+	if status := waitStopped(t, stopped); status != "Finished" {
+		t.Fatalf("stopped with %q (%v), want Finished", status, errs())
+	}
+	got, err := os.ReadFile(filePath)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("the queued download wasn't downloaded (%v)", err)
+	}
+}
+
+func TestSaveSchedule(t *testing.T) {
+	databasePath := t.TempDir()
+	schedule := Schedule{
+		Windows:    []ScheduleWindow{{Days: []time.Weekday{time.Monday}, Start: "01:00", End: "07:00"}},
+		Queue:      []string{"a", "b"},
+		MaxRunning: 3,
+	}
+	for range 2 {
+		if err := saveSchedule(databasePath, schedule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stat, err := os.Stat(schedulePath(databasePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := stat.Mode().Perm(); mode != 0600 {
+		t.Errorf("schedule mode = %o, want 600", mode)
+	}
+	entries, _ := os.ReadDir(databasePath)
+	if len(entries) != 1 {
+		t.Errorf("left %d files behind, want only schedule.json", len(entries))
+	}
+	loaded, err := loadSchedule(databasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Windows) != 1 || len(loaded.Queue) != 2 || loaded.MaxRunning != 3 {
+		t.Errorf("loaded %+v, want %+v", loaded, schedule)
+	}
+}
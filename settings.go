@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Preference keys, stored with the fyne app preferences
+const (
+	prefFFmpegPath  = "ffmpeg_path"
+	prefSeedRatio   = "seed_ratio"   // stop seeding at this ratio, 0 doesn't seed
+	prefSeedMinutes = "seed_minutes" // stop seeding after this long, 0 has no time limit
+	prefTorrentPort = "torrent_port" // 0 picks a free port
+	prefDaemonPort  = "daemon_port"
+	prefRPCPort     = "rpc_port" // aria2 JSON-RPC of the daemon, 0 turns it off
+	prefRPCSecret   = "rpc_secret"
+	// The GUI starts a daemon and hands it the downloads, so they survive closing the window
+	prefBackgroundService = "background_service"
+	prefClipboardWatch    = "clipboard_watch"
+	prefClipboardPatterns = "clipboard_patterns" // extensions or globs on the url, space separated
+	prefClipboardAlways   = "clipboard_always"   // domains added without asking
+	prefClipboardNever    = "clipboard_never"    // domains never offered
+	prefPostActions       = "post_actions"       // json of category -> actions run after its downloads
+	prefAutoExtract       = "auto_extract"       // archives are extracted once they're downloaded
+	prefExtractDelete     = "extract_delete"     // and deleted when that worked
+	prefSpeedLimit        = "speed_limit"        // KB/s for all downloads together, 0 for none
+)
+
+func showSettings(myapp *MyApp) {
+	prefs := myapp.App.Preferences()
+
+	ffmpegEntry := widget.NewEntry()
+	ffmpegEntry.SetPlaceHolder("e.g. /usr/bin/ffmpeg (optional)")
+	ffmpegEntry.SetText(prefs.String(prefFFmpegPath))
+
+	seedRatioEntry := widget.NewEntry()
+	seedRatioEntry.SetText(strconv.FormatFloat(prefs.FloatWithFallback(prefSeedRatio, 1), 'f', -1, 64))
+	seedMinutesEntry := widget.NewEntry()
+	seedMinutesEntry.SetPlaceHolder("0 for no time limit")
+	seedMinutesEntry.SetText(strconv.Itoa(prefs.Int(prefSeedMinutes)))
+	speedLimitEntry := widget.NewEntry()
+	speedLimitEntry.SetPlaceHolder("KB/s, 0 for no limit")
+	speedLimitEntry.SetText(strconv.Itoa(prefs.Int(prefSpeedLimit)))
+	torrentPortEntry := widget.NewEntry()
+	torrentPortEntry.SetPlaceHolder("0 for any free port")
+	torrentPortEntry.SetText(strconv.Itoa(prefs.Int(prefTorrentPort)))
+
+	rpcSecretEntry := widget.NewEntry()
+	rpcSecretEntry.SetPlaceHolder("made up by the daemon when empty")
+	rpcSecretEntry.SetText(prefs.String(prefRPCSecret))
+
+	backgroundCheck := widget.NewCheck("Keep downloads running after closing", nil)
+	backgroundCheck.SetChecked(prefs.Bool(prefBackgroundService))
+
+	clipboardCheck := widget.NewCheck("Offer copied download links", nil)
+	clipboardCheck.SetChecked(prefs.Bool(prefClipboardWatch))
+	clipboardPatternsEntry := widget.NewEntry()
+	clipboardPatternsEntry.SetPlaceHolder("extensions or globs, e.g. zip iso *://example.com/files/*")
+	clipboardPatternsEntry.SetText(prefs.StringWithFallback(prefClipboardPatterns, defaultClipboardPatterns))
+	forgetDomainsButton := widget.NewButton("Forget always/never domains", func() {
+		prefs.RemoveValue(prefClipboardAlways)
+		prefs.RemoveValue(prefClipboardNever)
+	})
+
+	autoExtractCheck := widget.NewCheck("Extract archives when they finish", nil)
+	autoExtractCheck.SetChecked(prefs.Bool(prefAutoExtract))
+	extractDeleteCheck := widget.NewCheck("Then delete the archive", nil)
+	extractDeleteCheck.SetChecked(prefs.Bool(prefExtractDelete))
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("ffmpeg", ffmpegEntry),
+		widget.NewFormItem("Speed limit", speedLimitEntry),
+		widget.NewFormItem("Seed ratio", seedRatioEntry),
+		widget.NewFormItem("Seed minutes", seedMinutesEntry),
+		widget.NewFormItem("Torrent port", torrentPortEntry),
+		widget.NewFormItem("Background", backgroundCheck),
+		widget.NewFormItem("aria2 RPC secret", rpcSecretEntry),
+		widget.NewFormItem("Clipboard", clipboardCheck),
+		widget.NewFormItem("Clipboard links", clipboardPatternsEntry),
+		widget.NewFormItem("", forgetDomainsButton),
+		widget.NewFormItem("After download", widget.NewButton("Actions per category...", func() { showCategoryActions(myapp) })),
+		widget.NewFormItem("Archives", autoExtractCheck),
+		widget.NewFormItem("", extractDeleteCheck),
+	}
+
+	dialog.ShowForm("Settings", "Save", "Cancel", items, func(confirm bool) {
+		if !confirm {
+			return
+		}
+		prefs.SetString(prefFFmpegPath, ffmpegEntry.Text)
+		prefs.SetString(prefRPCSecret, rpcSecretEntry.Text)
+		prefs.SetBool(prefClipboardWatch, clipboardCheck.Checked)
+		prefs.SetString(prefClipboardPatterns, clipboardPatternsEntry.Text)
+		prefs.SetBool(prefAutoExtract, autoExtractCheck.Checked)
+		prefs.SetBool(prefExtractDelete, extractDeleteCheck.Checked)
+		// Numbers that don't parse keep their old value
+		if ratio, err := strconv.ParseFloat(seedRatioEntry.Text, 64); err == nil && ratio >= 0 {
+			prefs.SetFloat(prefSeedRatio, ratio)
+		}
+		if minutes, err := strconv.Atoi(seedMinutesEntry.Text); err == nil && minutes >= 0 {
+			prefs.SetInt(prefSeedMinutes, minutes)
+		}
+		if limit, err := strconv.Atoi(speedLimitEntry.Text); err == nil && limit >= 0 {
+			prefs.SetInt(prefSpeedLimit, limit)
+			applySpeedLimit(prefs)
+			// The daemon only reads the settings when it starts
+			if remote := myapp.remote(); remote != nil {
+				go func() {
+					if err := remote.setSpeedLimit(globalLimit.limit()); err != nil {
+						myapp.showError(fmt.Errorf("couldnt change the limit of the background service: %v", err))
+					}
+				}()
+			}
+		}
+		if port, err := strconv.Atoi(torrentPortEntry.Text); err == nil && port >= 0 && port < 65536 {
+			prefs.SetInt(prefTorrentPort, port)
+		}
+
+		// New downloads go to the daemon from now on
+		prefs.SetBool(prefBackgroundService, backgroundCheck.Checked)
+		if backgroundCheck.Checked && myapp.remote() == nil {
+			go func() {
+				remote, err := startDaemon(filepath.Dir(myapp.DownloadStateFilePath))
+				if err != nil {
+					myapp.showError(err)
+					return
+				}
+				myapp.setRemote(remote)
+				myapp.followDaemon()
+			}()
+		}
+	}, myapp.MainWindow)
+}
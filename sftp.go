@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpSource downloads from sftp://user@host[:port]/path.
+// scp:// urls are accepted as well but are served over the sftp subsystem,
+// plain scp has no way to start reading at an offset.
+// One SSH connection is kept per user@host and every chunk opens its own
+// sftp session on it, so chunks are read in parallel.
+type sftpSource struct{}
+
+// SFTP v3 packet types (draft-ietf-secsh-filexfer-02)
+const (
+	sshFxpInit    = 1
+	sshFxpVersion = 2
+	sshFxpOpen    = 3
+	sshFxpClose   = 4
+	sshFxpRead    = 5
+	sshFxpStat    = 17
+	sshFxpStatus  = 101
+	sshFxpHandle  = 102
+	sshFxpData    = 103
+	sshFxpAttrs   = 105
+
+	sshFxEOF            = 1
+	sshFxfRead          = 0x00000001
+	sshFileXferAttrSize = 0x00000001
+
+	sftpReadSize      = 32 * 1024 // largest read every server accepts
+	sftpReadsInFlight = 16
+)
+
+var (
+	sshClientsMu sync.Mutex
+	sshClients   = map[string]*ssh.Client{}
+)
+
+func (s *sftpSource) Probe(ctx context.Context, rawURL string) (FileInfo, error) {
+	conn, filePath, err := dialSFTP(ctx, rawURL)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer conn.Close()
+
+	total, err := conn.stat(filePath)
+	if err != nil {
+		logger.Printf("Failed to get file size: %v\n", err)
+		return FileInfo{}, fmt.Errorf("failed to get file size: %v", err)
+	}
+
+	fileName := sanitizeFileName(path.Base(filePath))
+	if fileName == "" || fileName == "." || fileName == "_" {
+		fileName = "unknown_file"
+	}
+
+	return FileInfo{
+		FileName: fileName,
+		FileSize: float64(total) / (1024 * 1024),
+		Total:    int(total),
+	}, nil
+}
+
+func (s *sftpSource) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	conn, filePath, err := dialSFTP(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := conn.open(filePath)
+	if err != nil {
+		conn.Close()
+		logger.Printf("Error starting the download: %v\n", err)
+		return nil, fmt.Errorf("error starting the download: %v", err)
+	}
+
+	// Closing the session unblocks a pending read on cancel
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	return &sftpRangeReader{
+		ctx:      ctx,
+		conn:     conn,
+		handle:   handle,
+		offset:   start,
+		end:      end,
+		received: map[uint32]sftpReply{},
+		stop:     stop,
+	}, nil
+}
+
+// ----------------------------------------------- SSH
+
+// dialSFTP starts a new sftp session on the (shared) SSH connection for rawURL
+func dialSFTP(ctx context.Context, rawURL string) (*sftpConn, string, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid url: %v", err)
+	}
+
+	client, err := getSSHClient(ctx, parsedURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := openSFTP(client)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not start sftp session: %v", err)
+	}
+
+	// sftp://host/~/file is relative to the home directory
+	filePath := parsedURL.Path
+	if strings.HasPrefix(filePath, "/~/") {
+		filePath = filePath[3:]
+	}
+	return conn, filePath, nil
+}
+
+func getSSHClient(ctx context.Context, parsedURL *url.URL) (*ssh.Client, error) {
+	user := parsedURL.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	port := parsedURL.Port()
+	if port == "" {
+		port = "22"
+	}
+	addr := net.JoinHostPort(parsedURL.Hostname(), port)
+	key := user + "@" + addr
+
+	sshClientsMu.Lock()
+	client, ok := sshClients[key]
+	sshClientsMu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	// Dialing takes a while, other hosts shouldn't wait on it
+	password, _ := parsedURL.User.Password()
+	client, err := dialSSH(ctx, addr, user, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// Another chunk may have connected in the meantime, its connection is used
+	sshClientsMu.Lock()
+	if existing, ok := sshClients[key]; ok {
+		sshClientsMu.Unlock()
+		client.Close()
+		return existing, nil
+	}
+	sshClients[key] = client
+	sshClientsMu.Unlock()
+
+	// Forget the connection once it dies so the next chunk dials again
+	go func() {
+		client.Wait()
+		sshClientsMu.Lock()
+		if sshClients[key] == client {
+			delete(sshClients, key)
+		}
+		sshClientsMu.Unlock()
+	}()
+	return client, nil
+}
+
+// dialSSH connects and authenticates, the handshake gives up with ctx
+func dialSSH(ctx context.Context, addr, user, password string) (*ssh.Client, error) {
+	config, closeAgent, err := sshClientConfig(user, password)
+	if err != nil {
+		return nil, err
+	}
+	// The agent is only asked during the handshake
+	defer closeAgent()
+
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	netConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		logger.Printf("Error connecting to ssh server: %v\n", err)
+		return nil, fmt.Errorf("error connecting to ssh server: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		netConn.Close()
+	})
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	if !stop() && err == nil {
+		// Cancelled right as the handshake finished
+		sshConn.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("ssh handshake failed: %v", err)
+	}
+	netConn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// sshClientConfig authenticates with the ssh agent, the default keys in ~/.ssh
+// and the password from the url (in that order) and verifies the host
+// against ~/.ssh/known_hosts. closeAgent hangs up on the agent once the
+// handshake is done.
+func sshClientConfig(user, password string) (config *ssh.ClientConfig, closeAgent func(), err error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to find home directory: %v", err)
+	}
+
+	hostKeyCallback, err := knownhosts.New(filepath.Join(homeDir, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read known_hosts, connect once with ssh to trust the host: %v", err)
+	}
+
+	var auth []ssh.AuthMethod
+	closeAgent = func() {}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if agentConn, err := net.Dial("unix", socket); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+			closeAgent = func() { agentConn.Close() }
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		pemBytes, err := os.ReadFile(filepath.Join(homeDir, ".ssh", name))
+		if err != nil {
+			continue
+		}
+		// keys with a passphrase are left to the agent
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	if password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, closeAgent, nil
+}
+
+// ----------------------------------------------- SFTP
+
+type sftpConn struct {
+	session *ssh.Session
+	w       io.WriteCloser
+	r       io.Reader
+	nextID  uint32
+}
+
+type sftpReply struct {
+	packetType byte
+	data       []byte
+}
+
+func openSFTP(client *ssh.Client) (*sftpConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	conn := &sftpConn{session: session, w: w, r: r}
+
+	// INIT has no request id, just the version we speak
+	if err := conn.writePacket(sshFxpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	packetType, _, err := conn.readPacket()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if packetType != sshFxpVersion {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected sftp packet %d during init", packetType)
+	}
+	return conn, nil
+}
+
+func (c *sftpConn) Close() error {
+	return c.session.Close()
+}
+
+func (c *sftpConn) writePacket(packetType byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, packetType)
+	packet = append(packet, payload...)
+	_, err := c.w.Write(packet)
+	return err
+}
+
+func (c *sftpConn) readPacket() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 256*1024 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+// request sends a packet with a fresh request id and returns that id
+func (c *sftpConn) request(packetType byte, payload []byte) (uint32, error) {
+	c.nextID++
+	id := c.nextID
+	packet := binary.BigEndian.AppendUint32(nil, id)
+	packet = append(packet, payload...)
+	return id, c.writePacket(packetType, packet)
+}
+
+// reply waits for the answer of a single outstanding request
+func (c *sftpConn) reply(id uint32) (sftpReply, error) {
+	packetType, data, err := c.readPacket()
+	if err != nil {
+		return sftpReply{}, err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != id {
+		return sftpReply{}, errors.New("unexpected sftp reply id")
+	}
+	return sftpReply{packetType: packetType, data: data[4:]}, nil
+}
+
+func (c *sftpConn) stat(filePath string) (int64, error) {
+	id, err := c.request(sshFxpStat, appendSFTPString(nil, filePath))
+	if err != nil {
+		return 0, err
+	}
+	reply, err := c.reply(id)
+	if err != nil {
+		return 0, err
+	}
+	if reply.packetType != sshFxpAttrs {
+		return 0, sftpStatusError(reply)
+	}
+	if len(reply.data) < 12 || binary.BigEndian.Uint32(reply.data)&sshFileXferAttrSize == 0 {
+		return 0, errors.New("server did not report the file size")
+	}
+	return int64(binary.BigEndian.Uint64(reply.data[4:])), nil
+}
+
+func (c *sftpConn) open(filePath string) (string, error) {
+	payload := appendSFTPString(nil, filePath)
+	payload = binary.BigEndian.AppendUint32(payload, sshFxfRead)
+	payload = binary.BigEndian.AppendUint32(payload, 0) // no attributes
+	id, err := c.request(sshFxpOpen, payload)
+	if err != nil {
+		return "", err
+	}
+	reply, err := c.reply(id)
+	if err != nil {
+		return "", err
+	}
+	if reply.packetType != sshFxpHandle {
+		return "", sftpStatusError(reply)
+	}
+	handle, _, ok := readSFTPString(reply.data)
+	if !ok {
+		return "", errors.New("malformed sftp handle")
+	}
+	return string(handle), nil
+}
+
+func appendSFTPString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func readSFTPString(data []byte) ([]byte, []byte, bool) {
+	if len(data) < 4 {
+		return nil, nil, false
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint32(len(data)-4) < length {
+		return nil, nil, false
+	}
+	return data[4 : 4+length], data[4+length:], true
+}
+
+func sftpStatusError(reply sftpReply) error {
+	if reply.packetType != sshFxpStatus || len(reply.data) < 4 {
+		return fmt.Errorf("unexpected sftp packet %d", reply.packetType)
+	}
+	code := binary.BigEndian.Uint32(reply.data)
+	if code == sshFxEOF {
+		return io.EOF
+	}
+	if message, _, ok := readSFTPString(reply.data[4:]); ok && len(message) > 0 {
+		return fmt.Errorf("sftp error %d: %s", code, message)
+	}
+	return fmt.Errorf("sftp error %d", code)
+}
+
+// ----------------------------------------------- Range reader
+
+type sftpRead struct {
+	id     uint32
+	offset int64
+	length int64
+}
+
+// sftpRangeReader keeps several READ requests in flight so a chunk isn't
+// limited by the round trip time, and hands the data back in order.
+type sftpRangeReader struct {
+	ctx      context.Context
+	conn     *sftpConn
+	handle   string
+	offset   int64 // next offset to request
+	end      int64
+	pending  []sftpRead
+	received map[uint32]sftpReply
+	buf      []byte
+	stop     func() bool
+}
+
+func (r *sftpRangeReader) Read(p []byte) (int, error) {
+	n, err := r.read(p)
+	if err != nil && r.ctx.Err() != nil {
+		return n, r.ctx.Err()
+	}
+	return n, err
+}
+
+func (r *sftpRangeReader) read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		// Keep the pipeline full
+		for len(r.pending) < sftpReadsInFlight && r.offset <= r.end {
+			length := min(int64(sftpReadSize), r.end-r.offset+1)
+			if err := r.sendRead(len(r.pending), r.offset, length); err != nil {
+				return 0, err
+			}
+			r.offset += length
+		}
+		if len(r.pending) == 0 {
+			return 0, io.EOF
+		}
+
+		// Wait for the oldest request, replies may arrive out of order
+		next := r.pending[0]
+		reply, ok := r.received[next.id]
+		for !ok {
+			packetType, data, err := r.conn.readPacket()
+			if err != nil {
+				return 0, err
+			}
+			if len(data) < 4 {
+				return 0, errors.New("malformed sftp reply")
+			}
+			r.received[binary.BigEndian.Uint32(data)] = sftpReply{packetType: packetType, data: data[4:]}
+			reply, ok = r.received[next.id]
+		}
+		delete(r.received, next.id)
+		r.pending = r.pending[1:]
+
+		if reply.packetType != sshFxpData {
+			return 0, sftpStatusError(reply)
+		}
+		data, _, ok := readSFTPString(reply.data)
+		if !ok {
+			return 0, errors.New("malformed sftp data")
+		}
+		// A short read is allowed, ask for the rest right away and keep the order
+		if missing := next.length - int64(len(data)); missing > 0 {
+			if err := r.sendRead(0, next.offset+int64(len(data)), missing); err != nil {
+				return 0, err
+			}
+		}
+		r.buf = data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// sendRead issues a READ and queues it at position index of the pending list
+func (r *sftpRangeReader) sendRead(index int, offset, length int64) error {
+	payload := appendSFTPString(nil, r.handle)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(offset))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(length))
+	id, err := r.conn.request(sshFxpRead, payload)
+	if err != nil {
+		return err
+	}
+	r.pending = append(r.pending[:index], append([]sftpRead{{id: id, offset: offset, length: length}}, r.pending[index:]...)...)
+	return nil
+}
+
+func (r *sftpRangeReader) Close() error {
+	r.stop()
+	// No need to wait for the answer, the session goes away with it
+	r.conn.request(sshFxpClose, appendSFTPString(nil, r.handle))
+	return r.conn.Close()
+}
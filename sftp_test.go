@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer is an ssh server with a minimal sftp v3 subsystem: STAT,
+// OPEN, READ and CLOSE. Reads are answered out of order and never with more
+// than maxRead bytes, like real servers are allowed to. Reads of files
+// under /stalled are never answered.
+type testSFTPServer struct {
+	addr       string
+	files      map[string][]byte
+	maxRead    atomic.Int64
+	handshakes atomic.Int32
+}
+
+func startTestSFTPServer(t *testing.T, files map[string][]byte) *testSFTPServer {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "tester" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testSFTPServer{addr: listener.Addr().String(), files: files}
+	server.maxRead.Store(sftpReadSize)
+
+	// The client only talks to hosts in ~/.ssh/known_hosts
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	os.Mkdir(filepath.Join(home, ".ssh"), 0700)
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.addr)}, signer.PublicKey())
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var conns sync.WaitGroup
+	t.Cleanup(func() {
+		listener.Close()
+		// Connections of this server are cached for the next test otherwise
+		sshClientsMu.Lock()
+		for key, client := range sshClients {
+			client.Close()
+			delete(sshClients, key)
+		}
+		sshClientsMu.Unlock()
+		conns.Wait()
+	})
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				server.serveConn(netConn, config)
+			}()
+		}
+	}()
+	return server
+}
+
+func (server *testSFTPServer) serveConn(netConn net.Conn, config *ssh.ServerConfig) {
+	defer netConn.Close()
+	sshConn, chans, reqs, err := ssh.NewServerConn(netConn, config)
+	if err != nil {
+		return
+	}
+	defer sshConn.Close()
+	server.handshakes.Add(1)
+	go ssh.DiscardRequests(reqs)
+
+	var sessions sync.WaitGroup
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			defer channel.Close()
+			for req := range requests {
+				name, _, _ := readSFTPString(req.Payload)
+				if req.Type != "subsystem" || string(name) != "sftp" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				go ssh.DiscardRequests(requests)
+				server.serveSFTP(channel)
+				return
+			}
+		}()
+	}
+	sessions.Wait()
+}
+
+func (server *testSFTPServer) serveSFTP(channel ssh.Channel) {
+	var writeMu sync.Mutex
+	send := func(packetType byte, id uint32, payload []byte) {
+		packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+5))
+		packet = append(packet, packetType)
+		packet = binary.BigEndian.AppendUint32(packet, id)
+		packet = append(packet, payload...)
+		writeMu.Lock()
+		channel.Write(packet)
+		writeMu.Unlock()
+	}
+	status := func(id, code uint32, message string) {
+		payload := binary.BigEndian.AppendUint32(nil, code)
+		payload = appendSFTPString(payload, message)
+		payload = appendSFTPString(payload, "")
+		send(sshFxpStatus, id, payload)
+	}
+
+	handles := map[string]string{}
+	var replies sync.WaitGroup
+	defer replies.Wait()
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(channel, header[:]); err != nil {
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[:4])-1)
+		if _, err := io.ReadFull(channel, data); err != nil {
+			return
+		}
+		if header[4] == sshFxpInit {
+			writeMu.Lock()
+			channel.Write([]byte{0, 0, 0, 5, sshFxpVersion, 0, 0, 0, 3})
+			writeMu.Unlock()
+			continue
+		}
+		id, data := binary.BigEndian.Uint32(data), data[4:]
+		name, rest, _ := readSFTPString(data)
+
+		switch header[4] {
+		case sshFxpStat:
+			content, ok := server.files[string(name)]
+			if !ok {
+				status(id, 2, "no such file")
+				continue
+			}
+			attrs := binary.BigEndian.AppendUint32(nil, sshFileXferAttrSize)
+			send(sshFxpAttrs, id, binary.BigEndian.AppendUint64(attrs, uint64(len(content))))
+		case sshFxpOpen:
+			if _, ok := server.files[string(name)]; !ok {
+				status(id, 2, "no such file")
+				continue
+			}
+			handle := fmt.Sprintf("h%d", len(handles))
+			handles[handle] = string(name)
+			send(sshFxpHandle, id, appendSFTPString(nil, handle))
+		case sshFxpRead:
+			filePath := handles[string(name)]
+			if strings.HasPrefix(filePath, "/stalled") {
+				continue // never answered
+			}
+			content := server.files[filePath]
+			offset := int64(binary.BigEndian.Uint64(rest))
+			length := int64(binary.BigEndian.Uint32(rest[8:]))
+			// Answer a little later, so the replies come back in any order
+			replies.Add(1)
+			go func() {
+				defer replies.Done()
+				delay, _ := rand.Int(rand.Reader, big.NewInt(3))
+				time.Sleep(time.Duration(delay.Int64()) * time.Millisecond)
+				if offset >= int64(len(content)) {
+					status(id, sshFxEOF, "eof")
+					return
+				}
+				end := min(offset+length, int64(len(content)), offset+server.maxRead.Load())
+				send(sshFxpData, id, appendSFTPString(nil, string(content[offset:end])))
+			}()
+		case sshFxpClose:
+			delete(handles, string(name))
+			status(id, 0, "")
+		default:
+			status(id, 8, "unsupported")
+		}
+	}
+}
+
+func (server *testSFTPServer) url(filePath string) string {
+	return "sftp://tester:secret@" + server.addr + filePath
+}
+
+// testSFTPContent is a file that doesn't repeat, a chunk read from the wrong
+// offset can't look right
+func testSFTPContent(size int) []byte {
+	content := make([]byte, size)
+	for i := 0; i < size; i += 4 {
+		var word [4]byte
+		binary.BigEndian.PutUint32(word[:], uint32(i/4))
+		copy(content[i:], word[:])
+	}
+	return content
+}
+
+func TestSFTPProbe(t *testing.T) {
+	content := testSFTPContent(300_001)
+	server := startTestSFTPServer(t, map[string][]byte{"/files/big file.bin": content})
+
+	info, err := (&sftpSource{}).Probe(context.Background(), server.url("/files/big%20file.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Total != len(content) {
+		t.Errorf("Total = %d, want %d", info.Total, len(content))
+	}
+	if info.FileName != "big file.bin" {
+		t.Errorf("FileName = %q, want %q", info.FileName, "big file.bin")
+	}
+
+	if _, err := (&sftpSource{}).Probe(context.Background(), server.url("/files/missing.bin")); err == nil {
+		t.Error("Probe of a missing file succeeded")
+	}
+}
+
+func TestSFTPOpenRange(t *testing.T) {
+	content := testSFTPContent(1_000_003)
+	server := startTestSFTPServer(t, map[string][]byte{"/data.bin": content})
+
+	tests := []struct {
+		name       string
+		maxRead    int64
+		start, end int64
+	}{
+		{"whole file", sftpReadSize, 0, int64(len(content)) - 1},
+		{"middle", sftpReadSize, 12345, 654321},
+		{"one byte", sftpReadSize, 999, 999},
+		{"last bytes", sftpReadSize, int64(len(content)) - 7, int64(len(content)) - 1},
+		{"short reads", 5000, 100, 300_000},
+		{"past the end", sftpReadSize, int64(len(content)) - 10, int64(len(content)) + 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server.maxRead.Store(test.maxRead)
+			reader, err := (&sftpSource{}).OpenRange(context.Background(), server.url("/data.bin"), test.start, test.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := content[test.start:min(test.end+1, int64(len(content)))]
+			if !bytes.Equal(got, want) {
+				t.Errorf("got %d bytes, want %d bytes of the range", len(got), len(want))
+			}
+		})
+	}
+}
+
+// Chunks read at the same time share one ssh connection, each with its own session
+func TestSFTPChunksShareConnection(t *testing.T) {
+	content := testSFTPContent(400_000)
+	server := startTestSFTPServer(t, map[string][]byte{"/data.bin": content})
+
+	const chunks = 4
+	size := int64(len(content)) / chunks
+	got := make([][]byte, chunks)
+	errs := make([]error, chunks)
+	var wg sync.WaitGroup
+	for i := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reader, err := (&sftpSource{}).OpenRange(context.Background(), server.url("/data.bin"), int64(i)*size, int64(i+1)*size-1)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer reader.Close()
+			got[i], errs[i] = io.ReadAll(reader)
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.Join(got, nil), content) {
+		t.Error("the chunks don't add up to the file")
+	}
+	// Chunks that dial at once may each connect, but only one connection is kept
+	sshClientsMu.Lock()
+	kept := len(sshClients)
+	sshClientsMu.Unlock()
+	if kept != 1 {
+		t.Errorf("%d ssh connections kept, want 1", kept)
+	}
+
+	// Later chunks reuse it
+	before := server.handshakes.Load()
+	reader, err := (&sftpSource{}).OpenRange(context.Background(), server.url("/data.bin"), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	if server.handshakes.Load() != before {
+		t.Error("a later chunk connected again")
+	}
+}
+
+func TestSFTPCancel(t *testing.T) {
+	server := startTestSFTPServer(t, map[string][]byte{"/stalled.bin": testSFTPContent(1000)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := (&sftpSource{}).OpenRange(ctx, server.url("/stalled.bin"), 0, 999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := reader.Read(make([]byte, 100))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Read returned %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read didn't return after the cancel")
+	}
+}
+
+// A server that never finishes the handshake gives up with the ctx, and
+// doesn't hold up connections to other hosts meanwhile
+func TestSFTPDialTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // says nothing
+		}
+	}()
+
+	server := startTestSFTPServer(t, map[string][]byte{"/data.bin": testSFTPContent(100)})
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	silent := make(chan error, 1)
+	go func() {
+		_, err := (&sftpSource{}).Probe(ctx, "sftp://tester:secret@"+listener.Addr().String()+"/data.bin")
+		silent <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := (&sftpSource{}).Probe(context.Background(), server.url("/data.bin")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-silent:
+		t.Fatal("the silent host answered before its deadline")
+	default:
+	}
+	select {
+	case err := <-silent:
+		if err == nil {
+			t.Fatal("Probe of a silent host succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake didn't give up with the ctx")
+	}
+}
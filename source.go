@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Source is implemented by every protocol DownBit can download from.
+// Probe finds out the file name and size, OpenRange streams the bytes
+// between start and end (inclusive) so a chunk can be fetched on its own.
+type Source interface {
+	Probe(ctx context.Context, rawURL string) (FileInfo, error)
+	OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error)
+}
+
+// sourceFor picks the Source that handles the scheme of rawURL
+func sourceFor(client *http.Client, rawURL string) (Source, error) {
+	// data: payloads don't always survive url.Parse
+	if isDataURL(rawURL) {
+		return &dataSource{}, nil
+	}
+
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %v", err)
+	}
+
+	switch strings.ToLower(parsedURL.Scheme) {
+	case "http", "https":
+		return &httpSource{Client: client}, nil
+	case "ftp", "ftps", "ftpes":
+		return &ftpSource{}, nil
+	case "sftp", "scp":
+		return &sftpSource{}, nil
+	case "file":
+		return &fileSource{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported url scheme %q", parsedURL.Scheme)
+	}
+}
+
+// ----------------------------------------------- HTTP
+
+type httpSource struct {
+	Client *http.Client
+}
+
+// Headers go with every http request of a download, a browser hands them
+// over so downloads behind a login keep working
+type Headers struct {
+	Cookie    string `json:"cookie,omitempty"`
+	Referer   string `json:"referer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// clientFor is myapp.Client sending headers along, the cookies only to the
+// host of rawURL like a browser would
+func (myapp *MyApp) clientFor(headers *Headers, rawURL string) *http.Client {
+	if headers == nil {
+		return myapp.Client
+	}
+	client := *myapp.Client
+	transport := &headerTransport{base: client.Transport, headers: *headers}
+	if transport.base == nil {
+		transport.base = http.DefaultTransport
+	}
+	if parsedURL, err := url.Parse(rawURL); err == nil {
+		transport.cookieHost = parsedURL.Hostname()
+	}
+	client.Transport = transport
+	return &client
+}
+
+type headerTransport struct {
+	base       http.RoundTripper
+	headers    Headers
+	cookieHost string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.headers.Referer != "" && req.Header.Get("Referer") == "" {
+		req.Header.Set("Referer", t.headers.Referer)
+	}
+	if t.headers.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.headers.UserAgent)
+	}
+	if t.headers.Cookie != "" && strings.EqualFold(req.URL.Hostname(), t.cookieHost) {
+		req.Header.Add("Cookie", t.headers.Cookie)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// httpStatusError is a probe the server answered with something other than 200
+type httpStatusError struct {
+	Code int
+}
+
+func (err *httpStatusError) Error() string {
+	return fmt.Sprintf("failed to download file: HTTP %d", err.Code)
+}
+
+func (s *httpSource) Probe(ctx context.Context, rawURL string) (FileInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", rawURL, nil)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("error creating the request, %v", err)
+	}
+
+	// Get file Info
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		logger.Println("error making the request")
+		return FileInfo{}, fmt.Errorf("error making the request, %v", err)
+	}
+	defer resp.Body.Close() // Close response
+	if resp.StatusCode != http.StatusOK {
+		logger.Printf("Failed to download file: HTTP %d\n", resp.StatusCode)
+		return FileInfo{}, &httpStatusError{Code: resp.StatusCode}
+	}
+
+	fileSize, total := getFileSize(resp)
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{
+		FileName: getFileName(resp, rawURL),
+		FileSize: fileSize,
+		Total:    int(total),
+		MimeType: resp.Header.Get("Content-Type"),
+		Metalink: parseLinkMirrors(resp, rawURL),
+		ModTime:  modTime,
+	}, nil
+}
+
+func (s *httpSource) OpenRange(ctx context.Context, rawURL string, start, end int64) (io.ReadCloser, error) {
+	// Prepare the HTTP request with a range header
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		logger.Printf("Error creating the request: %v\n", err)
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	// Send Request
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		logger.Printf("Error starting the download: %v\n", err)
+		return nil, err
+	}
+	statsFrom(ctx).gotResponse(resp)
+	if resp.StatusCode >= http.StatusBadRequest {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server responded with HTTP %d", resp.StatusCode)
+	}
+	// A server ignoring the range would send the file from the beginning
+	if start > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server doesn't support ranges (HTTP %d)", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Speeds are smoothed over the last few seconds, one sample of a ticker
+// jumps around with every slow read.
+
+// rateWindow is about how far back the speed looks
+const rateWindow = 5 * time.Second
+
+// rateEstimator is an exponentially weighted average of the speed, weighted
+// by the time that really passed between samples
+type rateEstimator struct {
+	rate      float64 // bytes per second
+	lastBytes int64
+	lastTime  time.Time
+	primed    bool // has a first sample to start the average from
+}
+
+// update takes how much is downloaded at now and returns the speed
+func (r *rateEstimator) update(downloaded int64, now time.Time) float64 {
+	// The first sample, or the download started over
+	if r.lastTime.IsZero() || downloaded < r.lastBytes {
+		*r = rateEstimator{lastBytes: downloaded, lastTime: now}
+		return r.rate
+	}
+	elapsed := now.Sub(r.lastTime)
+	if elapsed <= 0 {
+		return r.rate
+	}
+	sample := float64(downloaded-r.lastBytes) / elapsed.Seconds()
+	if r.primed {
+		weight := 1 - math.Exp(-elapsed.Seconds()/rateWindow.Seconds())
+		r.rate += weight * (sample - r.rate)
+	} else {
+		// Averaging up from 0 would take the whole window
+		r.rate, r.primed = sample, true
+	}
+	r.lastBytes, r.lastTime = downloaded, now
+	return r.rate
+}
+
+// reset forgets the speed, a paused download starts from nothing
+func (r *rateEstimator) reset() {
+	*r = rateEstimator{}
+}
+
+// estimateETA is how long the rest takes at rate, 0 when it can't be told
+func estimateETA(remaining int64, rate float64) time.Duration {
+	if remaining <= 0 || rate < 1 {
+		return 0
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second))
+}
+
+// formatRate is a speed in the units the rest of the app uses
+func formatRate(rate float64) string {
+	if rate < 1024*1024 {
+		return fmt.Sprintf("%.0f KB/s", rate/1024)
+	}
+	return fmt.Sprintf("%.2f MB/s", rate/1024/1024)
+}
+
+// formatProgress is what the progress bar of a download says
+func formatProgress(value float64, size int64) string {
+	text := fmt.Sprintf("%.0f%%", value*100)
+	if size > 0 {
+		downloaded := formatSize(int64(value * float64(size)))
+		if downloaded == "" {
+			downloaded = "0 KB"
+		}
+		text += fmt.Sprintf(" · %s of %s", downloaded, formatSize(size))
+	}
+	return text
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const streamWorkers = 6
+
+// StreamVariant is one quality of an HLS or DASH stream
+type StreamVariant struct {
+	Kind      string `json:"kind"` // "hls" or "dash"
+	Name      string `json:"name"`
+	Bandwidth int    `json:"bandwidth"`
+	URL       string `json:"url"`                 // HLS media playlist or DASH manifest
+	AudioURL  string `json:"audio_url,omitempty"` // HLS alternate audio playlist
+	VideoID   string `json:"video_id"`            // DASH representations
+	AudioID   string `json:"audio_id"`
+}
+
+// separateAudio tells whether the audio comes as a track of its own, only
+// ffmpeg can merge it with the video
+func (variant StreamVariant) separateAudio() bool {
+	return variant.AudioURL != "" || (variant.VideoID != "" && variant.AudioID != "")
+}
+
+// defaultVariant is the variant to pick when nobody asked for one: the best,
+// or without ffmpeg the best with video and audio together
+func defaultVariant(myapp *MyApp, variants []StreamVariant) int {
+	if myapp.App.Preferences().String(prefFFmpegPath) != "" {
+		return 0
+	}
+	for i, variant := range variants {
+		if !variant.separateAudio() {
+			return i
+		}
+	}
+	return 0
+}
+
+type streamSegment struct {
+	URL         string
+	Track       int // 0 video (or muxed), 1 separate audio
+	RangeStart  int64
+	RangeLength int64 // -1 for the whole resource
+	Key         *streamKey
+}
+
+type streamKey struct {
+	URI string
+	IV  []byte
+}
+
+// streamKind tells whether rawURL points to an HLS or DASH manifest
+func streamKind(rawURL, mimeType string) string {
+	mimeType = strings.ToLower(mimeType)
+	ext := ""
+	if parsedURL, err := url.Parse(rawURL); err == nil {
+		ext = strings.ToLower(path.Ext(parsedURL.Path))
+	}
+
+	switch {
+	case ext == ".m3u8" || strings.Contains(mimeType, "mpegurl"):
+		return "hls"
+	case ext == ".mpd" || strings.Contains(mimeType, "dash+xml"):
+		return "dash"
+	default:
+		return ""
+	}
+}
+
+// probeStream reads the manifest and lists its variants, best first
+func probeStream(client *http.Client, rawURL, kind string, fileInfo FileInfo) (FileInfo, error) {
+	manifest, err := fetchBytes(context.Background(), client, rawURL, 0, -1)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("could not fetch manifest: %v", err)
+	}
+
+	var variants []StreamVariant
+	ext := ".ts"
+	if kind == "hls" {
+		variants, err = parseHLSVariants(manifest, rawURL)
+	} else {
+		variants, err = parseDASHVariants(manifest, rawURL)
+		ext = ".mp4"
+	}
+	if err != nil {
+		return FileInfo{}, err
+	}
+	sort.SliceStable(variants, func(i, j int) bool {
+		return variants[i].Bandwidth > variants[j].Bandwidth
+	})
+
+	fileInfo.FileName = strings.TrimSuffix(fileInfo.FileName, filepath.Ext(fileInfo.FileName)) + ext
+	fileInfo.FileSize = 0
+	fileInfo.Total = 0
+	fileInfo.Variants = variants
+	fileInfo.Stream = &variants[0]
+	return fileInfo, nil
+}
+
+// streamSegments (re)reads the media playlist or manifest of the chosen variant
+func streamSegments(ctx context.Context, client *http.Client, variant StreamVariant) ([]streamSegment, error) {
+	manifest, err := fetchBytes(ctx, client, variant.URL, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch manifest: %v", err)
+	}
+	if variant.Kind != "hls" {
+		return parseDASHSegments(manifest, variant)
+	}
+	segments, err := parseHLSSegments(manifest, variant.URL)
+	if err != nil || variant.AudioURL == "" {
+		return segments, err
+	}
+
+	// The alternate audio is a playlist of its own
+	manifest, err = fetchBytes(ctx, client, variant.AudioURL, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch audio playlist: %v", err)
+	}
+	audio, err := parseHLSSegments(manifest, variant.AudioURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range audio {
+		segment.Track = 1
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+func streamPartsDir(filePath string) string {
+	return filePath + ".parts"
+}
+
+// downloadStream fetches the segments of a stream in parallel, each segment
+// is one Chunk of the Download so a paused stream continues where it stopped.
+func downloadStream(myapp *MyApp, download *Download, fileItem *FileItem, ctx, ctxP context.Context) {
+	go func() {
+		client := myapp.clientFor(download.Headers, download.URL)
+		// Without ffmpeg the video and the audio would end up in two files
+		ffmpeg := myapp.App.Preferences().String(prefFFmpegPath)
+		if download.Stream.separateAudio() && ffmpeg == "" {
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("%s has the video and the audio apart, set the ffmpeg path in the settings to merge them or pick another quality", download.FileName))
+			fileItem.stopped("Failed")
+			return
+		}
+		segments, err := streamSegments(ctx, client, *download.Stream)
+		if err != nil {
+			logger.Println("Error reading stream:", err)
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error reading stream: %v", err))
+			fileItem.stopped("Failed")
+			return
+		}
+		if len(download.Chunks) != len(segments) {
+			download.Chunks = make([]Chunk, len(segments))
+		}
+
+		partsDir := streamPartsDir(download.FilePath)
+		if err := os.MkdirAll(partsDir, 0755); err != nil {
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error creating file: %v", err))
+			fileItem.stopped("Failed")
+			return
+		}
+
+		var finished int64
+		for _, chunk := range download.Chunks {
+			if chunk.Status == "Finished" {
+				finished++
+			}
+		}
+
+		keys := &streamKeyCache{keys: map[string][]byte{}}
+		jobs := make(chan int)
+		var wg sync.WaitGroup
+		var segmentErr error
+		var errOnce sync.Once
+
+		for w := 0; w < streamWorkers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for index := range jobs {
+					size, err := downloadSegment(ctx, ctxP, client, segments[index], keys, filepath.Join(partsDir, fmt.Sprintf("%06d", index)), &download.Downloaded)
+					if err != nil {
+						if !errors.Is(err, context.Canceled) {
+							logger.Printf("Error downloading segment %d: %v\n", index, err)
+							errOnce.Do(func() { segmentErr = fmt.Errorf("error downloading segment %d: %v", index, err) })
+						}
+						continue
+					}
+					download.Chunks[index] = Chunk{End: size - 1, CurrentOffset: size, Status: "Finished"}
+					atomic.AddInt64(&finished, 1)
+				}
+			}()
+		}
+
+		// Periodically update the progress bar
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(500 * time.Millisecond)
+			defer ticker.Stop()
+			var speed rateEstimator
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					fileItem.setProgress(float64(atomic.LoadInt64(&finished)) / float64(len(segments)))
+					// The size of a stream isn't known, only its segments
+					rate := speed.update(atomic.LoadInt64(&download.Downloaded), time.Now())
+					fileItem.setSpeed("Speed: " + formatRate(rate))
+				}
+			}
+		}()
+
+	feed:
+		for index := range segments {
+			if download.Chunks[index].Status == "Finished" {
+				continue
+			}
+			select {
+			case jobs <- index:
+			case <-ctx.Done():
+				break feed
+			case <-ctxP.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+		close(done)
+
+		// Handle cancellation and file deletion
+		if ctx.Err() != nil {
+			logger.Println("Download Cancelled")
+			os.RemoveAll(partsDir)
+			fileItem.stopped("Cancelled")
+			return
+		}
+
+		// Handle Pausing, a failed segment is retried on resume
+		if ctxP.Err() != nil || segmentErr != nil {
+			logger.Println("Download Paused.")
+			if segmentErr != nil {
+				fileItem.failed(myapp, segmentErr)
+			}
+			download.Status = "Paused"
+			download.UpdatedAt = time.Now().String()
+			fileItem.Ctx = ctx
+			fileItem.CtxP = ctxP
+			saveDownloadFileInfo(*download, myapp.DownloadStateFilePath)
+			fileItem.stopped("Paused")
+			return
+		}
+
+		fileItem.setProgress(1)
+		outputs, err := assembleStream(download, segments, partsDir)
+		if err != nil {
+			// The segments are kept, resuming assembles them again
+			logger.Println("Error assembling stream:", err)
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error assembling stream: %v", err))
+			download.Status = "Paused"
+			download.UpdatedAt = time.Now().String()
+			fileItem.Ctx = ctx
+			fileItem.CtxP = ctxP
+			saveDownloadFileInfo(*download, myapp.DownloadStateFilePath)
+			fileItem.stopped("Paused")
+			return
+		}
+		os.RemoveAll(partsDir)
+
+		// The concatenated output is kept when remuxing fails
+		if ffmpeg != "" {
+			if err := remuxStream(ffmpeg, download, outputs); err != nil {
+				logger.Println(err)
+				myapp.showDownloadError(fileItem.ID, err)
+			}
+		}
+
+		logger.Println("Download has Finished.")
+		download.Status = "Finished"
+		download.UpdatedAt = time.Now().String()
+		if stat, err := os.Stat(download.FilePath); err == nil {
+			download.TotalSize = stat.Size()
+		}
+		download.Checksum, err = verifyChecksum(client, *download)
+		if err != nil {
+			logger.Println(err)
+		}
+
+		go downloadFinished(fileItem)
+		saveDownloadFileInfo(*download, myapp.DownloadStateFilePath)
+		runPostActions(myapp, fileItem, *download)
+		fileItem.stopped("Finished")
+	}()
+}
+
+type streamKeyCache struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func (c *streamKeyCache) get(ctx context.Context, client *http.Client, uri string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[uri]; ok {
+		return key, nil
+	}
+	key, err := fetchBytes(ctx, client, uri, 0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch key: %v", err)
+	}
+	if len(key) != 16 {
+		return nil, fmt.Errorf("key %s has %d bytes, expected 16", uri, len(key))
+	}
+	c.keys[uri] = key
+	return key, nil
+}
+
+// downloadSegment fetches (and decrypts) one segment into partPath and returns its size
+func downloadSegment(ctx, ctxP context.Context, client *http.Client, segment streamSegment, keys *streamKeyCache, partPath string, downloaded *int64) (int64, error) {
+	// Pausing stops the segment as well, it's fetched again on resume
+	segmentCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	unpause := context.AfterFunc(ctxP, stop)
+	defer unpause()
+
+	var data []byte
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		data, err = fetchBytes(segmentCtx, client, segment.URL, segment.RangeStart, segment.RangeLength)
+		if err == nil || segmentCtx.Err() != nil {
+			break
+		}
+		time.Sleep(time.Duration(attempt+1) * time.Second)
+	}
+	if segmentCtx.Err() != nil {
+		return 0, context.Canceled
+	}
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(downloaded, int64(len(data)))
+
+	if segment.Key != nil {
+		key, err := keys.get(segmentCtx, client, segment.Key.URI)
+		if err != nil {
+			return 0, err
+		}
+		if data, err = decryptAES128(data, key, segment.Key.IV); err != nil {
+			return 0, err
+		}
+	}
+
+	// Write next to the final name so a half written part is never taken as done
+	if err := os.WriteFile(partPath+".tmp", data, 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(partPath+".tmp", partPath); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// fetchBytes GETs a manifest, key or segment, length -1 means until the end
+func fetchBytes(ctx context.Context, client *http.Client, rawURL string, start, length int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if length >= 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("HTTP %d for %s", resp.StatusCode, rawURL)
+	}
+	return io.ReadAll(&limitedReader{ctx: ctx, r: resp.Body})
+}
+
+// assembleStream concatenates the parts of every track and returns the files it wrote
+func assembleStream(download *Download, segments []streamSegment, partsDir string) ([]string, error) {
+	base := strings.TrimSuffix(download.FilePath, filepath.Ext(download.FilePath))
+	outputs := []string{download.FilePath}
+	for _, segment := range segments {
+		if segment.Track == 1 {
+			outputs = append(outputs, base+".m4a")
+			break
+		}
+	}
+
+	for track, output := range outputs {
+		outFile, err := os.Create(output)
+		if err != nil {
+			return nil, err
+		}
+		for index, segment := range segments {
+			if segment.Track != track {
+				continue
+			}
+			part, err := os.Open(filepath.Join(partsDir, fmt.Sprintf("%06d", index)))
+			if err != nil {
+				outFile.Close()
+				return nil, err
+			}
+			_, err = io.Copy(outFile, part)
+			part.Close()
+			if err != nil {
+				outFile.Close()
+				return nil, err
+			}
+		}
+		if err := outFile.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return outputs, nil
+}
+
+// remuxStream merges the assembled tracks into a single mp4 with ffmpeg
+func remuxStream(ffmpeg string, download *Download, outputs []string) error {
+	base := strings.TrimSuffix(download.FilePath, filepath.Ext(download.FilePath))
+
+	// Remux next to the output and only replace it once ffmpeg succeeded
+	remuxed := base + ".remux.mp4"
+	args := []string{"-y", "-loglevel", "error"}
+	for _, output := range outputs {
+		args = append(args, "-i", output)
+	}
+	// The audio of its own track wins over any the video has
+	if len(outputs) > 1 {
+		args = append(args, "-map", "0:v", "-map", "1:a")
+	}
+	args = append(args, "-c", "copy")
+	if download.Stream.Kind == "hls" {
+		args = append(args, "-bsf:a", "aac_adtstoasc")
+	}
+	args = append(args, remuxed)
+
+	if out, err := exec.Command(ffmpeg, args...).CombinedOutput(); err != nil {
+		os.Remove(remuxed)
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	for _, output := range outputs {
+		os.Remove(output)
+	}
+	if err := os.Rename(remuxed, base+".mp4"); err != nil {
+		return err
+	}
+	download.FilePath = base + ".mp4"
+	download.FileName = filepath.Base(download.FilePath)
+	return nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Torrent is what a Download keeps of a torrent to continue it later
+type Torrent struct {
+	InfoHash string   `json:"info_hash"` // hex
+	Trackers []string `json:"trackers"`
+	Info     []byte   `json:"info"` // bencoded info dictionary, empty until a magnet got its metadata
+	Have     []byte   `json:"have"` // bitfield of the verified pieces
+	Uploaded int64    `json:"uploaded"`
+}
+
+// torrentMeta is the parsed info dictionary
+type torrentMeta struct {
+	Name        string
+	PieceLength int64
+	Pieces      [][20]byte
+	Files       []torrentFile
+	Length      int64
+	MultiFile   bool
+}
+
+type torrentFile struct {
+	Path   string // relative to the torrent folder
+	Length int64
+	Offset int64 // where the file starts in the torrent
+}
+
+func isMagnet(rawURL string) bool {
+	return strings.HasPrefix(strings.ToLower(rawURL), "magnet:")
+}
+
+func isTorrent(rawURL, mimeType string) bool {
+	if strings.Contains(strings.ToLower(mimeType), "bittorrent") {
+		return true
+	}
+	if parsedURL, err := url.Parse(rawURL); err == nil {
+		return strings.ToLower(path.Ext(parsedURL.Path)) == ".torrent"
+	}
+	return false
+}
+
+func (t *Torrent) hash() [20]byte {
+	var infoHash [20]byte
+	hex.Decode(infoHash[:], []byte(t.InfoHash))
+	return infoHash
+}
+
+// parseTorrentFile reads a .torrent, the info dictionary is kept as it is
+// because the info hash is computed over its exact bytes
+func parseTorrentFile(data []byte) (*Torrent, *torrentMeta, error) {
+	decoder := &bencodeDecoder{data: data}
+	value, err := decoder.value(0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid torrent file: %v", err)
+	}
+	dict, ok := value.(map[string]any)
+	if !ok || decoder.infoEnd == 0 {
+		return nil, nil, errors.New("torrent file has no info dictionary")
+	}
+
+	info := data[decoder.infoStart:decoder.infoEnd]
+	meta, err := parseTorrentInfo(info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	infoHash := sha1.Sum(info)
+	torrent := &Torrent{
+		InfoHash: hex.EncodeToString(infoHash[:]),
+		Info:     append([]byte(nil), info...),
+	}
+	if announce, ok := dict["announce"].(string); ok {
+		torrent.Trackers = append(torrent.Trackers, announce)
+	}
+	// announce-list is a list of tiers, every tracker gets asked
+	if tiers, ok := dict["announce-list"].([]any); ok {
+		for _, tier := range tiers {
+			trackers, _ := tier.([]any)
+			for _, tracker := range trackers {
+				if tracker, ok := tracker.(string); ok && !containsString(torrent.Trackers, tracker) {
+					torrent.Trackers = append(torrent.Trackers, tracker)
+				}
+			}
+		}
+	}
+	return torrent, meta, nil
+}
+
+// parseMagnet reads the info hash, trackers and display name of a magnet link
+func parseMagnet(link string) (*Torrent, string, error) {
+	parsedURL, err := url.Parse(link)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid magnet link: %v", err)
+	}
+	query := parsedURL.Query()
+
+	torrent := &Torrent{}
+	for _, xt := range query["xt"] {
+		hash, ok := strings.CutPrefix(strings.ToLower(xt), "urn:btih:")
+		if !ok {
+			continue
+		}
+		switch len(hash) {
+		case 40:
+			if _, err := hex.DecodeString(hash); err == nil {
+				torrent.InfoHash = hash
+			}
+		case 32:
+			if decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash)); err == nil {
+				torrent.InfoHash = hex.EncodeToString(decoded)
+			}
+		}
+	}
+	if torrent.InfoHash == "" {
+		return nil, "", errors.New("magnet link has no bittorrent info hash")
+	}
+	for _, tracker := range query["tr"] {
+		if !containsString(torrent.Trackers, tracker) {
+			torrent.Trackers = append(torrent.Trackers, tracker)
+		}
+	}
+	return torrent, query.Get("dn"), nil
+}
+
+func parseTorrentInfo(info []byte) (*torrentMeta, error) {
+	value, err := bencodeDecode(info)
+	if err != nil {
+		return nil, fmt.Errorf("invalid torrent info: %v", err)
+	}
+	dict, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("torrent info isn't a dictionary")
+	}
+
+	meta := &torrentMeta{}
+	meta.Name, _ = dict["name"].(string)
+	meta.Name = sanitizeFileName(meta.Name)
+	if meta.Name == "" || meta.Name == "." || meta.Name == ".." {
+		return nil, errors.New("torrent has no name")
+	}
+	meta.PieceLength, _ = dict["piece length"].(int64)
+	if meta.PieceLength <= 0 {
+		return nil, errors.New("torrent has no piece length")
+	}
+	pieces, _ := dict["pieces"].(string)
+	if len(pieces) == 0 || len(pieces)%20 != 0 {
+		return nil, errors.New("torrent has invalid piece hashes")
+	}
+	meta.Pieces = make([][20]byte, len(pieces)/20)
+	for i := range meta.Pieces {
+		copy(meta.Pieces[i][:], pieces[i*20:])
+	}
+
+	if length, ok := dict["length"].(int64); ok {
+		meta.Files = []torrentFile{{Path: meta.Name, Length: length}}
+		meta.Length = length
+	} else {
+		files, _ := dict["files"].([]any)
+		if len(files) == 0 {
+			return nil, errors.New("torrent has no files")
+		}
+		meta.MultiFile = true
+		for _, file := range files {
+			fileDict, _ := file.(map[string]any)
+			length, _ := fileDict["length"].(int64)
+			parts, _ := fileDict["path"].([]any)
+			filePath, err := torrentFilePath(parts)
+			if err != nil {
+				return nil, err
+			}
+			meta.Files = append(meta.Files, torrentFile{Path: filePath, Length: length, Offset: meta.Length})
+			meta.Length += length
+		}
+	}
+
+	if want := (meta.Length + meta.PieceLength - 1) / meta.PieceLength; want != int64(len(meta.Pieces)) {
+		return nil, fmt.Errorf("torrent has %d pieces, expected %d", len(meta.Pieces), want)
+	}
+	return meta, nil
+}
+
+// torrentFilePath joins the path of a file inside a multi file torrent,
+// components that could leave the torrent folder are refused
+func torrentFilePath(parts []any) (string, error) {
+	var cleaned []string
+	for _, part := range parts {
+		name, _ := part.(string)
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return "", fmt.Errorf("torrent has an unsafe file path %q", name)
+		}
+		cleaned = append(cleaned, sanitizeFileName(name))
+	}
+	if len(cleaned) == 0 {
+		return "", errors.New("torrent has a file without path")
+	}
+	return filepath.Join(cleaned...), nil
+}
+
+func (meta *torrentMeta) pieceSize(index int) int64 {
+	if index == len(meta.Pieces)-1 {
+		return meta.Length - int64(index)*meta.PieceLength
+	}
+	return meta.PieceLength
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// probeTorrent fetches a .torrent and describes the content it points to
+func probeTorrent(client *http.Client, rawURL string, fileInfo FileInfo) (FileInfo, error) {
+	source, err := sourceFor(client, rawURL)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	body, err := source.OpenRange(context.Background(), rawURL, 0, int64(fileInfo.Total)-1)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("could not fetch torrent: %v", err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, 16*1024*1024))
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("could not fetch torrent: %v", err)
+	}
+
+	torrent, meta, err := parseTorrentFile(data)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fileInfo.FileName = meta.Name
+	fileInfo.Total = int(meta.Length)
+	fileInfo.FileSize = float64(meta.Length) / (1024 * 1024)
+	fileInfo.MimeType = ""
+	fileInfo.Torrent = torrent
+	return fileInfo, nil
+}
+
+// probeMagnet can't know the size yet, the metadata comes from the peers
+func probeMagnet(link string) (FileInfo, error) {
+	torrent, name, err := parseMagnet(link)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	// "." or ".." would make the download the downloads folder itself
+	if name = sanitizeFileName(name); name == "" || name == "." || name == ".." {
+		name = torrent.InfoHash
+	}
+	return FileInfo{FileName: name, URL: link, Torrent: torrent}, nil
+}
+
+// torrentBadPieces hashes the pieces of a finished torrent on disk
+func torrentBadPieces(download Download) ([]int, error) {
+	meta, err := parseTorrentInfo(download.Torrent.Info)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range meta.Files {
+		filePath := download.FilePath
+		if meta.MultiFile {
+			filePath = filepath.Join(download.FilePath, file.Path)
+		}
+		if _, err := os.Stat(filePath); err != nil {
+			return nil, err
+		}
+	}
+
+	storage := newTorrentStorage(download.FilePath, meta)
+	defer storage.Close()
+	var bad []int
+	buf := make([]byte, meta.PieceLength)
+	for index, expected := range meta.Pieces {
+		piece := buf[:meta.pieceSize(index)]
+		if err := storage.ReadAt(piece, int64(index)*meta.PieceLength); err != nil || sha1.Sum(piece) != expected {
+			bad = append(bad, index)
+		}
+	}
+	return bad, nil
+}
+
+// ----------------------------------------------- Storage
+
+// torrentStorage maps the torrent byte range onto its files
+type torrentStorage struct {
+	root  string // the file of a single file torrent, the folder otherwise
+	meta  *torrentMeta
+	mu    sync.Mutex
+	files map[int]*os.File
+}
+
+func newTorrentStorage(root string, meta *torrentMeta) *torrentStorage {
+	return &torrentStorage{root: root, meta: meta, files: map[int]*os.File{}}
+}
+
+func (s *torrentStorage) open(index int) (*os.File, error) {
+	if file, ok := s.files[index]; ok {
+		return file, nil
+	}
+	filePath := s.root
+	if s.meta.MultiFile {
+		filePath = filepath.Join(s.root, s.meta.Files[index].Path)
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.files[index] = file
+	return file, nil
+}
+
+// each calls fn for every file part that overlaps [offset, offset+len(p))
+func (s *torrentStorage) each(p []byte, offset int64, fn func(file *os.File, part []byte, fileOffset int64) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for index, info := range s.meta.Files {
+		if len(p) == 0 {
+			break
+		}
+		if offset >= info.Offset+info.Length || info.Length == 0 {
+			continue
+		}
+		file, err := s.open(index)
+		if err != nil {
+			return err
+		}
+		n := min(int64(len(p)), info.Offset+info.Length-offset)
+		if err := fn(file, p[:n], offset-info.Offset); err != nil {
+			return err
+		}
+		p = p[n:]
+		offset += n
+	}
+	return nil
+}
+
+func (s *torrentStorage) WriteAt(p []byte, offset int64) error {
+	return s.each(p, offset, func(file *os.File, part []byte, fileOffset int64) error {
+		_, err := file.WriteAt(part, fileOffset)
+		return err
+	})
+}
+
+func (s *torrentStorage) ReadAt(p []byte, offset int64) error {
+	return s.each(p, offset, func(file *os.File, part []byte, fileOffset int64) error {
+		_, err := file.ReadAt(part, fileOffset)
+		return err
+	})
+}
+
+func (s *torrentStorage) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for index, file := range s.files {
+		file.Close()
+		delete(s.files, index)
+	}
+}
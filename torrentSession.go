@@ -0,0 +1,975 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	torrentMaxPeers   = 40
+	torrentPipeline   = 10 // block requests in flight per peer
+	metadataPieceSize = 16 * 1024
+	maxMetadataSize   = 10 * 1024 * 1024
+)
+
+// torrentSession downloads (and seeds) one torrent, every peer runs in its
+// own goroutine and shares the session state under mu
+type torrentSession struct {
+	myapp    *MyApp
+	download *Download
+	infoHash [20]byte
+	peerID   [20]byte
+	port     int
+	ctx      context.Context
+	stop     context.CancelFunc
+
+	mu           sync.Mutex
+	meta         *torrentMeta
+	storage      *torrentStorage
+	have         bitfield
+	haveCount    int
+	active       map[int]int // pieces being downloaded and by how many peers
+	peers        map[string]*torrentPeer
+	known        map[string]bool // connecting or connected addresses
+	metadata     []byte          // a magnet's info dictionary while it's fetched
+	metadataHave []bool
+	stopped      bool
+	err          error
+
+	uploaded     int64 // atomic
+	downloadedIn int64 // atomic, for the speed
+	uploadedOut  int64 // atomic, for the speed
+	completed    chan struct{}
+	failed       chan struct{}
+	completeOnce sync.Once
+	failOnce     sync.Once
+	wg           sync.WaitGroup
+}
+
+type torrentPeer struct {
+	conn       net.Conn
+	addr       string
+	extensions bool
+	out        chan []byte
+	done       chan struct{}
+
+	// guarded by the session mu
+	bitfield     bitfield
+	peerChoking  bool
+	amChoking    bool
+	amInterested bool
+	utMetadata   int
+	metadataSize int
+	work         *pieceWork
+	strikes      int
+}
+
+// pieceWork is a piece a peer is downloading
+type pieceWork struct {
+	index     int
+	data      []byte
+	blocks    []bool
+	requested int
+	received  int
+	inFlight  int
+}
+
+func newTorrentSession(myapp *MyApp, download *Download) (*torrentSession, error) {
+	s := &torrentSession{
+		myapp:     myapp,
+		download:  download,
+		infoHash:  download.Torrent.hash(),
+		active:    map[int]int{},
+		peers:     map[string]*torrentPeer{},
+		known:     map[string]bool{},
+		uploaded:  download.Torrent.Uploaded,
+		completed: make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+	copy(s.peerID[:], "-DB0001-")
+	rand.Read(s.peerID[8:])
+
+	if len(download.Torrent.Info) > 0 {
+		meta, err := parseTorrentInfo(download.Torrent.Info)
+		if err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.setMeta(meta)
+		s.mu.Unlock()
+	}
+	return s, nil
+}
+
+// downloadTorrent runs the torrent until it's complete and then seeds it
+// until the seeding limits in the settings are reached
+func downloadTorrent(myapp *MyApp, download *Download, fileItem *FileItem, ctx, ctxP context.Context) {
+	go func() {
+		s, err := newTorrentSession(myapp, download)
+		if err != nil {
+			logger.Println("Error reading torrent:", err)
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error reading torrent: %v", err))
+			fileItem.stopped("Failed")
+			return
+		}
+		if err := s.start(); err != nil {
+			logger.Println("Error starting torrent:", err)
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error starting torrent: %v", err))
+			fileItem.stopped("Failed")
+			return
+		}
+
+		// Periodically update the progress, peers and ratio
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					s.updateUI(fileItem)
+				}
+			}
+		}()
+		defer close(done)
+
+		select {
+		case <-ctx.Done():
+			s.shutdown()
+			logger.Println("Download Cancelled")
+			if err := removeDownloadFolder(download.FilePath); err != nil {
+				logger.Println("Error deleting the download:", err)
+			}
+			fileItem.stopped("Cancelled")
+			return
+		case <-ctxP.Done():
+			s.shutdown()
+			logger.Println("Download Paused.")
+			s.save("Paused")
+			fileItem.Ctx = ctx
+			fileItem.CtxP = ctxP
+			fileItem.stopped("Paused")
+			return
+		case <-s.failed:
+			s.shutdown()
+			logger.Println("Error downloading torrent:", s.err)
+			myapp.showDownloadError(fileItem.ID, fmt.Errorf("error downloading torrent: %v", s.err))
+			s.save("Paused")
+			fileItem.stopped("Failed")
+			return
+		case <-s.completed:
+		}
+
+		logger.Println("Download has Finished.")
+		s.save("Finished")
+		go downloadFinished(fileItem)
+		fileItem.stopped("Finished")
+		for _, tracker := range download.Torrent.Trackers {
+			go s.announceOnce(tracker, "completed")
+		}
+
+		s.seed(ctx, ctxP)
+		s.shutdown()
+		s.save("Finished")
+		fileItem.setSpeed(fmt.Sprintf("Seeding done, Ratio: %.2f", s.ratio()))
+		// Only now, moving the files away would have cut the seeding short
+		if ctx.Err() == nil {
+			runPostActions(myapp, fileItem, *s.download)
+		}
+	}()
+}
+
+// seed keeps serving peers until the ratio or time limit is reached
+func (s *torrentSession) seed(ctx, ctxP context.Context) {
+	prefs := s.myapp.App.Preferences()
+	seedRatio := prefs.FloatWithFallback(prefSeedRatio, 1)
+	seedMinutes := prefs.IntWithFallback(prefSeedMinutes, 0)
+	if seedRatio <= 0 {
+		return
+	}
+
+	var deadline <-chan time.Time
+	if seedMinutes > 0 {
+		deadline = time.After(time.Duration(seedMinutes) * time.Minute)
+	}
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for s.ratio() < seedRatio {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ctxP.Done():
+			return
+		case <-s.failed:
+			return
+		case <-deadline:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *torrentSession) start() error {
+	s.ctx, s.stop = context.WithCancel(s.myapp.AppContext)
+
+	// Listen for peers that found us through the tracker, a fixed port is
+	// only used by the first torrent that gets it
+	port := s.myapp.App.Preferences().Int(prefTorrentPort)
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil && port != 0 {
+		listener, err = net.Listen("tcp", ":0")
+	}
+	if err != nil {
+		return err
+	}
+	s.port = listener.Addr().(*net.TCPAddr).Port
+	context.AfterFunc(s.ctx, func() { listener.Close() })
+	go s.acceptLoop(listener)
+
+	if len(s.download.Torrent.Trackers) == 0 {
+		logger.Println("Torrent has no trackers, waiting for incoming peers")
+	}
+	for _, tracker := range s.download.Torrent.Trackers {
+		go s.announceLoop(tracker)
+	}
+	return nil
+}
+
+// shutdown disconnects every peer and waits for them so the files can be
+// closed (or deleted) safely
+func (s *torrentSession) shutdown() {
+	s.stop()
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.wg.Wait()
+
+	s.mu.Lock()
+	if s.storage != nil {
+		s.storage.Close()
+	}
+	s.mu.Unlock()
+
+	for _, tracker := range s.download.Torrent.Trackers {
+		go s.announceOnce(tracker, "stopped")
+	}
+}
+
+func (s *torrentSession) save(status string) {
+	s.mu.Lock()
+	s.download.Status = status
+	s.download.UpdatedAt = time.Now().String()
+	s.download.Torrent.Have = append([]byte(nil), s.have...)
+	s.download.Torrent.Uploaded = atomic.LoadInt64(&s.uploaded)
+	download := *s.download
+	s.mu.Unlock()
+	saveDownloadFileInfo(download, s.myapp.DownloadStateFilePath)
+}
+
+func (s *torrentSession) fail(err error) {
+	s.failOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.failed)
+	})
+}
+
+func (s *torrentSession) ratio() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.meta == nil || s.meta.Length == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&s.uploaded)) / float64(s.meta.Length)
+}
+
+func (s *torrentSession) updateUI(fileItem *FileItem) {
+	downSpeed := float64(atomic.SwapInt64(&s.downloadedIn, 0)) / (1024 * 1024)
+	upSpeed := float64(atomic.SwapInt64(&s.uploadedOut, 0)) / (1024 * 1024)
+	ratio := s.ratio()
+
+	s.mu.Lock()
+	peers := len(s.peers)
+	meta := s.meta
+	haveCount := s.haveCount
+	s.mu.Unlock()
+
+	switch {
+	case meta == nil:
+		fileItem.setSpeed(fmt.Sprintf("Fetching metadata, Peers: %d", peers))
+	case haveCount == len(meta.Pieces):
+		fileItem.setProgress(1)
+		fileItem.setSpeed(fmt.Sprintf("Seeding: %.2f MB/s, Peers: %d, Ratio: %.2f", upSpeed, peers, ratio))
+	default:
+		fileItem.setProgress(float64(haveCount) / float64(len(meta.Pieces)))
+		fileItem.setSpeed(fmt.Sprintf("Speed: %.2f MB/s, Up: %.2f MB/s, Peers: %d, Ratio: %.2f", downSpeed, upSpeed, peers, ratio))
+	}
+}
+
+// setMeta is called once the info dictionary is known, mu must be held
+func (s *torrentSession) setMeta(meta *torrentMeta) {
+	s.meta = meta
+	s.storage = newTorrentStorage(s.download.FilePath, meta)
+	s.have = newBitfield(len(meta.Pieces))
+	s.haveCount = 0
+	s.download.TotalSize = meta.Length
+	s.download.Downloaded = 0
+
+	// A paused torrent continues with the pieces it already verified
+	if saved := s.download.Torrent.Have; len(saved) == len(s.have) {
+		for index := range meta.Pieces {
+			if bitfield(saved).has(index) {
+				s.have.set(index)
+				s.haveCount++
+				s.download.Downloaded += meta.pieceSize(index)
+			}
+		}
+	}
+	if s.haveCount == len(meta.Pieces) {
+		s.completeOnce.Do(func() { close(s.completed) })
+	}
+}
+
+// ----------------------------------------------- Trackers
+
+func (s *torrentSession) announceRequest(event string) announceRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req := announceRequest{
+		InfoHash: s.infoHash,
+		PeerID:   s.peerID,
+		Port:     s.port,
+		Uploaded: atomic.LoadInt64(&s.uploaded),
+		Event:    event,
+	}
+	if s.meta != nil {
+		req.Downloaded = s.download.Downloaded
+		req.Left = s.meta.Length - s.download.Downloaded
+	} else {
+		// The size isn't known yet, anything but 0 means we're leeching
+		req.Left = 1
+	}
+	return req
+}
+
+func (s *torrentSession) announceLoop(tracker string) {
+	event := "started"
+	for {
+		peers, interval, err := announce(s.ctx, s.myapp.Client, tracker, s.announceRequest(event))
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Printf("Tracker %s: %v\n", tracker, err)
+			interval = time.Minute
+		} else {
+			event = ""
+			for _, addr := range peers {
+				s.connect(addr)
+			}
+		}
+		interval = min(max(interval, 30*time.Second), 30*time.Minute)
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// announceOnce sends a completed or stopped event, it may outlive the session
+func (s *torrentSession) announceOnce(tracker, event string) {
+	ctx, cancel := context.WithTimeout(s.myapp.AppContext, 10*time.Second)
+	defer cancel()
+	if _, _, err := announce(ctx, s.myapp.Client, tracker, s.announceRequest(event)); err != nil {
+		logger.Printf("Tracker %s: %v\n", tracker, err)
+	}
+}
+
+// ----------------------------------------------- Peers
+
+// track registers a peer goroutine, false once the session is stopping
+func (s *torrentSession) track(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.known[addr] || len(s.known) >= torrentMaxPeers {
+		return false
+	}
+	s.known[addr] = true
+	s.wg.Add(1)
+	return true
+}
+
+func (s *torrentSession) untrack(addr string) {
+	s.mu.Lock()
+	delete(s.known, addr)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+func (s *torrentSession) connect(addr string) {
+	if !s.track(addr) {
+		return
+	}
+	go func() {
+		defer s.untrack(addr)
+		dialer := net.Dialer{Timeout: 10 * time.Second}
+		conn, err := dialer.DialContext(s.ctx, "tcp", addr)
+		if err != nil {
+			return
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := writeHandshake(conn, s.infoHash, s.peerID); err != nil {
+			conn.Close()
+			return
+		}
+		infoHash, peerID, extensions, err := readHandshake(conn)
+		if err != nil || infoHash != s.infoHash || peerID == s.peerID {
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		s.runPeer(conn, addr, extensions)
+	}()
+}
+
+func (s *torrentSession) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		addr := conn.RemoteAddr().String()
+		if !s.track(addr) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.untrack(addr)
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			infoHash, peerID, extensions, err := readHandshake(conn)
+			if err != nil || infoHash != s.infoHash || peerID == s.peerID {
+				conn.Close()
+				return
+			}
+			if err := writeHandshake(conn, s.infoHash, s.peerID); err != nil {
+				conn.Close()
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			s.runPeer(conn, addr, extensions)
+		}()
+	}
+}
+
+func (s *torrentSession) runPeer(conn net.Conn, addr string, extensions bool) {
+	p := &torrentPeer{
+		conn:        conn,
+		addr:        addr,
+		extensions:  extensions,
+		out:         make(chan []byte, 64),
+		done:        make(chan struct{}),
+		peerChoking: true,
+		amChoking:   true,
+	}
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	defer func() {
+		stop()
+		conn.Close()
+		close(p.done)
+		s.dropPeer(p)
+	}()
+
+	s.mu.Lock()
+	s.peers[addr] = p
+	var greeting [][]byte
+	if extensions {
+		greeting = append(greeting, s.extendedHandshake())
+	}
+	if s.haveCount > 0 {
+		greeting = append(greeting, encodeMessage(msgBitfield, s.have))
+	}
+	s.mu.Unlock()
+
+	go p.writeLoop()
+	p.send(greeting...)
+
+	// Peers count against the speed limit like any other download
+	reader := &limitedReader{ctx: s.ctx, r: conn}
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Minute))
+		msg, err := readMessage(reader)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue // keep-alive
+		}
+		if err := s.handleMessage(p, msg); err != nil {
+			logger.Printf("Peer %s: %v\n", addr, err)
+			return
+		}
+	}
+}
+
+func (s *torrentSession) dropPeer(p *torrentPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, p.addr)
+	s.releaseWork(p)
+}
+
+// releaseWork gives the piece of a peer back to the others, mu must be held
+func (s *torrentSession) releaseWork(p *torrentPeer) {
+	if p.work == nil {
+		return
+	}
+	if s.active[p.work.index]--; s.active[p.work.index] <= 0 {
+		delete(s.active, p.work.index)
+	}
+	p.work = nil
+}
+
+func (p *torrentPeer) writeLoop() {
+	keepAlive := time.NewTicker(2 * time.Minute)
+	defer keepAlive.Stop()
+	for {
+		var msg []byte
+		select {
+		case <-p.done:
+			return
+		case msg = <-p.out:
+		case <-keepAlive.C:
+			msg = make([]byte, 4)
+		}
+		p.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+		if _, err := p.conn.Write(msg); err != nil {
+			p.conn.Close()
+			return
+		}
+	}
+}
+
+func (p *torrentPeer) send(msgs ...[]byte) {
+	for _, msg := range msgs {
+		select {
+		case p.out <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+func (s *torrentSession) handleMessage(p *torrentPeer, msg *peerMessage) error {
+	var out [][]byte
+	payload := msg.Payload
+
+	switch msg.ID {
+	case msgChoke:
+		s.mu.Lock()
+		p.peerChoking = true
+		s.releaseWork(p) // a choking peer drops our requests
+		s.mu.Unlock()
+
+	case msgUnchoke:
+		s.mu.Lock()
+		p.peerChoking = false
+		out = s.requestMore(p)
+		s.mu.Unlock()
+
+	case msgInterested:
+		// Everyone who asks gets served
+		s.mu.Lock()
+		if p.amChoking {
+			p.amChoking = false
+			out = append(out, encodeMessage(msgUnchoke, nil))
+		}
+		s.mu.Unlock()
+
+	case msgHave, msgBitfield:
+		s.mu.Lock()
+		if msg.ID == msgHave {
+			if len(payload) != 4 {
+				s.mu.Unlock()
+				return errors.New("invalid have message")
+			}
+			p.bitfield.set(int(binary.BigEndian.Uint32(payload)))
+		} else {
+			p.bitfield = append(bitfield(nil), payload...)
+		}
+		out = append(s.updateInterest(p), s.requestMore(p)...)
+		s.mu.Unlock()
+
+	case msgRequest:
+		if len(payload) != 12 {
+			return errors.New("invalid request message")
+		}
+		piece, err := s.readBlock(p, payload)
+		if err != nil {
+			return err
+		}
+		if piece != nil {
+			out = append(out, piece)
+		}
+
+	case msgPiece:
+		if len(payload) < 8 {
+			return errors.New("invalid piece message")
+		}
+		var err error
+		if out, err = s.receiveBlock(p, payload); err != nil {
+			return err
+		}
+
+	case msgExtended:
+		if len(payload) < 1 {
+			return errors.New("invalid extended message")
+		}
+		var err error
+		if out, err = s.handleExtended(p, payload[0], payload[1:]); err != nil {
+			return err
+		}
+	}
+
+	p.send(out...)
+	return nil
+}
+
+// updateInterest tells the peer whether it has pieces we still need, mu must be held
+func (s *torrentSession) updateInterest(p *torrentPeer) [][]byte {
+	if s.meta == nil {
+		return nil
+	}
+	interesting := false
+	for index := range s.meta.Pieces {
+		if !s.have.has(index) && p.bitfield.has(index) {
+			interesting = true
+			break
+		}
+	}
+	if interesting == p.amInterested {
+		return nil
+	}
+	p.amInterested = interesting
+	if interesting {
+		return [][]byte{encodeMessage(msgInterested, nil)}
+	}
+	return [][]byte{encodeMessage(msgNotInterested, nil)}
+}
+
+// requestMore keeps torrentPipeline block requests going to the peer, mu must be held
+func (s *torrentSession) requestMore(p *torrentPeer) [][]byte {
+	if s.meta == nil || p.peerChoking {
+		return nil
+	}
+	// Another peer may have finished the piece first (end game)
+	if p.work != nil && s.have.has(p.work.index) {
+		s.releaseWork(p)
+	}
+	if p.work == nil {
+		index := s.pickPiece(p)
+		if index < 0 {
+			return nil
+		}
+		size := s.meta.pieceSize(index)
+		p.work = &pieceWork{
+			index:  index,
+			data:   make([]byte, size),
+			blocks: make([]bool, (size+blockSize-1)/blockSize),
+		}
+		s.active[index]++
+	}
+
+	var out [][]byte
+	work := p.work
+	for work.inFlight < torrentPipeline && work.requested < len(work.data) {
+		length := min(blockSize, len(work.data)-work.requested)
+		out = append(out, encodeMessage(msgRequest, requestPayload(work.index, work.requested, length)))
+		work.requested += length
+		work.inFlight++
+	}
+	return out
+}
+
+// pickPiece chooses a missing piece the peer has, starting at a random
+// place so peers don't all fight over the same pieces. When every missing
+// piece is taken a second peer may help with it (end game).
+func (s *torrentSession) pickPiece(p *torrentPeer) int {
+	count := len(s.meta.Pieces)
+	offset := 0
+	if n, err := rand.Int(rand.Reader, big.NewInt(int64(count))); err == nil {
+		offset = int(n.Int64())
+	}
+	endGame := -1
+	for i := 0; i < count; i++ {
+		index := (offset + i) % count
+		if s.have.has(index) || !p.bitfield.has(index) {
+			continue
+		}
+		if s.active[index] == 0 {
+			return index
+		}
+		if endGame < 0 && s.active[index] < 2 {
+			endGame = index
+		}
+	}
+	return endGame
+}
+
+func (s *torrentSession) receiveBlock(p *torrentPeer, payload []byte) ([][]byte, error) {
+	index := int(binary.BigEndian.Uint32(payload[0:]))
+	begin := int(binary.BigEndian.Uint32(payload[4:]))
+	block := payload[8:]
+
+	s.mu.Lock()
+	work := p.work
+	// Blocks of an abandoned piece are simply dropped
+	if work == nil || work.index != index || begin%blockSize != 0 || begin+len(block) > len(work.data) || work.blocks[begin/blockSize] {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	copy(work.data[begin:], block)
+	work.blocks[begin/blockSize] = true
+	work.received += len(block)
+	work.inFlight--
+	atomic.AddInt64(&s.downloadedIn, int64(len(block)))
+
+	if work.received < len(work.data) {
+		out := s.requestMore(p)
+		s.mu.Unlock()
+		return out, nil
+	}
+	s.releaseWork(p)
+	expected := s.meta.Pieces[index]
+	s.mu.Unlock()
+
+	// Verify the piece before it touches the disk
+	if sha1.Sum(work.data) != expected {
+		s.mu.Lock()
+		p.strikes++
+		strikes := p.strikes
+		s.mu.Unlock()
+		logger.Printf("Peer %s sent a bad piece %d\n", p.addr, index)
+		if strikes >= 3 {
+			return nil, errors.New("too many bad pieces")
+		}
+	} else if err := s.pieceDone(index, work.data); err != nil {
+		s.fail(err)
+		return nil, err
+	}
+
+	s.mu.Lock()
+	out := append(s.updateInterest(p), s.requestMore(p)...)
+	s.mu.Unlock()
+	return out, nil
+}
+
+func (s *torrentSession) pieceDone(index int, data []byte) error {
+	s.mu.Lock()
+	storage := s.storage
+	offset := int64(index) * s.meta.PieceLength
+	s.mu.Unlock()
+	if err := storage.WriteAt(data, offset); err != nil {
+		return fmt.Errorf("error writing piece %d: %v", index, err)
+	}
+
+	s.mu.Lock()
+	if s.have.has(index) {
+		s.mu.Unlock()
+		return nil
+	}
+	s.have.set(index)
+	s.haveCount++
+	s.download.Downloaded += int64(len(data))
+	complete := s.haveCount == len(s.meta.Pieces)
+	peers := make([]*torrentPeer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	s.mu.Unlock()
+
+	// Let everyone know, without waiting on slow peers
+	have := encodeMessage(msgHave, havePayload(index))
+	for _, peer := range peers {
+		go peer.send(have)
+	}
+	if complete {
+		s.completeOnce.Do(func() { close(s.completed) })
+	}
+	return nil
+}
+
+// readBlock answers a request of a peer we unchoked
+func (s *torrentSession) readBlock(p *torrentPeer, payload []byte) ([]byte, error) {
+	index := int(binary.BigEndian.Uint32(payload[0:]))
+	begin := int64(binary.BigEndian.Uint32(payload[4:]))
+	length := int64(binary.BigEndian.Uint32(payload[8:]))
+
+	s.mu.Lock()
+	if p.amChoking || s.meta == nil || !s.have.has(index) {
+		s.mu.Unlock()
+		return nil, nil
+	}
+	if length == 0 || length > 2*blockSize || begin+length > s.meta.pieceSize(index) {
+		s.mu.Unlock()
+		return nil, errors.New("invalid block request")
+	}
+	storage := s.storage
+	offset := int64(index)*s.meta.PieceLength + begin
+	s.mu.Unlock()
+
+	piece := make([]byte, 8+length)
+	copy(piece, payload[:8])
+	if err := storage.ReadAt(piece[8:], offset); err != nil {
+		return nil, fmt.Errorf("error reading piece %d: %v", index, err)
+	}
+	atomic.AddInt64(&s.uploaded, length)
+	atomic.AddInt64(&s.uploadedOut, length)
+	return encodeMessage(msgPiece, piece), nil
+}
+
+// ----------------------------------------------- Metadata (BEP 9, BEP 10)
+
+// extendedHandshake announces ut_metadata, mu must be held
+func (s *torrentSession) extendedHandshake() []byte {
+	handshake := map[string]any{
+		"m": map[string]any{"ut_metadata": utMetadataID},
+		"v": "DownBit",
+	}
+	if s.meta != nil {
+		handshake["metadata_size"] = len(s.download.Torrent.Info)
+	}
+	return encodeMessage(msgExtended, append([]byte{0}, bencodeEncode(handshake)...))
+}
+
+func (s *torrentSession) handleExtended(p *torrentPeer, id byte, payload []byte) ([][]byte, error) {
+	value, n, err := bencodeDecodePrefix(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended message: %v", err)
+	}
+	dict, _ := value.(map[string]any)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch id {
+	case 0: // handshake
+		extensions, _ := dict["m"].(map[string]any)
+		utMetadata, _ := extensions["ut_metadata"].(int64)
+		size, _ := dict["metadata_size"].(int64)
+		p.utMetadata = int(utMetadata)
+		p.metadataSize = int(size)
+		return s.requestMetadata(p), nil
+
+	case utMetadataID:
+		msgType, _ := dict["msg_type"].(int64)
+		piece, _ := dict["piece"].(int64)
+		switch msgType {
+		case 0: // request
+			return s.metadataPiece(p, int(piece)), nil
+		case 1: // data
+			return s.receiveMetadata(int(piece), payload[n:]), nil
+		}
+	}
+	return nil, nil
+}
+
+// requestMetadata asks a peer for the info dictionary of a magnet, mu must be held
+func (s *torrentSession) requestMetadata(p *torrentPeer) [][]byte {
+	if s.meta != nil || p.utMetadata == 0 || p.metadataSize <= 0 || p.metadataSize > maxMetadataSize {
+		return nil
+	}
+	if s.metadata == nil {
+		s.metadata = make([]byte, p.metadataSize)
+		s.metadataHave = make([]bool, (p.metadataSize+metadataPieceSize-1)/metadataPieceSize)
+	}
+	if len(s.metadata) != p.metadataSize {
+		return nil
+	}
+
+	var out [][]byte
+	for piece, ok := range s.metadataHave {
+		if !ok {
+			request := bencodeEncode(map[string]any{"msg_type": 0, "piece": piece})
+			out = append(out, encodeMessage(msgExtended, append([]byte{byte(p.utMetadata)}, request...)))
+		}
+	}
+	return out
+}
+
+// metadataPiece answers a metadata request, mu must be held
+func (s *torrentSession) metadataPiece(p *torrentPeer, piece int) [][]byte {
+	if p.utMetadata == 0 {
+		return nil
+	}
+	info := s.download.Torrent.Info
+	start := piece * metadataPieceSize
+	if s.meta == nil || piece < 0 || start >= len(info) {
+		reject := bencodeEncode(map[string]any{"msg_type": 2, "piece": piece})
+		return [][]byte{encodeMessage(msgExtended, append([]byte{byte(p.utMetadata)}, reject...))}
+	}
+	end := min(start+metadataPieceSize, len(info))
+	data := bencodeEncode(map[string]any{"msg_type": 1, "piece": piece, "total_size": len(info)})
+	data = append(append([]byte{byte(p.utMetadata)}, data...), info[start:end]...)
+	return [][]byte{encodeMessage(msgExtended, data)}
+}
+
+// receiveMetadata stores a piece of the info dictionary and, once it's all
+// there and matches the info hash, starts the actual download. mu must be held
+func (s *torrentSession) receiveMetadata(piece int, data []byte) [][]byte {
+	if s.meta != nil || s.metadata == nil || piece < 0 || piece >= len(s.metadataHave) {
+		return nil
+	}
+	start := piece * metadataPieceSize
+	if len(data) != min(metadataPieceSize, len(s.metadata)-start) {
+		return nil
+	}
+	copy(s.metadata[start:], data)
+	s.metadataHave[piece] = true
+	for _, ok := range s.metadataHave {
+		if !ok {
+			return nil
+		}
+	}
+
+	metadata := s.metadata
+	s.metadata, s.metadataHave = nil, nil
+	if sha1.Sum(metadata) != s.infoHash {
+		logger.Println("Received metadata doesn't match the info hash")
+		return nil
+	}
+	meta, err := parseTorrentInfo(metadata)
+	if err != nil {
+		logger.Println("Error reading metadata:", err)
+		return nil
+	}
+
+	s.download.Torrent.Info = metadata
+	// Without a display name the magnet was named after its hash
+	if s.download.FileName == s.download.Torrent.InfoHash {
+		s.download.FileName = meta.Name
+		s.download.FilePath = filepath.Join(filepath.Dir(s.download.FilePath), meta.Name)
+	}
+	s.setMeta(meta)
+
+	// Peers that were only asked for metadata may have pieces for us
+	for _, peer := range s.peers {
+		out := append(s.updateInterest(peer), s.requestMore(peer)...)
+		go peer.send(out...)
+	}
+	return nil
+}
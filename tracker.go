@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type announceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string // "started", "completed", "stopped" or empty
+}
+
+// announce tells a tracker about us and returns the peers it knows and how
+// long to wait before asking again
+func announce(ctx context.Context, client *http.Client, tracker string, req announceRequest) ([]string, time.Duration, error) {
+	parsedURL, err := url.Parse(tracker)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch strings.ToLower(parsedURL.Scheme) {
+	case "http", "https":
+		return announceHTTP(ctx, client, tracker, req)
+	case "udp":
+		return announceUDP(ctx, parsedURL.Host, req)
+	default:
+		return nil, 0, fmt.Errorf("unsupported tracker %s", tracker)
+	}
+}
+
+func announceHTTP(ctx context.Context, client *http.Client, tracker string, req announceRequest) ([]string, time.Duration, error) {
+	query := url.Values{}
+	query.Set("peer_id", string(req.PeerID[:]))
+	query.Set("port", strconv.Itoa(req.Port))
+	query.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	query.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	query.Set("left", strconv.FormatInt(req.Left, 10))
+	query.Set("compact", "1")
+	if req.Event != "" {
+		query.Set("event", req.Event)
+	}
+	separator := "?"
+	if strings.Contains(tracker, "?") {
+		separator = "&"
+	}
+	// info_hash is raw bytes and goes first, some trackers are picky about it
+	announceURL := tracker + separator + "info_hash=" + url.QueryEscape(string(req.InfoHash[:])) + "&" + query.Encode()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", announceURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, 0, fmt.Errorf("tracker answered HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4*1024*1024))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	value, err := bencodeDecode(body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid tracker response: %v", err)
+	}
+	dict, ok := value.(map[string]any)
+	if !ok {
+		return nil, 0, errors.New("invalid tracker response")
+	}
+	if failure, ok := dict["failure reason"].(string); ok {
+		return nil, 0, fmt.Errorf("tracker: %s", failure)
+	}
+	interval, _ := dict["interval"].(int64)
+
+	var peers []string
+	switch list := dict["peers"].(type) {
+	case string:
+		peers = parseCompactPeers([]byte(list), 6)
+	case []any:
+		for _, peer := range list {
+			peerDict, _ := peer.(map[string]any)
+			ip, _ := peerDict["ip"].(string)
+			port, _ := peerDict["port"].(int64)
+			if ip != "" && port > 0 {
+				peers = append(peers, net.JoinHostPort(ip, strconv.FormatInt(port, 10)))
+			}
+		}
+	}
+	if list, ok := dict["peers6"].(string); ok {
+		peers = append(peers, parseCompactPeers([]byte(list), 18)...)
+	}
+	return peers, time.Duration(interval) * time.Second, nil
+}
+
+// parseCompactPeers reads ip and port pairs, 6 bytes each for IPv4 and 18 for IPv6
+func parseCompactPeers(data []byte, size int) []string {
+	var peers []string
+	for i := 0; i+size <= len(data); i += size {
+		ip := net.IP(data[i : i+size-2])
+		port := binary.BigEndian.Uint16(data[i+size-2:])
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return peers
+}
+
+// ----------------------------------------------- UDP (BEP 15)
+
+const (
+	udpTrackerProtocolID = 0x41727101980
+	udpActionConnect     = 0
+	udpActionAnnounce    = 1
+	udpActionError       = 3
+)
+
+var udpEvents = map[string]uint32{"": 0, "completed": 1, "started": 2, "stopped": 3}
+
+func announceUDP(ctx context.Context, host string, req announceRequest) ([]string, time.Duration, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	connect := make([]byte, 16)
+	binary.BigEndian.PutUint64(connect[0:], udpTrackerProtocolID)
+	binary.BigEndian.PutUint32(connect[8:], udpActionConnect)
+	reply, err := udpTrackerRoundTrip(conn, connect, udpActionConnect, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	connectionID := binary.BigEndian.Uint64(reply[8:])
+
+	packet := make([]byte, 98)
+	binary.BigEndian.PutUint64(packet[0:], connectionID)
+	binary.BigEndian.PutUint32(packet[8:], udpActionAnnounce)
+	copy(packet[16:], req.InfoHash[:])
+	copy(packet[36:], req.PeerID[:])
+	binary.BigEndian.PutUint64(packet[56:], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(packet[64:], uint64(req.Left))
+	binary.BigEndian.PutUint64(packet[72:], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(packet[80:], udpEvents[req.Event])
+	rand.Read(packet[88:92])                            // key
+	binary.BigEndian.PutUint32(packet[92:], 0xffffffff) // as many peers as it wants to give
+	binary.BigEndian.PutUint16(packet[96:], uint16(req.Port))
+	reply, err = udpTrackerRoundTrip(conn, packet, udpActionAnnounce, 20)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	interval := time.Duration(binary.BigEndian.Uint32(reply[8:])) * time.Second
+	size := 6
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		size = 18
+	}
+	return parseCompactPeers(reply[20:], size), interval, nil
+}
+
+// udpTrackerRoundTrip sends packet with a fresh transaction id and waits for
+// the matching reply, retrying a few times since udp may drop either of them
+func udpTrackerRoundTrip(conn net.Conn, packet []byte, action uint32, minSize int) ([]byte, error) {
+	rand.Read(packet[12:16])
+	transactionID := binary.BigEndian.Uint32(packet[12:])
+
+	buf := make([]byte, 4096)
+	for attempt := 1; attempt <= 3; attempt++ {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Duration(attempt*5) * time.Second))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n < 8 || binary.BigEndian.Uint32(buf[4:]) != transactionID {
+				continue
+			}
+			if binary.BigEndian.Uint32(buf) == udpActionError {
+				return nil, fmt.Errorf("tracker: %s", buf[8:n])
+			}
+			if binary.BigEndian.Uint32(buf) != action || n < minSize {
+				return nil, errors.New("invalid udp tracker response")
+			}
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+	return nil, errors.New("udp tracker didn't answer")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// URL patterns stand for a series of files, like curl and bash write them:
+//
+//	part[001-120].bin    numbers, zero padded like the first one
+//	img[a-z].jpg         letters
+//	frame[0-100:10].png  every 10th
+//	img{a..z}.jpg        the same in bash style, {1..20..2} with a step
+//	{small,large}.png    a list
+//
+// Anything else in brackets or braces (an IPv6 host) is left alone.
+
+// Expanding more than this is most likely a typo
+const maxPatternURLs = 10000
+
+// expandURLPattern returns every url pattern stands for, in order
+func expandURLPattern(pattern string) ([]string, error) {
+	urls := []string{""}
+	for rest := pattern; rest != ""; {
+		start := strings.IndexAny(rest, "[{")
+		if start < 0 {
+			urls = appendToAll(urls, []string{rest})
+			break
+		}
+		closing := map[byte]string{'[': "]", '{': "}"}[rest[start]]
+		end := strings.Index(rest[start:], closing)
+		if end < 0 {
+			urls = appendToAll(urls, []string{rest})
+			break
+		}
+		end += start
+
+		values, ok, err := expandPart(rest[start], rest[start+1:end])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rest[start:end+1], err)
+		}
+		if !ok {
+			values = []string{rest[start : end+1]}
+		}
+		urls = appendToAll(urls, []string{rest[:start]})
+		if len(urls)*len(values) > maxPatternURLs {
+			return nil, fmt.Errorf("the pattern gives more than %d urls", maxPatternURLs)
+		}
+		urls = appendToAll(urls, values)
+		rest = rest[end+1:]
+	}
+	return urls, nil
+}
+
+// appendToAll returns every prefix followed by every suffix
+func appendToAll(prefixes, suffixes []string) []string {
+	result := make([]string, 0, len(prefixes)*len(suffixes))
+	for _, prefix := range prefixes {
+		for _, suffix := range suffixes {
+			result = append(result, prefix+suffix)
+		}
+	}
+	return result
+}
+
+// expandPart expands what's between the brackets or braces, ok is false when
+// it isn't a pattern
+func expandPart(open byte, part string) (values []string, ok bool, err error) {
+	if open == '{' {
+		if from, to, found := strings.Cut(part, ".."); found {
+			to, step, _ := strings.Cut(to, "..")
+			return expandRange(from, to, step)
+		}
+		if strings.Contains(part, ",") {
+			return strings.Split(part, ","), true, nil
+		}
+		return nil, false, nil
+	}
+
+	part, step, _ := strings.Cut(part, ":")
+	from, to, found := strings.Cut(part, "-")
+	if !found {
+		return nil, false, nil
+	}
+	return expandRange(from, to, step)
+}
+
+// expandRange counts from from to to (down too), numbers or single letters
+func expandRange(from, to, stepText string) ([]string, bool, error) {
+	step := 1
+	if stepText != "" {
+		var err error
+		if step, err = strconv.Atoi(stepText); err != nil {
+			return nil, false, nil
+		}
+		if step < 0 {
+			step = -step
+		}
+		if step == 0 {
+			return nil, true, fmt.Errorf("the step can't be 0")
+		}
+	}
+
+	// Letters, [A-z] would run through the punctuation between Z and a
+	if len(from) == 1 && len(to) == 1 && isLetter(from[0]) && isLetter(to[0]) {
+		if isUpper(from[0]) != isUpper(to[0]) {
+			return nil, true, fmt.Errorf("%s and %s aren't the same case", from, to)
+		}
+		var values []string
+		for _, value := range countRange(int(from[0]), int(to[0]), step) {
+			values = append(values, string(rune(value)))
+		}
+		return values, true, nil
+	}
+
+	// Numbers, zero padded when either end is
+	first, err := strconv.Atoi(from)
+	if err != nil {
+		return nil, false, nil
+	}
+	last, err := strconv.Atoi(to)
+	if err != nil {
+		return nil, false, nil
+	}
+	if (last-first)/step >= maxPatternURLs || (first-last)/step >= maxPatternURLs {
+		return nil, true, fmt.Errorf("the range gives more than %d urls", maxPatternURLs)
+	}
+	width := 0
+	if len(from) > 1 && from[0] == '0' || len(to) > 1 && to[0] == '0' {
+		width = max(len(from), len(to))
+	}
+	var values []string
+	for _, value := range countRange(first, last, step) {
+		values = append(values, fmt.Sprintf("%0*d", width, value))
+	}
+	return values, true, nil
+}
+
+func countRange(first, last, step int) []int {
+	var values []int
+	if first <= last {
+		for value := first; value <= last; value += step {
+			values = append(values, value)
+		}
+	} else {
+		for value := first; value >= last; value -= step {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func isLetter(char byte) bool {
+	return 'a' <= char && char <= 'z' || isUpper(char)
+}
+
+func isUpper(char byte) bool {
+	return 'A' <= char && char <= 'Z'
+}
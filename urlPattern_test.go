@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandURLPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+		err     string // empty when it expands
+	}{
+		{name: "no pattern", pattern: "https://example.com/a.bin", want: []string{"https://example.com/a.bin"}},
+		{name: "numbers", pattern: "f[1-3].bin", want: []string{"f1.bin", "f2.bin", "f3.bin"}},
+		{name: "zero padded", pattern: "part[001-003]", want: []string{"part001", "part002", "part003"}},
+		{name: "padded like the longer end", pattern: "[8-010]", want: []string{"008", "009", "010"}},
+		{name: "padding past the width", pattern: "[08-10]", want: []string{"08", "09", "10"}},
+		{name: "step", pattern: "[0-10:5]", want: []string{"0", "5", "10"}},
+		{name: "bash step", pattern: "{1..7..3}", want: []string{"1", "4", "7"}},
+		{name: "negative step counts the same way", pattern: "{1..5..-2}", want: []string{"1", "3", "5"}},
+		{name: "zero step", pattern: "[1-5:0]", err: "can't be 0"},
+		{name: "descending", pattern: "[3-1]", want: []string{"3", "2", "1"}},
+		{name: "descending with a step", pattern: "[10-0:5]", want: []string{"10", "5", "0"}},
+		{name: "letters", pattern: "img[a-c].jpg", want: []string{"imga.jpg", "imgb.jpg", "imgc.jpg"}},
+		{name: "upper case letters", pattern: "[X-Z]", want: []string{"X", "Y", "Z"}},
+		{name: "descending letters", pattern: "{z..x}", want: []string{"z", "y", "x"}},
+		{name: "lower to upper", pattern: "[a-Z]", err: "same case"},
+		{name: "upper to lower", pattern: "[A-z]", err: "same case"},
+		{name: "bash mixed case", pattern: "{a..Z}", err: "same case"},
+		{name: "list", pattern: "{small,large}.png", want: []string{"small.png", "large.png"}},
+		{name: "several", pattern: "[1-2]{a,b}", want: []string{"1a", "1b", "2a", "2b"}},
+		{name: "ipv6 host", pattern: "http://[::1]/f[1-2]", want: []string{"http://[::1]/f1", "http://[::1]/f2"}},
+		{name: "not a range", pattern: "[1-x]", want: []string{"[1-x]"}},
+		{name: "unclosed", pattern: "f[1-2", want: []string{"f[1-2"}},
+		// What's inside a list or range isn't expanded again
+		{name: "range in a list", pattern: "{a,[1-2]}", want: []string{"a", "[1-2]"}},
+		{name: "list in brackets", pattern: "[{1..2}]", want: []string{"[{1..2}]"}},
+		{name: "range over the cap", pattern: "[1-10001]", err: "more than"},
+		{name: "combination over the cap", pattern: "[1-100][1-101]", err: "more than"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := expandURLPattern(test.pattern)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("got %q, %v, want an error with %q", got, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// Right at the cap is fine
+	urls, err := expandURLPattern("[1-100][1-100]")
+	if err != nil || len(urls) != maxPatternURLs {
+		t.Errorf("got %d urls, %v, want %d", len(urls), err, maxPatternURLs)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+	"github.com/google/uuid"
+)
+
+// A watched download is fetched again whenever the file at its url changes,
+// for nightly builds and the like. It's a record in downloads.json with a
+// Watch; every interval the url is asked with If-None-Match and
+// If-Modified-Since and only a changed file is downloaded, next to the old
+// versions or in place of the last one.
+
+// Watch is what a watched download remembers between checks
+type Watch struct {
+	Interval     string         `json:"interval"` // like 1h or 24h
+	Replace      bool           `json:"replace"`  // the new version takes the old one's place, else each has its own name
+	ETag         string         `json:"etag"`
+	LastModified string         `json:"last_modified"`
+	LastCheck    time.Time      `json:"last_check"`
+	LastError    string         `json:"last_error,omitempty"`
+	Versions     []WatchVersion `json:"versions"`
+}
+
+// WatchVersion is a version of the file that was downloaded
+type WatchVersion struct {
+	FilePath     string    `json:"file_path"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"last_modified"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// How often the watcher looks for watches that are due
+const watchTick = time.Minute
+
+// Checks closer than this would just hammer the server
+const minWatchInterval = time.Minute
+
+var (
+	fetchingMu sync.Mutex
+	fetching   = map[string]bool{} // watches with a version downloading
+)
+
+// watchDownloads checks the watches that are due until the app quits, the
+// window does it or the daemon when there is one
+func watchDownloads(myapp *MyApp, onVersion func(download Download)) {
+	for {
+		downloads, _, err := loadDatabase(myapp.DownloadStateFilePath)
+		if err != nil {
+			logger.Println("Error loading the watches:", err)
+		}
+		for _, download := range downloads {
+			if download.Watch != nil && watchDue(download.Watch, time.Now()) {
+				go checkWatch(myapp, download, onVersion)
+			}
+		}
+		time.Sleep(watchTick)
+	}
+}
+
+func watchDue(watch *Watch, now time.Time) bool {
+	interval, err := time.ParseDuration(watch.Interval)
+	if err != nil {
+		return false
+	}
+	return !now.Before(watch.LastCheck.Add(max(interval, minWatchInterval)))
+}
+
+// checkWatch asks the server if the file changed and downloads it if it did
+func checkWatch(myapp *MyApp, download Download, onVersion func(download Download)) {
+	fetchingMu.Lock()
+	if fetching[download.ID] {
+		fetchingMu.Unlock()
+		return
+	}
+	fetching[download.ID] = true
+	fetchingMu.Unlock()
+	done := func() {
+		fetchingMu.Lock()
+		delete(fetching, download.ID)
+		fetchingMu.Unlock()
+	}
+
+	watch := download.Watch
+	watch.LastCheck = time.Now()
+	changed, etag, lastModified, err := remoteChanged(myapp.clientFor(download.Headers, download.URL), download.URL, watch)
+	if err != nil || !changed {
+		watch.LastError = ""
+		if err != nil {
+			logger.Println("Error checking", download.URL+":", err)
+			watch.LastError = err.Error()
+		}
+		saveWatch(myapp, download.ID, func(saved *Watch) {
+			saved.LastCheck, saved.LastError = watch.LastCheck, watch.LastError
+		})
+		done()
+		return
+	}
+
+	logger.Println("New version of", download.URL)
+	go func() {
+		defer done()
+		version, err := fetchVersion(myapp, download)
+		saveWatch(myapp, download.ID, func(saved *Watch) {
+			saved.LastCheck = watch.LastCheck
+			if err != nil {
+				saved.LastError = err.Error()
+				return
+			}
+			// Only now, a failed download is tried again at the next check
+			saved.LastError = ""
+			saved.ETag, saved.LastModified = etag, lastModified
+			version.ETag, version.LastModified = etag, lastModified
+			saved.Versions = append(saved.Versions, version)
+		})
+		if err != nil {
+			logger.Println("Error downloading the new version of", download.URL+":", err)
+			return
+		}
+		if onVersion != nil {
+			download.FilePath = version.FilePath
+			onVersion(download)
+		}
+	}()
+}
+
+// remoteChanged asks the server for the file unless it's the one we have
+func remoteChanged(client *http.Client, rawURL string, watch *Watch) (changed bool, etag, lastModified string, err error) {
+	if !strings.HasPrefix(rawURL, "http://") && !strings.HasPrefix(rawURL, "https://") {
+		return false, "", "", fmt.Errorf("only http urls can be watched")
+	}
+	response, err := conditionalRequest(client, http.MethodHead, rawURL, watch)
+	if err != nil {
+		return false, "", "", err
+	}
+	// Some servers refuse HEAD, ask for the first byte instead
+	if response.StatusCode == http.StatusMethodNotAllowed || response.StatusCode == http.StatusForbidden {
+		response, err = conditionalRequest(client, http.MethodGet, rawURL, watch)
+		if err != nil {
+			return false, "", "", err
+		}
+	}
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		return false, watch.ETag, watch.LastModified, nil
+	case http.StatusOK, http.StatusPartialContent:
+	default:
+		return false, "", "", &httpStatusError{Code: response.StatusCode}
+	}
+	etag, lastModified = response.Header.Get("ETag"), response.Header.Get("Last-Modified")
+	// Servers that don't do conditional requests still tell what they have
+	if len(watch.Versions) > 0 && (etag != "" && etag == watch.ETag || etag == "" && lastModified != "" && lastModified == watch.LastModified) {
+		return false, etag, lastModified, nil
+	}
+	return true, etag, lastModified, nil
+}
+
+// conditionalRequest asks for the file only if it's not what the watch saw
+// last time. The body is closed, only the headers matter
+func conditionalRequest(client *http.Client, method, rawURL string, watch *Watch) (*http.Response, error) {
+	request, err := http.NewRequest(method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodGet {
+		request.Header.Set("Range", "bytes=0-0")
+	}
+	if watch.ETag != "" {
+		request.Header.Set("If-None-Match", watch.ETag)
+	}
+	if watch.LastModified != "" {
+		request.Header.Set("If-Modified-Since", watch.LastModified)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	return response, nil
+}
+
+// fetchVersion downloads the file next to the others and moves it in place
+// once it's complete, so the old version is there until then
+func fetchVersion(myapp *MyApp, download Download) (WatchVersion, error) {
+	source, err := sourceFor(myapp.clientFor(download.Headers, download.URL), download.URL)
+	if err != nil {
+		return WatchVersion{}, err
+	}
+	fileInfo, err := source.Probe(context.Background(), download.URL)
+	if err != nil {
+		return WatchVersion{}, err
+	}
+	target := download.FilePath
+	if !download.Watch.Replace {
+		target = versionPath(download.FilePath, time.Now())
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return WatchVersion{}, err
+	}
+	fileInfo.URL = download.URL
+	fileInfo.FileName = filepath.Base(target)
+	fileInfo.FilePath = target + ".part"
+	fileInfo.Headers = download.Headers
+	fileInfo.Group = download.ID
+
+	// The fetch has its own record while it runs, like any download
+	fileItem := &FileItem{ID: uuid.New().String(), NoActions: true}
+	stopped := make(chan string, 1)
+	fileItem.OnStop = func(status string) { stopped <- status }
+	// A failed chunk pauses the fetch, its error is what the watch shows
+	var errMu sync.Mutex
+	var fetchErr error
+	fileItem.OnError = func(err error) {
+		errMu.Lock()
+		if fetchErr == nil {
+			fetchErr = err
+		}
+		errMu.Unlock()
+	}
+	ConfirmURL(myapp, fileInfo, fileItem, context.Background(), context.Background(), nil, nil)
+	status := <-stopped
+	removeDownload(myapp.DownloadStateFilePath, fileItem.ID)
+	if status != "Finished" {
+		os.Remove(fileInfo.FilePath)
+		errMu.Lock()
+		defer errMu.Unlock()
+		if fetchErr != nil {
+			return WatchVersion{}, fetchErr
+		}
+		return WatchVersion{}, fmt.Errorf("the download stopped: %s", status)
+	}
+
+	// A rename on the same disk, nobody sees half a file
+	if err := os.Rename(fileInfo.FilePath, target); err != nil {
+		return WatchVersion{}, err
+	}
+	return WatchVersion{FilePath: target, Size: int64(fileInfo.Total), FetchedAt: time.Now()}, nil
+}
+
+// versionPath is nightly.iso as nightly.20261019-0341.iso
+func versionPath(filePath string, at time.Time) string {
+	extension := filepath.Ext(filePath)
+	return strings.TrimSuffix(filePath, extension) + "." + at.Format("20060102-150405") + extension
+}
+
+// saveWatch changes the watch of the record with id, the rest of the record
+// is left as it's in the database now
+func saveWatch(myapp *MyApp, id string, change func(watch *Watch)) {
+	download, err := isFileExistByID(myapp.DownloadStateFilePath, id)
+	if err != nil || download.Watch == nil {
+		return // stopped watching meanwhile
+	}
+	change(download.Watch)
+	download.UpdatedAt = time.Now().String()
+	saveDownloadFileInfo(download, myapp.DownloadStateFilePath)
+}
+
+// addWatch starts watching rawURL, the first version is fetched right away
+func addWatch(myapp *MyApp, rawURL string, interval time.Duration, replace bool) error {
+	fileInfo, err := getFileInfo(myapp.Client, rawURL)
+	if err != nil {
+		return err
+	}
+	download := Download{
+		ID:        uuid.New().String(),
+		FileName:  fileInfo.FileName,
+		URL:       rawURL,
+		FilePath:  fileInfo.FilePath,
+		Status:    "Watching",
+		CreatedAt: time.Now().String(),
+		Watch:     &Watch{Interval: interval.String(), Replace: replace},
+	}
+	saveDownloadFileInfo(download, myapp.DownloadStateFilePath)
+	go checkWatch(myapp, download, nil)
+	return nil
+}
+
+// ----------------------------------------------- UI
+
+func WatchFunc(myapp *MyApp) func() {
+	return func() {
+		showWatches(myapp)
+	}
+}
+
+// showWatches lists the watched urls and adds new ones
+func showWatches(myapp *MyApp) {
+	urlEntry := widget.NewEntry()
+	urlEntry.SetPlaceHolder("https://example.com/nightly/latest.iso")
+	intervalEntry := widget.NewEntry()
+	intervalEntry.SetText("24h")
+	replaceSelect := widget.NewSelect([]string{"Keep every version", "Replace the old file"}, nil)
+	replaceSelect.SetSelectedIndex(0)
+
+	list := container.NewVBox()
+	var refresh func()
+	refresh = func() {
+		list.RemoveAll()
+		downloads, _, _ := loadDatabase(myapp.DownloadStateFilePath)
+		for _, download := range downloads {
+			if download.Watch == nil {
+				continue
+			}
+			text := fmt.Sprintf("%s, every %s, %d versions", download.FileName, download.Watch.Interval, len(download.Watch.Versions))
+			if download.Watch.LastError != "" {
+				text += ", " + download.Watch.LastError
+			}
+			label := widget.NewLabel(text)
+			label.Truncation = fyne.TextTruncateEllipsis
+			checkNow := widget.NewButton("Check now", func() {
+				go checkWatch(myapp, download, nil)
+			})
+			stop := widget.NewButton("Stop", func() {
+				// The versions already there stay
+				if err := removeDownload(myapp.DownloadStateFilePath, download.ID); err != nil {
+					myapp.showError(err)
+				}
+				refresh()
+			})
+			list.Add(container.NewBorder(nil, nil, nil, container.NewHBox(checkNow, stop), label))
+		}
+		if len(list.Objects) == 0 {
+			list.Add(widget.NewLabel("Nothing is watched yet"))
+		}
+	}
+	refresh()
+
+	add := widget.NewButton("Watch", func() {
+		interval, err := time.ParseDuration(strings.TrimSpace(intervalEntry.Text))
+		if err != nil || interval < minWatchInterval {
+			myapp.showError(fmt.Errorf("the interval is like 30m, 6h or 24h, at least a minute"))
+			return
+		}
+		if err := addWatch(myapp, strings.TrimSpace(urlEntry.Text), interval, replaceSelect.SelectedIndex() == 1); err != nil {
+			myapp.showError(fmt.Errorf("couldnt watch the url: %v", err))
+			return
+		}
+		urlEntry.SetText("")
+		refresh()
+	})
+	add.Importance = widget.HighImportance
+
+	form := widget.NewForm(
+		widget.NewFormItem("URL", urlEntry),
+		widget.NewFormItem("Every", intervalEntry),
+		widget.NewFormItem("New versions", replaceSelect),
+	)
+	content := container.NewBorder(container.NewVBox(form, add, widget.NewSeparator()), nil, nil, nil, container.NewVScroll(list))
+	watchDialog := dialog.NewCustom("Watched URLs", "Close", content, myapp.MainWindow)
+	watchDialog.Resize(fyne.NewSize(560, 420))
+	watchDialog.Show()
+}
+
+// newVersionNotice tells the user a watched file changed
+func newVersionNotice(myapp *MyApp) func(download Download) {
+	return func(download Download) {
+		myapp.App.SendNotification(fyne.NewNotification("DownBit", "New version of "+download.FileName+" downloaded"))
+	}
+}
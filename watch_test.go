@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoteChanged(t *testing.T) {
+	const etag, lastModified = `"v2"`, "Mon, 19 Oct 2026 03:41:00 GMT"
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		watch   Watch
+		changed bool
+		etag    string
+		status  int // of the error, 0 for none
+	}{
+		{
+			name: "first check",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", etag)
+			},
+			changed: true,
+			etag:    etag,
+		},
+		{
+			name: "not modified",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+				}
+			},
+			watch: Watch{ETag: etag, Versions: []WatchVersion{{}}},
+			etag:  etag,
+		},
+		{
+			name: "new version",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", etag)
+			},
+			watch:   Watch{ETag: `"v1"`, Versions: []WatchVersion{{}}},
+			changed: true,
+			etag:    etag,
+		},
+		{
+			name: "no conditional requests, same etag",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", etag)
+			},
+			watch: Watch{ETag: etag, Versions: []WatchVersion{{}}},
+			etag:  etag,
+		},
+		{
+			name: "no conditional requests, same date",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Last-Modified", lastModified)
+			},
+			watch: Watch{LastModified: lastModified, Versions: []WatchVersion{{}}},
+		},
+		{
+			name: "HEAD refused",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				if r.Header.Get("Range") != "bytes=0-0" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Content-Range", "bytes 0-0/100")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte("x"))
+			},
+			watch:   Watch{ETag: `"v1"`, Versions: []WatchVersion{{}}},
+			changed: true,
+			etag:    etag,
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			status: http.StatusInternalServerError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.handler)
+			defer server.Close()
+
+			changed, gotETag, _, err := remoteChanged(server.Client(), server.URL+"/nightly.iso", &test.watch)
+			var statusError *httpStatusError
+			switch {
+			case test.status != 0:
+				if !errors.As(err, &statusError) || statusError.Code != test.status {
+					t.Fatalf("err = %v, want HTTP %d", err, test.status)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+			if changed != test.changed || gotETag != test.etag {
+				t.Errorf("got changed %v etag %q, want %v %q", changed, gotETag, test.changed, test.etag)
+			}
+		})
+	}
+
+	if _, _, _, err := remoteChanged(http.DefaultClient, "ftp://example.com/nightly.iso", &Watch{}); err == nil {
+		t.Error("an ftp url was checked")
+	}
+}
+
+func TestWatchDue(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		watch Watch
+		due   bool
+	}{
+		{"never checked", Watch{Interval: "1h"}, true},
+		{"checked just now", Watch{Interval: "1h", LastCheck: now.Add(-time.Minute)}, false},
+		{"interval passed", Watch{Interval: "1h", LastCheck: now.Add(-time.Hour)}, true},
+		{"short interval is raised to the minimum", Watch{Interval: "1s", LastCheck: now.Add(-30 * time.Second)}, false},
+		{"minimum passed", Watch{Interval: "1s", LastCheck: now.Add(-minWatchInterval)}, true},
+		{"bad interval", Watch{Interval: "daily"}, false},
+	}
+	for _, test := range tests {
+		if due := watchDue(&test.watch, now); due != test.due {
+			t.Errorf("%s: due = %v, want %v", test.name, due, test.due)
+		}
+	}
+}
+
+func TestVersionPath(t *testing.T) {
+	at := time.Date(2026, 10, 19, 3, 41, 7, 0, time.UTC)
+	tests := []struct {
+		filePath, want string
+	}{
+		{filepath.Join("dl", "nightly.iso"), filepath.Join("dl", "nightly.20261019-034107.iso")},
+		{filepath.Join("dl", "nightly"), filepath.Join("dl", "nightly.20261019-034107")},
+		{filepath.Join("dl", "app.tar.gz"), filepath.Join("dl", "app.tar.20261019-034107.gz")},
+	}
+	for _, test := range tests {
+		if got := versionPath(test.filePath, at); got != test.want {
+			t.Errorf("versionPath(%q) = %q, want %q", test.filePath, got, test.want)
+		}
+	}
+}
+
+// A version that fails to download gives the error and leaves nothing behind
+func TestFetchVersionFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", "5000")
+			return
+		}
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	myapp := testHeadlessApp(t)
+
+	dir := t.TempDir()
+	download := Download{
+		ID:       "watched",
+		URL:      server.URL + "/nightly.iso",
+		FilePath: filepath.Join(dir, "nightly.iso"),
+		Watch:    &Watch{Interval: "1h", Replace: true},
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := fetchVersion(myapp, download)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "500") {
+			t.Errorf("fetchVersion returned %v, want the chunk's HTTP 500", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("fetchVersion never returned")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("left %d files behind", len(entries))
+	}
+	downloads, _, err := loadDatabase(myapp.DownloadStateFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(downloads) != 0 {
+		t.Errorf("the fetch left %d records behind", len(downloads))
+	}
+}